@@ -5,23 +5,47 @@ import (
 	"obfuscator/pkg/obfuscator"
 	"os"
 	"path/filepath"
+	"strings"
 )
 func main() {
 	inputPath := flag.String("input", "", "Path to the source directory or file")
 	outputPath := flag.String("output", "./obfuscated_src", "Path to the output directory for the results")
 	rename := flag.Bool("rename", true, "Enable identifier renaming")
 	encryptStrings := flag.Bool("encrypt-strings", true, "Enable string encryption")
+	encryptStringConsts := flag.Bool("encrypt-string-consts", true, "Use type information to encrypt string constants and keep constant-required strings compilable")
 	insertDeadCode := flag.Bool("insert-dead-code", true, "Enable dead code insertion")
 	obfuscateControlFlow := flag.Bool("obfuscate-control-flow", true, "Enable control flow obfuscation")
+	controlFlowDepth := flag.Int("control-flow-depth", obfuscator.DefaultControlFlowDepth, "Levels of nested statements lowered into dispatcher states by control flow flattening")
+	weaveControlFlow := flag.Bool("weave-control-flow", false, "Tie dispatcher state encoding to the anti-debug weaving key (flattened code hangs when tampering is detected)")
+	bogusFlowDensity := flag.Int("bogus-flow-density", 30, "Percentage of flattened states given a mutated clone behind an opaque predicate (0 disables bogus control flow)")
+	dispatcherBackend := flag.String("dispatcher", "random", "Shape of control flow dispatchers: "+strings.Join(obfuscator.DispatcherBackends, ", ")+" (override per function with //obf:dispatcher <shape>)")
+	virtualize := flag.Bool("virtualize", true, "Compile functions marked //obf:virtualize into bytecode for a generated interpreter")
+	outlineFunctions := flag.Bool("outline", true, "Split functions by moving runs of statements into helpers spread over the files of their package")
 	obfuscateExpressions := flag.Bool("obfuscate-expressions", true, "Enable expression obfuscation")
+	mbaDepth := flag.Int("mba-depth", obfuscator.DefaultMBADepth, "Times the mixed boolean-arithmetic rewriting of integer expressions is applied to its own output")
 	obfuscateDataFlow := flag.Bool("obfuscate-data-flow", true, "Enable data flow obfuscation (structs, globals)")
 	obfuscateConstants := flag.Bool("obfuscate-constants", true, "Enable constant obfuscation")
+	constantDensity := flag.Int("constant-density", 100, "Percentage of eligible numeric constants moved into package variables decoded at init")
+	encodeValues := flag.Bool("encode-values", true, "Store local integer variables encoded (affine maps or XOR masks), decoding them on every read")
+	splitBooleans := flag.Bool("split-bools", true, "Split bool variables, and bool struct fields marked //obf:split, into integer shares whose parity is the truth value")
 	antiDebugging := flag.Bool("anti-debug", true, "Enable anti-debugging checks")
 	antiVM := flag.Bool("anti-vm", true, "Enable anti-virtual machine checks")
 	indirectCalls := flag.Bool("indirect-calls", true, "Enable call indirection")
+	mergeFunctions := flag.Bool("merge-functions", true, "Fold unexported functions returning the same types into super-functions taking a selector argument")
 	weaveIntegrity := flag.Bool("weave-integrity", true, "Enable integrity weaving checks")
 	addMetamorphicCode := flag.Bool("metamorphic", true, "Enable metamorphic code generation")
 	enableSelfModifying := flag.Bool("self-modifying", true, "Enable self-modifying code generation")
+	obfuscateDeps := flag.String("obfuscate-deps", "", "Comma-separated module path patterns of dependencies to obfuscate and vendor (e.g. example.com/secret/...)")
+	stringMode := flag.String("string-mode", "inline", "String encryption layout: inline (decryptor per literal) or table (per-package blob with cached accessor)")
+	stringModePackages := flag.String("string-mode-packages", "", "Comma-separated per-package overrides of -string-mode, e.g. example.com/app/hot/...=table")
+	stringCiphers := flag.String("string-ciphers", strings.Join(obfuscator.StringCipherNames, ","), "Comma-separated string cipher backends to mix: "+strings.Join(obfuscator.StringCipherNames, ", "))
+	stringCipherPolicy := flag.String("string-cipher-policy", "random", "How string ciphers are distributed: random or round-robin")
+	deriveStringKeys := flag.Bool("derive-string-keys", true, "Derive string keys at runtime from state spread over each package instead of embedding them")
+	encryptData := flag.Bool("encrypt-data", true, "Encrypt []byte/[]uint32/array literals of constants and rune literals (opt out per literal with //obf:plaintext)")
+	dataThreshold := flag.Int("data-threshold", 16, "Minimum size in bytes of a data literal to encrypt")
+	decoyDensity := flag.Int("decoy-density", 30, "Percentage of encrypted strings preceded by a decoy decryptor (0 disables decoys)")
+	hideComparisons := flag.Bool("hide-comparisons", true, "Compare against string and integer constants marked //obf:secret through salted SHA-256 digests")
+	encryptEmbeds := flag.Bool("encrypt-embeds", true, "Encrypt files embedded with //go:embed and decrypt them on read")
 	disableAntiVM := flag.Bool("disable-anti-vm", false, "Disable anti-virtual machine checks (can also set OBF_DISABLE_ANTI_VM env)")
 	flag.Parse()
 	if *inputPath == "" {
@@ -39,6 +63,40 @@ func main() {
 		fmt.Printf("Error getting absolute path for output: %v\n", err)
 		os.Exit(1)
 	}
+	defaultStringMode, err := obfuscator.ParseStringEncryptionMode(*stringMode)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	dispatcher, err := obfuscator.ParseDispatcherBackend(*dispatcherBackend)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	stringModeOverrides := make(map[string]obfuscator.StringEncryptionMode)
+	for _, item := range splitList(*stringModePackages) {
+		pattern, modeName, ok := strings.Cut(item, "=")
+		mode, err := obfuscator.ParseStringEncryptionMode(modeName)
+		if !ok || err != nil {
+			fmt.Printf("Error: invalid -string-mode-packages entry %q (expected pattern=mode)\n", item)
+			os.Exit(1)
+		}
+		stringModeOverrides[pattern] = mode
+	}
+	var ciphers []obfuscator.StringCipher
+	for _, name := range splitList(*stringCiphers) {
+		c, err := obfuscator.NewStringCipher(name)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		ciphers = append(ciphers, c)
+	}
+	cipherPolicy, err := obfuscator.ParseStringCipherPolicy(*stringCipherPolicy)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
 	// --- Initialize Anti Manager facade (profile=safe, tagsAnti/tagsIntegrity=true by default) ---
 	antiCfg := &obfuscator.AntiConfig{
 		VMThreshold:   1.0,
@@ -60,17 +118,40 @@ func main() {
 		Anti:                 anti,
 		RenameIdentifiers:    *rename,
 		EncryptStrings:       *encryptStrings,
+		EncryptStringConstants: *encryptStringConsts,
 		InsertDeadCode:       *insertDeadCode,
 		ObfuscateControlFlow: *obfuscateControlFlow,
+		ControlFlowDepth:     *controlFlowDepth,
+		WeaveControlFlow:     *weaveControlFlow,
+		DispatcherBackend:    dispatcher,
+		BogusFlowDensity:     *bogusFlowDensity,
+		Virtualize:           *virtualize,
+		OutlineFunctions:     *outlineFunctions,
 		ObfuscateExpressions: *obfuscateExpressions,
+		ExpressionDepth:      *mbaDepth,
 		ObfuscateDataFlow:    *obfuscateDataFlow,
 		ObfuscateConstants:   *obfuscateConstants,
+		ConstantDensity:      *constantDensity,
+		EncodeValues:         *encodeValues,
+		SplitBooleans:        *splitBooleans,
 		AntiDebugging:        *antiDebugging,
 		AntiVM:               *antiVM && !*disableAntiVM,
 		IndirectCalls:        *indirectCalls,
+		MergeFunctions:       *mergeFunctions,
 		WeaveIntegrity:       *weaveIntegrity,
 		AddMetamorphicCode:   *addMetamorphicCode,
 		EnableSelfModifying:  *enableSelfModifying,
+		ObfuscateDeps:        splitList(*obfuscateDeps),
+		StringMode:           defaultStringMode,
+		StringModePackages:   stringModeOverrides,
+		StringCiphers:        ciphers,
+		StringCipherPolicy:   cipherPolicy,
+		DeriveStringKeys:     *deriveStringKeys,
+		DecoyDensity:         *decoyDensity,
+		HideComparisons:      *hideComparisons,
+		EncryptData:          *encryptData,
+		DataEncryptionThreshold: *dataThreshold,
+		EncryptEmbeds:        *encryptEmbeds,
 	}
 	fmt.Printf("Starting obfuscation...\n")
 	fmt.Printf("Source: %s\n", absInput)
@@ -83,3 +164,13 @@ func main() {
 	}
 	fmt.Println("\nObfuscation completed successfully.")
 }
+// splitList turns a comma-separated flag value into its non-empty, trimmed elements.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,228 @@
+package obfuscator
+import (
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"reflect"
+	"strconv"
+)
+// bogusSwaps are the operators a mutated clone may use instead of the original one; the pairs
+// accept the same operand types, so the clone still compiles.
+var bogusSwaps = map[token.Token]token.Token{
+	token.ADD: token.SUB, token.SUB: token.ADD,
+	token.LSS: token.GTR, token.GTR: token.LSS,
+	token.LEQ: token.GEQ, token.GEQ: token.LEQ,
+	token.EQL: token.NEQ, token.NEQ: token.EQL,
+	token.LAND: token.LOR, token.LOR: token.LAND,
+	token.AND: token.OR, token.OR: token.XOR, token.XOR: token.AND,
+	token.SHL: token.SHR, token.SHR: token.SHL,
+}
+// addBogusFlow puts density percent of the states of every dispatcher behind an opaque predicate
+// choosing between the real block and a mutated clone of it:
+//
+//	if <always true> { ...block... } else { ...clone with other constants, operators and jumps... }
+//
+// It runs once the hoisted variables are renamed and the branches rewritten, so the clones are
+// final code apart from their transitions and restarts, which join those the dispatchers encode
+// and build.
+func (f *flattener) addBogusFlow(density int) {
+	if density <= 0 {
+		return
+	}
+	for _, d := range f.dispatchers {
+		for _, clause := range d.clauses {
+			if randInt(100) >= int64(density) || !f.cloneable(clause.Body) {
+				continue
+			}
+			clone := f.mutatedClone(clause.Body)
+			real, bogus := &ast.BlockStmt{List: clause.Body}, &ast.BlockStmt{List: clone}
+			stmt := &ast.IfStmt{Cond: f.predicates.True(), Body: real, Else: bogus}
+			if randInt(2) == 0 {
+				stmt = &ast.IfStmt{Cond: f.predicates.False(), Body: bogus, Else: real}
+			}
+			clause.Body = []ast.Stmt{stmt}
+		}
+	}
+}
+// cloneable reports whether a block is more than a jump and can be duplicated: labels would be
+// declared twice, and declarations belong to nested dispatchers, whose clone would not run them.
+func (f *flattener) cloneable(stmts []ast.Stmt) bool {
+	if len(stmts) == 0 {
+		return false
+	}
+	if len(stmts) == 1 {
+		switch s := stmts[0].(type) {
+		case *ast.BranchStmt:
+			return false
+		case *ast.AssignStmt:
+			for _, d := range f.dispatchers {
+				if _, ok := d.transitions[s]; ok {
+					return false
+				}
+			}
+		}
+	}
+	ok := true
+	inspectFunc(&ast.BlockStmt{List: stmts}, func(n ast.Node) {
+		switch n.(type) {
+		case *ast.LabeledStmt, *ast.DeclStmt:
+			ok = false
+		}
+	})
+	return ok
+}
+// mutatedClone copies stmts, alters constants and operators of the original code, where the type
+// information shows that the clone still compiles, sends its transitions to random states and
+// repeats a call or adds a store to the predicate sink.
+func (f *flattener) mutatedClone(stmts []ast.Stmt) []ast.Stmt {
+	clones := make(map[ast.Node]ast.Node)
+	orig := &ast.BlockStmt{List: stmts}
+	copied := cloneNode(orig, clones).(*ast.BlockStmt)
+	parents := make(map[ast.Node]ast.Node)
+	walkWithStack(orig, func(n ast.Node, stack []ast.Node) {
+		if len(stack) > 1 {
+			parents[n] = stack[len(stack)-2]
+		}
+	})
+	for n, c := range clones {
+		switch n := n.(type) {
+		case *ast.BasicLit:
+			f.mutateLiteral(n, c.(*ast.BasicLit), parents[n])
+		case *ast.BinaryExpr:
+			if swap, ok := bogusSwaps[n.Op]; ok && randInt(2) == 0 && f.swappable(n, swap) {
+				c.(*ast.BinaryExpr).Op = swap
+			}
+		case *ast.AssignStmt:
+			for _, d := range f.dispatchers {
+				if _, ok := d.transitions[n]; ok {
+					d.transitions[c.(*ast.AssignStmt)] = int(randInt(int64(len(d.blocks))))
+				}
+			}
+		case *ast.BranchStmt:
+			for _, d := range f.dispatchers {
+				for _, cont := range d.continues {
+					if cont == n {
+						d.continues = append(d.continues, c.(*ast.BranchStmt))
+						break
+					}
+				}
+			}
+		}
+	}
+	var calls []*ast.ExprStmt
+	for _, s := range stmts {
+		if e, ok := s.(*ast.ExprStmt); ok {
+			if _, ok := e.X.(*ast.CallExpr); ok {
+				calls = append(calls, e)
+			}
+		}
+	}
+	extra := f.predicates.Sink()
+	if len(calls) > 0 {
+		extra = cloneNode(calls[randInt(int64(len(calls)))], make(map[ast.Node]ast.Node)).(ast.Stmt)
+	}
+	at := randInt(int64(len(copied.List)))
+	return append(copied.List[:at], append([]ast.Stmt{extra}, copied.List[at:]...)...)
+}
+// mutateLiteral gives the clone of a small integer operand or assigned value another small value,
+// representable in every integer type and never a zero divisor.
+func (f *flattener) mutateLiteral(orig, clone *ast.BasicLit, parent ast.Node) {
+	if orig.Kind != token.INT || randInt(2) == 0 {
+		return
+	}
+	switch p := parent.(type) {
+	case *ast.BinaryExpr:
+		if tv, ok := f.info.Types[p]; !ok || tv.Value != nil {
+			return
+		}
+	case *ast.AssignStmt:
+	default:
+		return
+	}
+	tv, ok := f.info.Types[orig]
+	if !ok || tv.Value == nil || !isIntegerType(tv.Type) {
+		return
+	}
+	v, exact := constant.Int64Val(tv.Value)
+	if !exact || v < 0 || v > 127 {
+		return
+	}
+	n := 1 + randInt(127)
+	if n == v {
+		n = v%127 + 1
+	}
+	clone.Value = strconv.FormatInt(n, 10)
+}
+// swappable reports whether the clone of e may use op instead: strings add but do not subtract,
+// and the bitwise operators need integers on both sides.
+func (f *flattener) swappable(e *ast.BinaryExpr, op token.Token) bool {
+	tv, ok := f.info.Types[e]
+	if !ok || tv.Value != nil {
+		return false
+	}
+	switch op {
+	case token.ADD, token.SUB:
+		t := f.info.TypeOf(e.X)
+		b, ok := t.Underlying().(*types.Basic)
+		return ok && b.Info()&types.IsNumeric != 0
+	case token.AND, token.OR, token.XOR:
+		return isIntegerType(f.info.TypeOf(e.X)) && isIntegerType(f.info.TypeOf(e.Y))
+	}
+	return true
+}
+func isIntegerType(t types.Type) bool {
+	if t == nil {
+		return false
+	}
+	b, ok := t.Underlying().(*types.Basic)
+	return ok && b.Info()&types.IsInteger != 0
+}
+// cloneNode deep-copies a syntax tree, recording the copy of every node in clones. Objects and
+// scopes of the parser are shared.
+func cloneNode(n ast.Node, clones map[ast.Node]ast.Node) ast.Node {
+	return cloneValue(reflect.ValueOf(n), clones).Interface().(ast.Node)
+}
+func cloneValue(v reflect.Value, clones map[ast.Node]ast.Node) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		switch v.Interface().(type) {
+		case *ast.Object, *ast.Scope:
+			return v
+		}
+		c := reflect.New(v.Elem().Type())
+		c.Elem().Set(cloneValue(v.Elem(), clones))
+		if n, ok := v.Interface().(ast.Node); ok {
+			clones[n] = c.Interface().(ast.Node)
+		}
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(cloneValue(v.Elem(), clones))
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(cloneValue(v.Index(i), clones))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(cloneValue(v.Field(i), clones))
+			}
+		}
+		return c
+	}
+	return v
+}
@@ -0,0 +1,54 @@
+package obfuscator
+import (
+	"go/ast"
+	"go/token"
+	"testing"
+)
+func TestBogusFlow_PreservesBehaviour(t *testing.T) {
+	want := runGoProgram(t, map[string]string{"main.go": controlFlowProgram})
+	for _, backend := range DispatcherBackends {
+		t.Run(backend, func(t *testing.T) {
+			pkg := loadTestPackage(t, map[string]string{"main.go": controlFlowProgram})
+			ControlFlow(pkg.Fset, pkg.Syntax[0], pkg.TypesInfo, pkg.Types, ControlFlowOptions{Depth: DefaultControlFlowDepth, Backend: DispatcherBackend(backend), BogusDensity: 100})
+			out := printFile(t, pkg.Fset, pkg.Syntax[0])
+			if got := runGoProgram(t, map[string]string{"main.go": out}); got != want {
+				t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out)
+			}
+			mutated := 0
+			ast.Inspect(pkg.Syntax[0], func(n ast.Node) bool {
+				if s, ok := n.(*ast.IfStmt); ok && s.Else != nil {
+					if body, ok := s.Else.(*ast.BlockStmt); ok && len(body.List) == len(s.Body.List)+1 {
+						if printNode(t, pkg.Fset, s.Body) != printNode(t, pkg.Fset, body) {
+							mutated++
+						}
+					}
+				}
+				return true
+			})
+			if mutated < 10 {
+				t.Errorf("Expected mutated clones of most states, got %d:\n%s", mutated, out)
+			}
+		})
+	}
+}
+func TestBogusFlow_CloneIsDeep(t *testing.T) {
+	fset, file := parseTestFile(t, "package main\nfunc f(x int) int {\n\tif x > 1 {\n\t\treturn x + 2\n\t}\n\treturn x\n}\n")
+	body := file.Decls[0].(*ast.FuncDecl).Body
+	clones := make(map[ast.Node]ast.Node)
+	copied := cloneNode(body, clones).(*ast.BlockStmt)
+	ast.Inspect(copied, func(n ast.Node) bool {
+		if b, ok := n.(*ast.BinaryExpr); ok {
+			b.Op = token.SUB
+		}
+		return true
+	})
+	if got := printNode(t, fset, body); got != "{\n\tif x > 1 {\n\t\treturn x + 2\n\t}\n\treturn x\n}" {
+		t.Errorf("Expected the original to be untouched, got:\n%s", got)
+	}
+	if len(clones) != 12 {
+		t.Errorf("Expected every node to be recorded, got %d", len(clones))
+	}
+	if copied.List[0].(*ast.IfStmt).Body.List[0].(*ast.ReturnStmt).Results[0].(*ast.BinaryExpr).X.(*ast.Ident).Obj != body.List[0].(*ast.IfStmt).Body.List[0].(*ast.ReturnStmt).Results[0].(*ast.BinaryExpr).X.(*ast.Ident).Obj {
+		t.Error("Expected identifiers to keep their objects")
+	}
+}
@@ -0,0 +1,770 @@
+package obfuscator
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	mrand "math/rand"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+// splitDirective marks a bool struct field to be split into integer shares: `//obf:split`.
+const splitDirective = "//obf:split"
+// BoolSplitPass splits bool variables, and the bool struct fields marked with splitDirective, into
+// two or three unsigned integer shares: the parity of their sum, or of their exclusive or, is the
+// truth value, and every write draws new shares, so that no single location holds the flag.
+// Local and unexported package-level variables are split unless their address is taken or they
+// are assigned in ways a rewrite cannot follow (tuple assignments, range clauses, select cases).
+// Fields change the layout of their struct, hence the directive: they are left alone if their
+// struct is compared, used as a map key or built from positional literals, or if they are read
+// through expressions with side effects. The marked fields left alone are reported.
+type BoolSplitPass struct {
+	// Unsplit lists the fields marked with splitDirective that were left alone, and why.
+	Unsplit []string
+}
+// boolShares is how one variable or field is split.
+type boolShares struct {
+	typ  types.Type
+	bits uint
+	xor  bool
+	// shares holds the share variables or fields; a write updates every share s but the last to
+	// s*mul + inc.
+	shares   []*types.Var
+	mul, inc []uint64
+	// conversion spells the type of the shares.
+	conversion ast.Expr
+}
+// boolSplit is the plan of the pass over one package.
+type boolSplit struct {
+	pkg  *packages.Package
+	info *types.Info
+	// split maps the variables and fields to their shares; files, to the file declaring them.
+	split map[*types.Var]*boolShares
+	files map[*types.Var]*ast.File
+	// structs maps the structs declaring split fields to these fields.
+	structs map[*types.Struct][]*types.Var
+	// marked holds the names of the fields marked with splitDirective; reasons, why variables and
+	// fields were dropped from the plan.
+	marked  []*ast.Ident
+	reasons map[*types.Var]string
+}
+func (p *BoolSplitPass) Apply(obf *Obfuscator, pkg *packages.Package) error {
+	if pkg.TypesInfo == nil {
+		return nil
+	}
+	s := &boolSplit{pkg: pkg, info: pkg.TypesInfo, split: make(map[*types.Var]*boolShares), files: make(map[*types.Var]*ast.File), structs: make(map[*types.Struct][]*types.Var), reasons: make(map[*types.Var]string)}
+	s.plan()
+	for _, name := range s.marked {
+		if v := pkg.TypesInfo.Defs[name].(*types.Var); !s.splits(v) {
+			p.report(pkg.Fset, name.Pos(), fmt.Sprintf("field %s (%s)", v.Name(), s.reasons[v]))
+		}
+	}
+	if len(s.split) == 0 {
+		return nil
+	}
+	for _, file := range pkg.Syntax {
+		if !usesCgo(file) {
+			s.rewrite(file)
+		}
+	}
+	fmt.Printf("    - Split %d bool variables and fields into integer shares\n", len(s.split))
+	return nil
+}
+func (p *BoolSplitPass) report(fset *token.FileSet, pos token.Pos, what string) {
+	msg := fmt.Sprintf("%s: %s", fset.Position(pos), what)
+	p.Unsplit = append(p.Unsplit, msg)
+	fmt.Printf("    - Field kept as a bool: %s\n", msg)
+}
+// plan collects the variables and fields to split and draws their shares.
+func (s *boolSplit) plan() {
+	info := s.info
+	candidate := func(id *ast.Ident, file *ast.File, local bool) {
+		v, ok := info.Defs[id].(*types.Var)
+		switch {
+		case !ok || id.Name == "_":
+		case !types.Identical(v.Type(), types.Typ[types.Bool]):
+			s.reasons[v] = "not of type bool"
+		case !local && v.Exported() && s.pkg.Name != "main":
+			// Other packages may refer to exported variables and fields.
+			s.reasons[v] = "exported from a package other than main"
+		default:
+			s.split[v], s.files[v] = nil, file
+		}
+	}
+	for _, file := range s.pkg.Syntax {
+		if usesCgo(file) {
+			continue
+		}
+		walkWithStack(file, func(n ast.Node, stack []ast.Node) {
+			switch n := n.(type) {
+			case *ast.AssignStmt:
+				if n.Tok != token.DEFINE || len(n.Lhs) != len(n.Rhs) || selectCase(n, stack) {
+					return
+				}
+				for _, lhs := range n.Lhs {
+					candidate(lhs.(*ast.Ident), file, true)
+				}
+			case *ast.ValueSpec:
+				if len(n.Values) != 0 && len(n.Values) != len(n.Names) {
+					return
+				}
+				_, local := stack[len(stack)-3].(*ast.DeclStmt)
+				for _, name := range n.Names {
+					candidate(name, file, local)
+				}
+			case *ast.TypeSpec:
+				st, ok := n.Type.(*ast.StructType)
+				if !ok {
+					return
+				}
+				for _, field := range st.Fields.List {
+					directive := splitComment(field)
+					if directive == nil {
+						continue
+					}
+					removeComment(file, directive)
+					if field.Doc != nil && len(field.Doc.List) == 0 {
+						field.Doc = nil
+					}
+					if field.Comment != nil && len(field.Comment.List) == 0 {
+						field.Comment = nil
+					}
+					s.marked = append(s.marked, field.Names...)
+					for _, name := range field.Names {
+						if n.TypeParams != nil {
+							s.reasons[info.Defs[name].(*types.Var)] = "field of a generic struct"
+							continue
+						}
+						candidate(name, file, false)
+						if v := info.Defs[name].(*types.Var); s.splits(v) {
+							t := info.TypeOf(st).(*types.Struct)
+							s.structs[t] = append(s.structs[t], v)
+						}
+					}
+				}
+			}
+		})
+	}
+	// Drop the variables and fields used where the shares would leak or could not be rewritten.
+	for _, file := range s.pkg.Syntax {
+		cgo := usesCgo(file)
+		walkWithStack(file, func(n ast.Node, stack []ast.Node) {
+			var v *types.Var
+			switch n := n.(type) {
+			case *ast.Ident:
+				if v, _ = info.Uses[n].(*types.Var); v == nil || v.IsField() {
+					return
+				}
+			case *ast.SelectorExpr:
+				if v = s.field(n); v == nil {
+					return
+				}
+				if !pureExpr(n.X, info) {
+					s.reject(v, "read through an expression with side effects")
+				}
+			case *ast.CompositeLit:
+				if len(n.Elts) > 0 {
+					// Only the layout of the struct built changes: the structs it holds keep theirs.
+					_, keyed := n.Elts[0].(*ast.KeyValueExpr)
+					if st, ok := underlying(info.TypeOf(n)).(*types.Struct); ok && !keyed {
+						for _, v := range s.structs[st] {
+							s.reject(v, "struct built from a positional literal")
+						}
+					}
+				}
+				s.convertElts(n)
+				return
+			case *ast.BinaryExpr:
+				if n.Op == token.EQL || n.Op == token.NEQ {
+					s.drop(info.TypeOf(n.X), "struct compared")
+					s.drop(info.TypeOf(n.Y), "struct compared")
+				}
+				return
+			case *ast.SwitchStmt:
+				// The tag is compared with every case value.
+				if n.Tag != nil {
+					s.drop(info.TypeOf(n.Tag), "struct compared")
+					for _, clause := range n.Body.List {
+						for _, e := range clause.(*ast.CaseClause).List {
+							s.drop(info.TypeOf(e), "struct compared")
+						}
+					}
+				}
+				return
+			case *ast.CallExpr:
+				s.convertCall(n)
+				return
+			case *ast.AssignStmt:
+				if n.Tok == token.ASSIGN {
+					for i, t := range s.values(n.Rhs) {
+						if i < len(n.Lhs) {
+							s.convert(t, info.TypeOf(n.Lhs[i]))
+						}
+					}
+				}
+				return
+			case *ast.ValueSpec:
+				if n.Type != nil {
+					for _, t := range s.values(n.Values) {
+						s.convert(t, info.TypeOf(n.Type))
+					}
+				}
+				return
+			case *ast.ReturnStmt:
+				if sig := enclosingSignature(stack, info); sig != nil {
+					for i, t := range s.values(n.Results) {
+						if i < sig.Results().Len() {
+							s.convert(t, sig.Results().At(i).Type())
+						}
+					}
+				}
+				return
+			case *ast.SendStmt:
+				if ch, ok := underlying(info.TypeOf(n.Chan)).(*types.Chan); ok {
+					s.convert(info.TypeOf(n.Value), ch.Elem())
+				}
+				return
+			case *ast.IndexExpr:
+				if m, ok := underlying(info.TypeOf(n.X)).(*types.Map); ok {
+					s.convert(info.TypeOf(n.Index), m.Key())
+				}
+				return
+			default:
+				return
+			}
+			if !s.splits(v) {
+				return
+			}
+			if cgo {
+				s.reject(v, "used in a file importing C")
+				return
+			}
+			switch parent := stack[len(stack)-2].(type) {
+			case *ast.AssignStmt:
+				for _, lhs := range parent.Lhs {
+					if lhs == n && (len(parent.Lhs) != len(parent.Rhs) || selectCase(parent, stack[:len(stack)-1])) {
+						s.reject(v, "assigned by a tuple assignment or a select case")
+					}
+				}
+			case *ast.UnaryExpr:
+				if parent.Op == token.AND {
+					s.reject(v, "address taken")
+				}
+			case *ast.RangeStmt:
+				s.reject(v, "assigned by a range clause")
+			case *ast.ParenExpr:
+				s.reject(v, "parenthesized")
+			}
+		})
+	}
+	// Map lookups compare their keys.
+	for _, tv := range info.Types {
+		if m, ok := tv.Type.(*types.Map); ok {
+			s.drop(m.Key(), "struct used as a map key")
+		}
+	}
+	// Generic code may compare or convert its type arguments.
+	for _, inst := range info.Instances {
+		for i := 0; i < inst.TypeArgs.Len(); i++ {
+			s.drop(inst.TypeArgs.At(i), "struct used as a type argument")
+		}
+	}
+	// The names of a declaration with a type share it: they are split together or not at all, into
+	// shares of the same type.
+	kinds := make(map[*types.Var]types.BasicKind)
+	for _, file := range s.pkg.Syntax {
+		ast.Inspect(file, func(n ast.Node) bool {
+			spec, ok := n.(*ast.ValueSpec)
+			if !ok || spec.Type == nil {
+				return true
+			}
+			all := true
+			for _, name := range spec.Names {
+				all = all && s.splits(info.Defs[name])
+			}
+			kind := shareKind()
+			for _, name := range spec.Names {
+				if v, ok := info.Defs[name].(*types.Var); ok && !all {
+					s.reject(v, "declared with variables left alone")
+				} else if ok {
+					kinds[v] = kind
+				}
+			}
+			return true
+		})
+	}
+	for v := range s.split {
+		pos := v.Pos()
+		if v.IsField() || v.Parent() == s.pkg.Types.Scope() {
+			pos = s.files[v].Name.Pos()
+		}
+		kind, ok := kinds[v]
+		if !ok {
+			kind = shareKind()
+		}
+		sh, err := newBoolShares(v, kind, s.pkg, s.files[v], pos)
+		if err != nil {
+			s.reject(v, err.Error())
+			continue
+		}
+		s.split[v] = sh
+	}
+}
+// splitComment returns the directive of a field asking for its split, or nil.
+func splitComment(field *ast.Field) *ast.Comment {
+	for _, group := range []*ast.CommentGroup{field.Doc, field.Comment} {
+		if group == nil {
+			continue
+		}
+		for _, c := range group.List {
+			if c.Text == splitDirective {
+				return c
+			}
+		}
+	}
+	return nil
+}
+// splits reports whether obj is a variable or field planned to be split.
+func (s *boolSplit) splits(obj types.Object) bool {
+	v, ok := obj.(*types.Var)
+	if !ok {
+		return false
+	}
+	_, planned := s.split[v]
+	return planned
+}
+// field returns the split field selected by sel, or nil.
+func (s *boolSplit) field(sel *ast.SelectorExpr) *types.Var {
+	selection := s.info.Selections[sel]
+	if selection == nil || selection.Kind() != types.FieldVal {
+		return nil
+	}
+	v := selection.Obj().(*types.Var).Origin()
+	if !s.splits(v) {
+		return nil
+	}
+	return v
+}
+// reject drops v from the plan for the given reason.
+func (s *boolSplit) reject(v *types.Var, reason string) {
+	if _, planned := s.split[v]; planned {
+		delete(s.split, v)
+		s.reasons[v] = reason
+	}
+}
+// drop leaves alone, for the given reason, the fields of the struct type t and of the structs t
+// holds by value: equal values may hold different shares.
+func (s *boolSplit) drop(t types.Type, reason string) {
+	if t == nil {
+		return
+	}
+	switch t := t.Underlying().(type) {
+	case *types.Struct:
+		for _, v := range s.structs[t] {
+			s.reject(v, reason)
+		}
+		for i := 0; i < t.NumFields(); i++ {
+			s.drop(t.Field(i).Type(), reason)
+		}
+	case *types.Array:
+		s.drop(t.Elem(), reason)
+	}
+}
+// convert drops the fields of a value of type from converted to the type to, if that is an
+// interface: the shares would be compared, hashed and printed through it.
+func (s *boolSplit) convert(from, to types.Type) {
+	if from != nil && to != nil && types.IsInterface(to) && !types.IsInterface(from) {
+		s.drop(from, "struct converted to an interface")
+	}
+}
+// values returns the types of the values of exprs, a single call returning several values
+// included.
+func (s *boolSplit) values(exprs []ast.Expr) []types.Type {
+	if len(exprs) == 1 {
+		if tuple, ok := s.info.TypeOf(exprs[0]).(*types.Tuple); ok {
+			var ts []types.Type
+			for i := 0; i < tuple.Len(); i++ {
+				ts = append(ts, tuple.At(i).Type())
+			}
+			return ts
+		}
+	}
+	var ts []types.Type
+	for _, e := range exprs {
+		ts = append(ts, s.info.TypeOf(e))
+	}
+	return ts
+}
+// convertCall drops the fields of the arguments of call converted to interface parameters, or
+// of its operand if call is a conversion to an interface.
+func (s *boolSplit) convertCall(call *ast.CallExpr) {
+	tv, ok := s.info.Types[call.Fun]
+	if !ok || tv.Type == nil {
+		return
+	}
+	if tv.IsType() {
+		if len(call.Args) == 1 {
+			s.convert(s.info.TypeOf(call.Args[0]), tv.Type)
+		}
+		return
+	}
+	sig, ok := tv.Type.Underlying().(*types.Signature)
+	if !ok {
+		return
+	}
+	params := sig.Params()
+	for i, t := range s.values(call.Args) {
+		switch {
+		case sig.Variadic() && i >= params.Len()-1 && !call.Ellipsis.IsValid():
+			if slice, ok := params.At(params.Len() - 1).Type().Underlying().(*types.Slice); ok {
+				s.convert(t, slice.Elem())
+			}
+		case i < params.Len():
+			s.convert(t, params.At(i).Type())
+		}
+	}
+}
+// convertElts drops the fields of the elements of lit converted to interface elements or fields.
+func (s *boolSplit) convertElts(lit *ast.CompositeLit) {
+	t := underlying(s.info.TypeOf(lit))
+	for i, elt := range lit.Elts {
+		key, value := ast.Expr(nil), elt
+		if kv, ok := elt.(*ast.KeyValueExpr); ok {
+			key, value = kv.Key, kv.Value
+		}
+		switch t := t.(type) {
+		case *types.Struct:
+			if id, ok := key.(*ast.Ident); ok {
+				if f, ok := s.info.Uses[id].(*types.Var); ok {
+					s.convert(s.info.TypeOf(value), f.Type())
+				}
+			} else if key == nil && i < t.NumFields() {
+				s.convert(s.info.TypeOf(value), t.Field(i).Type())
+			}
+		case *types.Array:
+			s.convert(s.info.TypeOf(value), t.Elem())
+		case *types.Slice:
+			s.convert(s.info.TypeOf(value), t.Elem())
+		case *types.Map:
+			if key != nil {
+				s.convert(s.info.TypeOf(key), t.Key())
+			}
+			s.convert(s.info.TypeOf(value), t.Elem())
+		}
+	}
+}
+// underlying returns the underlying type of t, or nil for code without type information.
+func underlying(t types.Type) types.Type {
+	if t == nil {
+		return nil
+	}
+	return t.Underlying()
+}
+// enclosingSignature returns the signature of the innermost function of stack, or nil.
+func enclosingSignature(stack []ast.Node, info *types.Info) *types.Signature {
+	for i := len(stack) - 1; i >= 0; i-- {
+		switch fn := stack[i].(type) {
+		case *ast.FuncLit:
+			sig, _ := info.TypeOf(fn).(*types.Signature)
+			return sig
+		case *ast.FuncDecl:
+			if obj := info.Defs[fn.Name]; obj != nil {
+				sig, _ := obj.Type().(*types.Signature)
+				return sig
+			}
+			return nil
+		}
+	}
+	return nil
+}
+// shareKind draws the type of shares.
+func shareKind() types.BasicKind {
+	kinds := []types.BasicKind{types.Uint8, types.Uint16, types.Uint32, types.Uint64}
+	return kinds[mrand.Intn(len(kinds))]
+}
+// newBoolShares draws the shares of kind of v, declared in file: their type is named at pos.
+func newBoolShares(v *types.Var, kind types.BasicKind, pkg *packages.Package, file *ast.File, pos token.Pos) (*boolShares, error) {
+	sh := &boolShares{typ: types.Typ[kind], bits: 8 << (kind - types.Uint8), xor: randInt(2) == 0}
+	names := newTypeNamer(pkg.Fset, file, pkg.Types, pos)
+	var err error
+	if sh.conversion, err = names.expr(sh.typ); err != nil {
+		return nil, err
+	}
+	names.addImports()
+	for i := 2 + randInt(2); i > 0; i-- {
+		var share *types.Var
+		switch {
+		case v.IsField():
+			share = types.NewField(v.Pos(), pkg.Types, NewName(), sh.typ, false)
+		case v.Parent() == pkg.Types.Scope():
+			share = types.NewVar(v.Pos(), pkg.Types, NewName(), sh.typ)
+			pkg.Types.Scope().Insert(share)
+		default:
+			share = types.NewVar(v.Pos(), pkg.Types, NewName(), sh.typ)
+			v.Parent().Insert(share)
+		}
+		sh.shares = append(sh.shares, share)
+		sh.mul = append(sh.mul, mrand.Uint64()&sh.truncation()|1)
+		sh.inc = append(sh.inc, mrand.Uint64()&sh.truncation())
+	}
+	return sh, nil
+}
+func (sh *boolShares) truncation() uint64 {
+	return ^uint64(0) >> (64 - sh.bits)
+}
+// op is the relation of the shares.
+func (sh *boolShares) op() token.Token {
+	if sh.xor {
+		return token.XOR
+	}
+	return token.ADD
+}
+// literal returns a constant of the type of the shares, converted if typed is set.
+func (sh *boolShares) literal(v uint64, typed bool, info *types.Info) ast.Expr {
+	v &= sh.truncation()
+	tv := types.TypeAndValue{Type: sh.typ, Value: constant.MakeUint64(v)}
+	lit := &ast.BasicLit{Kind: token.INT, Value: tv.Value.ExactString()}
+	info.Types[lit] = tv
+	if !typed {
+		return lit
+	}
+	conv := &ast.CallExpr{Fun: cloneExpr(sh.conversion, info), Args: []ast.Expr{lit}}
+	info.Types[conv] = tv
+	return conv
+}
+// binary returns x op y, of the type of the shares.
+func (sh *boolShares) binary(x ast.Expr, op token.Token, y ast.Expr, info *types.Info) ast.Expr {
+	expr := &ast.BinaryExpr{X: parenthesize(x, info), Op: op, Y: parenthesize(y, info)}
+	info.Types[expr] = types.TypeAndValue{Type: sh.typ}
+	return expr
+}
+// read returns the truth value of the shares read by base.
+func (sh *boolShares) read(base func(i int) ast.Expr, info *types.Info) ast.Expr {
+	value := base(0)
+	for i := 1; i < len(sh.shares); i++ {
+		value = sh.binary(value, sh.op(), base(i), info)
+	}
+	parity := sh.binary(value, token.AND, sh.literal(1, false, info), info)
+	cmp := &ast.BinaryExpr{X: parity, Op: token.NEQ, Y: sh.literal(0, false, info)}
+	if randInt(2) == 0 {
+		cmp.Op, cmp.Y = token.EQL, sh.literal(1, false, info)
+	}
+	info.Types[cmp] = types.TypeAndValue{Type: types.Typ[types.Bool]}
+	paren := &ast.ParenExpr{X: cmp}
+	info.Types[paren] = info.Types[cmp]
+	return paren
+}
+// values returns the values of the shares written with value. The shares read by base are
+// updated, or drawn as constants if fresh is set, in which case typed converts them.
+func (sh *boolShares) values(value ast.Expr, base func(i int) ast.Expr, fresh, typed bool, info *types.Info) []ast.Expr {
+	// The bits of the truth value have its parity and random others.
+	one, zero := mrand.Uint64()|1, mrand.Uint64()&^1
+	var values []ast.Expr
+	if tv := info.Types[value]; tv.Value != nil && fresh {
+		bits := zero
+		if constant.BoolVal(tv.Value) {
+			bits = one
+		}
+		for i := 0; i < len(sh.shares)-1; i++ {
+			share := mrand.Uint64()
+			if sh.xor {
+				bits ^= share
+			} else {
+				bits -= share
+			}
+			values = append(values, sh.literal(share, typed, info))
+		}
+		return append(values, sh.literal(bits, typed, info))
+	}
+	var last ast.Expr
+	if tv := info.Types[value]; tv.Value != nil {
+		last = sh.literal(zero, false, info)
+		if constant.BoolVal(tv.Value) {
+			last = sh.literal(one, false, info)
+		}
+	} else {
+		last = sh.truth(value, one, zero, info)
+	}
+	inverse := token.SUB
+	if sh.xor {
+		inverse = token.XOR
+	}
+	for i := 0; i < len(sh.shares)-1; i++ {
+		var share ast.Expr
+		if fresh {
+			share = sh.literal(mrand.Uint64(), typed, info)
+		} else {
+			share = sh.binary(sh.binary(base(i), token.MUL, sh.literal(sh.mul[i], false, info), info), token.ADD, sh.literal(sh.inc[i], false, info), info)
+		}
+		values = append(values, share)
+		last = sh.binary(last, inverse, cloneExpr(share, info), info)
+	}
+	return append(values, last)
+}
+// truth returns a call of a function literal returning one if value is true and zero otherwise.
+func (sh *boolShares) truth(value ast.Expr, one, zero uint64, info *types.Info) ast.Expr {
+	ret := func(bits uint64) ast.Stmt {
+		return &ast.ReturnStmt{Results: []ast.Expr{sh.literal(bits, false, info)}}
+	}
+	fn := &ast.FuncLit{
+		Type: &ast.FuncType{Params: &ast.FieldList{}, Results: &ast.FieldList{List: []*ast.Field{{Type: cloneExpr(sh.conversion, info)}}}},
+		Body: &ast.BlockStmt{List: []ast.Stmt{
+			&ast.IfStmt{Cond: value, Body: &ast.BlockStmt{List: []ast.Stmt{ret(one)}}},
+			ret(zero),
+		}},
+	}
+	info.Types[fn] = types.TypeAndValue{Type: types.NewSignatureType(nil, nil, nil, nil, types.NewTuple(types.NewVar(token.NoPos, nil, "", sh.typ)), false)}
+	call := &ast.CallExpr{Fun: fn}
+	info.Types[call] = types.TypeAndValue{Type: sh.typ}
+	return call
+}
+// rewrite replaces the declarations, writes and reads of the split variables and fields of file.
+func (s *boolSplit) rewrite(file *ast.File) {
+	info := s.info
+	// ident returns an identifier of share, declaring it if def is set. The identifiers have no
+	// objects, so that RenameIdentifiers leaves the shares alone.
+	ident := func(share *types.Var, def bool) *ast.Ident {
+		id := &ast.Ident{Name: share.Name()}
+		if def {
+			info.Defs[id] = share
+		} else {
+			info.Uses[id] = share
+			info.Types[id] = types.TypeAndValue{Type: share.Type()}
+		}
+		return id
+	}
+	// target returns the shares written or read by expr, and how to refer to each of them.
+	target := func(expr ast.Expr) (*boolShares, func(i int) ast.Expr) {
+		switch expr := expr.(type) {
+		case *ast.Ident:
+			if v, ok := info.ObjectOf(expr).(*types.Var); ok && !v.IsField() && s.split[v] != nil {
+				sh := s.split[v]
+				return sh, func(i int) ast.Expr { return ident(sh.shares[i], false) }
+			}
+		case *ast.SelectorExpr:
+			if v := s.field(expr); v != nil && s.split[v] != nil {
+				sh := s.split[v]
+				return sh, func(i int) ast.Expr {
+					sel := &ast.SelectorExpr{X: cloneExpr(expr.X, info), Sel: ident(sh.shares[i], false)}
+					info.Types[sel] = types.TypeAndValue{Type: sh.typ}
+					return sel
+				}
+			}
+		}
+		return nil, nil
+	}
+	astutil.Apply(file, func(cursor *astutil.Cursor) bool {
+		switch n := cursor.Node().(type) {
+		case *ast.AssignStmt:
+			if len(n.Lhs) != len(n.Rhs) {
+				return true
+			}
+			var lhs, rhs []ast.Expr
+			for i, l := range n.Lhs {
+				sh, base := target(l)
+				if sh == nil {
+					lhs, rhs = append(lhs, l), append(rhs, n.Rhs[i])
+					continue
+				}
+				id, _ := l.(*ast.Ident)
+				fresh := id != nil && info.Defs[id] != nil
+				for j, share := range sh.shares {
+					if fresh {
+						lhs = append(lhs, ident(share, true))
+					} else {
+						lhs = append(lhs, base(j))
+					}
+				}
+				rhs = append(rhs, sh.values(n.Rhs[i], base, fresh, n.Tok == token.DEFINE, info)...)
+			}
+			n.Lhs, n.Rhs = lhs, rhs
+		case *ast.ValueSpec:
+			var names []*ast.Ident
+			var values []ast.Expr
+			for i, name := range n.Names {
+				sh, _ := target(name)
+				if sh == nil {
+					names = append(names, name)
+					if len(n.Values) > 0 {
+						values = append(values, n.Values[i])
+					}
+					continue
+				}
+				for _, share := range sh.shares {
+					names = append(names, ident(share, true))
+				}
+				if n.Type != nil {
+					n.Type = cloneExpr(sh.conversion, info)
+				}
+				// The zero value is split too.
+				value := ast.Expr(ast.NewIdent("false"))
+				info.Types[value] = types.TypeAndValue{Type: types.Typ[types.Bool], Value: constant.MakeBool(false)}
+				if len(n.Values) > 0 {
+					value = n.Values[i]
+				}
+				values = append(values, sh.values(value, nil, true, n.Type == nil, info)...)
+			}
+			n.Names, n.Values = names, values
+		case *ast.CompositeLit:
+			var elts []ast.Expr
+			for _, elt := range n.Elts {
+				var v *types.Var
+				kv, ok := elt.(*ast.KeyValueExpr)
+				if ok {
+					if key, isIdent := kv.Key.(*ast.Ident); isIdent {
+						v, _ = info.Uses[key].(*types.Var)
+					}
+				}
+				if v == nil || !v.IsField() || s.split[v.Origin()] == nil {
+					elts = append(elts, elt)
+					continue
+				}
+				sh := s.split[v.Origin()]
+				for i, value := range sh.values(kv.Value, nil, true, false, info) {
+					elts = append(elts, &ast.KeyValueExpr{Key: ident(sh.shares[i], false), Value: value})
+				}
+			}
+			n.Elts = elts
+		case *ast.FieldList:
+			var fields []*ast.Field
+			for _, field := range n.List {
+				split := false
+				for _, name := range field.Names {
+					v, ok := info.Defs[name].(*types.Var)
+					split = split || ok && v.IsField() && s.split[v] != nil
+				}
+				if !split {
+					fields = append(fields, field)
+					continue
+				}
+				// The names of the field may not all be split: each gets a field of its own.
+				for _, name := range field.Names {
+					sh := s.split[info.Defs[name].(*types.Var)]
+					if sh == nil {
+						fields = append(fields, &ast.Field{Doc: field.Doc, Names: []*ast.Ident{name}, Type: cloneExpr(field.Type, info)})
+						continue
+					}
+					f := &ast.Field{Doc: field.Doc, Type: cloneExpr(sh.conversion, info)}
+					for _, share := range sh.shares {
+						f.Names = append(f.Names, ident(share, true))
+					}
+					fields = append(fields, f)
+				}
+			}
+			n.List = fields
+		}
+		return true
+	}, func(cursor *astutil.Cursor) bool {
+		switch n := cursor.Node().(type) {
+		case *ast.Ident, *ast.SelectorExpr:
+			if _, ok := cursor.Parent().(*ast.SelectorExpr); ok && cursor.Name() == "Sel" {
+				return true
+			}
+			if sh, base := target(n.(ast.Expr)); sh != nil {
+				cursor.Replace(sh.read(base, info))
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,241 @@
+package obfuscator
+import (
+	"go/ast"
+	"strings"
+	"testing"
+)
+var boolSplitProgram = map[string]string{
+	"main.go": `package main
+import "fmt"
+var debugMode = false
+var verbose bool
+type license struct {
+	owner    string
+	licensed bool //obf:split
+	// trial marks an evaluation copy.
+	//obf:split
+	trial, expired bool
+	seats int
+}
+type pair struct {
+	on bool //obf:split
+}
+func (l *license) valid() bool {
+	return l.licensed && !l.expired
+}
+func check(key string, days int) (license, bool) {
+	l := license{owner: key, licensed: len(key) > 3, trial: days > 0}
+	if days > 30 {
+		l.expired = true
+	}
+	ok := l.valid()
+	var strict, lax bool = len(key) > 8, true
+	for i := 0; i < days%5; i++ {
+		strict = !strict
+		lax = lax && i < 2
+	}
+	flip := func() bool {
+		verbose = !verbose
+		return verbose
+	}
+	flip()
+	return l, ok && (strict || lax) && flip() == verbose
+}
+func untouched() bool {
+	kept := true
+	p := &kept
+	*p = false
+	found, other := false, 1
+	m := map[string]int{"a": other}
+	_, found = m["a"]
+	return kept || found
+}
+func main() {
+	for _, key := range []string{"abc", "abcdef", "abcdefghij"} {
+		for days := 0; days < 40; days += 7 {
+			l, ok := check(key, days)
+			fmt.Println(key, days, ok, l.licensed, l.trial, l.expired, l.valid())
+		}
+	}
+	if !debugMode {
+		debugMode = untouched()
+	}
+	a, b := pair{on: true}, pair{on: true}
+	fmt.Println(debugMode, verbose, a == b)
+}
+`,
+}
+func TestBoolSplitPass_PreservesBehaviour(t *testing.T) {
+	want := runGoProgram(t, boolSplitProgram)
+	pkg := loadTestPackage(t, boolSplitProgram)
+	pass := &BoolSplitPass{}
+	if err := pass.Apply(nil, pkg); err != nil {
+		t.Fatalf("BoolSplitPass failed: %v", err)
+	}
+	if report := strings.Join(pass.Unsplit, "\n"); len(pass.Unsplit) != 1 || !strings.Contains(report, "field on (struct compared)") {
+		t.Errorf("Expected on to be reported as kept, got:\n%s", report)
+	}
+	// The shares are integer variables: the values can be encoded over them.
+	if err := (&ValueEncodingPass{}).Apply(nil, pkg); err != nil {
+		t.Fatalf("ValueEncodingPass failed: %v", err)
+	}
+	out := printPackage(t, pkg)
+	if got := runGoProgram(t, out); got != want {
+		t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out["main.go"])
+	}
+	for _, plain := range []string{"debugMode", "verbose", "licensed", "expired", "strict", "lax", "ok := l.valid()", "//obf:split"} {
+		if strings.Contains(out["main.go"], plain) {
+			t.Errorf("Expected %q to be split:\n%s", plain, out["main.go"])
+		}
+	}
+	for _, kept := range []string{"kept := true", "found, other :=", "l, ok := check", "on bool", "// trial marks an evaluation copy."} {
+		if !strings.Contains(out["main.go"], kept) {
+			t.Errorf("Expected %q to be left alone:\n%s", kept, out["main.go"])
+		}
+	}
+}
+func TestBoolSplitPass_ReportsUnsplitFields(t *testing.T) {
+	pkg := loadTestPackage(t, map[string]string{"lib.go": `package lib
+type State struct {
+	Enabled bool //obf:split
+	ready   bool //obf:split
+	count   int  //obf:split
+}
+type Box[T any] struct {
+	v    T
+	full bool //obf:split
+}
+func (s *State) Ready() bool { return s.ready }
+`})
+	pass := &BoolSplitPass{}
+	if err := pass.Apply(nil, pkg); err != nil {
+		t.Fatalf("BoolSplitPass failed: %v", err)
+	}
+	report := strings.Join(pass.Unsplit, "\n")
+	for _, want := range []string{"lib.go:3:2: field Enabled (exported from a package other than main)", "field count (not of type bool)", "field full (field of a generic struct)"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Expected %q to be reported, got:\n%s", want, report)
+		}
+	}
+	if len(pass.Unsplit) != 3 {
+		t.Errorf("Expected 3 fields reported, got:\n%s", report)
+	}
+	out := printPackage(t, pkg)
+	if !strings.Contains(out["lib.go"], "Enabled") || strings.Contains(out["lib.go"], "ready") {
+		t.Errorf("Expected Enabled to be kept and ready to be split:\n%s", out["lib.go"])
+	}
+}
+func TestBoolSplitPass_KeepsComparedFields(t *testing.T) {
+	program := map[string]string{"main.go": `package main
+import "fmt"
+type inner struct {
+	nested bool //obf:split
+}
+type outer struct{ in inner }
+type keyIn struct {
+	keyed bool //obf:split
+}
+type key struct{ in keyIn }
+type cell struct {
+	cell bool //obf:split
+}
+type boxed struct {
+	boxed bool //obf:split
+}
+type tag struct {
+	tagged bool //obf:split
+}
+type shown struct {
+	shown bool //obf:split
+}
+type param struct {
+	param bool //obf:split
+}
+type plain struct {
+	plain bool //obf:split
+}
+func same[T comparable](x, y T) bool { return x == y }
+func wrap(b boxed) any { return b }
+func main() {
+	var a, b outer
+	a.in.nested = false
+	a.in.nested = true
+	b.in.nested = true
+	fmt.Println(a == b)
+	var k, l key
+	k.in.keyed = false
+	k.in.keyed = true
+	l.in.keyed = true
+	fmt.Println(len(map[key]int{k: 1, l: 2}))
+	var c, d [2]cell
+	c[0].cell = false
+	c[0].cell = true
+	d[0].cell = true
+	fmt.Println(c == d)
+	var x, y boxed
+	x.boxed = false
+	x.boxed = true
+	y.boxed = true
+	fmt.Println(any(x) == any(y), wrap(x) == wrap(y))
+	var s, u tag
+	s.tagged = false
+	s.tagged = true
+	u.tagged = true
+	switch s {
+	case u:
+		fmt.Println("same tag")
+	default:
+		fmt.Println("other tag")
+	}
+	var v shown
+	v.shown = false
+	v.shown = true
+	fmt.Println(v)
+	var p, q param
+	p.param = false
+	p.param = true
+	q.param = true
+	fmt.Println(same(p, q))
+	var m, n plain
+	m.plain = false
+	m.plain = true
+	n.plain = true
+	fmt.Println(m.plain == n.plain)
+}
+`}
+	want := runGoProgram(t, program)
+	pkg := loadTestPackage(t, program)
+	// Earlier passes leave code without type information.
+	for _, decl := range pkg.Syntax[0].Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok && fd.Name.Name == "main" {
+			fd.Body.List = append(mustParseStmts(`ch := make(chan []any, 1)
+ch <- []any{map[string]int{"k": 1}["k"]}
+<-ch`), fd.Body.List...)
+		}
+	}
+	pass := &BoolSplitPass{}
+	if err := pass.Apply(nil, pkg); err != nil {
+		t.Fatalf("BoolSplitPass failed: %v", err)
+	}
+	out := printPackage(t, pkg)
+	if got := runGoProgram(t, out); got != want {
+		t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out["main.go"])
+	}
+	report := strings.Join(pass.Unsplit, "\n")
+	for _, reason := range []string{
+		"field nested (struct compared)",
+		"field keyed (struct used as a map key)",
+		"field cell (struct compared)",
+		"field boxed (struct converted to an interface)",
+		"field tagged (struct compared)",
+		"field shown (struct converted to an interface)",
+		"field param (struct used as a type argument)",
+	} {
+		if !strings.Contains(report, reason) {
+			t.Errorf("Expected %q to be reported, got:\n%s", reason, report)
+		}
+	}
+	if strings.Contains(out["main.go"], "plain bool") || strings.Contains(report, "field plain") {
+		t.Errorf("Expected plain to be split:\n%s\n%s", report, out["main.go"])
+	}
+}
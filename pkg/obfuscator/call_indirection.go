@@ -12,6 +12,8 @@ type funcInfo struct {
 	id       int
 	file     *ast.File
 	isMethod bool
+	// merged is set once the function has been folded into a super-function.
+	merged *mergedCall
 }
 type CallIndirectionPass struct {
 	funcs              map[string]*funcInfo
@@ -19,6 +21,12 @@ type CallIndirectionPass struct {
 	dispatcherFuncName string
 	maskingKey         int // A static key component to add noise.
 	nextFuncID         int
+	// MergeFunctions folds groups of unexported functions into super-functions before the calls
+	// are rewritten.
+	MergeFunctions bool
+	// DirectCalls leaves the calls direct instead of routing them through the dispatcher, so
+	// that only the merging applies.
+	DirectCalls bool
 }
 func (p *CallIndirectionPass) Apply(obf *Obfuscator, fset *token.FileSet, files map[string]*ast.File) error {
 	fmt.Println("  - Applying call indirection with dynamic keying...")
@@ -33,6 +41,12 @@ func (p *CallIndirectionPass) Apply(obf *Obfuscator, fset *token.FileSet, files
 		fmt.Println("   - Call indirection: no functions found to replace.")
 		return nil
 	}
+	if p.MergeFunctions {
+		p.mergeFuncs(fset, files)
+	}
+	if p.DirectCalls {
+		return nil
+	}
 	if err := p.rewriteCalls(files); err != nil {
 		return fmt.Errorf("error rewriting calls: %w", err)
 	}
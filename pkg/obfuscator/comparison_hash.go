@@ -0,0 +1,274 @@
+package obfuscator
+import (
+	"crypto/sha256"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+// secretDirective marks the comparisons on the same or the following line, or the constants of the
+// declaration it documents, as secret: `//obf:secret`.
+const secretDirective = "//obf:secret"
+// ComparisonHashPass rewrites equality checks of a variable against a secret constant into a
+// comparison of salted SHA-256 digests, so the constant itself never appears in the binary:
+//
+//	password == "hunter2"          ->  h(salt, []byte(password)) == [32]byte{...}
+//	bytes.Equal(b, []byte("key"))  ->  h(salt, b) == [32]byte{...}
+//	code != 0x5eed                 ->  hi(salt, uint64(code)) != [32]byte{...}
+//
+// Only the comparisons marked with secretDirective, or against constants declared with it, are
+// rewritten: each costs an allocation and a hash. Constants shorter than two bytes are left alone:
+// hashing them hides nothing from a brute force.
+type ComparisonHashPass struct{}
+// comparisonHashState holds the helper names and the rewrites computed for one package.
+type comparisonHashState struct {
+	obf          *Obfuscator
+	fset         *token.FileSet
+	info         *types.Info
+	// lines holds the lines of the current file marked with secretDirective; consts, the constants
+	// declared with it.
+	lines        map[int]bool
+	consts       map[types.Object]bool
+	bytesHash    string
+	intHash      string
+	replacements map[ast.Node]ast.Expr
+}
+func (p *ComparisonHashPass) Apply(obf *Obfuscator, pkg *packages.Package) error {
+	if pkg.TypesInfo == nil || len(pkg.Syntax) == 0 {
+		return nil
+	}
+	st := &comparisonHashState{
+		obf:          obf,
+		fset:         pkg.Fset,
+		info:         pkg.TypesInfo,
+		consts:       make(map[types.Object]bool),
+		bytesHash:    NewName(),
+		intHash:      NewName(),
+		replacements: make(map[ast.Node]ast.Expr),
+	}
+	for _, file := range pkg.Syntax {
+		st.markConsts(file)
+	}
+	for _, file := range pkg.Syntax {
+		st.lines = directiveLines(pkg.Fset, file, secretDirective)
+		ast.Inspect(file, func(n ast.Node) bool {
+			var repl ast.Expr
+			switch e := n.(type) {
+			case *ast.BinaryExpr:
+				repl = st.rewriteEquality(e)
+			case *ast.CallExpr:
+				repl = st.rewriteBytesEqual(e)
+			}
+			if repl == nil {
+				return true
+			}
+			st.replacements[n] = repl
+			return false
+		})
+		astutil.Apply(file, func(cursor *astutil.Cursor) bool {
+			if repl, ok := st.replacements[cursor.Node()]; ok {
+				cursor.Replace(repl)
+			}
+			return true
+		}, nil)
+		dropUnusedImport(pkg.Fset, file, "bytes")
+		var directives []*ast.Comment
+		for _, group := range file.Comments {
+			for _, c := range group.List {
+				if strings.HasPrefix(c.Text, secretDirective) {
+					directives = append(directives, c)
+				}
+			}
+		}
+		for _, c := range directives {
+			removeComment(file, c)
+		}
+	}
+	if len(st.replacements) == 0 {
+		return nil
+	}
+	file := pkg.Syntax[0]
+	names := newTypeNamer(pkg.Fset, file, pkg.Types, file.Name.Pos())
+	sha, err := names.packageName("crypto/sha256", "sha256")
+	if err != nil {
+		return err
+	}
+	helpers := mustParseDecls(fmt.Sprintf(`func %[1]s(salt string, b []byte) [32]byte {
+	return %[3]s.Sum256(append([]byte(salt), b...))
+}
+func %[2]s(salt string, v uint64) [32]byte {
+	return %[1]s(salt, []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24), byte(v >> 32), byte(v >> 40), byte(v >> 48), byte(v >> 56)})
+}`, st.bytesHash, st.intHash, sha))
+	names.addImports()
+	appendDecls(file, helpers)
+	fmt.Printf("    - Hid %d comparisons behind salted hashes\n", len(st.replacements))
+	return nil
+}
+// rewriteEquality handles == and != between a non-constant string or integer and a constant.
+func (st *comparisonHashState) rewriteEquality(e *ast.BinaryExpr) ast.Expr {
+	if e.Op != token.EQL && e.Op != token.NEQ {
+		return nil
+	}
+	x, c := e.X, e.Y
+	if st.isConstant(x) {
+		x, c = c, x
+	}
+	if st.isConstant(x) || !st.isConstant(c) || !st.secret(e, c) {
+		return nil
+	}
+	tv, ok := st.info.Types[x]
+	if !ok {
+		return nil
+	}
+	value := st.info.Types[c].Value
+	switch {
+	case isStringType(tv.Type) && value.Kind() == constant.String:
+		plain := constant.StringVal(value)
+		if len(plain) < 2 {
+			return nil
+		}
+		return st.compare(e, st.bytesHash, "[]byte", x, []byte(plain), nil)
+	case integerSize(tv.Type) > 0:
+		v, ok := integerValue(st.info, c)
+		if !ok || int64(v) > -256 && int64(v) < 256 {
+			return nil
+		}
+		return st.compare(e, st.intHash, "uint64", x, nil, &v)
+	}
+	return nil
+}
+// rewriteBytesEqual handles bytes.Equal(b, []byte(constant)) in either argument order.
+func (st *comparisonHashState) rewriteBytesEqual(call *ast.CallExpr) ast.Expr {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || len(call.Args) != 2 {
+		return nil
+	}
+	fn, ok := st.info.Uses[sel.Sel].(*types.Func)
+	if !ok || fn.Pkg() == nil || fn.Pkg().Path() != "bytes" || fn.Name() != "Equal" {
+		return nil
+	}
+	x, c := call.Args[0], call.Args[1]
+	plain, ok := st.constantBytes(c)
+	if !ok {
+		x, c = c, x
+		if plain, ok = st.constantBytes(c); !ok {
+			return nil
+		}
+	}
+	if _, both := st.constantBytes(x); both || len(plain) < 2 || !st.secret(call, c.(*ast.CallExpr).Args[0]) {
+		return nil
+	}
+	return st.compare(call, st.bytesHash, "", x, plain, nil)
+}
+// markConsts records the constants of file declared with secretDirective.
+func (st *comparisonHashState) markConsts(file *ast.File) {
+	ast.Inspect(file, func(n ast.Node) bool {
+		decl, ok := n.(*ast.GenDecl)
+		if !ok || decl.Tok != token.CONST {
+			return true
+		}
+		for _, spec := range decl.Specs {
+			vs := spec.(*ast.ValueSpec)
+			if !secretComment(decl.Doc) && !secretComment(vs.Doc) && !secretComment(vs.Comment) {
+				continue
+			}
+			for _, name := range vs.Names {
+				st.consts[st.info.Defs[name]] = true
+			}
+		}
+		return false
+	})
+}
+// secretComment reports whether group carries secretDirective.
+func secretComment(group *ast.CommentGroup) bool {
+	if group == nil {
+		return false
+	}
+	for _, c := range group.List {
+		if strings.HasPrefix(c.Text, secretDirective) {
+			return true
+		}
+	}
+	return false
+}
+// secret reports whether the comparison e against the constant c is marked with secretDirective,
+// or c names a constant declared with it.
+func (st *comparisonHashState) secret(e, c ast.Expr) bool {
+	if line := st.fset.Position(e.Pos()).Line; st.lines[line] || st.lines[line-1] {
+		return true
+	}
+	switch c := ast.Unparen(c).(type) {
+	case *ast.Ident:
+		return st.consts[st.info.Uses[c]]
+	case *ast.SelectorExpr:
+		return st.consts[st.info.Uses[c.Sel]]
+	}
+	return false
+}
+// constantBytes returns the value of a []byte conversion of a constant string.
+func (st *comparisonHashState) constantBytes(e ast.Expr) ([]byte, bool) {
+	conv, ok := e.(*ast.CallExpr)
+	if !ok || len(conv.Args) != 1 {
+		return nil, false
+	}
+	fun, ok := st.info.Types[conv.Fun]
+	if !ok || !fun.IsType() {
+		return nil, false
+	}
+	arg, ok := st.info.Types[conv.Args[0]]
+	if !ok || arg.Value == nil || arg.Value.Kind() != constant.String {
+		return nil, false
+	}
+	return []byte(constant.StringVal(arg.Value)), true
+}
+// isConstant reports whether e is a constant expression.
+func (st *comparisonHashState) isConstant(e ast.Expr) bool {
+	tv, ok := st.info.Types[e]
+	return ok && tv.Value != nil
+}
+// compare builds `helper(salt, conv(operand)) op digest`, where digest is the salted hash of
+// either data or the little-endian encoding of *intValue.
+func (st *comparisonHashState) compare(orig ast.Expr, helper, conv string, operand ast.Expr, data []byte, intValue *uint64) ast.Expr {
+	salt := randomToken(12)
+	if intValue != nil {
+		data = make([]byte, 8)
+		for i := range data {
+			data[i] = byte(*intValue >> (8 * i))
+		}
+	}
+	digest := sha256.Sum256(append([]byte(salt), data...))
+	digestLit, err := parser.ParseExpr(fmt.Sprintf("[32]byte{%s}", byteListLiteral(digest[:])))
+	if err != nil {
+		return nil
+	}
+	saltLit := &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(salt)}
+	if st.obf != nil && st.obf.stringEncryption != nil {
+		// The salt is not secret; decrypting it on every comparison would only cost time.
+		st.obf.stringEncryption.keepPlaintext(saltLit)
+	}
+	op := token.EQL
+	if b, ok := orig.(*ast.BinaryExpr); ok {
+		op = b.Op
+	}
+	pos := orig.Pos()
+	call := &ast.CallExpr{Fun: ast.NewIdent(helper), Args: []ast.Expr{saltLit}}
+	pinPositions(call, pos)
+	pinPositions(digestLit, pos)
+	arg := operand
+	if conv != "" {
+		fun, err := parser.ParseExpr(conv)
+		if err != nil {
+			return nil
+		}
+		pinPositions(fun, pos)
+		arg = &ast.CallExpr{Fun: fun, Lparen: pos, Args: []ast.Expr{operand}, Rparen: pos}
+	}
+	call.Args = append(call.Args, arg)
+	return &ast.BinaryExpr{X: call, OpPos: pos, Op: op, Y: digestLit}
+}
@@ -0,0 +1,99 @@
+package obfuscator
+import (
+	"strings"
+	"testing"
+)
+func TestComparisonHashPass_CheckPassword(t *testing.T) {
+	src := `package main
+import (
+	"bytes"
+	"fmt"
+)
+var weave_key_dummy int64
+type Token string
+//obf:secret
+const adminToken Token = "tok-31337"
+const (
+	guest = "guest-account"
+	quota = 4096
+)
+func checkPassword(userInput string) bool {
+	return userInput == "hunter2" //obf:secret
+}
+func checkKey(key []byte) bool {
+	//obf:secret
+	return bytes.Equal([]byte("sesame-open"), key)
+}
+func checkCode(code int32) bool {
+	//obf:secret
+	return 0x5eed != code
+}
+func main() {
+	for _, in := range []string{"hunter2", "hunter3", ""} {
+		fmt.Println(checkPassword(in), checkKey([]byte(in+"sesame-open"[len(in):])), in == "x", in == guest || in == "not-a-secret")
+	}
+	for _, code := range []int32{0x5eed, 0x5eee, -1} {
+		fmt.Println(checkCode(code), code == -1, code == quota)
+	}
+	var tok Token = "tok-31337"
+	fmt.Println(tok == adminToken, tok != adminToken)
+}
+`
+	want := "true false false false\nfalse false false false\nfalse true false false\nfalse false false\ntrue false false\ntrue true false\ntrue false\n"
+	pkg := loadTestPackage(t, map[string]string{"main.go": src})
+	obf := &Obfuscator{WeavingKeyVarName: "weave_key_dummy", stringEncryption: NewStringEncryptionPass()}
+	if err := (&ComparisonHashPass{}).Apply(obf, pkg); err != nil {
+		t.Fatalf("ComparisonHashPass.Apply failed: %v", err)
+	}
+	hashed := printFile(t, pkg.Fset, pkg.Syntax[0])
+	for _, s := range []string{`== "hunter2"`, `[]byte("sesame-open"), key`, "0x5eed !=", "tok == adminToken"} {
+		if strings.Contains(hashed, s) {
+			t.Errorf("Expected %s to be replaced by a hash comparison:\n%s", s, hashed)
+		}
+	}
+	for _, s := range []string{`in == "x"`, "code == -1", "in == guest", `in == "not-a-secret"`, "code == quota", "sha256.Sum256"} {
+		if !strings.Contains(hashed, s) {
+			t.Errorf("Expected %s in the output:\n%s", s, hashed)
+		}
+	}
+	if strings.Contains(hashed, secretDirective) {
+		t.Errorf("Expected the directives to be removed:\n%s", hashed)
+	}
+	if err := (&StringConstPass{}).Apply(obf, pkg); err != nil {
+		t.Fatalf("StringConstPass.Apply failed: %v", err)
+	}
+	obf.stringEncryption.BeginPackage(StringModeInline)
+	if err := obf.stringEncryption.Apply(obf, pkg.Fset, pkg.Syntax[0]); err != nil {
+		t.Fatalf("StringEncryptionPass.Apply failed: %v", err)
+	}
+	out := printFile(t, pkg.Fset, pkg.Syntax[0])
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("The password must not survive in any form:\n%s", out)
+	}
+	if got := runGoProgram(t, map[string]string{"main.go": out}); got != want {
+		t.Errorf("Output mismatch:\ngot  %q\nwant %q", got, want)
+	}
+}
+func TestComparisonHashPass_Sha256Declared(t *testing.T) {
+	src := `package main
+import "fmt"
+var sha256 = "not the package"
+func main() {
+	for _, in := range []string{"open-sesame", sha256} {
+		//obf:secret
+		fmt.Println(in == "open-sesame")
+	}
+}
+`
+	pkg := loadTestPackage(t, map[string]string{"main.go": src})
+	if err := (&ComparisonHashPass{}).Apply(&Obfuscator{}, pkg); err != nil {
+		t.Fatalf("ComparisonHashPass.Apply failed: %v", err)
+	}
+	out := printFile(t, pkg.Fset, pkg.Syntax[0])
+	if strings.Contains(out, "open-sesame\")") {
+		t.Errorf("Expected the comparison to be hashed:\n%s", out)
+	}
+	if got := runGoProgram(t, map[string]string{"main.go": out}); got != "true\nfalse\n" {
+		t.Errorf("Output mismatch: got %q\n%s", got, out)
+	}
+}
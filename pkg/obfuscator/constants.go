@@ -3,110 +3,241 @@ import (
 	"crypto/rand"
 	"fmt"
 	"go/ast"
+	"go/constant"
 	"go/token"
+	"go/types"
+	"math"
 	"math/big"
+	mrand "math/rand"
 	"strconv"
+	"strings"
 	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
 )
-// ObfuscateConstants traverses the AST and replaces integer literals with
-// more complex, functionally equivalent expressions.
-func ObfuscateConstants(file *ast.File) {
-	astutil.Apply(file, func(cursor *astutil.Cursor) bool {
-		node := cursor.Node()
-		lit, ok := node.(*ast.BasicLit)
-		if !ok || lit.Kind != token.INT {
-			return true
+// ConstantPass moves numeric constants out of the code. Constant expressions of integer and
+// floating-point types, typed constants included, are replaced with package-level variables of
+// the same type, whose values are decoded from a table when the package is initialized: unlike
+// arithmetic over literals, the compiler cannot fold them back. Positions that require a constant
+// (const declarations, array lengths and keys, shifts) and the elements of integer data literals
+// are left alone.
+type ConstantPass struct {
+	// Density is the percentage of the eligible constants that are moved; 0 means all of them.
+	Density int
+}
+// constantTable collects the values moved out of one file.
+type constantTable struct {
+	pkg     *types.Package
+	names   *typeNamer
+	density int
+	name  string
+	// values holds the bits of every value, in table order.
+	values []uint64
+	// vars maps a type and the bits of a value to the variable holding it.
+	vars  map[string]*types.Var
+	specs []string
+}
+func (p *ConstantPass) Apply(obf *Obfuscator, pkg *packages.Package) error {
+	if pkg.TypesInfo == nil {
+		return nil
+	}
+	moved := 0
+	for _, file := range pkg.Syntax {
+		if usesCgo(file) {
+			continue
 		}
-		// New check: Do not obfuscate integers inside a byte slice literal.
-		if isInsideByteSlice(cursor) {
-			return true
+		t := &constantTable{pkg: pkg.Types, density: p.Density, names: newTypeNamer(pkg.Fset, file, pkg.Types, file.Name.Pos()), name: NewName(), vars: make(map[string]*types.Var)}
+		replacements := make(map[ast.Node]ast.Expr)
+		walkWithStack(file, func(n ast.Node, stack []ast.Node) {
+			if expr, ok := n.(ast.Expr); ok {
+				if repl := t.replace(pkg.TypesInfo, expr, stack); repl != nil {
+					replacements[n] = repl
+				}
+			}
+		})
+		if len(replacements) == 0 {
+			continue
 		}
-		if isInsideConstDecl(file, cursor) {
+		astutil.Apply(file, func(cursor *astutil.Cursor) bool {
+			if repl, ok := replacements[cursor.Node()]; ok {
+				cursor.Replace(repl)
+				return false
+			}
 			return true
+		}, nil)
+		appendDecls(file, t.decls())
+		t.names.addImports()
+		// The constants may have been the only uses of a package, such as math.MaxInt32.
+		for _, imp := range append([]*ast.ImportSpec(nil), file.Imports...) {
+			path, _ := strconv.Unquote(imp.Path.Value)
+			dropUnusedImport(pkg.Fset, file, path)
 		}
-		if randInt(100) < 50 {
-			return true
+		moved += len(replacements)
+	}
+	if moved > 0 {
+		fmt.Printf("    - Moved %d constants into package variables\n", moved)
+	}
+	return nil
+}
+// replace returns the variable replacing expr, or nil if expr is not a numeric constant
+// expression that can be replaced. Only maximal constant expressions are replaced, since their
+// parts are evaluated with the precision of untyped constants.
+func (t *constantTable) replace(info *types.Info, expr ast.Expr, stack []ast.Node) ast.Expr {
+	tv, ok := info.Types[expr]
+	if !ok || tv.Value == nil || isUntyped(tv.Type) {
+		return nil
+	}
+	if parent, ok := stack[len(stack)-2].(ast.Expr); ok && info.Types[parent].Value != nil {
+		return nil
+	}
+	if _, ok := tv.Type.(*types.TypeParam); ok {
+		return nil
+	}
+	b, ok := tv.Type.Underlying().(*types.Basic)
+	if !ok || b.Info()&(types.IsInteger|types.IsFloat) == 0 {
+		return nil
+	}
+	if requiresConstant(stack, info, nil) || shiftOperand(stack) || dataElement(stack, info) || !standalone(expr, info) {
+		return nil
+	}
+	var bits uint64
+	switch {
+	case b.Info()&types.IsInteger != 0:
+		bits, _ = integerValue(info, expr)
+		if int64(bits) >= -2 && int64(bits) <= 2 {
+			return nil
 		}
-		val, err := strconv.ParseInt(lit.Value, 0, 64)
+	case b.Kind() == types.Float32:
+		f, _ := constant.Float32Val(tv.Value)
+		bits = uint64(math.Float32bits(f))
+	default:
+		f, _ := constant.Float64Val(tv.Value)
+		bits = math.Float64bits(f)
+	}
+	if t.density > 0 && randInt(100) >= int64(t.density) {
+		return nil
+	}
+	v := t.variable(tv.Type, b, bits)
+	if v == nil {
+		return nil
+	}
+	ident := &ast.Ident{NamePos: expr.Pos(), Name: v.Name()}
+	info.Types[ident] = types.TypeAndValue{Type: tv.Type}
+	info.Uses[ident] = v
+	return ident
+}
+// variable returns the package-level variable of type typ holding the value with the given bits,
+// declaring it on first use, or nil if typ cannot be named in the file.
+func (t *constantTable) variable(typ types.Type, b *types.Basic, bits uint64) *types.Var {
+	key := types.TypeString(typ, nil) + "=" + strconv.FormatUint(bits, 16)
+	if v, ok := t.vars[key]; ok {
+		return v
+	}
+	conv, err := t.names.expr(typ)
+	if err != nil {
+		return nil
+	}
+	value := fmt.Sprintf("%s[%d]", t.name, len(t.values))
+	if b.Info()&types.IsFloat != 0 {
+		mathName, err := t.names.packageName("math", "math")
 		if err != nil {
-			return true
+			return nil
 		}
-		if val >= -2 && val <= 2 {
-			return true
+		if b.Kind() == types.Float32 {
+			u32, err := t.names.expr(types.Typ[types.Uint32])
+			if err != nil {
+				return nil
+			}
+			value = fmt.Sprintf("%s.Float32frombits(%s(%s))", mathName, types.ExprString(u32), value)
+		} else {
+			value = fmt.Sprintf("%s.Float64frombits(%s)", mathName, value)
 		}
-		newNode := generateObfuscatedIntExpr(val)
-		cursor.Replace(newNode)
-		return false
-	}, nil)
+	}
+	v := types.NewVar(token.NoPos, t.pkg, NewName(), typ)
+	t.pkg.Scope().Insert(v)
+	t.vars[key] = v
+	t.values = append(t.values, bits)
+	t.specs = append(t.specs, fmt.Sprintf("%s = %s(%s)", v.Name(), types.ExprString(conv), value))
+	return v
 }
-// isInsideByteSlice checks if the cursor's current position is inside a byte slice literal.
-func isInsideByteSlice(cursor *astutil.Cursor) bool {
-	// A composite literal is something like `[]byte{1, 2, 3}`.
-	// We check if the parent node is a composite literal.
-	compLit, ok := cursor.Parent().(*ast.CompositeLit)
-	if !ok {
-		return false
+// decls returns the declarations of the table and of the variables. The table is decoded by the
+// initializer of a package-level variable, so that the initialization order of the package makes
+// it available to the initializers of other package-level variables.
+func (t *constantTable) decls() []ast.Decl {
+	seed, mul, inc := mrand.Uint64(), mrand.Uint64()|1, mrand.Uint64()|1
+	var encoded []string
+	s := seed
+	for _, bits := range t.values {
+		s = s*mul + inc
+		encoded = append(encoded, fmt.Sprintf("%#x", bits^s))
+	}
+	decls := mustParseDecls(fmt.Sprintf(`var %[1]s = func() (t [%[2]d]uint64) {
+	s := uint64(%#[3]x)
+	for i, v := range [...]uint64{%[4]s} {
+		s = s*%#[5]x + %#[6]x
+		t[i] = v ^ s
+	}
+	return
+}()
+var (
+	%[7]s
+)`, t.name, len(t.values), seed, strings.Join(encoded, ", "), mul, inc, strings.Join(t.specs, "\n\t")))
+	// The uses of the variables have no objects: RenameIdentifiers must not rename the names
+	// declared either.
+	for _, spec := range decls[1].(*ast.GenDecl).Specs {
+		spec.(*ast.ValueSpec).Names[0].Obj = nil
 	}
-	// If it is, we check its type.
-	// The type for `[]byte` is an ArrayType with Elt being an Ident with name "byte".
-	if arrayType, ok := compLit.Type.(*ast.ArrayType); ok {
-		if ident, ok := arrayType.Elt.(*ast.Ident); ok {
-			return ident.Name == "byte"
+	return decls
+}
+// standalone reports whether expr only refers to constants, types and packages: the variables
+// of len(array) or unsafe.Sizeof(v) would be left unused.
+func standalone(expr ast.Expr, info *types.Info) bool {
+	ok := true
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if id, isIdent := n.(*ast.Ident); isIdent {
+			switch info.Uses[id].(type) {
+			case *types.Var, *types.Func:
+				ok = false
+			}
+		}
+		return ok
+	})
+	return ok
+}
+// shiftOperand reports whether the expression on top of stack is an operand of a shift, whose
+// constant operands the compiler treats specially.
+func shiftOperand(stack []ast.Node) bool {
+	for i := len(stack) - 2; i >= 0; i-- {
+		switch parent := stack[i].(type) {
+		case *ast.ParenExpr:
+			continue
+		case *ast.BinaryExpr:
+			return parent.Op == token.SHL || parent.Op == token.SHR
+		case *ast.AssignStmt:
+			return parent.Tok == token.SHL_ASSIGN || parent.Tok == token.SHR_ASSIGN
 		}
+		return false
 	}
 	return false
 }
-// isInsideConstDecl checks if the cursor's current position is inside a 'const' block.
-func isInsideConstDecl(file *ast.File, cursor *astutil.Cursor) bool {
-	path, _ := astutil.PathEnclosingInterval(file, cursor.Node().Pos(), cursor.Node().End())
-	if path == nil {
+// dataElement reports whether the expression on top of stack is an element of a composite
+// literal of integers, which is data rather than code.
+func dataElement(stack []ast.Node, info *types.Info) bool {
+	i := len(stack) - 2
+	if kv, ok := stack[i].(*ast.KeyValueExpr); ok && kv.Value == stack[i+1] && i > 0 {
+		i--
+	}
+	lit, ok := stack[i].(*ast.CompositeLit)
+	if !ok || info.TypeOf(lit) == nil {
 		return false
 	}
-	for _, node := range path {
-		if decl, ok := node.(*ast.GenDecl); ok && decl.Tok == token.CONST {
-			return true
-		}
+	switch t := info.TypeOf(lit).Underlying().(type) {
+	case *types.Slice:
+		return integerSize(t.Elem()) > 0
+	case *types.Array:
+		return integerSize(t.Elem()) > 0
 	}
 	return false
 }
-// generateObfuscatedIntExpr creates a binary expression that evaluates to the original value.
-func generateObfuscatedIntExpr(val int64) ast.Expr {
-	k := randInt(1000) + 1 // A random integer to use in the expression.
-	// Randomly choose one of the reliable obfuscation techniques.
-	method := randInt(2)
-	switch method {
-	case 0:
-		// Technique 1: val => (val ^ k) ^ k
-		// This is a robust method using the properties of XOR.
-		return &ast.BinaryExpr{
-			X: &ast.ParenExpr{
-				X: &ast.BinaryExpr{
-					X:  &ast.BasicLit{Kind: token.INT, Value: fmt.Sprintf("%d", val)},
-					Op: token.XOR,
-					Y:  &ast.BasicLit{Kind: token.INT, Value: fmt.Sprintf("%d", k)},
-				},
-			},
-			Op: token.XOR,
-			Y:  &ast.BasicLit{Kind: token.INT, Value: fmt.Sprintf("%d", k)},
-		}
-	case 1:
-		// Technique 2: val => (val + k) - k
-		return &ast.BinaryExpr{
-			X: &ast.ParenExpr{
-				X: &ast.BinaryExpr{
-					X:  &ast.BasicLit{Kind: token.INT, Value: fmt.Sprintf("%d", val)},
-					Op: token.ADD,
-					Y:  &ast.BasicLit{Kind: token.INT, Value: fmt.Sprintf("%d", k)},
-				},
-			},
-			Op: token.SUB,
-			Y:  &ast.BasicLit{Kind: token.INT, Value: fmt.Sprintf("%d", k)},
-		}
-	default:
-		// Fallback, should not be reached.
-		return &ast.BasicLit{Kind: token.INT, Value: fmt.Sprintf("%d", val)}
-	}
-}
 // randInt generates a cryptographically random integer up to a max value.
 func randInt(max int64) int64 {
 	n, err := rand.Int(rand.Reader, big.NewInt(max))
@@ -0,0 +1,93 @@
+package obfuscator
+import (
+	"strings"
+	"testing"
+)
+var constantsProgram = map[string]string{
+	"main.go": `package main
+import (
+	"fmt"
+	"math"
+	"time"
+)
+type celsius float32
+type level uint16
+const (
+	low level = iota + 7
+	mid
+	high
+)
+const size = 6
+const boiling celsius = 99.975
+var table = [size]int16{-300, 2, 0x7ff}
+var doubled = 2 * high
+var grid = []float64{1.5, -2.25}
+func widths(n int) {
+	var a int8 = -100
+	var b uint8 = 200
+	var c int16 = -30000
+	var d uint32 = 4000000000
+	e := int64(-9000000000000000000)
+	f := uint64(0xfeedfacecafef00d)
+	var g uintptr = 12345
+	var r rune = 0x1F600
+	fmt.Println(a+int8(n), b-uint8(n), c*3, d/7, e%1000003, f^0x0123456789abcdef, g, r)
+	fmt.Println(math.MaxInt64, uint64(math.MaxUint64), math.MinInt8, byte(250)+byte(n))
+}
+func floats(x float64) {
+	var h float32 = 1.0 / 3
+	fmt.Println(x*2.718281828459045, h, boiling, celsius(12.5)+boiling, math.Pi/4, float32(1e-7))
+}
+func shifts(n uint) (uint64, int, int) {
+	var buf [size << 1]byte
+	return 1<<n | 1<<40, len(buf) >> 2, 3 << (n % 5)
+}
+func local() string {
+	type meters int
+	var m meters = 1000
+	return fmt.Sprint(m + 250)
+}
+func generic[T ~int | ~float64](v T) T {
+	return v*10 + 5
+}
+func main() {
+	widths(3)
+	floats(2)
+	fmt.Println(shifts(3))
+	fmt.Println(low, mid, high, doubled, table, grid, local(), generic(4), generic(0.5))
+	fmt.Println(1500*time.Millisecond, time.Duration(42))
+	switch x := level(8); x {
+	case mid:
+		fmt.Println("mid", 1000+int(x))
+	case 10:
+		fmt.Println("ten")
+	}
+}
+`,
+}
+func TestConstantPass_PreservesBehaviour(t *testing.T) {
+	want := runGoProgram(t, constantsProgram)
+	pkg := loadTestPackage(t, constantsProgram)
+	if err := (&ConstantPass{}).Apply(nil, pkg); err != nil {
+		t.Fatalf("ConstantPass failed: %v", err)
+	}
+	out := printPackage(t, pkg)
+	for _, plain := range []string{"0xfeedfacecafef00d", "2.718281828459045", "4000000000", "1500 * time.Millisecond", "12.5", "MaxInt64"} {
+		if strings.Contains(out["main.go"], plain) {
+			t.Errorf("Expected %q to be moved out of the code:\n%s", plain, out["main.go"])
+		}
+	}
+	for _, kept := range []string{"iota + 7", "[size << 1]byte", "len(buf) >> 2", "1<<n |", "3 << (n %", "{-300, 2, 0x7ff}", "v*10 + 5"} {
+		if !strings.Contains(out["main.go"], kept) {
+			t.Errorf("Expected %q to be left alone:\n%s", kept, out["main.go"])
+		}
+	}
+	// The renaming of variables must keep the declarations and the uses of the variables together.
+	for _, file := range pkg.Syntax {
+		RenameIdentifiers(file)
+	}
+	out = printPackage(t, pkg)
+	if got := runGoProgram(t, out); got != want {
+		t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out["main.go"])
+	}
+}
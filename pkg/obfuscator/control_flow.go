@@ -1,322 +1,1346 @@
 package obfuscator
 import (
-	"crypto/rand"
 	"fmt"
 	"go/ast"
-	"go/parser"
 	"go/token"
 	"go/types"
-	"math/big"
 	"strconv"
+	"strings"
 	"golang.org/x/tools/go/ast/astutil"
 )
-// ControlFlow flattens the control flow of function bodies using a switch-based dispatcher,
-// enhanced with opaque predicates to create junk code paths.
-func ControlFlow(f *ast.File, info *types.Info) {
-	astutil.Apply(f, func(cursor *astutil.Cursor) bool {
-		funcDecl, ok := cursor.Node().(*ast.FuncDecl)
-		if !ok || funcDecl.Body == nil || len(funcDecl.Body.List) == 0 {
-			return true
-		}
-		if funcDecl.Name.Name == "main" || funcDecl.Name.Name == "init" || len(funcDecl.Body.List) < 3 {
-			return true
+// DefaultControlFlowDepth is how many levels of nested statements are lowered into dispatcher
+// states when no depth is configured.
+const DefaultControlFlowDepth = 3
+// ControlFlowOptions configures ControlFlow.
+type ControlFlowOptions struct {
+	// Depth is how many levels of nested statements are lowered into dispatcher states.
+	Depth int
+	// StateKey names the weaving key the dispatcher state encoding depends on, if any.
+	StateKey string
+	// Backend selects the dispatcher shape; the zero value picks one at random per dispatcher.
+	// A function can ask for another one with an //obf:dispatcher directive.
+	Backend DispatcherBackend
+	// Predicates guards the junk states. Without it, ControlFlow declares predicate state of
+	// its own in f.
+	Predicates *OpaquePredicates
+	// BogusDensity is the percentage of states also given a mutated clone behind an opaque
+	// predicate.
+	BogusDensity int
+}
+// ControlFlow flattens function bodies into a dispatcher over the blocks of their control flow
+// graph. if/for/range/switch/select statements nested up to opts.Depth levels are lowered into
+// states together with break, continue, goto and fallthrough; deeper statements stay structured.
+// Functions, methods and function literals are flattened alike, each on its own; the ones whose
+// semantics the rewrite cannot preserve are left alone.
+func ControlFlow(fset *token.FileSet, f *ast.File, info *types.Info, pkg *types.Package, opts ControlFlowOptions) {
+	if info == nil {
+		return
+	}
+	preds := opts.Predicates
+	if preds == nil {
+		preds = NewOpaquePredicates()
+		defer preds.Emit(fset, []*ast.File{f})
+	}
+	flatten := func(name string, typ *ast.FuncType, body **ast.BlockStmt, backend DispatcherBackend) {
+		if *body == nil || len((*body).List) == 0 {
+			return
 		}
-		newBody, err := flattenFunctionBody(funcDecl, info)
+		fl := newFlattener(fset, f, info, pkg)
+		fl.stateKey = opts.StateKey
+		fl.backend = backend
+		fl.predicates = preds
+		fl.bogusDensity = opts.BogusDensity
+		flat, err := fl.flatten(typ, *body, opts.Depth)
 		if err != nil {
-			return true
+			fmt.Printf("    - Control flow of %s left structured: %v\n", name, err)
+			return
 		}
-		funcDecl.Body = newBody
-		return false
-	}, nil)
+		if flat != nil {
+			dropComments(f, *body)
+			*body = flat
+		}
+	}
+	for _, decl := range f.Decls {
+		// Declarations without type information were generated by earlier passes.
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || info.Defs[fn.Name] == nil {
+			continue
+		}
+		if directive := stackDirective(fn.Doc); directive != "" {
+			fmt.Printf("    - Control flow of %s left structured: %s\n", fn.Name.Name, directive)
+			continue
+		}
+		flatten(fn.Name.Name, fn.Type, &fn.Body, functionBackend(fn.Name.Name, fn.Doc, opts.Backend))
+	}
+	// Closures are collected after their enclosing functions have been flattened, which moves
+	// them around but leaves the literals themselves in place.
+	var lits []*ast.FuncLit
+	ast.Inspect(f, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.FuncLit); ok {
+			if _, typed := info.Types[lit]; typed {
+				lits = append(lits, lit)
+			}
+		}
+		return true
+	})
+	for _, lit := range lits {
+		flatten("function literal at "+fset.Position(lit.Pos()).String(), lit.Type, &lit.Body, opts.Backend)
+	}
+}
+// stackDirective returns the compiler directive of a function whose stack frame or write
+// barriers must stay under the control of the runtime, which a dispatcher would break.
+func stackDirective(doc *ast.CommentGroup) string {
+	if doc == nil {
+		return ""
+	}
+	for _, c := range doc.List {
+		switch directive := strings.Fields(c.Text + " ")[0]; directive {
+		case "//go:nosplit", "//go:systemstack", "//go:nowritebarrier", "//go:nowritebarrierrec", "//go:yeswritebarrierrec", "//go:uintptrkeepalive":
+			return directive[2:]
+		}
+	}
+	return ""
 }
+// BasicBlock is a straight-line run of statements; the last ones select the next block.
 type BasicBlock struct {
 	ID    int
 	Stmts []ast.Stmt
 }
+// hoistedVar is a local variable or constant moved to the top of a flattened function.
 type hoistedVar struct {
 	OriginalName string
 	NewName      string
 	Type         ast.Expr
 }
-func flattenFunctionBody(fn *ast.FuncDecl, info *types.Info) (*ast.BlockStmt, error) {
-	hoistedVars, hoistedDecls := hoistAndRenameVariables(fn.Body, info)
-	blocks := decomposeToBasicBlocks(fn.Body.List)
-	if len(blocks) <= 1 {
-		return nil, fmt.Errorf("not enough blocks to flatten")
-	}
-	stateVar := ast.NewIdent(NewName())
-	exitState := len(blocks)
-	var returnVars []*ast.Ident
-	var returnStmts []ast.Stmt
-	if fn.Type.Results != nil {
-		for _, field := range fn.Type.Results.List {
-			retVar := ast.NewIdent(NewName())
-			returnVars = append(returnVars, retVar)
-			returnStmts = append(returnStmts, &ast.DeclStmt{
-				Decl: &ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{&ast.ValueSpec{Names: []*ast.Ident{retVar}, Type: field.Type}}},
-			})
-		}
-	}
-	for i := range blocks {
-		nextState := i + 1
-		if i == len(blocks)-1 {
-			nextState = exitState
-		}
-		blocks[i].Stmts = rewriteBlock(blocks[i].Stmts, stateVar, nextState, exitState, returnVars, hoistedVars)
-	}
-	junkCases := createJunkCases(len(blocks), len(blocks)+5)
-	// Fisher-Yates shuffle using crypto/rand
-	for i := len(blocks) - 1; i > 0; i-- {
-		j, _ := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
-		blocks[i], blocks[j.Int64()] = blocks[j.Int64()], blocks[i]
-	}
-	var cases []ast.Stmt
-	for _, block := range blocks {
-		cases = append(cases, &ast.CaseClause{
-			List: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(block.ID)}},
-			Body: block.Stmts,
+// jumpTarget is where a branch goes: a state of a dispatcher, or for targets outside every
+// dispatcher (the structured loop around a nested one), a plain branch statement.
+type jumpTarget struct {
+	d      *dispatcher
+	state  int
+	branch *ast.BranchStmt
+}
+// branchScope resolves break, continue and fallthrough inside a lowered statement.
+type branchScope struct {
+	parent     *branchScope
+	label      string
+	breakTo    *jumpTarget
+	continueTo *jumpTarget
+	fallTo     *jumpTarget
+}
+// find returns the target of a break, continue or fallthrough, or nil if there is none.
+func (s *branchScope) find(tok token.Token, label *ast.Ident) *jumpTarget {
+	if tok == token.FALLTHROUGH {
+		if s == nil {
+			return nil
+		}
+		return s.fallTo
+	}
+	for ; s != nil; s = s.parent {
+		if label != nil && s.label != label.Name {
+			continue
+		}
+		t := s.breakTo
+		if tok == token.CONTINUE {
+			t = s.continueTo
+		}
+		if t != nil || label != nil {
+			return t
+		}
+	}
+	return nil
+}
+// dispatcher runs the states of a flattened function, in the shape of one of the
+// DispatcherBackend values. Blocks are numbered in creation order while lowering; the dispatcher
+// only ever sees random 32-bit codes for them.
+type dispatcher struct {
+	state  string
+	label  string
+	blocks []*BasicBlock
+	cur    *BasicBlock // block being filled, nil after a terminator
+	// void is set for the outermost dispatcher of a function without results.
+	void bool
+	// key names the weaving key mixed into the state encoding, or is empty.
+	key         string
+	codes       []uint32
+	table       string
+	tableValues []uint32
+	transitions map[*ast.AssignStmt]int
+	clauses     []*ast.CaseClause
+	junk        []*ast.CaseClause
+	predicates  *OpaquePredicates
+	// continues restart the dispatcher from code nested in a state; their form depends on the
+	// backend, which is only chosen once the whole function has been lowered.
+	continues   []*ast.BranchStmt
+	placeholder *ast.EmptyStmt
+}
+func newDispatcher(key string) *dispatcher {
+	tableValues := make([]uint32, 1<<(2+randInt(3)))
+	for i := range tableValues {
+		tableValues[i] = uint32(randInt(1 << 32))
+	}
+	return &dispatcher{
+		state:       NewName(),
+		label:       NewName(),
+		key:         key,
+		table:       NewName(),
+		tableValues: tableValues,
+		transitions: make(map[*ast.AssignStmt]int),
+		placeholder: &ast.EmptyStmt{Implicit: true},
+	}
+}
+func (d *dispatcher) newBlock() int {
+	d.blocks = append(d.blocks, &BasicBlock{ID: len(d.blocks)})
+	return len(d.blocks) - 1
+}
+// emit appends statements to the current block; code after a terminator goes to a fresh block
+// that nothing jumps to unless it carries a label.
+func (d *dispatcher) emit(stmts ...ast.Stmt) {
+	if d.cur == nil {
+		d.cur = d.blocks[d.newBlock()]
+	}
+	d.cur.Stmts = append(d.cur.Stmts, stmts...)
+}
+// assign returns the statement selecting block id as the next state. Its right-hand side is only
+// filled in by encode, once it is known which state the statement runs in.
+func (d *dispatcher) assign(id int) ast.Stmt {
+	s := &ast.AssignStmt{Lhs: []ast.Expr{ast.NewIdent(d.state)}, Tok: token.ASSIGN}
+	d.transitions[s] = id
+	return s
+}
+// jump ends the current block with a transition to block id.
+func (d *dispatcher) jump(id int) {
+	d.emit(d.assign(id))
+	d.cur = nil
+}
+// startBlock makes block id current, falling through to it from an open block.
+func (d *dispatcher) startBlock(id int) {
+	if d.cur != nil {
+		d.jump(id)
+	}
+	d.cur = d.blocks[id]
+}
+// continueStmt restarts the dispatcher from code nested inside one of its blocks.
+func (d *dispatcher) continueStmt() ast.Stmt {
+	c := &ast.BranchStmt{Tok: token.CONTINUE, Label: ast.NewIdent(d.label)}
+	d.continues = append(d.continues, c)
+	return c
+}
+// loop emits the state table and the state variable, followed by a placeholder for the
+// dispatcher itself, which build replaces once the code of the states is final. Every state,
+// including a few junk ones, gets a distinct random code.
+func (d *dispatcher) loop(entry int) []ast.Stmt {
+	junk := 2 + int(randInt(3))
+	seen := make(map[uint32]bool)
+	for len(d.codes) < len(d.blocks)+junk {
+		if c := uint32(randInt(1 << 32)); !seen[c] {
+			seen[c] = true
+			d.codes = append(d.codes, c)
+		}
+	}
+	for _, b := range d.blocks {
+		d.clauses = append(d.clauses, &ast.CaseClause{List: []ast.Expr{stateLiteral(d.codes[b.ID])}, Body: b.Stmts})
+	}
+	for _, c := range createJunkCases(d.codes[len(d.blocks):], d.predicates) {
+		d.junk = append(d.junk, c.(*ast.CaseClause))
+	}
+	elts := make([]ast.Expr, len(d.tableValues))
+	for i, v := range d.tableValues {
+		elts[i] = stateLiteral(v)
+	}
+	table := &ast.CompositeLit{
+		Type: &ast.ArrayType{Len: &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(len(elts))}, Elt: ast.NewIdent("uint32")},
+		Elts: elts,
+	}
+	return []ast.Stmt{
+		&ast.DeclStmt{Decl: &ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{
+			&ast.ValueSpec{Names: []*ast.Ident{ast.NewIdent(d.table)}, Values: []ast.Expr{table}},
+		}}},
+		// The entry state is always read from the table, which keeps the table used.
+		&ast.DeclStmt{Decl: &ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{&ast.ValueSpec{
+			Names:  []*ast.Ident{ast.NewIdent(d.state)},
+			Type:   ast.NewIdent("uint32"),
+			Values: []ast.Expr{d.lookup(d.codes[entry])},
+		}}}},
+		d.placeholder,
+	}
+}
+// encode fills in the transitions. A transition found inside the case of block b is computed
+// from the current state, which is known to hold the code of b there: the code of the target
+// only exists as the result of the computation. Transitions outside every case (none are
+// expected) fall back to a table lookup.
+func (d *dispatcher) encode() {
+	for i, clause := range d.clauses {
+		from := d.codes[i]
+		ast.Inspect(clause, func(n ast.Node) bool {
+			if s, ok := n.(*ast.AssignStmt); ok {
+				if to, ok := d.transitions[s]; ok {
+					d.transition(s, from, d.codes[to])
+					delete(d.transitions, s)
+				}
+			}
+			_, isFunc := n.(*ast.FuncLit)
+			return !isFunc
 		})
 	}
-	cases = append(cases, junkCases...)
-	newBody := &ast.BlockStmt{}
-	newBody.List = append(newBody.List, hoistedDecls...)
-	newBody.List = append(newBody.List, returnStmts...)
-	newBody.List = append(newBody.List, &ast.DeclStmt{
-		Decl: &ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{
-			&ast.ValueSpec{Names: []*ast.Ident{stateVar}, Values: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: "0"}}},
-		}},
+	for s, to := range d.transitions {
+		s.Tok = token.ASSIGN
+		s.Rhs = []ast.Expr{d.lookup(d.codes[to])}
+	}
+}
+// transition rewrites s to move the state from one code to another with one of a few
+// arithmetic forms, all computed modulo 2^32 from the current state.
+func (d *dispatcher) transition(s *ast.AssignStmt, from, to uint32) {
+	state := func() ast.Expr { return ast.NewIdent(d.state) }
+	switch randInt(4) {
+	case 0:
+		s.Tok = token.XOR_ASSIGN
+		s.Rhs = []ast.Expr{d.keyed(stateLiteral(from ^ to))}
+	case 1:
+		s.Tok = token.ADD_ASSIGN
+		s.Rhs = []ast.Expr{stateLiteral(to - from)}
+	case 2:
+		m := uint32(randInt(1<<32)) | 1
+		s.Tok = token.ASSIGN
+		s.Rhs = []ast.Expr{&ast.BinaryExpr{
+			X:  &ast.BinaryExpr{X: state(), Op: token.MUL, Y: stateLiteral(m)},
+			Op: token.ADD,
+			Y:  stateLiteral(to - from*m),
+		}}
+	default:
+		// state = table[(state^x)&mask] ^ y, with x chosen so that from selects a random slot.
+		mask := uint32(len(d.tableValues) - 1)
+		slot := uint32(randInt(int64(len(d.tableValues))))
+		x := uint32(randInt(1<<32))&^mask | (from^slot)&mask
+		index := &ast.BinaryExpr{
+			X:  &ast.ParenExpr{X: &ast.BinaryExpr{X: state(), Op: token.XOR, Y: stateLiteral(x)}},
+			Op: token.AND,
+			Y:  stateLiteral(mask),
+		}
+		s.Tok = token.ASSIGN
+		s.Rhs = []ast.Expr{&ast.BinaryExpr{
+			X:  &ast.IndexExpr{X: ast.NewIdent(d.table), Index: index},
+			Op: token.XOR,
+			Y:  stateLiteral(d.tableValues[slot] ^ to),
+		}}
+	}
+}
+// lookup returns an expression of the given code that does not depend on the current state.
+func (d *dispatcher) lookup(code uint32) ast.Expr {
+	slot := randInt(int64(len(d.tableValues)))
+	return &ast.BinaryExpr{
+		X:  &ast.IndexExpr{X: ast.NewIdent(d.table), Index: &ast.BasicLit{Kind: token.INT, Value: strconv.FormatInt(slot, 10)}},
+		Op: token.XOR,
+		Y:  d.keyed(stateLiteral(d.tableValues[slot] ^ code)),
+	}
+}
+// keyed mixes the weaving key into a constant that is XORed into the state. The key is zero in a
+// clean environment; anywhere else the dispatcher wanders off into states that do not exist.
+func (d *dispatcher) keyed(e ast.Expr) ast.Expr {
+	if d.key == "" {
+		return e
+	}
+	return &ast.ParenExpr{X: &ast.BinaryExpr{
+		X:  e,
+		Op: token.XOR,
+		Y:  &ast.CallExpr{Fun: ast.NewIdent("uint32"), Args: []ast.Expr{ast.NewIdent(d.key)}},
+	}}
+}
+func stateLiteral(v uint32) *ast.BasicLit {
+	return &ast.BasicLit{Kind: token.INT, Value: fmt.Sprintf("%#x", v)}
+}
+// flattener lowers one function. Nothing in the original body is modified until the whole
+// function has been lowered successfully: renames and branch rewrites are recorded and applied
+// to the new body at the end.
+type flattener struct {
+	fset     *token.FileSet
+	file     *ast.File
+	info     *types.Info
+	pkg      *types.Package
+	hoisted  map[types.Object]*hoistedVar
+	consts   []ast.Stmt
+	decls    []ast.Stmt
+	labels   map[string]*jumpTarget
+	branches map[*ast.BranchStmt][]ast.Stmt
+	used     map[types.Object]bool
+	names    *typeNamer
+	err      error
+	// stateKey, backend and dispatchers drive the state encoding and the dispatcher shapes,
+	// done last.
+	stateKey    string
+	backend     DispatcherBackend
+	dispatchers []*dispatcher
+	// predicates guards the junk states of the dispatchers and, for bogusDensity percent of
+	// the states, the choice between the real block and its bogus clone.
+	predicates   *OpaquePredicates
+	bogusDensity int
+	// perIteration holds the loops kept structured for the variables they declare.
+	perIteration map[ast.Stmt]bool
+}
+func newFlattener(fset *token.FileSet, file *ast.File, info *types.Info, pkg *types.Package) *flattener {
+	return &flattener{
+		fset:     fset,
+		file:     file,
+		info:     info,
+		pkg:      pkg,
+		hoisted:  make(map[types.Object]*hoistedVar),
+		labels:   make(map[string]*jumpTarget),
+		branches: make(map[*ast.BranchStmt][]ast.Stmt),
+	}
+}
+func (f *flattener) newDispatcher() *dispatcher {
+	d := newDispatcher(f.stateKey)
+	d.predicates = f.predicates
+	f.dispatchers = append(f.dispatchers, d)
+	return d
+}
+func (f *flattener) fail(format string, args ...interface{}) {
+	if f.err == nil {
+		f.err = fmt.Errorf(format, args...)
+	}
+}
+// flatten returns the new body of a function, or nil if it has too little control flow to be worth it.
+func (f *flattener) flatten(typ *ast.FuncType, orig *ast.BlockStmt, depth int) (*ast.BlockStmt, error) {
+	if reason := flattenBlocker(orig, f.info); reason != "" {
+		return nil, fmt.Errorf("%s", reason)
+	}
+	f.names = newTypeNamer(f.fset, f.file, f.pkg, orig.Lbrace)
+	f.perIteration = perIterationLoops(orig, f.info)
+	f.used = make(map[types.Object]bool)
+	ast.Inspect(orig, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && f.info.Uses[id] != nil {
+			f.used[f.info.Uses[id]] = true
+		}
+		return true
 	})
-	newBody.List = append(newBody.List, &ast.ForStmt{
-		Body: &ast.BlockStmt{List: []ast.Stmt{
-			&ast.IfStmt{
-				Cond: &ast.BinaryExpr{X: stateVar, Op: token.EQL, Y: &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(exitState)}},
-				Body: &ast.BlockStmt{List: []ast.Stmt{&ast.BranchStmt{Tok: token.BREAK}}},
-			},
-			&ast.SwitchStmt{Tag: stateVar, Body: &ast.BlockStmt{List: cases}},
-		}},
+	d := f.newDispatcher()
+	d.void = typ.Results == nil || len(typ.Results.List) == 0
+	entry := d.newBlock()
+	d.cur = d.blocks[entry]
+	f.lowerList(d, orig.List, nil, depth)
+	if f.err != nil {
+		return nil, f.err
+	}
+	if len(d.blocks) < 3 {
+		return nil, nil
+	}
+	if d.cur != nil {
+		// Falling off the end of a function with unnamed results is unreachable.
+		if res := typ.Results; res != nil && len(res.List) > 0 && len(res.List[0].Names) == 0 {
+			d.emit(&ast.ExprStmt{X: &ast.CallExpr{Fun: ast.NewIdent("panic"), Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: `"unreachable"`}}}})
+		} else {
+			d.emit(&ast.ReturnStmt{})
+		}
+	}
+	body := &ast.BlockStmt{Lbrace: orig.Lbrace, Rbrace: orig.Rbrace}
+	body.List = append(body.List, f.consts...)
+	body.List = append(body.List, f.decls...)
+	body.List = append(body.List, d.loop(entry)...)
+	f.apply(body)
+	f.addBogusFlow(f.bogusDensity)
+	for _, d := range f.dispatchers {
+		d.encode()
+	}
+	// Innermost dispatchers first: their code is part of the states of the enclosing ones.
+	roots := f.roots(body)
+	for i := len(f.dispatchers) - 1; i >= 0; i-- {
+		d := f.dispatchers[i]
+		stmts := d.build(f.backend)
+		for _, root := range roots {
+			astutil.Apply(root, func(cursor *astutil.Cursor) bool {
+				if cursor.Node() != d.placeholder {
+					return true
+				}
+				for _, s := range stmts[:len(stmts)-1] {
+					cursor.InsertBefore(s)
+				}
+				cursor.Replace(stmts[len(stmts)-1])
+				return false
+			}, nil)
+		}
+	}
+	fillPositions(body, orig.Lbrace)
+	f.names.addImports()
+	return body, nil
+}
+// apply renames hoisted variables and rewrites the branches that left structured statements, in
+// the new body and in the states of its dispatchers, which are not part of it yet.
+func (f *flattener) apply(body *ast.BlockStmt) {
+	for _, root := range f.roots(body) {
+		f.applyTo(root)
+	}
+}
+// roots returns the new body and the states of its dispatchers, which together hold all the
+// code of the function until the dispatchers are built.
+func (f *flattener) roots(body *ast.BlockStmt) []ast.Node {
+	roots := []ast.Node{body}
+	for _, d := range f.dispatchers {
+		for _, c := range d.clauses {
+			roots = append(roots, c)
+		}
+	}
+	return roots
+}
+func (f *flattener) applyTo(root ast.Node) {
+	ast.Inspect(root, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		obj := f.info.Defs[id]
+		if obj == nil {
+			obj = f.info.Uses[id]
+		}
+		if hv, ok := f.hoisted[obj]; ok && obj != nil {
+			id.Name = hv.NewName
+		}
+		return true
 	})
-	if len(returnVars) > 0 {
-		newBody.List = append(newBody.List, &ast.ReturnStmt{Results: Deref(returnVars)})
+	astutil.Apply(root, func(cursor *astutil.Cursor) bool {
+		b, ok := cursor.Node().(*ast.BranchStmt)
+		if !ok {
+			return true
+		}
+		repl, ok := f.branches[b]
+		if !ok {
+			return true
+		}
+		if cursor.Index() < 0 {
+			cursor.Replace(&ast.BlockStmt{List: repl})
+			return false
+		}
+		for _, s := range repl[:len(repl)-1] {
+			cursor.InsertBefore(s)
+		}
+		cursor.Replace(repl[len(repl)-1])
+		return false
+	}, nil)
+}
+// lowerList lowers a statement list into the current block and the blocks that follow it.
+func (f *flattener) lowerList(d *dispatcher, stmts []ast.Stmt, scope *branchScope, depth int) {
+	for _, s := range stmts {
+		if ls, ok := s.(*ast.LabeledStmt); ok {
+			f.labels[ls.Label.Name] = &jumpTarget{d: d, state: d.newBlock()}
+		}
+	}
+	for _, s := range stmts {
+		f.lowerStmt(d, s, scope, depth, "")
 	}
-	return newBody, nil
 }
-func createJunkCases(startID, count int) []ast.Stmt {
-	var junkCases []ast.Stmt
-	for i := 0; i < count; i++ {
-		junkID := startID + i
-		x, y := NewName(), NewName()
-		var cond ast.Expr
-		template := randInt(5) // Increased number of templates
-		switch template {
-		case 0:
-			// (x*x + 1) < 0 -- always false
-			cond = &ast.BinaryExpr{
-				X: &ast.BinaryExpr{
-					X:  &ast.BinaryExpr{X: ast.NewIdent(x), Op: token.MUL, Y: ast.NewIdent(x)},
-					Op: token.ADD,
-					Y:  &ast.BasicLit{Kind: token.INT, Value: "1"},
-				},
-				Op: token.LSS,
-				Y:  &ast.BasicLit{Kind: token.INT, Value: "0"},
+func (f *flattener) lowerStmt(d *dispatcher, s ast.Stmt, scope *branchScope, depth int, label string) {
+	if f.err != nil {
+		return
+	}
+	switch s := s.(type) {
+	case *ast.LabeledStmt:
+		d.startBlock(f.labels[s.Label.Name].state)
+		f.lowerStmt(d, s.Stmt, scope, depth, s.Label.Name)
+	case *ast.BranchStmt:
+		t := f.resolve(s, scope)
+		if t == nil {
+			return
+		}
+		f.jumpFrom(d, t)
+	case *ast.ReturnStmt:
+		// Returns stay as written and parameters are never hoisted: naked returns, deferred
+		// closures assigning named results, and recover in those closures behave as before.
+		d.emit(s)
+		d.cur = nil
+	case *ast.DeclStmt:
+		f.lowerDecl(d, s)
+	case *ast.AssignStmt:
+		d.emit(f.assign(s))
+	case *ast.BlockStmt:
+		if depth > 0 {
+			f.lowerList(d, s.List, scope, depth)
+		} else {
+			f.structured(d, s, scope, label)
+		}
+	case *ast.IfStmt:
+		if depth > 0 {
+			f.lowerIf(d, s, scope, depth)
+		} else {
+			f.structured(d, s, scope, label)
+		}
+	case *ast.ForStmt:
+		if depth > 0 && !f.perIteration[s] {
+			f.lowerFor(d, s, scope, depth, label)
+		} else {
+			f.structured(d, s, scope, label)
+		}
+	case *ast.RangeStmt:
+		f.lowerRange(d, s, scope, depth, label)
+	case *ast.SwitchStmt:
+		if depth > 0 {
+			f.lowerSwitch(d, s, scope, depth, label)
+		} else {
+			f.structured(d, s, scope, label)
+		}
+	case *ast.TypeSwitchStmt:
+		if depth > 0 {
+			f.lowerTypeSwitch(d, s, scope, depth, label)
+		} else {
+			f.structured(d, s, scope, label)
+		}
+	case *ast.SelectStmt:
+		if depth > 0 && len(s.Body.List) > 0 {
+			f.lowerSelect(d, s, scope, depth, label)
+		} else {
+			f.structured(d, s, scope, label)
+		}
+	default:
+		d.emit(s)
+	}
+}
+// resolve returns the target of a branch statement of the lowered code.
+func (f *flattener) resolve(b *ast.BranchStmt, scope *branchScope) *jumpTarget {
+	var t *jumpTarget
+	if b.Tok == token.GOTO {
+		t = f.labels[b.Label.Name]
+	} else {
+		t = scope.find(b.Tok, b.Label)
+	}
+	if t == nil {
+		f.fail("cannot resolve %s at %s", b.Tok, f.fset.Position(b.Pos()))
+	}
+	return t
+}
+// jumpFrom ends the current block of d with a branch to t.
+func (f *flattener) jumpFrom(d *dispatcher, t *jumpTarget) {
+	if t.d == d {
+		d.jump(t.state)
+		return
+	}
+	d.emit(f.escape(t)...)
+	d.cur = nil
+}
+// escape returns the statements reaching t from code nested inside a dispatcher block.
+func (f *flattener) escape(t *jumpTarget) []ast.Stmt {
+	if t.branch != nil {
+		return []ast.Stmt{&ast.BranchStmt{Tok: t.branch.Tok, Label: ast.NewIdent(t.branch.Label.Name)}}
+	}
+	return []ast.Stmt{t.d.assign(t.state), t.d.continueStmt()}
+}
+// structured emits a statement as is, except for the branches leaving it, which are redirected
+// to the dispatcher states of their targets.
+func (f *flattener) structured(d *dispatcher, s ast.Stmt, scope *branchScope, label string) {
+	inner := make(map[string]bool)
+	ast.Inspect(s, func(n ast.Node) bool {
+		if ls, ok := n.(*ast.LabeledStmt); ok {
+			inner[ls.Label.Name] = true
+		}
+		_, isFunc := n.(*ast.FuncLit)
+		return !isFunc
+	})
+	labelUsed := false
+	walkWithStack(s, func(n ast.Node, stack []ast.Node) {
+		b, ok := n.(*ast.BranchStmt)
+		if !ok {
+			return
+		}
+		breakable, continuable := false, false
+		for _, anc := range stack[:len(stack)-1] {
+			switch anc.(type) {
+			case *ast.FuncLit:
+				return
+			case *ast.ForStmt, *ast.RangeStmt:
+				breakable, continuable = true, true
+			case *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+				breakable = true
 			}
-		case 1:
-			// (x - y) * (x + y) != x*x - y*y -- always false
-			cond = &ast.BinaryExpr{
-				X: &ast.BinaryExpr{
-					X:  &ast.ParenExpr{X: &ast.BinaryExpr{X: ast.NewIdent(x), Op: token.SUB, Y: ast.NewIdent(y)}},
-					Op: token.MUL,
-					Y:  &ast.ParenExpr{X: &ast.BinaryExpr{X: ast.NewIdent(x), Op: token.ADD, Y: ast.NewIdent(y)}},
-				},
-				Op: token.NEQ,
-				Y: &ast.BinaryExpr{
-					X:  &ast.BinaryExpr{X: ast.NewIdent(x), Op: token.MUL, Y: ast.NewIdent(x)},
-					Op: token.SUB,
-					Y:  &ast.BinaryExpr{X: ast.NewIdent(y), Op: token.MUL, Y: ast.NewIdent(y)},
-				},
+		}
+		if b.Label != nil && b.Label.Name == label {
+			labelUsed = true
+			return
+		}
+		switch {
+		case b.Label != nil && inner[b.Label.Name]:
+			return
+		case b.Tok == token.FALLTHROUGH:
+			return
+		case b.Label == nil && b.Tok == token.BREAK && breakable:
+			return
+		case b.Label == nil && b.Tok == token.CONTINUE && continuable:
+			return
+		}
+		if t := f.resolve(b, scope); t != nil {
+			f.branches[b] = f.escape(t)
+		}
+	})
+	if labelUsed {
+		s = &ast.LabeledStmt{Label: ast.NewIdent(label), Stmt: s}
+	}
+	d.emit(s)
+}
+// lowerDecl hoists local constants and variables; a variable declaration becomes an assignment
+// that also resets variables without initializer to their zero value.
+func (f *flattener) lowerDecl(d *dispatcher, s *ast.DeclStmt) {
+	gd := s.Decl.(*ast.GenDecl)
+	switch gd.Tok {
+	case token.CONST:
+		for _, spec := range gd.Specs {
+			for _, name := range spec.(*ast.ValueSpec).Names {
+				if obj := f.info.Defs[name]; obj != nil {
+					f.hoisted[obj] = &hoistedVar{OriginalName: name.Name, NewName: NewName()}
+				}
 			}
-		case 2:
-			// (x ^ y) ^ y != x -- always false
-			cond = &ast.BinaryExpr{
-				X: &ast.ParenExpr{X: &ast.BinaryExpr{
-					X:  &ast.ParenExpr{X: &ast.BinaryExpr{X: ast.NewIdent(x), Op: token.XOR, Y: ast.NewIdent(y)}},
-					Op: token.XOR,
-					Y:  ast.NewIdent(y),
-				}},
-				Op: token.NEQ,
-				Y:  ast.NewIdent(x),
+		}
+		f.consts = append(f.consts, s)
+	case token.VAR:
+		for _, spec := range gd.Specs {
+			vs := spec.(*ast.ValueSpec)
+			var lhs []ast.Expr
+			for i, name := range vs.Names {
+				i := i
+				f.define(name, func() types.Type { return valueType(f.info, vs.Type, vs.Values, i) })
+				lhs = append(lhs, name)
 			}
-		case 3:
-			// 7*x - 3*x - 4*x != 0 -- always false
-			cond = &ast.BinaryExpr{
-				X: &ast.BinaryExpr{
-					X: &ast.BinaryExpr{
-						X:  &ast.BinaryExpr{X: &ast.BasicLit{Kind: token.INT, Value: "7"}, Op: token.MUL, Y: ast.NewIdent(x)},
-						Op: token.SUB,
-						Y:  &ast.BinaryExpr{X: &ast.BasicLit{Kind: token.INT, Value: "3"}, Op: token.MUL, Y: ast.NewIdent(x)},
-					},
-					Op: token.SUB,
-					Y:  &ast.BinaryExpr{X: &ast.BasicLit{Kind: token.INT, Value: "4"}, Op: token.MUL, Y: ast.NewIdent(x)},
-				},
-				Op: token.NEQ,
-				Y:  &ast.BasicLit{Kind: token.INT, Value: "0"},
+			if len(vs.Values) > 0 {
+				d.emit(&ast.AssignStmt{Lhs: lhs, TokPos: vs.Pos(), Tok: token.ASSIGN, Rhs: vs.Values})
+				continue
 			}
-		default:
-			// x*y + 1 == x*y -- always false
-			cond = &ast.BinaryExpr{
-				X: &ast.BinaryExpr{
-					X:  &ast.BinaryExpr{X: ast.NewIdent(x), Op: token.MUL, Y: ast.NewIdent(y)},
-					Op: token.ADD,
-					Y:  &ast.BasicLit{Kind: token.INT, Value: "1"},
-				},
-				Op: token.EQL,
-				Y:  &ast.BinaryExpr{X: ast.NewIdent(x), Op: token.MUL, Y: ast.NewIdent(y)},
+			for _, name := range vs.Names {
+				if name.Name == "_" {
+					continue
+				}
+				zero := &ast.StarExpr{X: &ast.CallExpr{Fun: ast.NewIdent("new"), Args: []ast.Expr{vs.Type}}}
+				d.emit(&ast.AssignStmt{Lhs: []ast.Expr{name}, Tok: token.ASSIGN, Rhs: []ast.Expr{zero}})
 			}
 		}
-		junkCases = append(junkCases, &ast.CaseClause{
-			List: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(junkID)}},
-			Body: []ast.Stmt{
-				&ast.AssignStmt{Lhs: []ast.Expr{ast.NewIdent(x)}, Tok: token.DEFINE, Rhs: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: "123"}}},
-				&ast.AssignStmt{Lhs: []ast.Expr{ast.NewIdent(y)}, Tok: token.DEFINE, Rhs: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: "456"}}},
-				&ast.IfStmt{
-					Cond: cond,
-					Body: &ast.BlockStmt{List: []ast.Stmt{
-						&ast.ExprStmt{X: &ast.CallExpr{Fun: ast.NewIdent("panic"), Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: "\"unreachable\""}}}},
-					}},
-				},
-				// Add this line to "use" the y variable
-				&ast.AssignStmt{Lhs: []ast.Expr{ast.NewIdent("_")}, Tok: token.ASSIGN, Rhs: []ast.Expr{ast.NewIdent(y)}},
-			},
+	default:
+		f.fail("local type declaration")
+	}
+}
+// assign turns a short variable declaration into an assignment to hoisted variables.
+func (f *flattener) assign(s *ast.AssignStmt) ast.Stmt {
+	if s.Tok != token.DEFINE {
+		return s
+	}
+	for i, lhs := range s.Lhs {
+		i := i
+		id, ok := lhs.(*ast.Ident)
+		if !ok {
+			f.fail("invalid short variable declaration")
+			return s
+		}
+		f.define(id, func() types.Type { return valueType(f.info, nil, s.Rhs, i) })
+	}
+	return &ast.AssignStmt{Lhs: s.Lhs, TokPos: s.TokPos, Tok: token.ASSIGN, Rhs: s.Rhs}
+}
+// define hoists the variable declared by id. Identifiers generated by earlier passes have no
+// type information, but their names are unique: they keep them and take the type of their value.
+func (f *flattener) define(id *ast.Ident, typeOf func() types.Type) {
+	if id.Name == "_" {
+		return
+	}
+	if obj := f.info.Defs[id]; obj != nil {
+		f.hoist(obj)
+		return
+	}
+	if f.info.Uses[id] != nil {
+		// Redeclared by :=, the variable already exists.
+		return
+	}
+	t := typeOf()
+	if t == nil {
+		f.fail("unknown type of %s", id.Name)
+		return
+	}
+	f.declare(id.Name, t)
+}
+// hoist declares a variable for obj at the top of the function under a fresh name.
+func (f *flattener) hoist(obj types.Object) *hoistedVar {
+	if hv, ok := f.hoisted[obj]; ok {
+		return hv
+	}
+	hv := &hoistedVar{OriginalName: obj.Name(), NewName: NewName()}
+	f.hoisted[obj] = hv
+	hv.Type = f.declare(hv.NewName, obj.Type())
+	return hv
+}
+// declare adds `var name T` to the top of the function.
+func (f *flattener) declare(name string, t types.Type) ast.Expr {
+	expr, err := f.names.expr(t)
+	if err != nil {
+		f.fail("cannot declare %s of type %s: %v", name, t, err)
+		return nil
+	}
+	f.decls = append(f.decls, &ast.DeclStmt{Decl: &ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{
+		&ast.ValueSpec{Names: []*ast.Ident{ast.NewIdent(name)}, Type: expr},
+	}}})
+	return expr
+}
+// temp hoists a fresh variable of type t for the lowering itself.
+func (f *flattener) temp(t types.Type) *ast.Ident {
+	name := NewName()
+	f.declare(name, t)
+	return ast.NewIdent(name)
+}
+// valueType returns the type of the i-th variable of a declaration from its values.
+func valueType(info *types.Info, typ ast.Expr, values []ast.Expr, i int) types.Type {
+	if typ != nil {
+		return info.TypeOf(typ)
+	}
+	if len(values) == 1 && i > 0 {
+		if tuple, ok := info.TypeOf(values[0]).(*types.Tuple); ok && i < tuple.Len() {
+			return tuple.At(i).Type()
+		}
+		// Comma-ok forms.
+		return types.Typ[types.Bool]
+	}
+	if i < len(values) {
+		if tuple, ok := info.TypeOf(values[i]).(*types.Tuple); ok && tuple.Len() > 0 {
+			return tuple.At(0).Type()
+		}
+		return info.TypeOf(values[i])
+	}
+	return nil
+}
+// importName returns the name under which the function refers to path, importing it if needed.
+func (f *flattener) importName(path, name string) string {
+	local, err := f.names.packageName(path, name)
+	if err != nil {
+		f.fail("%v", err)
+	}
+	return local
+}
+func (f *flattener) lowerIf(d *dispatcher, s *ast.IfStmt, scope *branchScope, depth int) {
+	if s.Init != nil {
+		f.lowerStmt(d, s.Init, scope, 0, "")
+	}
+	then, after := d.newBlock(), d.newBlock()
+	otherwise := after
+	if s.Else != nil {
+		otherwise = d.newBlock()
+	}
+	d.emit(&ast.IfStmt{
+		If:   s.If,
+		Cond: s.Cond,
+		Body: &ast.BlockStmt{List: []ast.Stmt{d.assign(then)}},
+		Else: &ast.BlockStmt{List: []ast.Stmt{d.assign(otherwise)}},
+	})
+	d.cur = nil
+	d.startBlock(then)
+	f.lowerList(d, s.Body.List, scope, depth-1)
+	if d.cur != nil {
+		d.jump(after)
+	}
+	if s.Else != nil {
+		d.startBlock(otherwise)
+		switch e := s.Else.(type) {
+		case *ast.BlockStmt:
+			f.lowerList(d, e.List, scope, depth-1)
+		case *ast.IfStmt:
+			f.lowerIf(d, e, scope, depth)
+		}
+		if d.cur != nil {
+			d.jump(after)
+		}
+	}
+	d.startBlock(after)
+}
+func (f *flattener) lowerFor(d *dispatcher, s *ast.ForStmt, scope *branchScope, depth int, label string) {
+	if s.Init != nil {
+		f.lowerStmt(d, s.Init, scope, 0, "")
+	}
+	cond, body, post, after := d.newBlock(), d.newBlock(), d.newBlock(), d.newBlock()
+	loopScope := &branchScope{parent: scope, label: label, breakTo: &jumpTarget{d: d, state: after}, continueTo: &jumpTarget{d: d, state: post}}
+	d.startBlock(cond)
+	if s.Cond != nil {
+		f.branchOn(d, s.Cond, body, after)
+	} else {
+		d.jump(body)
+	}
+	d.startBlock(body)
+	f.lowerList(d, s.Body.List, loopScope, depth-1)
+	d.startBlock(post)
+	if s.Post != nil {
+		f.lowerStmt(d, s.Post, scope, 0, "")
+	}
+	d.jump(cond)
+	d.startBlock(after)
+}
+// branchOn ends the current block with a conditional transition.
+func (f *flattener) branchOn(d *dispatcher, cond ast.Expr, then, otherwise int) {
+	d.emit(&ast.IfStmt{
+		Cond: cond,
+		Body: &ast.BlockStmt{List: []ast.Stmt{d.assign(then)}},
+		Else: &ast.BlockStmt{List: []ast.Stmt{d.assign(otherwise)}},
+	})
+	d.cur = nil
+}
+// lowerRange lowers ranges over integers, slices, arrays, strings and channels into explicit
+// index or receive loops. Other ranges (maps, iterator functions) keep their loop, whose body gets
+// a nested dispatcher.
+func (f *flattener) lowerRange(d *dispatcher, s *ast.RangeStmt, scope *branchScope, depth int, label string) {
+	if depth <= 0 || f.perIteration[s] {
+		f.structured(d, s, scope, label)
+		return
+	}
+	t := f.info.TypeOf(s.X)
+	var under types.Type
+	if t != nil {
+		under = t.Underlying()
+		if p, ok := under.(*types.Pointer); ok {
+			if arr, ok := p.Elem().Underlying().(*types.Array); ok {
+				under = arr
+			}
+		}
+	}
+	kind := ""
+	switch u := under.(type) {
+	case *types.Basic:
+		switch {
+		case u.Info()&types.IsInteger != 0:
+			kind = "int"
+		case u.Info()&types.IsString != 0:
+			kind = "string"
+		}
+	case *types.Slice, *types.Array:
+		kind = "index"
+	case *types.Chan:
+		kind = "chan"
+	}
+	if kind == "" {
+		f.nestedRange(d, s, scope, depth, label)
+		return
+	}
+	var key, value ast.Expr
+	if s.Key != nil && !isBlank(s.Key) {
+		key = s.Key
+	}
+	if s.Value != nil && !isBlank(s.Value) {
+		value = s.Value
+	}
+	if s.Tok == token.DEFINE {
+		for _, e := range []ast.Expr{key, value} {
+			if id, ok := e.(*ast.Ident); ok {
+				f.define(id, func() types.Type { return nil })
+			}
+		}
+	}
+	set := func(lhs, rhs ast.Expr) ast.Stmt {
+		return &ast.AssignStmt{Lhs: []ast.Expr{lhs}, Tok: token.ASSIGN, Rhs: []ast.Expr{rhs}}
+	}
+	cond, body, post, after := d.newBlock(), d.newBlock(), d.newBlock(), d.newBlock()
+	loopScope := &branchScope{parent: scope, label: label, breakTo: &jumpTarget{d: d, state: after}, continueTo: &jumpTarget{d: d, state: post}}
+	intType := types.Typ[types.Int]
+	var enter []ast.Stmt
+	var advance ast.Stmt
+	switch kind {
+	case "int":
+		n, idx := f.temp(t), f.temp(t)
+		d.emit(set(n, s.X), set(idx, &ast.BasicLit{Kind: token.INT, Value: "0"}))
+		d.startBlock(cond)
+		f.branchOn(d, &ast.BinaryExpr{X: idx, Op: token.LSS, Y: n}, body, after)
+		if key != nil {
+			enter = append(enter, set(key, idx))
+		}
+		advance = &ast.IncDecStmt{X: idx, Tok: token.INC}
+	case "index":
+		n, idx := f.temp(intType), f.temp(intType)
+		src := s.X
+		if value != nil {
+			tmp := f.temp(t)
+			d.emit(set(tmp, s.X))
+			src = tmp
+		}
+		// With no value variable, len of an array is constant and the range expression is not evaluated.
+		d.emit(set(n, &ast.CallExpr{Fun: ast.NewIdent("len"), Args: []ast.Expr{src}}), set(idx, &ast.BasicLit{Kind: token.INT, Value: "0"}))
+		d.startBlock(cond)
+		f.branchOn(d, &ast.BinaryExpr{X: idx, Op: token.LSS, Y: n}, body, after)
+		if key != nil {
+			enter = append(enter, set(key, idx))
+		}
+		if value != nil {
+			enter = append(enter, set(value, &ast.IndexExpr{X: src, Index: idx}))
+		}
+		advance = &ast.IncDecStmt{X: idx, Tok: token.INC}
+	case "string":
+		tmp, idx, w := f.temp(t), f.temp(intType), f.temp(intType)
+		r := ast.NewIdent("_")
+		if value != nil {
+			r = f.temp(types.Typ[types.Rune])
+		}
+		d.emit(set(tmp, s.X), set(idx, &ast.BasicLit{Kind: token.INT, Value: "0"}))
+		d.startBlock(cond)
+		f.branchOn(d, &ast.BinaryExpr{X: idx, Op: token.LSS, Y: &ast.CallExpr{Fun: ast.NewIdent("len"), Args: []ast.Expr{tmp}}}, body, after)
+		utf8 := f.importName("unicode/utf8", "utf8")
+		enter = append(enter, &ast.AssignStmt{
+			Lhs: []ast.Expr{r, w},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{&ast.CallExpr{
+				Fun:  &ast.SelectorExpr{X: ast.NewIdent(utf8), Sel: ast.NewIdent("DecodeRuneInString")},
+				Args: []ast.Expr{&ast.SliceExpr{X: tmp, Low: idx}},
+			}},
 		})
+		if key != nil {
+			enter = append(enter, set(key, idx))
+		}
+		if value != nil {
+			enter = append(enter, set(value, r))
+		}
+		advance = &ast.AssignStmt{Lhs: []ast.Expr{idx}, Tok: token.ADD_ASSIGN, Rhs: []ast.Expr{w}}
+	case "chan":
+		tmp, ok := f.temp(t), f.temp(types.Typ[types.Bool])
+		elem := ast.NewIdent("_")
+		if key != nil {
+			elem = f.temp(under.(*types.Chan).Elem())
+		}
+		d.emit(set(tmp, s.X))
+		d.startBlock(cond)
+		d.emit(&ast.AssignStmt{Lhs: []ast.Expr{elem, ok}, Tok: token.ASSIGN, Rhs: []ast.Expr{&ast.UnaryExpr{Op: token.ARROW, X: tmp}}})
+		f.branchOn(d, ok, body, after)
+		if key != nil {
+			enter = append(enter, set(key, elem))
+		}
 	}
-	return junkCases
+	d.startBlock(body)
+	d.emit(enter...)
+	f.lowerList(d, s.Body.List, loopScope, depth-1)
+	d.startBlock(post)
+	if advance != nil {
+		d.emit(advance)
+	}
+	d.jump(cond)
+	d.startBlock(after)
 }
-func hoistAndRenameVariables(body *ast.BlockStmt, info *types.Info) (map[string]*hoistedVar, []ast.Stmt) {
-	vars := make(map[string]*hoistedVar)
-	var decls []ast.Stmt
-	registerVar := func(ident *ast.Ident) {
-		if _, exists := vars[ident.Name]; !exists {
-			var varType ast.Expr
-			if info != nil && info.TypeOf(ident) != nil {
-				typeString := info.TypeOf(ident).String()
-				if _, err := parser.ParseExpr(typeString); err == nil {
-					varType = ast.NewIdent(typeString)
-				} else {
-					varType = ast.NewIdent("interface{}")
-				}
-			} else {
-				varType = ast.NewIdent("interface{}")
+// nestedRange keeps a range loop whose iteration cannot be made explicit and flattens its body
+// into a dispatcher of its own.
+func (f *flattener) nestedRange(d *dispatcher, s *ast.RangeStmt, scope *branchScope, depth int, label string) {
+	if len(s.Body.List) == 0 {
+		f.structured(d, s, scope, label)
+		return
+	}
+	name := label
+	if name == "" {
+		name = NewName()
+	}
+	used := false
+	branch := func(tok token.Token) *jumpTarget {
+		return &jumpTarget{branch: &ast.BranchStmt{Tok: tok, Label: ast.NewIdent(name)}}
+	}
+	bodyScope := &branchScope{parent: scope, label: label, breakTo: branch(token.BREAK), continueTo: branch(token.CONTINUE)}
+	inner := f.newDispatcher()
+	entry := inner.newBlock()
+	inner.cur = inner.blocks[entry]
+	f.lowerList(inner, s.Body.List, bodyScope, depth-1)
+	if inner.cur != nil {
+		f.jumpFrom(inner, bodyScope.continueTo)
+	}
+	for _, b := range inner.blocks {
+		ast.Inspect(&ast.BlockStmt{List: b.Stmts}, func(n ast.Node) bool {
+			if br, ok := n.(*ast.BranchStmt); ok && br.Label != nil && br.Label.Name == name {
+				used = true
 			}
-			newVar := &hoistedVar{
-				OriginalName: ident.Name,
-				NewName:      NewName(),
-				Type:         varType,
+			_, isFunc := n.(*ast.FuncLit)
+			return !isFunc
+		})
+	}
+	var loop ast.Stmt = &ast.RangeStmt{
+		For:    s.For,
+		Key:    s.Key,
+		Value:  s.Value,
+		TokPos: s.TokPos,
+		Tok:    s.Tok,
+		Range:  s.Range,
+		X:      s.X,
+		Body:   &ast.BlockStmt{Lbrace: s.Body.Lbrace, List: inner.loop(entry), Rbrace: s.Body.Rbrace},
+	}
+	if used {
+		loop = &ast.LabeledStmt{Label: ast.NewIdent(name), Stmt: loop}
+	}
+	d.emit(loop)
+}
+func (f *flattener) lowerSwitch(d *dispatcher, s *ast.SwitchStmt, scope *branchScope, depth int, label string) {
+	if s.Init != nil {
+		f.lowerStmt(d, s.Init, scope, 0, "")
+	}
+	after := d.newBlock()
+	dispatch := &ast.SwitchStmt{Switch: s.Switch, Tag: s.Tag, Body: &ast.BlockStmt{}}
+	var clauses []*ast.CaseClause
+	var ids []int
+	hasDefault := false
+	for _, stmt := range s.Body.List {
+		cc := stmt.(*ast.CaseClause)
+		id := d.newBlock()
+		clauses, ids = append(clauses, cc), append(ids, id)
+		hasDefault = hasDefault || cc.List == nil
+		dispatch.Body.List = append(dispatch.Body.List, &ast.CaseClause{Case: cc.Case, List: cc.List, Colon: cc.Colon, Body: []ast.Stmt{d.assign(id)}})
+	}
+	if !hasDefault {
+		dispatch.Body.List = append(dispatch.Body.List, &ast.CaseClause{Body: []ast.Stmt{d.assign(after)}})
+	}
+	d.emit(dispatch)
+	d.cur = nil
+	for i, cc := range clauses {
+		clauseScope := &branchScope{parent: scope, label: label, breakTo: &jumpTarget{d: d, state: after}}
+		if i+1 < len(ids) {
+			clauseScope.fallTo = &jumpTarget{d: d, state: ids[i+1]}
+		}
+		d.startBlock(ids[i])
+		f.lowerList(d, cc.Body, clauseScope, depth-1)
+		if d.cur != nil {
+			d.jump(after)
+		}
+	}
+	d.startBlock(after)
+}
+// lowerTypeSwitch keeps a type switch to select the clause; the clause variables are hoisted
+// with the type they have in their clause and assigned before jumping.
+func (f *flattener) lowerTypeSwitch(d *dispatcher, s *ast.TypeSwitchStmt, scope *branchScope, depth int, label string) {
+	if s.Init != nil {
+		f.lowerStmt(d, s.Init, scope, 0, "")
+	}
+	var assert *ast.TypeAssertExpr
+	switch a := s.Assign.(type) {
+	case *ast.AssignStmt:
+		assert, _ = a.Rhs[0].(*ast.TypeAssertExpr)
+	case *ast.ExprStmt:
+		assert, _ = a.X.(*ast.TypeAssertExpr)
+	}
+	if assert == nil {
+		f.fail("malformed type switch")
+		return
+	}
+	after := d.newBlock()
+	tmp := NewName()
+	tmpUsed, hasDefault := false, false
+	dispatch := &ast.TypeSwitchStmt{Switch: s.Switch, Body: &ast.BlockStmt{}}
+	var clauses []*ast.CaseClause
+	var ids []int
+	for _, stmt := range s.Body.List {
+		cc := stmt.(*ast.CaseClause)
+		id := d.newBlock()
+		clauses, ids = append(clauses, cc), append(ids, id)
+		hasDefault = hasDefault || cc.List == nil
+		var body []ast.Stmt
+		if obj := f.info.Implicits[cc]; obj != nil && f.used[obj] {
+			hv := f.hoist(obj)
+			body = append(body, &ast.AssignStmt{Lhs: []ast.Expr{ast.NewIdent(hv.NewName)}, Tok: token.ASSIGN, Rhs: []ast.Expr{ast.NewIdent(tmp)}})
+			tmpUsed = true
+		}
+		body = append(body, d.assign(id))
+		dispatch.Body.List = append(dispatch.Body.List, &ast.CaseClause{Case: cc.Case, List: cc.List, Colon: cc.Colon, Body: body})
+	}
+	if !hasDefault {
+		dispatch.Body.List = append(dispatch.Body.List, &ast.CaseClause{Body: []ast.Stmt{d.assign(after)}})
+	}
+	guard := &ast.TypeAssertExpr{X: assert.X, Lparen: assert.Lparen, Rparen: assert.Rparen}
+	if tmpUsed {
+		dispatch.Assign = &ast.AssignStmt{Lhs: []ast.Expr{ast.NewIdent(tmp)}, Tok: token.DEFINE, Rhs: []ast.Expr{guard}}
+	} else {
+		dispatch.Assign = &ast.ExprStmt{X: guard}
+	}
+	d.emit(dispatch)
+	d.cur = nil
+	for i, cc := range clauses {
+		d.startBlock(ids[i])
+		f.lowerList(d, cc.Body, &branchScope{parent: scope, label: label, breakTo: &jumpTarget{d: d, state: after}}, depth-1)
+		if d.cur != nil {
+			d.jump(after)
+		}
+	}
+	d.startBlock(after)
+}
+// lowerSelect keeps the select to pick the communication, which now assigns to hoisted
+// variables, and lowers the clause bodies into states.
+func (f *flattener) lowerSelect(d *dispatcher, s *ast.SelectStmt, scope *branchScope, depth int, label string) {
+	after := d.newBlock()
+	dispatch := &ast.SelectStmt{Select: s.Select, Body: &ast.BlockStmt{}}
+	var clauses []*ast.CommClause
+	var ids []int
+	for _, stmt := range s.Body.List {
+		cc := stmt.(*ast.CommClause)
+		id := d.newBlock()
+		clauses, ids = append(clauses, cc), append(ids, id)
+		comm := cc.Comm
+		if a, ok := comm.(*ast.AssignStmt); ok {
+			comm = f.assign(a)
+		}
+		dispatch.Body.List = append(dispatch.Body.List, &ast.CommClause{Case: cc.Case, Comm: comm, Colon: cc.Colon, Body: []ast.Stmt{d.assign(id)}})
+	}
+	d.emit(dispatch)
+	d.cur = nil
+	for i, cc := range clauses {
+		d.startBlock(ids[i])
+		f.lowerList(d, cc.Body, &branchScope{parent: scope, label: label, breakTo: &jumpTarget{d: d, state: after}}, depth-1)
+		if d.cur != nil {
+			d.jump(after)
+		}
+	}
+	d.startBlock(after)
+}
+func isBlank(e ast.Expr) bool {
+	id, ok := e.(*ast.Ident)
+	return ok && id.Name == "_"
+}
+// flattenBlocker explains why a function body cannot be flattened, or returns "". Hoisting turns
+// the variables declared inside a loop into a single variable for all iterations, which is only
+// invisible as long as no closure captures them and their address is not taken.
+func flattenBlocker(body *ast.BlockStmt, info *types.Info) string {
+	reason := ""
+	hasGoto := false
+	declared := make(map[types.Object]bool)
+	walkWithStack(body, func(n ast.Node, stack []ast.Node) {
+		for _, anc := range stack[:len(stack)-1] {
+			if _, ok := anc.(*ast.FuncLit); ok {
+				return
 			}
-			vars[ident.Name] = newVar
-			decls = append(decls, &ast.DeclStmt{
-				Decl: &ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{
-					&ast.ValueSpec{
-						Names: []*ast.Ident{ast.NewIdent(newVar.NewName)},
-						Type:  newVar.Type,
-					},
-				}},
-			})
-		}
-	}
-	astutil.Apply(body, func(cursor *astutil.Cursor) bool {
-		switch n := cursor.Node().(type) {
-		case *ast.GenDecl:
-			if n.Tok == token.VAR {
-				var assignments []ast.Stmt
-				for _, spec := range n.Specs {
-					if vs, ok := spec.(*ast.ValueSpec); ok {
-						for _, name := range vs.Names {
-							registerVar(name)
-						}
-						if len(vs.Values) > 0 {
-							var lhs []ast.Expr
-							for _, name := range vs.Names {
-								lhs = append(lhs, name)
-							}
-							assignments = append(assignments, &ast.AssignStmt{
-								Lhs: lhs,
-								Tok: token.ASSIGN,
-								Rhs: vs.Values,
-							})
-						}
-					}
-				}
-				if len(assignments) > 0 {
-					if len(assignments) == 1 {
-						cursor.Replace(assignments[0])
-					}
-				} else {
-					cursor.Delete()
-				}
+		}
+		var obj types.Object
+		switch n := n.(type) {
+		case *ast.BranchStmt:
+			hasGoto = hasGoto || n.Tok == token.GOTO
+		case *ast.DeclStmt:
+			gd := n.Decl.(*ast.GenDecl)
+			if gd.Tok == token.TYPE && reason == "" {
+				reason = "declares local types"
 			}
-		case *ast.AssignStmt:
-			if n.Tok == token.DEFINE {
-				for _, lhs := range n.Lhs {
-					if ident, ok := lhs.(*ast.Ident); ok {
-						registerVar(ident)
+			if gd.Tok == token.CONST {
+				ast.Inspect(gd, func(m ast.Node) bool {
+					if id, ok := m.(*ast.Ident); ok {
+						if _, isVar := info.Uses[id].(*types.Var); isVar && reason == "" {
+							reason = "a local constant depends on a variable"
+						}
 					}
-				}
-				n.Tok = token.ASSIGN
+					return true
+				})
 			}
+		case *ast.Ident:
+			obj = info.Defs[n]
+		case *ast.CaseClause:
+			obj = info.Implicits[n]
 		}
-		return true
-	}, nil)
-	return vars, decls
-}
-func decomposeToBasicBlocks(stmts []ast.Stmt) []BasicBlock {
-	var blocks []BasicBlock
-	currentBlock := BasicBlock{ID: 0}
-	for _, stmt := range stmts {
-		currentBlock.Stmts = append(currentBlock.Stmts, stmt)
-		if isBlockTerminal(stmt) {
-			blocks = append(blocks, currentBlock)
-			currentBlock = BasicBlock{ID: len(blocks)}
+		if v, ok := obj.(*types.Var); ok {
+			declared[v] = true
 		}
+	})
+	if reason != "" || !hasGoto {
+		return reason
 	}
-	if len(currentBlock.Stmts) > 0 {
-		blocks = append(blocks, currentBlock)
+	// A backward goto may run a declaration again, creating a new variable each time.
+	for obj := range escapingVars(body, info) {
+		if declared[obj] {
+			return fmt.Sprintf("%s is captured by a closure or has its address taken in a function using goto", obj.Name())
+		}
 	}
-	return blocks
+	return ""
 }
-func isBlockTerminal(stmt ast.Stmt) bool {
-	switch stmt.(type) {
-	case *ast.ReturnStmt, *ast.IfStmt, *ast.ForStmt, *ast.SwitchStmt, *ast.RangeStmt:
-		return true
-	default:
-		return false
-	}
+// perIterationLoops returns the loops of body declaring, in their header or anywhere in their
+// body, a variable that is captured by a closure or whose address is taken. Each iteration of
+// such a loop (or each run of it, before Go 1.22) has its own instance of the variable, which a
+// single hoisted variable would merge: code that hoists declarations must keep these loops with
+// their scopes intact.
+func perIterationLoops(body *ast.BlockStmt, info *types.Info) map[ast.Stmt]bool {
+	loops := make(map[ast.Stmt]bool)
+	escaping := escapingVars(body, info)
+	walkWithStack(body, func(n ast.Node, stack []ast.Node) {
+		var obj types.Object
+		switch n := n.(type) {
+		case *ast.Ident:
+			obj = info.Defs[n]
+		case *ast.CaseClause:
+			obj = info.Implicits[n]
+		}
+		if obj == nil || !escaping[obj] {
+			return
+		}
+		for i := len(stack) - 2; i >= 0; i-- {
+			switch anc := stack[i].(type) {
+			case *ast.FuncLit:
+				// The variable belongs to the closure.
+				return
+			case *ast.ForStmt:
+				loops[anc] = true
+			case *ast.RangeStmt:
+				loops[anc] = true
+			}
+		}
+	})
+	return loops
 }
-func rewriteBlock(stmts []ast.Stmt, stateVar *ast.Ident, nextState, exitState int, returnVars []*ast.Ident, hoistedVars map[string]*hoistedVar) []ast.Stmt {
-	astutil.Apply(&ast.BlockStmt{List: stmts}, func(cursor *astutil.Cursor) bool {
-		ident, ok := cursor.Node().(*ast.Ident)
-		if ok {
-			if hv, exists := hoistedVars[ident.Name]; exists {
-				ident.Name = hv.NewName
+// escapingVars returns the variables that may be referenced after their scope is left: captured
+// by a function literal, or addressed explicitly or through a pointer method or array slicing.
+func escapingVars(body *ast.BlockStmt, info *types.Info) map[types.Object]bool {
+	result := make(map[types.Object]bool)
+	root := func(e ast.Expr) {
+		for {
+			switch x := e.(type) {
+			case *ast.ParenExpr:
+				e = x.X
+			case *ast.SelectorExpr:
+				e = x.X
+			case *ast.IndexExpr:
+				e = x.X
+			case *ast.Ident:
+				if obj, ok := info.Uses[x].(*types.Var); ok {
+					result[obj] = true
+				}
+				return
+			default:
+				return
 			}
 		}
-		return true
-	}, nil)
-	lastStmt := stmts[len(stmts)-1]
-	switch s := lastStmt.(type) {
-	case *ast.ReturnStmt:
-		var assignments []ast.Stmt
-		for i, res := range s.Results {
-			assignments = append(assignments, &ast.AssignStmt{Lhs: []ast.Expr{returnVars[i]}, Tok: token.ASSIGN, Rhs: []ast.Expr{res}})
+	}
+	walkWithStack(body, func(n ast.Node, stack []ast.Node) {
+		switch x := n.(type) {
+		case *ast.UnaryExpr:
+			if x.Op == token.AND {
+				root(x.X)
+			}
+		case *ast.SliceExpr:
+			if t := info.TypeOf(x.X); t != nil {
+				if _, ok := t.Underlying().(*types.Array); ok {
+					root(x.X)
+				}
+			}
+		case *ast.SelectorExpr:
+			sel, ok := info.Selections[x]
+			if !ok || sel.Kind() == types.FieldVal {
+				return
+			}
+			if sig, ok := sel.Obj().Type().(*types.Signature); ok && sig.Recv() != nil {
+				if _, ptrRecv := sig.Recv().Type().(*types.Pointer); ptrRecv {
+					if _, ptr := sel.Recv().Underlying().(*types.Pointer); !ptr {
+						root(x.X)
+					}
+				}
+			}
+		case *ast.Ident:
+			obj, ok := info.Uses[x].(*types.Var)
+			if !ok {
+				return
+			}
+			for _, anc := range stack[:len(stack)-1] {
+				if lit, ok := anc.(*ast.FuncLit); ok && (obj.Pos() < lit.Pos() || obj.Pos() >= lit.End()) {
+					result[obj] = true
+				}
+			}
+		}
+	})
+	return result
+}
+// dropComments removes the comments of a function body that is about to be replaced, since
+// they would be attached to unrelated generated code.
+func dropComments(file *ast.File, body *ast.BlockStmt) {
+	kept := file.Comments[:0]
+	for _, group := range file.Comments {
+		if group.Pos() < body.Pos() || group.End() > body.End() {
+			kept = append(kept, group)
 		}
-		assignments = append(assignments, &ast.AssignStmt{Lhs: []ast.Expr{stateVar}, Tok: token.ASSIGN, Rhs: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(exitState)}}})
-		return append(stmts[:len(stmts)-1], assignments...)
-	default:
-		return append(stmts, &ast.AssignStmt{Lhs: []ast.Expr{stateVar}, Tok: token.ASSIGN, Rhs: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(nextState)}}})
 	}
+	file.Comments = kept
 }
-func Deref(vars []*ast.Ident) []ast.Expr {
-	exprs := make([]ast.Expr, len(vars))
-	for i, v := range vars {
-		exprs[i] = v
+// createJunkCases creates the states no transition leads to, each failing an opaque predicate.
+func createJunkCases(states []uint32, preds *OpaquePredicates) []ast.Stmt {
+	var junkCases []ast.Stmt
+	for _, state := range states {
+		unreachable := &ast.ExprStmt{X: &ast.CallExpr{Fun: ast.NewIdent("panic"), Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: "\"unreachable\""}}}}
+		body := []ast.Stmt{preds.Dead(unreachable)}
+		if randInt(2) == 0 {
+			body = []ast.Stmt{&ast.IfStmt{Cond: preds.Random(), Body: &ast.BlockStmt{List: []ast.Stmt{preds.Sink()}}, Else: &ast.BlockStmt{List: []ast.Stmt{unreachable}}}}
+		}
+		junkCases = append(junkCases, &ast.CaseClause{List: []ast.Expr{stateLiteral(state)}, Body: body})
 	}
-	return exprs
+	return junkCases
 }
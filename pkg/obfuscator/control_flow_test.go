@@ -0,0 +1,923 @@
+package obfuscator
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"strconv"
+	"strings"
+	"testing"
+)
+// controlFlowProgram exercises every statement the flattener lowers. Each function prints a
+// trace so a miscompiled branch changes the output.
+const controlFlowProgram = `package main
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+type shape interface{ area() int }
+type square struct{ side int }
+func (s square) area() int { return s.side * s.side }
+func loops(n int) int {
+	total := 0
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			continue
+		}
+		total += i
+		if total > 20 {
+			break
+		}
+	}
+	j := 0
+	for j < 3 {
+		j++
+	}
+	for {
+		j *= 2
+		if j > 40 {
+			break
+		}
+	}
+	return total + j
+}
+func labeled(grid [][]int) (found int, where string) {
+outer:
+	for y, row := range grid {
+		for x, v := range row {
+			switch {
+			case v < 0:
+				continue outer
+			case v == 7:
+				found, where = v, fmt.Sprint(x, ",", y)
+				break outer
+			}
+		}
+	}
+	return
+}
+func ranges(s string, xs []int, arr [3]string, p *[2]int, m map[string]int, ch chan int) string {
+	var b strings.Builder
+	for i, r := range s {
+		fmt.Fprint(&b, i, string(r), ";")
+	}
+	for _, x := range xs {
+		fmt.Fprint(&b, x)
+	}
+	for i := range arr {
+		fmt.Fprint(&b, arr[i])
+	}
+	for i, v := range p {
+		fmt.Fprint(&b, i, v)
+	}
+	for k := range 3 {
+		fmt.Fprint(&b, k)
+	}
+	sum := 0
+	for _, v := range m {
+		if v > 100 {
+			continue
+		}
+		sum += v
+	}
+	fmt.Fprint(&b, "|", sum, "|")
+	for v := range ch {
+		fmt.Fprint(&b, v)
+	}
+	return b.String()
+}
+func switches(x int, v interface{}) string {
+	out := ""
+	switch y := x * 2; y {
+	case 2:
+		out += "two"
+		fallthrough
+	case 4:
+		out += "four"
+	case 6, 8:
+		out += "big"
+		break
+	default:
+		out += "other"
+	}
+	switch t := v.(type) {
+	case int:
+		out += fmt.Sprint("int", t+1)
+	case string, error:
+		out += fmt.Sprint("text", t)
+	case shape:
+		out += fmt.Sprint("shape", t.area())
+	case nil:
+		out += "nil"
+	}
+	switch {
+	}
+	return out
+}
+func gotos(n int) (steps int) {
+	i := 0
+loop:
+	if i >= n {
+		goto done
+	}
+	i++
+	steps += i
+	goto loop
+done:
+	return
+}
+func selects(a, b chan int, quit chan struct{}) int {
+	got := 0
+	for {
+		select {
+		case v, ok := <-a:
+			if !ok {
+				a = nil
+				continue
+			}
+			got += v
+		case v := <-b:
+			got += 10 * v
+			if v == 3 {
+				break
+			}
+		case <-quit:
+			return got
+		}
+	}
+}
+func deep(n int) int {
+	r := 0
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if (i+j)%3 == 0 {
+				for k := 0; k < 2; k++ {
+					if k == 1 {
+						r += i * j
+					} else if k == 0 {
+						r -= j
+					}
+				}
+			}
+		}
+	}
+	return r
+}
+func consts(x int) int {
+	const base = 10
+	var acc int
+	var err error
+	if x > 0 {
+		const scale = base * 2
+		acc = x * scale
+	} else {
+		err = errors.New("negative")
+	}
+	if err != nil {
+		return -1
+	}
+	return acc
+}
+func main() {
+	fmt.Println(loops(10), loops(3))
+	fmt.Println(labeled([][]int{{1, -1, 7}, {2, 3, 7}}))
+	ch := make(chan int, 3)
+	ch <- 1
+	ch <- 2
+	close(ch)
+	fmt.Println(ranges("héllo", []int{4, 5}, [3]string{"a", "b", "c"}, &[2]int{8, 9}, map[string]int{"a": 1, "b": 2, "c": 500}, ch))
+	for _, c := range []struct {
+		x int
+		v interface{}
+	}{{1, 5}, {2, "s"}, {3, errors.New("e")}, {4, square{3}}, {5, nil}} {
+		fmt.Println(switches(c.x, c.v))
+	}
+	fmt.Println(gotos(5), gotos(0))
+	a, b, quit := make(chan int, 2), make(chan int, 2), make(chan struct{})
+	a <- 1
+	a <- 2
+	close(a)
+	b <- 3
+	go func() {
+		for len(b) > 0 || len(a) > 0 {
+		}
+		close(quit)
+	}()
+	fmt.Println(selects(a, b, quit) > 0)
+	fmt.Println(deep(4), consts(3), consts(-3))
+}
+`
+func TestControlFlow_PreservesBehaviour(t *testing.T) {
+	want := runGoProgram(t, map[string]string{"main.go": controlFlowProgram})
+	for _, depth := range []int{1, 2, 3, 8} {
+		t.Run("depth"+strconv.Itoa(depth), func(t *testing.T) {
+			pkg := loadTestPackage(t, map[string]string{"main.go": controlFlowProgram})
+			ControlFlow(pkg.Fset, pkg.Syntax[0], pkg.TypesInfo, pkg.Types, ControlFlowOptions{Depth: depth, Backend: DispatcherSwitch})
+			out := printFile(t, pkg.Fset, pkg.Syntax[0])
+			if got := runGoProgram(t, map[string]string{"main.go": out}); got != want {
+				t.Errorf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out)
+			}
+			for _, fn := range pkg.Syntax[0].Decls {
+				if fd, ok := fn.(*ast.FuncDecl); ok && fd.Name.Name != "main" && fd.Name.Name != "area" {
+					if _, isFor := fd.Body.List[len(fd.Body.List)-1].(*ast.ForStmt); !isFor {
+						if _, isLabeled := fd.Body.List[len(fd.Body.List)-1].(*ast.LabeledStmt); !isLabeled {
+							t.Errorf("Expected %s to be flattened into a dispatcher", fd.Name.Name)
+						}
+					}
+				}
+			}
+			if depth >= 3 && (strings.Contains(out, "goto ") || strings.Contains(out, "fallthrough") || strings.Contains(out, "outer")) {
+				t.Errorf("Expected goto, fallthrough and labels to be lowered into states:\n%s", out)
+			}
+		})
+	}
+}
+func TestControlFlow_SkipsUnsafeFunctions(t *testing.T) {
+	src := `package main
+import "fmt"
+func closures() []func() int {
+	var fs []func() int
+	for i := 0; i < 3; i++ {
+		v := i * 10
+		if v > 0 {
+			fs = append(fs, func() int { return v })
+		}
+	}
+	return fs
+}
+func localType(n int) int {
+	type pair struct{ a, b int }
+	p := pair{n, n}
+	if p.a > 0 {
+		return p.a + p.b
+	}
+	return 0
+}
+func main() {
+	for _, f := range closures() {
+		fmt.Println(f())
+	}
+	fmt.Println(localType(2))
+}
+`
+	pkg := loadTestPackage(t, map[string]string{"main.go": src})
+	bodies := map[string]*ast.BlockStmt{}
+	for _, decl := range pkg.Syntax[0].Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok {
+			bodies[fd.Name.Name] = fd.Body
+		}
+	}
+	ControlFlow(pkg.Fset, pkg.Syntax[0], pkg.TypesInfo, pkg.Types, ControlFlowOptions{Depth: DefaultControlFlowDepth})
+	for _, decl := range pkg.Syntax[0].Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok && fd.Name.Name != "main" && fd.Body != bodies[fd.Name.Name] {
+			t.Errorf("Expected %s, with a captured loop variable or a local type, to stay structured", fd.Name.Name)
+		}
+	}
+}
+func TestControlFlow_EncodedStates(t *testing.T) {
+	want := runGoProgram(t, map[string]string{"main.go": controlFlowProgram})
+	src := controlFlowProgram + "var weaveKey int64\n"
+	pkg := loadTestPackage(t, map[string]string{"main.go": src})
+	ControlFlow(pkg.Fset, pkg.Syntax[0], pkg.TypesInfo, pkg.Types, ControlFlowOptions{Depth: DefaultControlFlowDepth, StateKey: "weaveKey", Backend: DispatcherSwitch})
+	out := printFile(t, pkg.Fset, pkg.Syntax[0])
+	if got := runGoProgram(t, map[string]string{"main.go": out}); got != want {
+		t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out)
+	}
+	if !strings.Contains(out, "uint32(weaveKey)") {
+		t.Errorf("Expected the state encoding to depend on the weaving key:\n%s", out)
+	}
+	states := map[string]bool{}
+	labels := 0
+	ast.Inspect(pkg.Syntax[0], func(n ast.Node) bool {
+		loop, ok := n.(*ast.ForStmt)
+		if !ok || len(loop.Body.List) != 1 {
+			return true
+		}
+		sw, ok := loop.Body.List[0].(*ast.SwitchStmt)
+		if !ok {
+			return true
+		}
+		if tag, ok := sw.Tag.(*ast.Ident); ok {
+			states[tag.Name] = true
+		}
+		for _, c := range sw.Body.List {
+			for _, e := range c.(*ast.CaseClause).List {
+				if v, err := strconv.ParseUint(e.(*ast.BasicLit).Value, 0, 32); err == nil && v < 64 {
+					labels++
+				}
+			}
+		}
+		return true
+	})
+	if len(states) == 0 {
+		t.Fatalf("Expected dispatchers in the output:\n%s", out)
+	}
+	if labels > 2 {
+		t.Errorf("Expected state codes drawn from the full 32-bit space, found %d small ones", labels)
+	}
+	ast.Inspect(pkg.Syntax[0], func(n ast.Node) bool {
+		if as, ok := n.(*ast.AssignStmt); ok && as.Tok == token.ASSIGN && len(as.Lhs) == 1 {
+			if id, ok := as.Lhs[0].(*ast.Ident); ok && states[id.Name] {
+				if _, isLit := as.Rhs[0].(*ast.BasicLit); isLit {
+					t.Errorf("Expected transitions computed from the current state, found %s = %s", id.Name, as.Rhs[0].(*ast.BasicLit).Value)
+				}
+			}
+		}
+		return true
+	})
+}
+func TestControlFlow_MethodsClosuresAndEntryPoints(t *testing.T) {
+	src := `package main
+import (
+	"fmt"
+	"sync"
+)
+var table []int
+func init() {
+	for i := 0; i < 5; i++ {
+		if i%2 == 0 {
+			table = append(table, i*i)
+		} else {
+			table = append(table, -i)
+		}
+	}
+}
+type counter struct{ n int }
+func (c *counter) step(k int) int {
+	for i := 0; i < k; i++ {
+		if c.n > 10 {
+			c.n -= 7
+			continue
+		}
+		c.n += i
+	}
+	return c.n
+}
+var classify = func(n int) string {
+	switch {
+	case n < 0:
+		return "neg"
+	case n == 0:
+		return "zero"
+	}
+	for n > 9 {
+		n /= 10
+	}
+	return fmt.Sprint("digit", n)
+}
+func generator() func() int {
+	total := 0
+	return func() int {
+		for i := 0; i < 3; i++ {
+			if total%2 == 0 {
+				total += i
+			} else {
+				total *= 2
+			}
+		}
+		return total
+	}
+}
+//go:nosplit
+func pinned(n int) int {
+	if n > 0 {
+		return n
+	}
+	return -n
+}
+func main() {
+	c := &counter{}
+	fmt.Println(table, c.step(6), c.step(3))
+	for _, n := range []int{-4, 0, 7, 12345} {
+		fmt.Println(classify(n))
+	}
+	next := generator()
+	fmt.Println(next(), next(), pinned(-3))
+	var wg sync.WaitGroup
+	results := make([]int, 4)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			sum := 0
+			for i := 0; i <= w; i++ {
+				if i%2 == 1 {
+					continue
+				}
+				sum += i * w
+			}
+			results[w] = sum
+		}(w)
+	}
+	wg.Wait()
+	fmt.Println(results)
+}
+`
+	want := runGoProgram(t, map[string]string{"main.go": src})
+	pkg := loadTestPackage(t, map[string]string{"main.go": src})
+	bodies := map[string]*ast.BlockStmt{}
+	for _, decl := range pkg.Syntax[0].Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok {
+			bodies[fd.Name.Name] = fd.Body
+		}
+	}
+	var lits []*ast.FuncLit
+	ast.Inspect(pkg.Syntax[0], func(n ast.Node) bool {
+		if lit, ok := n.(*ast.FuncLit); ok {
+			lits = append(lits, lit)
+		}
+		return true
+	})
+	litBodies := map[*ast.FuncLit]*ast.BlockStmt{}
+	for _, lit := range lits {
+		litBodies[lit] = lit.Body
+	}
+	ControlFlow(pkg.Fset, pkg.Syntax[0], pkg.TypesInfo, pkg.Types, ControlFlowOptions{Depth: DefaultControlFlowDepth})
+	out := printFile(t, pkg.Fset, pkg.Syntax[0])
+	if got := runGoProgram(t, map[string]string{"main.go": out}); got != want {
+		t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out)
+	}
+	for _, decl := range pkg.Syntax[0].Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		// generator has no control flow of its own, only its closure does.
+		if flattened := fd.Body != bodies[fd.Name.Name]; flattened == (fd.Name.Name == "pinned" || fd.Name.Name == "generator") {
+			t.Errorf("Unexpected flattening state of %s (flattened: %v)", fd.Name.Name, flattened)
+		}
+	}
+	for _, lit := range lits {
+		if lit.Body == litBodies[lit] {
+			t.Errorf("Expected the function literal at %s to be flattened", pkg.Fset.Position(lit.Pos()))
+		}
+	}
+}
+func TestControlFlow_HoistedTypes(t *testing.T) {
+	files := map[string]string{
+		"shapes/shapes.go": `package shapes
+import "testprog/shapes/internal/geo"
+type Pair[K comparable, V any] struct {
+	Key K
+	Val V
+}
+type impl struct{ n int }
+func (i *impl) Next() int {
+	i.n += 2
+	return i.n
+}
+func New() *impl { return &impl{} }
+func Origin() geo.Point { return geo.Point{X: 1, Y: 2} }
+`,
+		"shapes/internal/geo/geo.go": `package geo
+type Point struct{ X, Y int }
+`,
+	}
+	main := `package main
+import (
+	"fmt"
+	"net/http"
+	sh "testprog/shapes"
+)
+func hosts(url []string) []string {
+	var out []string
+	for _, raw := range url {
+		req, err := http.NewRequest("GET", raw, nil)
+		if err != nil {
+			continue
+		}
+		u := req.URL
+		if u.Port() != "" {
+			out = append(out, u.Hostname()+":"+u.Port())
+		} else {
+			out = append(out, u.Hostname())
+		}
+	}
+	return out
+}
+func lookup[K comparable, V any](pairs []sh.Pair[K, V], key K) (V, bool) {
+	for _, p := range pairs {
+		if p.Key == key {
+			v := p.Val
+			return v, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+func untyped(n int) string {
+	shift, ratio, letter := 1<<4, 2.5, 'a'
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			shift++
+		} else {
+			ratio *= 2
+		}
+		letter++
+	}
+	return fmt.Sprint(shift, ratio, string(letter))
+}
+func counter() int {
+	it := sh.New()
+	total := 0
+	for i := 0; i < 3; i++ {
+		if i%2 == 0 {
+			total += it.Next()
+		}
+	}
+	return total
+}
+func origin() int {
+	p := sh.Origin()
+	if p.X > 0 {
+		return p.X + p.Y
+	}
+	return 0
+}
+func main() {
+	fmt.Println(hosts([]string{"http://example.com:8080/x", "https://golang.org/", "::bad"}))
+	pairs := []sh.Pair[string, int]{{"a", 1}, {"b", 2}}
+	fmt.Println(lookup(pairs, "b"))
+	fmt.Println(lookup(pairs, "z"))
+	fmt.Println(untyped(5), counter(), origin())
+}
+`
+	all := map[string]string{"main.go": main}
+	for name, content := range files {
+		all[name] = content
+	}
+	want := runGoProgram(t, all)
+	pkg := loadTestPackage(t, all)
+	bodies := map[string]*ast.BlockStmt{}
+	for _, decl := range pkg.Syntax[0].Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok {
+			bodies[fd.Name.Name] = fd.Body
+		}
+	}
+	ControlFlow(pkg.Fset, pkg.Syntax[0], pkg.TypesInfo, pkg.Types, ControlFlowOptions{Depth: DefaultControlFlowDepth})
+	out := printFile(t, pkg.Fset, pkg.Syntax[0])
+	all["main.go"] = out
+	if got := runGoProgram(t, all); got != want {
+		t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out)
+	}
+	for _, decl := range pkg.Syntax[0].Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok || fd.Name.Name == "main" {
+			continue
+		}
+		// counter and origin hold values of an unexported type and of a type in an internal
+		// package of another package: no declaration can name them.
+		unnameable := fd.Name.Name == "counter" || fd.Name.Name == "origin"
+		if flattened := fd.Body != bodies[fd.Name.Name]; flattened == unnameable {
+			t.Errorf("Unexpected flattening state of %s (flattened: %v)", fd.Name.Name, flattened)
+		}
+	}
+	var urlImport *ast.ImportSpec
+	for _, imp := range pkg.Syntax[0].Imports {
+		if imp.Path.Value == `"net/url"` {
+			urlImport = imp
+		}
+	}
+	if urlImport == nil || urlImport.Name == nil || urlImport.Name.Name == "url" {
+		t.Errorf("Expected net/url to be imported under an alias, since a parameter shadows url:\n%s", out)
+	}
+}
+func TestControlFlow_PerIterationLoopVariables(t *testing.T) {
+	src := `package main
+import (
+	"fmt"
+	"sync"
+)
+func threeClause(n int) []int {
+	if n < 0 {
+		n = -n
+	}
+	var fs []func() int
+	for i := 0; i < n; i++ {
+		fs = append(fs, func() int { return i })
+		i++
+	}
+	var out []int
+	for _, f := range fs {
+		out = append(out, f())
+	}
+	return out
+}
+func goroutines(items []int) []int {
+	res := make([]int, len(items))
+	if len(items) == 0 {
+		return res
+	}
+	var wg sync.WaitGroup
+	for i, v := range items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res[i] = v * 2
+		}()
+	}
+	wg.Wait()
+	return res
+}
+func addresses(n int) int {
+	var ptrs []*int
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			continue
+		}
+		x := i * 10
+		ptrs = append(ptrs, &x)
+	}
+	sum := 0
+	for _, p := range ptrs {
+		sum += *p
+	}
+	return sum
+}
+func nested(n int) []int {
+	var fs []func() int
+	for round := 0; round < n; round++ {
+		if round == 1 {
+			continue
+		}
+		for j := range 2 {
+			fs = append(fs, func() int { return round*10 + j })
+		}
+	}
+	var out []int
+	for _, f := range fs {
+		out = append(out, f())
+	}
+	return out
+}
+func deferred(n int) {
+	if n == 0 {
+		return
+	}
+	for i := range n {
+		defer func() { fmt.Print(i, " ") }()
+	}
+	fmt.Print("deferred: ")
+}
+func main() {
+	fmt.Println(threeClause(6), goroutines([]int{1, 2, 3}), addresses(6), nested(3))
+	deferred(3)
+	fmt.Println()
+}
+`
+	want := runGoProgram(t, map[string]string{"main.go": src})
+	pkg := loadTestPackage(t, map[string]string{"main.go": src})
+	bodies := map[string]*ast.BlockStmt{}
+	for _, decl := range pkg.Syntax[0].Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok {
+			bodies[fd.Name.Name] = fd.Body
+		}
+	}
+	ControlFlow(pkg.Fset, pkg.Syntax[0], pkg.TypesInfo, pkg.Types, ControlFlowOptions{Depth: 8})
+	out := printFile(t, pkg.Fset, pkg.Syntax[0])
+	if got := runGoProgram(t, map[string]string{"main.go": out}); got != want {
+		t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out)
+	}
+	for _, decl := range pkg.Syntax[0].Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok && fd.Name.Name != "main" && fd.Body == bodies[fd.Name.Name] {
+			t.Errorf("Expected %s to be flattened around its per-iteration loops", fd.Name.Name)
+		}
+	}
+}
+func TestControlFlow_DeferRecoverAndNamedResults(t *testing.T) {
+	cases := []struct {
+		name, decl, call string
+	}{
+		{"deferredResult", `func deferredResult(n int) (res int) {
+	defer func() { res *= 2 }()
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			res += i
+		}
+	}
+	return res + 1
+}`, "deferredResult(7)"},
+		{"nakedReturn", `func nakedReturn(s []int) (sum, count int) {
+	for _, v := range s {
+		if v < 0 {
+			return
+		}
+		sum += v
+		count++
+	}
+	return
+}`, "fmt.Sprint(nakedReturn([]int{3, 4, -1, 5}))"},
+		{"recoverToError", `func recoverToError(a, b int) (q int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered: %v", r)
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		if b == 0 {
+			panic("division by zero")
+		}
+		q += a / b
+	}
+	return
+}`, "fmt.Sprint(recoverToError(7, 2)) + fmt.Sprint(recoverToError(1, 0))"},
+		{"deferOrder", `func deferOrder(n int) (out []int) {
+	defer func() { out = append(out, -1) }()
+	for i := 0; i < n; i++ {
+		defer func(v int) { out = append(out, v) }(i)
+	}
+	if n > 2 {
+		return nil
+	}
+	return []int{100}
+}`, "fmt.Sprint(deferOrder(2), deferOrder(4))"},
+		{"recoverTypeSwitch", `func recoverTypeSwitch(crash bool) (msg string) {
+	defer func() {
+		r := recover()
+		switch v := r.(type) {
+		case nil:
+		case string:
+			msg = "string: " + v
+		case error:
+			msg = "error: " + v.Error()
+		default:
+			msg = "other"
+		}
+	}()
+	var m map[string]int
+	for i := 0; i < 2; i++ {
+		if crash && i == 1 {
+			m["x"] = 1
+		}
+	}
+	return "none"
+}`, "recoverTypeSwitch(false) + \" / \" + recoverTypeSwitch(true)"},
+		{"shadowedResult", `func shadowedResult(n int) (x int) {
+	if n > 0 {
+		x := n * 2
+		x++
+		_ = x
+	}
+	for i := 0; i < n; i++ {
+		x += i
+	}
+	return
+}`, "shadowedResult(5)"},
+		{"deferArguments", `func deferArguments(n int) (s string) {
+	i := 0
+	defer func(v int) { s += fmt.Sprint(" deferred ", v, " ", i) }(i)
+	for ; i < n; i++ {
+		if i == 2 {
+			break
+		}
+	}
+	s = fmt.Sprint("i=", i)
+	return
+}`, "deferArguments(5)"},
+		{"repanic", `func repanic(n int) (out string) {
+	if n < 1 {
+		return "none"
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			out = fmt.Sprint("outer caught ", r)
+		}
+	}()
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				for i := 0; i < n; i++ {
+					if i == n-1 {
+						panic(fmt.Sprint(r, " again"))
+					}
+				}
+			}
+		}()
+		panic("first")
+	}()
+	return "unreached"
+}`, "repanic(3)"},
+	}
+	var src strings.Builder
+	src.WriteString("package main\nimport \"fmt\"\n")
+	for _, c := range cases {
+		src.WriteString(c.decl + "\n")
+	}
+	src.WriteString("func main() {\n")
+	for _, c := range cases {
+		fmt.Fprintf(&src, "\tfmt.Println(%q, %s)\n", c.name+":", c.call)
+	}
+	src.WriteString("}\n")
+	want := strings.Split(runGoProgram(t, map[string]string{"main.go": src.String()}), "\n")
+	pkg := loadTestPackage(t, map[string]string{"main.go": src.String()})
+	bodies := map[string]*ast.BlockStmt{}
+	for _, decl := range pkg.Syntax[0].Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok {
+			bodies[fd.Name.Name] = fd.Body
+		}
+	}
+	ControlFlow(pkg.Fset, pkg.Syntax[0], pkg.TypesInfo, pkg.Types, ControlFlowOptions{Depth: DefaultControlFlowDepth})
+	out := printFile(t, pkg.Fset, pkg.Syntax[0])
+	got := strings.Split(runGoProgram(t, map[string]string{"main.go": out}), "\n")
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, decl := range pkg.Syntax[0].Decls {
+				if fd, ok := decl.(*ast.FuncDecl); ok && fd.Name.Name == c.name && fd.Body == bodies[c.name] {
+					t.Errorf("Expected %s to be flattened", c.name)
+				}
+			}
+			if i >= len(got) || got[i] != want[i] {
+				t.Errorf("Output mismatch:\nwant %q\ngot  %q", want[i], got)
+			}
+		})
+	}
+}
+func TestControlFlow_DispatcherBackends(t *testing.T) {
+	want := runGoProgram(t, map[string]string{"main.go": controlFlowProgram})
+	for _, backend := range DispatcherBackends {
+		t.Run(backend, func(t *testing.T) {
+			pkg := loadTestPackage(t, map[string]string{"main.go": controlFlowProgram})
+			ControlFlow(pkg.Fset, pkg.Syntax[0], pkg.TypesInfo, pkg.Types, ControlFlowOptions{Depth: DefaultControlFlowDepth, Backend: DispatcherBackend(backend)})
+			out := printFile(t, pkg.Fset, pkg.Syntax[0])
+			if got := runGoProgram(t, map[string]string{"main.go": out}); got != want {
+				t.Errorf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out)
+			}
+		})
+	}
+}
+func TestControlFlow_DispatcherDirective(t *testing.T) {
+	src := `package main
+import "fmt"
+//obf:dispatcher goto
+func jumps(n int) int {
+	total := 0
+	for i := 0; i < n; i++ {
+		if i%3 == 0 {
+			continue
+		}
+		total += i
+	}
+	return total
+}
+//obf:dispatcher closures
+func calls(words []string) {
+	for i, w := range words {
+		if w == "" {
+			return
+		}
+		fmt.Println(i, w)
+	}
+}
+func plain(n int) int {
+	if n > 2 {
+		return n * 2
+	}
+	return n
+}
+func main() {
+	fmt.Println(jumps(10), plain(1), plain(5))
+	calls([]string{"a", "b", "", "c"})
+}
+`
+	want := runGoProgram(t, map[string]string{"main.go": src})
+	pkg := loadTestPackage(t, map[string]string{"main.go": src})
+	ControlFlow(pkg.Fset, pkg.Syntax[0], pkg.TypesInfo, pkg.Types, ControlFlowOptions{Depth: DefaultControlFlowDepth, Backend: DispatcherSwitch})
+	out := printFile(t, pkg.Fset, pkg.Syntax[0])
+	if got := runGoProgram(t, map[string]string{"main.go": out}); got != want {
+		t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out)
+	}
+	for _, decl := range pkg.Syntax[0].Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		var gotos, closures, switches int
+		ast.Inspect(fd.Body, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.BranchStmt:
+				if n.Tok == token.GOTO {
+					gotos++
+				}
+			case *ast.FuncLit:
+				closures++
+			case *ast.SwitchStmt:
+				switches++
+			}
+			return true
+		})
+		switch fd.Name.Name {
+		case "jumps":
+			if gotos == 0 || switches != 0 {
+				t.Errorf("Expected jumps to be dispatched by goto:\n%s", out)
+			}
+		case "calls":
+			if closures == 0 || switches != 0 {
+				t.Errorf("Expected calls to be dispatched by closures:\n%s", out)
+			}
+		case "plain":
+			if switches == 0 || gotos != 0 {
+				t.Errorf("Expected plain to keep the default switch:\n%s", out)
+			}
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package obfuscator
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"strings"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+// dataOptOutDirective excludes the literal on the same or the following line from data encryption.
+const dataOptOutDirective = "//obf:plaintext"
+// DataEncryptionPass encrypts composite literals of integer constants ([]byte, []uint32, arrays,
+// ...) and rune literals. The ciphertext goes into a per-package table decrypted once on first
+// use; every evaluation of a slice or array literal still yields a fresh value.
+type DataEncryptionPass struct {
+	// Threshold is the minimum size in bytes of a composite literal worth encrypting.
+	Threshold int
+}
+// dataEncryptionState holds the per-package table and the replacements computed for one package.
+type dataEncryptionState struct {
+	obf          *Obfuscator
+	pkg          *packages.Package
+	table        *stringTable
+	decoderName  string
+	replacements map[ast.Node]ast.Expr
+}
+func (p *DataEncryptionPass) Apply(obf *Obfuscator, pkg *packages.Package) error {
+	if pkg.TypesInfo == nil || len(pkg.Syntax) == 0 {
+		return nil
+	}
+	st := &dataEncryptionState{
+		obf:          obf,
+		pkg:          pkg,
+		table:        newStringTable(),
+		decoderName:  NewName(),
+		replacements: make(map[ast.Node]ast.Expr),
+	}
+	skipped := make(map[ast.Node]bool)
+	for _, file := range pkg.Syntax {
+		optOut := directiveLines(pkg.Fset, file, dataOptOutDirective)
+		walkWithStack(file, func(n ast.Node, stack []ast.Node) {
+			for _, ancestor := range stack[:len(stack)-1] {
+				if _, done := st.replacements[ancestor]; done || skipped[ancestor] {
+					return
+				}
+			}
+			if line := pkg.Fset.Position(n.Pos()).Line; optOut[line] || optOut[line-1] {
+				skipped[n] = true
+				return
+			}
+			var repl ast.Expr
+			switch lit := n.(type) {
+			case *ast.CompositeLit:
+				repl = p.encryptComposite(st, file, lit, stack)
+			case *ast.BasicLit:
+				if lit.Kind == token.CHAR && !requiresConstant(stack, pkg.TypesInfo, nil) {
+					repl = st.encryptRune(file, lit)
+				}
+			}
+			if repl != nil {
+				st.replacements[n] = repl
+			}
+		})
+		astutil.Apply(file, func(cursor *astutil.Cursor) bool {
+			if repl, ok := st.replacements[cursor.Node()]; ok {
+				cursor.Replace(repl)
+				return false
+			}
+			return true
+		}, nil)
+	}
+	if len(st.table.entries) == 0 {
+		return nil
+	}
+	decls, err := st.table.buildDecls(obf)
+	if err != nil {
+		return err
+	}
+	decoder, err := parser.ParseFile(token.NewFileSet(), "decoder.go", fmt.Sprintf(`package p
+// %[1]s decodes a little-endian integer.
+func %[1]s(s string) uint64 {
+	var v uint64
+	for i := len(s) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(s[i])
+	}
+	return v
+}`, st.decoderName), 0)
+	if err != nil {
+		return fmt.Errorf("failed to parse data decoder: %w", err)
+	}
+	stripPositions(decoder)
+	for _, path := range st.table.imports() {
+		astutil.AddImport(pkg.Fset, pkg.Syntax[0], path)
+	}
+	appendDecls(pkg.Syntax[0], append(decls, decoder.Decls...))
+	fmt.Printf("    - Encrypted %d data literals\n", len(st.table.entries))
+	return nil
+}
+// encryptComposite returns the replacement of a composite literal whose elements are all integer
+// constants, or nil if it must stay as is.
+func (p *DataEncryptionPass) encryptComposite(st *dataEncryptionState, file *ast.File, lit *ast.CompositeLit, stack []ast.Node) ast.Expr {
+	info := st.pkg.TypesInfo
+	tv, ok := info.Types[lit]
+	if !ok {
+		return nil
+	}
+	var elem types.Type
+	length := int64(-1)
+	switch t := tv.Type.Underlying().(type) {
+	case *types.Slice:
+		elem = t.Elem()
+	case *types.Array:
+		elem, length = t.Elem(), t.Len()
+	default:
+		return nil
+	}
+	size := integerSize(elem)
+	if size == 0 {
+		return nil
+	}
+	if lit.Type == nil && elidedAddress(stack, info) {
+		return nil
+	}
+	// len and cap of an array literal are constant, and may be needed as such.
+	if requiresConstant(stack, info, nil) {
+		return nil
+	}
+	if len(stack) > 1 {
+		if u, ok := stack[len(stack)-2].(*ast.UnaryExpr); ok && u.Op == token.AND {
+			return nil
+		}
+	}
+	values := make(map[int64]uint64)
+	var index, count int64
+	for _, elt := range lit.Elts {
+		if kv, ok := elt.(*ast.KeyValueExpr); ok {
+			key, ok := info.Types[kv.Key]
+			if !ok || key.Value == nil {
+				return nil
+			}
+			if index, ok = constant.Int64Val(constant.ToInt(key.Value)); !ok {
+				return nil
+			}
+			elt = kv.Value
+		}
+		v, ok := integerValue(info, elt)
+		if !ok {
+			return nil
+		}
+		values[index] = v
+		index++
+		if index > count {
+			count = index
+		}
+	}
+	if length < 0 {
+		length = count
+	}
+	if length == 0 || int(length)*size < p.Threshold {
+		return nil
+	}
+	litType, err := typeSource(tv.Type, file, st.pkg.Types)
+	if err != nil {
+		return nil
+	}
+	elemType, err := typeSource(elem, file, st.pkg.Types)
+	if err != nil {
+		return nil
+	}
+	data := make([]byte, int(length)*size)
+	for i, v := range values {
+		for b := 0; b < size; b++ {
+			data[int(i)*size+b] = byte(v >> (8 * b))
+		}
+	}
+	accessor := st.add(data)
+	if accessor == "" {
+		return nil
+	}
+	sVar, outVar, iVar := NewName(), NewName(), NewName()
+	decl := fmt.Sprintf("%s := make(%s, %d)", outVar, litType, length)
+	if _, isArray := tv.Type.Underlying().(*types.Array); isArray {
+		decl = fmt.Sprintf("var %s %s", outVar, litType)
+	}
+	src := fmt.Sprintf(`func() %[1]s {
+	%[2]s := %[3]s
+	%[4]s
+	for %[5]s := range %[6]s {
+		%[6]s[%[5]s] = %[7]s(%[8]s(%[2]s[%[5]s*%[9]d : %[5]s*%[9]d+%[9]d]))
+	}
+	return %[6]s
+}()`, litType, sVar, accessor, decl, iVar, outVar, elemType, st.decoderName, size)
+	expr, err := parser.ParseExpr(src)
+	if err != nil {
+		return nil
+	}
+	pinPositions(expr, lit.Pos())
+	return expr
+}
+// encryptRune returns the replacement of a rune literal converted to the type it takes in context.
+func (st *dataEncryptionState) encryptRune(file *ast.File, lit *ast.BasicLit) ast.Expr {
+	tv, ok := st.pkg.TypesInfo.Types[lit]
+	if !ok || tv.Value == nil || isUntyped(tv.Type) || integerSize(tv.Type) == 0 {
+		return nil
+	}
+	v, ok := integerValue(st.pkg.TypesInfo, lit)
+	if !ok {
+		return nil
+	}
+	typ, err := typeSource(tv.Type, file, st.pkg.Types)
+	if err != nil {
+		return nil
+	}
+	accessor := st.add([]byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)})
+	if accessor == "" {
+		return nil
+	}
+	expr, err := parser.ParseExpr(fmt.Sprintf("%s(%s(%s))", typ, st.decoderName, accessor))
+	if err != nil {
+		return nil
+	}
+	pinPositions(expr, lit.Pos())
+	return expr
+}
+// add encrypts data into the package table and returns the source of the accessor call.
+func (st *dataEncryptionState) add(data []byte) string {
+	cipher, keys := st.obf.dataCipher()
+	enc, err := cipher.Encrypt(data, keys)
+	if err != nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	printer.Fprint(&buf, token.NewFileSet(), st.table.add(enc))
+	return buf.String()
+}
+// dataCipher picks the cipher and key source for non-string data, following the string
+// encryption settings of the current package when string encryption is enabled.
+func (obf *Obfuscator) dataCipher() (StringCipher, KeySource) {
+	if obf != nil && obf.stringEncryption != nil {
+		return obf.stringEncryption.pickCipher(), obf.stringEncryption.keySource()
+	}
+	return aesCTRCipher{}, literalKeySource{}
+}
+// integerSize returns the encoded size of an integer type, or 0 for any other type.
+func integerSize(t types.Type) int {
+	if _, ok := t.(*types.TypeParam); ok {
+		return 0
+	}
+	b, ok := t.Underlying().(*types.Basic)
+	if !ok || b.Info()&types.IsInteger == 0 || b.Info()&types.IsUntyped != 0 {
+		return 0
+	}
+	switch b.Kind() {
+	case types.Int8, types.Uint8:
+		return 1
+	case types.Int16, types.Uint16:
+		return 2
+	case types.Int32, types.Uint32:
+		return 4
+	default:
+		return 8
+	}
+}
+// integerValue returns the two's complement bits of a constant integer expression.
+func integerValue(info *types.Info, expr ast.Expr) (uint64, bool) {
+	tv, ok := info.Types[expr]
+	if !ok || tv.Value == nil {
+		return 0, false
+	}
+	v := constant.ToInt(tv.Value)
+	if v.Kind() != constant.Int {
+		return 0, false
+	}
+	if i, exact := constant.Int64Val(v); exact {
+		return uint64(i), true
+	}
+	return constant.Uint64Val(v)
+}
+// elidedAddress reports whether an elided composite literal stands for &T{...}, which a call
+// expression cannot replace.
+func elidedAddress(stack []ast.Node, info *types.Info) bool {
+	if len(stack) < 2 {
+		return true
+	}
+	parent := stack[len(stack)-2]
+	if _, ok := parent.(*ast.KeyValueExpr); ok && len(stack) > 2 {
+		parent = stack[len(stack)-3]
+	}
+	outer, ok := parent.(*ast.CompositeLit)
+	if !ok {
+		return true
+	}
+	tv, ok := info.Types[outer]
+	if !ok {
+		return true
+	}
+	switch t := tv.Type.Underlying().(type) {
+	case *types.Slice:
+		_, ptr := t.Elem().Underlying().(*types.Pointer)
+		return ptr
+	case *types.Array:
+		_, ptr := t.Elem().Underlying().(*types.Pointer)
+		return ptr
+	case *types.Map:
+		_, keyPtr := t.Key().Underlying().(*types.Pointer)
+		_, elemPtr := t.Elem().Underlying().(*types.Pointer)
+		return keyPtr || elemPtr
+	}
+	return true
+}
+// typeSource renders t for use in generated source inside file.
+func typeSource(t types.Type, file *ast.File, pkg *types.Package) (string, error) {
+	if named, ok := t.(*types.Named); ok && named.Obj().Pkg() != pkg && !named.Obj().Exported() {
+		return "", fmt.Errorf("type %s is not accessible from package %s", named, pkg.Path())
+	}
+	expr, err := typeExpr(t, file, pkg)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, token.NewFileSet(), expr); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+// directiveLines returns the lines of file carrying directive.
+func directiveLines(fset *token.FileSet, file *ast.File, directive string) map[int]bool {
+	lines := make(map[int]bool)
+	for _, group := range file.Comments {
+		for _, c := range group.List {
+			if strings.HasPrefix(c.Text, directive) {
+				lines[fset.Position(c.Pos()).Line] = true
+			}
+		}
+	}
+	return lines
+}
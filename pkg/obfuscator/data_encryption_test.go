@@ -0,0 +1,79 @@
+package obfuscator
+import (
+	"go/ast"
+	"strings"
+	"testing"
+)
+func TestDataEncryptionPass_RoundTrip(t *testing.T) {
+	src := `package main
+import "fmt"
+var weave_key_dummy int64
+type Table []uint32
+var cert = []byte{0x30, 0x82, 0x01, 0x0a, 0x02, 0x82, 0x01, 0x01, 0x00, 0xc3, 0x5f, 0x91, 0x44, 0x7e, 0x2d, 0x19}
+var crcTable = Table{0xdeadbeef, 0x01020304, 0xcafebabe, 0x0badf00d, 7: 0xffffffff}
+const blockLen = len([16]byte{0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x5b, 0x5c, 0x5d, 0x5e, 0x5f, 0x60})
+var blocks [cap([4]uint32{0x61626364, 0x65666768, 0x696a6b6c, 0x6d6e6f70}) * 2]int
+func main() {
+	signed := [8]int16{-1, -32768, 32767, 0, 1, 2, 3, -4}
+	// Every evaluation must produce a fresh slice.
+	for i := 0; i < 2; i++ {
+		key := []uint8{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+		key[0] += byte(i)
+		fmt.Println(key)
+	}
+	//obf:plaintext
+	plain := []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0x00}
+	small := []byte{1, 2}
+	var c byte = 'x'
+	r := 'é'
+	const k = 'q'
+	fmt.Println(cert, crcTable, signed, plain, small, c == 'x', r, string(r), k, len(crcTable), blockLen, len(blocks))
+}
+`
+	want := "[1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16]\n[2 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16]\n" +
+		"[48 130 1 10 2 130 1 1 0 195 95 145 68 126 45 25] [3735928559 16909060 3405691582 195948557 0 0 0 4294967295] [-1 -32768 32767 0 1 2 3 -4] [170 187 204 221 238 255 17 34 51 68 85 102 119 136 153 0] [1 2] true 233 é 113 8 16 8\n"
+	pkg := loadTestPackage(t, map[string]string{"main.go": src})
+	obf := &Obfuscator{WeavingKeyVarName: "weave_key_dummy"}
+	pass := &DataEncryptionPass{Threshold: 16}
+	if err := pass.Apply(obf, pkg); err != nil {
+		t.Fatalf("DataEncryptionPass.Apply failed: %v", err)
+	}
+	out := printFile(t, pkg.Fset, pkg.Syntax[0])
+	for _, s := range []string{"0x30, 0x82, 0x01", "0xdeadbeef", "-32768", "'x'", "'é'", "1, 2, 3, 4, 5, 6"} {
+		if strings.Contains(out, s) {
+			t.Errorf("Expected %s to be encrypted:\n%s", s, out)
+		}
+	}
+	for _, s := range []string{"0xaa, 0xbb", "{1, 2}", "'q'", "0x51, 0x52", "0x61626364"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected %s to stay in plaintext (opt-out, threshold or constant):\n%s", s, out)
+		}
+	}
+	if got := runGoProgram(t, map[string]string{"main.go": out}); got != want {
+		t.Errorf("Output mismatch:\ngot  %q\nwant %q", got, want)
+	}
+}
+func TestDataEncryptionPass_DerivedKeys(t *testing.T) {
+	pkg := loadTestPackage(t, map[string]string{"main.go": `package main
+import "fmt"
+var weave_key_dummy int64
+var table = [4]uint64{1 << 63, 42, 1<<40 + 7, 9}
+func main() {
+	fmt.Println(table)
+}
+`})
+	obf := &Obfuscator{WeavingKeyVarName: "weave_key_dummy", stringEncryption: NewStringEncryptionPass()}
+	obf.stringEncryption.UseCiphers(CipherPolicyRoundRobin, allStringCiphers(t)...)
+	obf.stringEncryption.DeriveKeys()
+	obf.stringEncryption.BeginPackage(StringModeInline)
+	if err := (&DataEncryptionPass{}).Apply(obf, pkg); err != nil {
+		t.Fatalf("DataEncryptionPass.Apply failed: %v", err)
+	}
+	if err := obf.stringEncryption.FinishPackage(obf, pkg.Fset, []*ast.File{pkg.Syntax[0]}); err != nil {
+		t.Fatalf("FinishPackage failed: %v", err)
+	}
+	out := printFile(t, pkg.Fset, pkg.Syntax[0])
+	if got := runGoProgram(t, map[string]string{"main.go": out}); got != "[9223372036854775808 42 1099511627783 9]\n" {
+		t.Errorf("Output mismatch: %q", got)
+	}
+}
@@ -5,8 +5,9 @@ import (
 	"golang.org/x/tools/go/ast/astutil"
 )
 // InsertDeadCode traverses the AST and injects various patterns of junk code
-// into function bodies to hinder manual analysis.
-func InsertDeadCode(file *ast.File) {
+// into function bodies to hinder manual analysis. Opaque predicates come from preds; without
+// it, none are inserted.
+func InsertDeadCode(file *ast.File, preds *OpaquePredicates) {
 	astutil.Apply(file, func(cursor *astutil.Cursor) bool {
 		// Check if we are inside a function declaration
 		funcDecl, isFunc := cursor.Parent().(*ast.FuncDecl)
@@ -36,11 +37,14 @@ func InsertDeadCode(file *ast.File) {
 		if randInt(3) == 0 { // 33% chance to insert code into any given block
 			var junkStmts []ast.Stmt
 			template := randInt(3) // Choose one of the templates
+			if template == 1 && preds == nil {
+				template = 0
+			}
 			switch template {
 			case 0:
 				junkStmts = createMathJunk()
 			case 1:
-				junkStmts = createOpaquePredicateJunk()
+				junkStmts = createOpaquePredicateJunk(preds)
 			case 2:
 				junkStmts = createAllocationJunk()
 			}
@@ -75,74 +79,10 @@ func createMathJunk() []ast.Stmt {
 		},
 	}
 }
-// createOpaquePredicateJunk creates an if statement with a condition that is always true
-// but harder for a static analyzer to prove.
-func createOpaquePredicateJunk() []ast.Stmt {
-	x, y := NewName(), NewName()
-	var cond ast.Expr
-	template := randInt(3)
-	switch template {
-	case 0:
-		// (x*x - 1) == (x-1)*(x+1)
-		cond = &ast.BinaryExpr{
-			X: &ast.BinaryExpr{
-				X:  &ast.BinaryExpr{X: ast.NewIdent(x), Op: token.MUL, Y: ast.NewIdent(x)},
-				Op: token.SUB,
-				Y:  &ast.BasicLit{Kind: token.INT, Value: "1"},
-			},
-			Op: token.EQL,
-			Y: &ast.BinaryExpr{
-				X:  &ast.ParenExpr{X: &ast.BinaryExpr{X: ast.NewIdent(x), Op: token.SUB, Y: &ast.BasicLit{Kind: token.INT, Value: "1"}}},
-				Op: token.MUL,
-				Y:  &ast.ParenExpr{X: &ast.BinaryExpr{X: ast.NewIdent(x), Op: token.ADD, Y: &ast.BasicLit{Kind: token.INT, Value: "1"}}},
-			},
-		}
-	case 1:
-		// 7*x - 3*x - 4*x == 0
-		cond = &ast.BinaryExpr{
-			X: &ast.BinaryExpr{
-				X: &ast.BinaryExpr{
-					X:  &ast.BinaryExpr{X: &ast.BasicLit{Kind: token.INT, Value: "7"}, Op: token.MUL, Y: ast.NewIdent(x)},
-					Op: token.SUB,
-					Y:  &ast.BinaryExpr{X: &ast.BasicLit{Kind: token.INT, Value: "3"}, Op: token.MUL, Y: ast.NewIdent(x)},
-				},
-				Op: token.SUB,
-				Y:  &ast.BinaryExpr{X: &ast.BasicLit{Kind: token.INT, Value: "4"}, Op: token.MUL, Y: ast.NewIdent(x)},
-			},
-			Op: token.EQL,
-			Y:  &ast.BasicLit{Kind: token.INT, Value: "0"},
-		}
-	default:
-		// y := x*x; (y - x*x) == 0
-		cond = &ast.BinaryExpr{
-			X: &ast.BinaryExpr{
-				X:  ast.NewIdent(y),
-				Op: token.SUB,
-				Y:  &ast.BinaryExpr{X: ast.NewIdent(x), Op: token.MUL, Y: ast.NewIdent(x)},
-			},
-			Op: token.EQL,
-			Y:  &ast.BasicLit{Kind: token.INT, Value: "0"},
-		}
-	}
-	return []ast.Stmt{&ast.IfStmt{
-		Init: &ast.AssignStmt{
-			Lhs: []ast.Expr{ast.NewIdent(x)}, Tok: token.DEFINE,
-			Rhs: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: "123"}},
-		},
-		Cond: cond,
-		Body: &ast.BlockStmt{
-			List: []ast.Stmt{
-				&ast.AssignStmt{
-					Lhs: []ast.Expr{ast.NewIdent(y)}, Tok: token.DEFINE,
-					Rhs: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: "\"junk\""}},
-				},
-				&ast.AssignStmt{
-					Lhs: []ast.Expr{ast.NewIdent("_")}, Tok: token.ASSIGN,
-					Rhs: []ast.Expr{ast.NewIdent(y)},
-				},
-			},
-		},
-	}}
+// createOpaquePredicateJunk creates an if statement whose body never runs, behind a predicate
+// the compiler cannot fold.
+func createOpaquePredicateJunk(preds *OpaquePredicates) []ast.Stmt {
+	return []ast.Stmt{preds.Dead(preds.Sink())}
 }
 // createAllocationJunk creates junk code that allocates memory and then "uses" it.
 func createAllocationJunk() []ast.Stmt {
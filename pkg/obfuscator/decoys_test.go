@@ -0,0 +1,116 @@
+package obfuscator
+import (
+	"go/ast"
+	"strings"
+	"testing"
+)
+func TestDecoys_FullDensityRoundTrip(t *testing.T) {
+	src := `
+package main
+import "fmt"
+var weave_key_dummy int64
+func main() {
+	fmt.Println("api.internal.example")
+	for i := 0; i < 2; i++ {
+		switch i {
+		case 0:
+			fmt.Println("first")
+		default:
+			fmt.Println("second")
+		}
+	}
+}
+`
+	want := "api.internal.example\nfirst\nsecond\n"
+	for _, mode := range []StringEncryptionMode{StringModeInline, StringModeTable} {
+		t.Run(string(mode), func(t *testing.T) {
+			fset, file := parseTestFile(t, src)
+			// The decoys take their predicates from the generator shared by the passes.
+			preds := NewOpaquePredicates()
+			obf := &Obfuscator{WeavingKeyVarName: "weave_key_dummy", predicates: preds}
+			pass := NewStringEncryptionPass()
+			pass.UseCiphers(CipherPolicyRoundRobin, allStringCiphers(t)...)
+			pass.UseDecoys(100)
+			pass.BeginPackage(mode)
+			if err := pass.Apply(obf, fset, file); err != nil {
+				t.Fatalf("StringEncryptionPass.Apply failed: %v", err)
+			}
+			if err := pass.FinishPackage(obf, fset, []*ast.File{file}); err != nil {
+				t.Fatalf("StringEncryptionPass.FinishPackage failed: %v", err)
+			}
+			preds.Emit(fset, []*ast.File{file})
+			out := printFile(t, fset, file)
+			guards := 0
+			for _, line := range strings.Split(out, "\n") {
+				if line = strings.TrimSpace(line); !strings.HasPrefix(line, "if ") {
+					continue
+				}
+				for _, state := range []string{preds.seed, preds.cells, preds.alias[0], preds.alias[1], preds.other} {
+					if strings.Contains(line, state) {
+						guards++
+						break
+					}
+				}
+			}
+			if guards != 3 {
+				t.Errorf("Expected 3 decoys guarded by opaque predicates, found %d in:\n%s", guards, out)
+			}
+			if !strings.Contains(out, "var "+preds.seed+" = ") {
+				t.Errorf("Expected the opaque state to be declared:\n%s", out)
+			}
+			if got := runGoProgram(t, map[string]string{"main.go": out}); got != want {
+				t.Errorf("Output mismatch: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+func TestDecoys_CaseExpressions(t *testing.T) {
+	src := `
+package main
+import "fmt"
+var weave_key_dummy int64
+func main() {
+	ch := make(chan string, 1)
+	for _, s := range []string{"alpha", "beta", "gamma"} {
+		switch {
+		case s == "alpha":
+			fmt.Println("first")
+		case s == "beta", s == "delta":
+			fmt.Println("second")
+		}
+		select {
+		case ch <- "sent " + s:
+			fmt.Println(<-ch)
+		}
+	}
+}
+`
+	want := "first\nsent alpha\nsecond\nsent beta\nsent gamma\n"
+	for _, mode := range []StringEncryptionMode{StringModeInline, StringModeTable} {
+		t.Run(string(mode), func(t *testing.T) {
+			fset, file := parseTestFile(t, src)
+			obf := &Obfuscator{WeavingKeyVarName: "weave_key_dummy"}
+			pass := NewStringEncryptionPass()
+			pass.UseDecoys(100)
+			pass.BeginPackage(mode)
+			if err := pass.Apply(obf, fset, file); err != nil {
+				t.Fatalf("StringEncryptionPass.Apply failed: %v", err)
+			}
+			if err := pass.FinishPackage(obf, fset, []*ast.File{file}); err != nil {
+				t.Fatalf("StringEncryptionPass.FinishPackage failed: %v", err)
+			}
+			if got := runGoProgram(t, map[string]string{"main.go": printFile(t, fset, file)}); got != want {
+				t.Errorf("Output mismatch: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+func TestDecoys_PlaintextDiffers(t *testing.T) {
+	for _, s := range []string{"secret", "x", "https://example.com/a", "!!"} {
+		for i := 0; i < 50; i++ {
+			if got := decoyPlaintext(s); got == s || got == "" {
+				t.Fatalf("decoyPlaintext(%q) = %q", s, got)
+			}
+		}
+	}
+}
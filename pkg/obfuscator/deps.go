@@ -0,0 +1,257 @@
+package obfuscator
+import (
+	"fmt"
+	"go/token"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/tools/go/packages"
+)
+// vendoredModule collects everything needed to describe one module in vendor/modules.txt.
+type vendoredModule struct {
+	path      string
+	version   string
+	goVersion string
+	explicit  bool
+	localDir  string // source directory of a local (directory) replacement, if any
+	packages  []string
+}
+// matchModulePattern reports whether modPath matches pattern. A pattern is either an exact
+// module path, a prefix ending in "/..." or a path.Match glob.
+func matchModulePattern(pattern, modPath string) bool {
+	if strings.HasSuffix(pattern, "/...") {
+		prefix := strings.TrimSuffix(pattern, "/...")
+		return modPath == prefix || strings.HasPrefix(modPath, prefix+"/")
+	}
+	if ok, err := path.Match(pattern, modPath); err == nil && ok {
+		return true
+	}
+	return pattern == modPath
+}
+func matchAnyModulePattern(patterns []string, modPath string) bool {
+	for _, pattern := range patterns {
+		if matchModulePattern(pattern, modPath) {
+			return true
+		}
+	}
+	return false
+}
+// vendorDependencies copies every non-standard dependency of roots into outputPath/vendor,
+// obfuscating the packages of modules matching patterns with the same passes as the main module.
+// It then rewrites go.mod so local replacements point into vendor/ and generates vendor/modules.txt.
+func (obfuscator *Obfuscator) vendorDependencies(fset *token.FileSet, roots []*packages.Package, inputPath, outputPath string, patterns []string) error {
+	mainModule := findMainModule(roots)
+	if mainModule == nil || mainModule.GoMod == "" {
+		return fmt.Errorf("main module information is not available")
+	}
+	if filepath.Clean(mainModule.Dir) != filepath.Clean(inputPath) {
+		return fmt.Errorf("dependency vendoring requires the input path to be the module root %s", mainModule.Dir)
+	}
+	goModData, err := os.ReadFile(mainModule.GoMod)
+	if err != nil {
+		return err
+	}
+	modFile, err := modfile.Parse(mainModule.GoMod, goModData, nil)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", mainModule.GoMod, err)
+	}
+	modules := make(map[string]*vendoredModule)
+	getModule := func(modPath string) *vendoredModule {
+		m, ok := modules[modPath]
+		if !ok {
+			m = &vendoredModule{path: modPath}
+			modules[modPath] = m
+		}
+		return m
+	}
+	for _, req := range modFile.Require {
+		m := getModule(req.Mod.Path)
+		m.version = req.Mod.Version
+		m.explicit = true
+	}
+	var deps []*packages.Package
+	packages.Visit(roots, nil, func(pkg *packages.Package) {
+		if pkg.Module == nil || pkg.Module.Main {
+			return
+		}
+		deps = append(deps, pkg)
+	})
+	vendorDir := filepath.Join(outputPath, "vendor")
+	for _, pkg := range deps {
+		m := getModule(pkg.Module.Path)
+		if m.version == "" {
+			m.version = pkg.Module.Version
+		}
+		m.goVersion = pkg.Module.GoVersion
+		if pkg.Module.Replace != nil && pkg.Module.Replace.Version == "" {
+			m.localDir = pkg.Module.Replace.Dir
+		}
+		m.packages = append(m.packages, pkg.PkgPath)
+		if len(pkg.GoFiles) == 0 {
+			continue
+		}
+		pkgVendorDir := filepath.Join(vendorDir, filepath.FromSlash(pkg.PkgPath))
+		if err := copyPackageDir(filepath.Dir(pkg.GoFiles[0]), pkgVendorDir, pkg.EmbedFiles); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", pkg.PkgPath, err)
+		}
+		if !matchAnyModulePattern(patterns, pkg.Module.Path) {
+			continue
+		}
+		if err := obfuscator.processPackage(fset, pkg); err != nil {
+			return err
+		}
+		if err := writePackageFiles(fset, pkg, filepath.Dir(pkg.GoFiles[0]), pkgVendorDir); err != nil {
+			return err
+		}
+		if err := obfuscator.writeAssets(pkg, filepath.Dir(pkg.GoFiles[0]), pkgVendorDir); err != nil {
+			return err
+		}
+	}
+	// Local replacements would dangle in the output tree; point them at the vendored copy instead
+	// and keep the module's go.mod next to it so -mod=mod builds keep working.
+	for _, rep := range modFile.Replace {
+		if !modfile.IsDirectoryPath(rep.New.Path) {
+			continue
+		}
+		newPath := "./vendor/" + rep.Old.Path
+		if err := modFile.AddReplace(rep.Old.Path, rep.Old.Version, newPath, ""); err != nil {
+			return err
+		}
+		if m, ok := modules[rep.Old.Path]; ok && m.localDir != "" {
+			if err := copyFile(filepath.Join(m.localDir, "go.mod"), filepath.Join(vendorDir, filepath.FromSlash(rep.Old.Path), "go.mod")); err != nil {
+				return err
+			}
+		}
+	}
+	modFile.Cleanup()
+	newGoMod, err := modFile.Format()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(outputPath, "go.mod"), newGoMod, 0644); err != nil {
+		return err
+	}
+	goSum := filepath.Join(filepath.Dir(mainModule.GoMod), "go.sum")
+	if _, err := os.Stat(goSum); err == nil {
+		if err := copyFile(goSum, filepath.Join(outputPath, "go.sum")); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(vendorDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(vendorDir, "modules.txt"), []byte(buildModulesTxt(modules, modFile)), 0644)
+}
+// findMainModule returns the main module of the first root package that reports one.
+func findMainModule(roots []*packages.Package) *packages.Module {
+	for _, pkg := range roots {
+		if pkg.Module != nil && pkg.Module.Main {
+			return pkg.Module
+		}
+	}
+	return nil
+}
+// buildModulesTxt renders vendor/modules.txt in the format produced by `go mod vendor`.
+func buildModulesTxt(modules map[string]*vendoredModule, modFile *modfile.File) string {
+	replacements := make(map[string]*modfile.Replace)
+	for _, rep := range modFile.Replace {
+		replacements[rep.Old.Path+"@"+rep.Old.Version] = rep
+	}
+	findReplace := func(modPath, version string) *modfile.Replace {
+		if rep, ok := replacements[modPath+"@"+version]; ok {
+			return rep
+		}
+		return replacements[modPath+"@"]
+	}
+	formatReplace := func(rep *modfile.Replace) string {
+		if rep.New.Version == "" {
+			return " => " + rep.New.Path
+		}
+		return " => " + rep.New.Path + " " + rep.New.Version
+	}
+	var paths []string
+	for modPath := range modules {
+		paths = append(paths, modPath)
+	}
+	sort.Strings(paths)
+	var sb strings.Builder
+	for _, modPath := range paths {
+		m := modules[modPath]
+		sb.WriteString("# " + m.path + " " + m.version)
+		if rep := findReplace(m.path, m.version); rep != nil {
+			sb.WriteString(formatReplace(rep))
+		}
+		sb.WriteString("\n")
+		var annotations []string
+		if m.explicit {
+			annotations = append(annotations, "explicit")
+		}
+		if m.goVersion != "" {
+			annotations = append(annotations, "go "+m.goVersion)
+		}
+		if len(annotations) > 0 {
+			sb.WriteString("## " + strings.Join(annotations, "; ") + "\n")
+		}
+		sort.Strings(m.packages)
+		for _, pkgPath := range m.packages {
+			sb.WriteString(pkgPath + "\n")
+		}
+	}
+	// Wildcard replacements are recorded on their own so the go command can verify go.mod.
+	for _, rep := range modFile.Replace {
+		if rep.Old.Version == "" {
+			sb.WriteString("# " + rep.Old.Path + formatReplace(rep) + "\n")
+		}
+	}
+	return sb.String()
+}
+// copyPackageDir copies the non-test files of a package directory (and its embedded files)
+// into dstDir, mirroring what `go mod vendor` keeps.
+func copyPackageDir(srcDir, dstDir string, embedFiles []string) error {
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasSuffix(name, "_test.go") || name == "go.mod" || name == "go.sum" {
+			continue
+		}
+		if err := copyFile(filepath.Join(srcDir, name), filepath.Join(dstDir, name)); err != nil {
+			return err
+		}
+	}
+	for _, embedded := range embedFiles {
+		rel, err := filepath.Rel(srcDir, embedded)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if err := copyFile(embedded, filepath.Join(dstDir, rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,82 @@
+package obfuscator
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+func TestMatchModulePattern(t *testing.T) {
+	cases := []struct {
+		pattern, modPath string
+		want             bool
+	}{
+		{"example.com/secret", "example.com/secret", true},
+		{"example.com/secret", "example.com/secretive", false},
+		{"example.com/...", "example.com/secret", true},
+		{"example.com/secret/...", "example.com/secret", true},
+		{"example.com/secret/...", "example.com/other", false},
+		{"corp.internal/*", "corp.internal/keys", true},
+		{"corp.internal/*", "corp.internal/keys/v2", false},
+	}
+	for _, c := range cases {
+		if got := matchModulePattern(c.pattern, c.modPath); got != c.want {
+			t.Errorf("matchModulePattern(%q, %q) = %v, want %v", c.pattern, c.modPath, got, c.want)
+		}
+	}
+}
+func TestProcessDirectory_VendorsObfuscatedDeps(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not available")
+	}
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"secret/go.mod":     "module example.com/secret\n\ngo 1.22\n",
+		"secret/secret.go":  "package secret\n\nfunc Key() string {\n\treturn \"topsecret-value\"\n}\n",
+		"secret/inner/i.go": "package inner\n\nfunc Label() string {\n\treturn \"inner-label\"\n}\n",
+		"app/go.mod":        "module example.com/app\n\ngo 1.24.4\n\nrequire example.com/secret v0.0.0\n\nreplace example.com/secret => ../secret\n",
+		"app/main.go":       "package main\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/secret\"\n\t\"example.com/secret/inner\"\n)\n\nfunc main() {\n\tfmt.Println(secret.Key(), inner.Label())\n}\n",
+	})
+	t.Setenv("GOFLAGS", "-mod=mod")
+	t.Setenv("GOPROXY", "off")
+	t.Setenv("GOWORK", "off")
+	input := filepath.Join(root, "app")
+	output := filepath.Join(root, "out")
+	cfg := &Config{EncryptStrings: true, ObfuscateDeps: []string{"example.com/secret/..."}}
+	if err := ProcessDirectory(input, output, cfg); err != nil {
+		t.Fatalf("ProcessDirectory failed: %v", err)
+	}
+	vendored, err := os.ReadFile(filepath.Join(output, "vendor", "example.com", "secret", "secret.go"))
+	if err != nil {
+		t.Fatalf("Vendored dependency missing: %v", err)
+	}
+	if strings.Contains(string(vendored), "topsecret-value") {
+		t.Errorf("Vendored dependency should have its strings encrypted")
+	}
+	modulesTxt, err := os.ReadFile(filepath.Join(output, "vendor", "modules.txt"))
+	if err != nil {
+		t.Fatalf("vendor/modules.txt missing: %v", err)
+	}
+	for _, want := range []string{
+		"# example.com/secret v0.0.0 => ./vendor/example.com/secret\n## explicit; go 1.22\n",
+		"example.com/secret/inner\n",
+		"# example.com/secret => ./vendor/example.com/secret\n",
+	} {
+		if !strings.Contains(string(modulesTxt), want) {
+			t.Errorf("modules.txt is missing %q:\n%s", want, modulesTxt)
+		}
+	}
+	goMod, err := os.ReadFile(filepath.Join(output, "go.mod"))
+	if err != nil {
+		t.Fatalf("go.mod missing in output: %v", err)
+	}
+	if !strings.Contains(string(goMod), "=> ./vendor/example.com/secret") {
+		t.Errorf("go.mod replacement was not rewritten:\n%s", goMod)
+	}
+	build := exec.Command("go", "build", "-o", os.DevNull, ".")
+	build.Dir = output
+	build.Env = append(os.Environ(), "GOFLAGS=-mod=vendor")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("Obfuscated module with vendored deps does not build: %v\n%s", err, out)
+	}
+}
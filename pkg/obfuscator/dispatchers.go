@@ -0,0 +1,291 @@
+package obfuscator
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+	"golang.org/x/tools/go/ast/astutil"
+)
+// DispatcherBackend selects the shape of the code that runs the states of a flattened function.
+type DispatcherBackend string
+const (
+	// DispatcherSwitch is a `for { switch state { ... } }` loop.
+	DispatcherSwitch DispatcherBackend = "switch"
+	// DispatcherGoto labels every state and jumps to it from a chain of comparisons.
+	DispatcherGoto DispatcherBackend = "goto"
+	// DispatcherClosures calls the state from a table of closures. Functions whose states return
+	// values, defer or recover cannot be split into closures and use DispatcherSwitch instead.
+	DispatcherClosures DispatcherBackend = "closures"
+	// DispatcherIfTree finds the state by binary search in a tree of if statements.
+	DispatcherIfTree DispatcherBackend = "if-tree"
+	// DispatcherNested switches on a hash of the state, then on the state itself.
+	DispatcherNested DispatcherBackend = "nested"
+	// DispatcherRandom picks one of the others for every dispatcher.
+	DispatcherRandom DispatcherBackend = "random"
+)
+// DispatcherBackends lists the accepted backend names.
+var DispatcherBackends = []string{string(DispatcherSwitch), string(DispatcherGoto), string(DispatcherClosures), string(DispatcherIfTree), string(DispatcherNested), string(DispatcherRandom)}
+// dispatcherDirective selects the backend of one function: `//obf:dispatcher goto`.
+const dispatcherDirective = "//obf:dispatcher"
+// ParseDispatcherBackend validates a backend name coming from the command line or a directive.
+func ParseDispatcherBackend(s string) (DispatcherBackend, error) {
+	if s == "" {
+		return DispatcherRandom, nil
+	}
+	for _, name := range DispatcherBackends {
+		if s == name {
+			return DispatcherBackend(s), nil
+		}
+	}
+	return "", fmt.Errorf("unknown dispatcher backend %q", s)
+}
+// functionBackend returns the backend requested by the directive in the doc comment of a
+// function, or def.
+func functionBackend(name string, doc *ast.CommentGroup, def DispatcherBackend) DispatcherBackend {
+	if doc == nil {
+		return def
+	}
+	for _, c := range doc.List {
+		arg, ok := strings.CutPrefix(c.Text, dispatcherDirective+" ")
+		if !ok {
+			continue
+		}
+		backend, err := ParseDispatcherBackend(strings.TrimSpace(arg))
+		if err != nil {
+			fmt.Printf("    - Ignoring directive of %s: %v\n", name, err)
+			return def
+		}
+		return backend
+	}
+	return def
+}
+// build returns the statements running the states with the given backend. The state cases are
+// taken from d.clauses and d.junk, which by now hold the final code of every state.
+func (d *dispatcher) build(backend DispatcherBackend) []ast.Stmt {
+	if backend == DispatcherRandom || backend == "" {
+		choices := []DispatcherBackend{DispatcherSwitch, DispatcherGoto, DispatcherIfTree, DispatcherNested}
+		if d.splittable() {
+			choices = append(choices, DispatcherClosures)
+		}
+		backend = choices[randInt(int64(len(choices)))]
+	}
+	switch backend {
+	case DispatcherGoto:
+		return d.gotoChain()
+	case DispatcherClosures:
+		if d.splittable() {
+			return d.closureTable()
+		}
+	case DispatcherIfTree:
+		return d.loopOver(d.ifTree(d.sortedCases()))
+	case DispatcherNested:
+		return d.loopOver(d.nestedSwitch())
+	}
+	return d.loopOver(&ast.SwitchStmt{Tag: ast.NewIdent(d.state), Body: &ast.BlockStmt{List: d.shuffledCases()}})
+}
+// allCases returns the state cases followed by the junk ones.
+func (d *dispatcher) allCases() []*ast.CaseClause {
+	return append(append([]*ast.CaseClause{}, d.clauses...), d.junk...)
+}
+func (d *dispatcher) shuffledCases() []ast.Stmt {
+	cases := d.allCases()
+	var stmts []ast.Stmt
+	for _, i := range randomPermutation(len(cases)) {
+		stmts = append(stmts, cases[i])
+	}
+	return stmts
+}
+func (d *dispatcher) sortedCases() []*ast.CaseClause {
+	cases := d.allCases()
+	sort.Slice(cases, func(i, j int) bool { return caseCode(cases[i]) < caseCode(cases[j]) })
+	return cases
+}
+// caseCode returns the state selecting a case.
+func caseCode(c *ast.CaseClause) uint32 {
+	v, _ := strconv.ParseUint(c.List[0].(*ast.BasicLit).Value, 0, 32)
+	return uint32(v)
+}
+// loopOver wraps a statement selecting the state in the dispatcher loop, labeled if code nested
+// in the states restarts it.
+func (d *dispatcher) loopOver(selector ast.Stmt) []ast.Stmt {
+	var loop ast.Stmt = &ast.ForStmt{Body: &ast.BlockStmt{List: []ast.Stmt{selector}}}
+	if len(d.continues) > 0 {
+		loop = &ast.LabeledStmt{Label: ast.NewIdent(d.label), Stmt: loop}
+	}
+	return []ast.Stmt{loop}
+}
+// ifTree searches the sorted cases by comparing the state with the first code of the upper half.
+func (d *dispatcher) ifTree(cases []*ast.CaseClause) ast.Stmt {
+	if len(cases) == 1 {
+		return &ast.BlockStmt{List: cases[0].Body}
+	}
+	mid := len(cases) / 2
+	return &ast.IfStmt{
+		Cond: &ast.BinaryExpr{X: ast.NewIdent(d.state), Op: token.LSS, Y: stateLiteral(caseCode(cases[mid]))},
+		Body: &ast.BlockStmt{List: []ast.Stmt{d.ifTree(cases[:mid])}},
+		Else: &ast.BlockStmt{List: []ast.Stmt{d.ifTree(cases[mid:])}},
+	}
+}
+// nestedSwitch groups the cases by (state ^ salt) % n and switches on the group first.
+func (d *dispatcher) nestedSwitch() ast.Stmt {
+	n := uint32(2 + randInt(3))
+	salt := uint32(randInt(1 << 32))
+	groups := make([][]ast.Stmt, n)
+	for _, i := range randomPermutation(len(d.allCases())) {
+		c := d.allCases()[i]
+		g := (caseCode(c) ^ salt) % n
+		groups[g] = append(groups[g], c)
+	}
+	var outer []ast.Stmt
+	for _, g := range randomPermutation(int(n)) {
+		if len(groups[g]) == 0 {
+			continue
+		}
+		outer = append(outer, &ast.CaseClause{
+			List: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(g)}},
+			Body: []ast.Stmt{&ast.SwitchStmt{Tag: ast.NewIdent(d.state), Body: &ast.BlockStmt{List: groups[g]}}},
+		})
+	}
+	hash := &ast.BinaryExpr{
+		X:  &ast.ParenExpr{X: &ast.BinaryExpr{X: ast.NewIdent(d.state), Op: token.XOR, Y: stateLiteral(salt)}},
+		Op: token.REM,
+		Y:  &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(int(n))},
+	}
+	return &ast.SwitchStmt{Tag: hash, Body: &ast.BlockStmt{List: outer}}
+}
+// gotoChain labels every state and reaches it from a chain of comparisons:
+//
+//	head: if state == c1 { goto L1 }; ...; goto head
+//	L1: { ...; goto head }
+//
+// Each state is a block of its own so that no jump crosses a declaration, and the
+// whole chain is one more so that later passes cannot insert any between labels.
+func (d *dispatcher) gotoChain() []ast.Stmt {
+	for _, c := range d.continues {
+		c.Tok = token.GOTO
+	}
+	var head, states []ast.Stmt
+	for _, i := range randomPermutation(len(d.allCases())) {
+		c := d.allCases()[i]
+		label := NewName()
+		head = append(head, &ast.IfStmt{
+			Cond: &ast.BinaryExpr{X: ast.NewIdent(d.state), Op: token.EQL, Y: c.List[0]},
+			Body: &ast.BlockStmt{List: []ast.Stmt{&ast.BranchStmt{Tok: token.GOTO, Label: ast.NewIdent(label)}}},
+		})
+		body := c.Body
+		if len(body) == 0 || !isReturn(body[len(body)-1]) {
+			body = append(body, &ast.BranchStmt{Tok: token.GOTO, Label: ast.NewIdent(d.label)})
+		}
+		states = append(states, &ast.LabeledStmt{Label: ast.NewIdent(label), Stmt: &ast.BlockStmt{List: body}})
+	}
+	head = append(head, &ast.BranchStmt{Tok: token.GOTO, Label: ast.NewIdent(d.label)})
+	head[0] = &ast.LabeledStmt{Label: ast.NewIdent(d.label), Stmt: head[0]}
+	return []ast.Stmt{&ast.BlockStmt{List: append(head, states...)}}
+}
+// closureTable turns every state into a closure reporting whether the function returned:
+//
+//	handlers := map[uint32]func() bool{c1: func() bool { ...; return false }, ...}
+//	for !handlers[state]() {}
+func (d *dispatcher) closureTable() []ast.Stmt {
+	continues := make(map[*ast.BranchStmt]bool)
+	for _, c := range d.continues {
+		continues[c] = true
+	}
+	boolLit := func(v bool) *ast.Ident { return ast.NewIdent(strconv.FormatBool(v)) }
+	table := NewName()
+	var elts []ast.Expr
+	for _, i := range randomPermutation(len(d.allCases())) {
+		c := d.allCases()[i]
+		body := &ast.BlockStmt{List: c.Body}
+		astutil.Apply(body, func(cursor *astutil.Cursor) bool {
+			switch n := cursor.Node().(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.ReturnStmt:
+				cursor.Replace(&ast.ReturnStmt{Return: n.Return, Results: []ast.Expr{boolLit(true)}})
+			case *ast.BranchStmt:
+				if continues[n] {
+					cursor.Replace(&ast.ReturnStmt{Results: []ast.Expr{boolLit(false)}})
+				}
+			}
+			return true
+		}, nil)
+		if len(body.List) == 0 || !isReturn(body.List[len(body.List)-1]) {
+			body.List = append(body.List, &ast.ReturnStmt{Results: []ast.Expr{boolLit(false)}})
+		}
+		elts = append(elts, &ast.KeyValueExpr{Key: c.List[0], Value: &ast.FuncLit{
+			Type: &ast.FuncType{Params: &ast.FieldList{}, Results: &ast.FieldList{List: []*ast.Field{{Type: ast.NewIdent("bool")}}}},
+			Body: body,
+		}})
+	}
+	tableType := &ast.MapType{Key: ast.NewIdent("uint32"), Value: &ast.FuncType{Params: &ast.FieldList{}, Results: &ast.FieldList{List: []*ast.Field{{Type: ast.NewIdent("bool")}}}}}
+	return []ast.Stmt{
+		&ast.AssignStmt{Lhs: []ast.Expr{ast.NewIdent(table)}, Tok: token.DEFINE, Rhs: []ast.Expr{&ast.CompositeLit{Type: tableType, Elts: elts}}},
+		&ast.ForStmt{
+			Cond: &ast.UnaryExpr{Op: token.NOT, X: &ast.CallExpr{Fun: &ast.IndexExpr{X: ast.NewIdent(table), Index: ast.NewIdent(d.state)}}},
+			Body: &ast.BlockStmt{},
+		},
+	}
+}
+// splittable reports whether the states can run as closures: they may only leave the function
+// through a plain return of a function without results, must not defer or recover, and may only
+// branch to labels inside themselves or back to the dispatcher.
+func (d *dispatcher) splittable() bool {
+	continues := make(map[*ast.BranchStmt]bool)
+	for _, c := range d.continues {
+		continues[c] = true
+	}
+	for _, c := range d.allCases() {
+		labels := make(map[string]bool)
+		for _, s := range c.Body {
+			ast.Inspect(s, func(n ast.Node) bool {
+				if ls, ok := n.(*ast.LabeledStmt); ok {
+					labels[ls.Label.Name] = true
+				}
+				return true
+			})
+		}
+		ok := true
+		for _, s := range c.Body {
+			ast.Inspect(s, func(n ast.Node) bool {
+				switch n := n.(type) {
+				case *ast.FuncLit:
+					return false
+				case *ast.DeferStmt:
+					ok = false
+				case *ast.ReturnStmt:
+					ok = ok && d.void && len(n.Results) == 0
+				case *ast.BranchStmt:
+					ok = ok && (n.Label == nil || continues[n] || labels[n.Label.Name])
+				case *ast.CallExpr:
+					if id, isIdent := n.Fun.(*ast.Ident); isIdent && id.Name == "recover" {
+						ok = false
+					}
+				}
+				return ok
+			})
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+func isReturn(s ast.Stmt) bool {
+	_, ok := s.(*ast.ReturnStmt)
+	return ok
+}
+// randomPermutation returns the integers 0..n-1 in random order.
+func randomPermutation(n int) []int {
+	p := make([]int, n)
+	for i := range p {
+		p[i] = i
+	}
+	for i := n - 1; i > 0; i-- {
+		j := int(randInt(int64(i + 1)))
+		p[i], p[j] = p[j], p[i]
+	}
+	return p
+}
@@ -0,0 +1,630 @@
+package obfuscator
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+// embedAsset is a file to write next to a package's sources in the output tree.
+type embedAsset struct {
+	rel  string // slash-separated path relative to the package directory
+	data []byte
+}
+// packageAssets collects the output files of one package produced by EmbedAssetsPass.
+type packageAssets struct {
+	files []embedAsset
+	// consumed lists the original embedded files (relative to the package directory) that are
+	// now only present in encrypted form and must not be copied to the output.
+	consumed []string
+}
+// EmbedAssetsPass encrypts the files behind //go:embed variables of type string, []byte and
+// embed.FS. The directive is redirected to the encrypted copies and the variable is rebuilt from
+// them: strings and byte slices are decrypted at initialization, embed.FS becomes an fs.FS
+// wrapper that decrypts each file on read.
+type EmbedAssetsPass struct{}
+// embedVar is a variable initialized by a //go:embed directive.
+type embedVar struct {
+	file      *ast.File
+	decl      *ast.GenDecl
+	spec      *ast.ValueSpec
+	directive *ast.Comment
+	obj       *types.Var
+	kind      string // "string", "bytes" or "fs"
+	files     []string
+}
+// embedState is the per-package state of the pass.
+type embedState struct {
+	obf       *Obfuscator
+	pkg       *packages.Package
+	decName   string
+	wrapName  string
+	cases     []*ast.CaseClause
+	imports   map[string]bool
+	nextIndex int
+	rawDecls  []string
+}
+func (p *EmbedAssetsPass) Apply(obf *Obfuscator, pkg *packages.Package) error {
+	if pkg.TypesInfo == nil || len(pkg.GoFiles) == 0 {
+		return nil
+	}
+	dir := filepath.Dir(pkg.GoFiles[0])
+	vars, err := findEmbedVars(pkg, dir)
+	if err != nil {
+		return err
+	}
+	if len(vars) == 0 {
+		return nil
+	}
+	assets := obf.assetsFor(pkg)
+	st := &embedState{obf: obf, pkg: pkg, decName: NewName(), wrapName: NewName(), imports: make(map[string]bool)}
+	kept := make(map[string]bool)
+	var rewritten []*embedVar
+	var host *ast.File
+	for _, v := range vars {
+		if reason := embedRewriteBlocker(pkg, v); reason != "" {
+			fmt.Printf("    - Embedded variable %s kept in plaintext: %s\n", v.obj.Name(), reason)
+			for _, f := range v.files {
+				kept[f] = true
+			}
+			continue
+		}
+		if err := st.rewrite(v, dir, assets); err != nil {
+			return err
+		}
+		rewritten = append(rewritten, v)
+		if host == nil {
+			host = v.file
+		}
+	}
+	// Files still embedded in plaintext are copied as is; the others must not reach the output.
+	for f := range kept {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(f)))
+		if err != nil {
+			return err
+		}
+		assets.files = append(assets.files, embedAsset{rel: f, data: data})
+	}
+	for _, v := range rewritten {
+		for _, f := range v.files {
+			if !kept[f] {
+				assets.consumed = append(assets.consumed, f)
+			}
+		}
+	}
+	if host == nil {
+		return nil
+	}
+	for _, v := range rewritten {
+		dropUnusedImport(pkg.Fset, v.file, "embed")
+	}
+	assets.files = append(assets.files, embedAsset{
+		rel:  NewName() + ".go",
+		data: []byte(fmt.Sprintf("package %s\n\nimport \"embed\"\n\n%s\n", pkg.Name, strings.Join(st.rawDecls, "\n\n"))),
+	})
+	return st.emit(host)
+}
+// findEmbedVars returns the package-level variables initialized by //go:embed, with the files
+// their patterns resolve to.
+func findEmbedVars(pkg *packages.Package, dir string) ([]*embedVar, error) {
+	var vars []*embedVar
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				vs := spec.(*ast.ValueSpec)
+				doc := vs.Doc
+				if doc == nil && len(gd.Specs) == 1 {
+					doc = gd.Doc
+				}
+				directive, patterns := embedDirective(doc)
+				if directive == nil || len(vs.Names) != 1 || len(vs.Values) != 0 {
+					continue
+				}
+				obj, ok := pkg.TypesInfo.Defs[vs.Names[0]].(*types.Var)
+				if !ok {
+					continue
+				}
+				v := &embedVar{file: file, decl: gd, spec: vs, directive: directive, obj: obj, kind: embedKind(obj.Type())}
+				if v.kind == "" {
+					continue
+				}
+				files, err := resolveEmbedPatterns(dir, patterns)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", pkg.Fset.Position(directive.Pos()), err)
+				}
+				v.files = files
+				vars = append(vars, v)
+			}
+		}
+	}
+	return vars, nil
+}
+// embedDirective returns the //go:embed comment of a doc group and its patterns.
+func embedDirective(doc *ast.CommentGroup) (*ast.Comment, []string) {
+	if doc == nil {
+		return nil, nil
+	}
+	var directive *ast.Comment
+	var patterns []string
+	for _, c := range doc.List {
+		rest, ok := strings.CutPrefix(c.Text, "//go:embed")
+		if !ok || (rest != "" && rest[0] != ' ' && rest[0] != '\t') {
+			continue
+		}
+		if directive != nil {
+			// Several directives on one variable: leave it alone.
+			return nil, nil
+		}
+		directive = c
+		for _, field := range strings.Fields(rest) {
+			if unquoted, err := strconv.Unquote(field); err == nil {
+				field = unquoted
+			}
+			patterns = append(patterns, field)
+		}
+	}
+	return directive, patterns
+}
+// embedKind classifies the type of an embed variable.
+func embedKind(t types.Type) string {
+	if named, ok := t.(*types.Named); ok {
+		if obj := named.Obj(); obj.Pkg() != nil && obj.Pkg().Path() == "embed" && obj.Name() == "FS" {
+			return "fs"
+		}
+		return ""
+	}
+	switch u := t.(type) {
+	case *types.Basic:
+		if u.Kind() == types.String {
+			return "string"
+		}
+	case *types.Slice:
+		if b, ok := u.Elem().(*types.Basic); ok && b.Kind() == types.Byte {
+			return "bytes"
+		}
+	}
+	return ""
+}
+// resolveEmbedPatterns expands //go:embed patterns like the go command: directories are walked
+// recursively, skipping names starting with '.' or '_' unless the pattern has the "all:" prefix.
+func resolveEmbedPatterns(dir string, patterns []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var files []string
+	for _, pattern := range patterns {
+		all := false
+		if rest, ok := strings.CutPrefix(pattern, "all:"); ok {
+			pattern, all = rest, true
+		}
+		matches, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(pattern)))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("pattern %s: no matching files found", pattern)
+		}
+		for _, match := range matches {
+			err := filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				name := info.Name()
+				if path != match && !all && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if info.IsDir() || !info.Mode().IsRegular() {
+					return nil
+				}
+				rel, err := filepath.Rel(dir, path)
+				if err != nil {
+					return err
+				}
+				rel = filepath.ToSlash(rel)
+				if !seen[rel] {
+					seen[rel] = true
+					files = append(files, rel)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+// embedRewriteBlocker explains why an embed variable cannot be rewritten, or returns "".
+// Strings and byte slices keep their type; an embed.FS becomes a pointer to the wrapper, so every
+// use must go through Open/ReadFile/ReadDir or an interface.
+func embedRewriteBlocker(pkg *packages.Package, v *embedVar) string {
+	if v.kind != "fs" {
+		return ""
+	}
+	if v.obj.Exported() && pkg.Name != "main" {
+		return "exported embed.FS may be used by other packages"
+	}
+	for _, file := range pkg.Syntax {
+		blocker := ""
+		walkWithStack(file, func(n ast.Node, stack []ast.Node) {
+			ident, ok := n.(*ast.Ident)
+			if !ok || blocker != "" || pkg.TypesInfo.Uses[ident] != v.obj {
+				return
+			}
+			if !usedAsFS(pkg.TypesInfo, ident, stack) {
+				blocker = fmt.Sprintf("used as embed.FS at %s", pkg.Fset.Position(ident.Pos()))
+			}
+		})
+		if blocker != "" {
+			return blocker
+		}
+	}
+	return ""
+}
+// usedAsFS reports whether a use of an embed.FS variable still compiles with the wrapper.
+func usedAsFS(info *types.Info, ident *ast.Ident, stack []ast.Node) bool {
+	if len(stack) < 2 {
+		return false
+	}
+	switch parent := stack[len(stack)-2].(type) {
+	case *ast.SelectorExpr:
+		switch parent.Sel.Name {
+		case "Open", "ReadFile", "ReadDir":
+			return true
+		}
+	case *ast.CallExpr:
+		sig, ok := info.TypeOf(parent.Fun).(*types.Signature)
+		if !ok {
+			return false
+		}
+		for i, arg := range parent.Args {
+			if arg != ident {
+				continue
+			}
+			params := sig.Params()
+			var t types.Type
+			switch {
+			case sig.Variadic() && i >= params.Len()-1:
+				t = params.At(params.Len() - 1).Type().(*types.Slice).Elem()
+			case i < params.Len():
+				t = params.At(i).Type()
+			default:
+				return false
+			}
+			return types.IsInterface(t)
+		}
+	}
+	return false
+}
+// rewrite encrypts the files of one variable and redirects its directive to the ciphertext.
+func (st *embedState) rewrite(v *embedVar, dir string, assets *packageAssets) error {
+	assetDir := NewName()
+	base := st.nextIndex
+	if v.kind == "fs" {
+		if err := st.addAsset(assetDir+"/m", []byte(strings.Join(v.files, "\n")), assets); err != nil {
+			return err
+		}
+	}
+	for _, f := range v.files {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(f)))
+		if err != nil {
+			return err
+		}
+		name := strconv.Itoa(st.nextIndex - base)
+		if v.kind != "fs" {
+			name = "0"
+		}
+		if err := st.addAsset(assetDir+"/"+name, data, assets); err != nil {
+			return err
+		}
+	}
+	// The raw ciphertext variables live in a generated file written with the assets, where
+	// no later pass can separate a directive from its variable.
+	rawName := NewName()
+	var value string
+	switch v.kind {
+	case "fs":
+		st.rawDecls = append(st.rawDecls, fmt.Sprintf("//go:embed %s\nvar %s embed.FS", assetDir, rawName))
+		value = fmt.Sprintf("&%s{raw: %s, dir: %q, base: %d}", st.wrapName, rawName, assetDir, base)
+		v.spec.Type = nil
+	case "string":
+		st.rawDecls = append(st.rawDecls, fmt.Sprintf("//go:embed %s/0\nvar %s []byte", assetDir, rawName))
+		value = fmt.Sprintf("string(%s(%d, append([]byte(nil), %s...)))", st.decName, base, rawName)
+	default:
+		st.rawDecls = append(st.rawDecls, fmt.Sprintf("//go:embed %s/0\nvar %s []byte", assetDir, rawName))
+		value = fmt.Sprintf("%s(%d, append([]byte(nil), %s...))", st.decName, base, rawName)
+	}
+	expr, err := parser.ParseExpr(value)
+	if err != nil {
+		return fmt.Errorf("failed to parse embed initializer: %w", err)
+	}
+	pinPositions(expr, v.spec.Names[0].End())
+	v.spec.Values = []ast.Expr{expr}
+	removeComment(v.file, v.directive)
+	fmt.Printf("    - Encrypted %d embedded file(s) of %s\n", len(v.files), v.obj.Name())
+	return nil
+}
+// removeComment deletes c from the comments of file.
+func removeComment(file *ast.File, c *ast.Comment) {
+	for gi, group := range file.Comments {
+		for i, other := range group.List {
+			if other != c {
+				continue
+			}
+			group.List = append(group.List[:i], group.List[i+1:]...)
+			if len(group.List) == 0 {
+				file.Comments = append(file.Comments[:gi], file.Comments[gi+1:]...)
+				ast.Inspect(file, func(n ast.Node) bool {
+					switch d := n.(type) {
+					case *ast.GenDecl:
+						if d.Doc == group {
+							d.Doc = nil
+						}
+					case *ast.FuncDecl:
+						if d.Doc == group {
+							d.Doc = nil
+						}
+					case *ast.ValueSpec:
+						if d.Doc == group {
+							d.Doc = nil
+						}
+					}
+					return true
+				})
+			}
+			return
+		}
+	}
+}
+// addAsset encrypts data under the next decryptor index and schedules it for writing.
+func (st *embedState) addAsset(rel string, data []byte, assets *packageAssets) error {
+	cipher, keys := st.obf.dataCipher()
+	enc, err := cipher.Encrypt(data, keys)
+	if err != nil {
+		return err
+	}
+	for _, path := range enc.Imports {
+		st.imports[path] = true
+	}
+	st.cases = append(st.cases, &ast.CaseClause{
+		List: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(st.nextIndex)}},
+		Body: enc.Decrypt(st.obf, "buf"),
+	})
+	st.nextIndex++
+	assets.files = append(assets.files, embedAsset{rel: rel, data: enc.Ciphertext})
+	return nil
+}
+// emit adds the decryptor and, if needed, the fs.FS wrapper to file.
+func (st *embedState) emit(file *ast.File) error {
+	src := fmt.Sprintf(embedRuntimeTemplate, st.decName, st.wrapName, NewName(), NewName())
+	// Without objects, RenameIdentifiers leaves buf alone in the template as in the cases.
+	parsed, err := parser.ParseFile(token.NewFileSet(), "embed_runtime.go", src, parser.SkipObjectResolution)
+	if err != nil {
+		return fmt.Errorf("failed to parse embed runtime: %w", err)
+	}
+	stripPositions(parsed)
+	for _, decl := range parsed.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Name.Name == st.decName {
+			fn.Body.List[0].(*ast.SwitchStmt).Body.List = caseStmts(st.cases)
+		}
+	}
+	for _, path := range []string{"bytes", "io", "io/fs", "path", "sort", "strconv", "strings", "sync", "time"} {
+		st.imports[path] = true
+	}
+	paths := make([]string, 0, len(st.imports))
+	for path := range st.imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		astutil.AddImport(st.pkg.Fset, file, path)
+	}
+	appendDecls(file, parsed.Decls)
+	return nil
+}
+func caseStmts(cases []*ast.CaseClause) []ast.Stmt {
+	stmts := make([]ast.Stmt, len(cases))
+	for i, c := range cases {
+		stmts[i] = c
+	}
+	return stmts
+}
+// assetsFor returns the asset list of pkg, creating it on first use.
+func (obf *Obfuscator) assetsFor(pkg *packages.Package) *packageAssets {
+	if obf.assets == nil {
+		obf.assets = make(map[*packages.Package]*packageAssets)
+	}
+	if obf.assets[pkg] == nil {
+		obf.assets[pkg] = &packageAssets{}
+	}
+	return obf.assets[pkg]
+}
+// writeAssets writes the assets of pkg into the output tree and removes plaintext copies of
+// files that are now embedded encrypted.
+func (obf *Obfuscator) writeAssets(pkg *packages.Package, inputPath, outputPath string) error {
+	assets := obf.assets[pkg]
+	if assets == nil || len(pkg.GoFiles) == 0 {
+		return nil
+	}
+	rel, err := filepath.Rel(inputPath, filepath.Dir(pkg.GoFiles[0]))
+	if err != nil {
+		return err
+	}
+	pkgOut := filepath.Join(outputPath, rel)
+	for _, f := range assets.consumed {
+		if err := os.Remove(filepath.Join(pkgOut, filepath.FromSlash(f))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, asset := range assets.files {
+		target := filepath.Join(pkgOut, filepath.FromSlash(asset.rel))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, asset.data, 0644); err != nil {
+			return fmt.Errorf("failed to write asset %s: %w", target, err)
+		}
+	}
+	return nil
+}
+// embedRuntimeTemplate is the decryptor (%[1]s) and the fs.FS wrapper (%[2]s, with its file
+// type %[3]s and file info type %[4]s) emitted into packages with encrypted embeds.
+const embedRuntimeTemplate = `package p
+func %[1]s(i int, buf []byte) []byte {
+	switch i {
+	}
+	return buf
+}
+type %[2]s struct {
+	raw   fs.ReadFileFS
+	dir   string
+	base  int
+	once  sync.Once
+	files map[string]int
+}
+func (f *%[2]s) load() {
+	f.once.Do(func() {
+		raw, err := f.raw.ReadFile(f.dir + "/m")
+		if err != nil {
+			panic(err)
+		}
+		f.files = make(map[string]int)
+		for i, name := range strings.Split(string(%[1]s(f.base, raw)), "\n") {
+			f.files[name] = i + 1
+		}
+	})
+}
+func (f *%[2]s) ReadFile(name string) ([]byte, error) {
+	f.load()
+	i, ok := f.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	raw, err := f.raw.ReadFile(f.dir + "/" + strconv.Itoa(i))
+	if err != nil {
+		return nil, err
+	}
+	return %[1]s(f.base+i, raw), nil
+}
+func (f *%[2]s) ReadDir(name string) ([]fs.DirEntry, error) {
+	f.load()
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	seen := make(map[string]bool)
+	var entries []fs.DirEntry
+	for file := range f.files {
+		rel := file
+		if name != "." {
+			if !strings.HasPrefix(file, name+"/") {
+				continue
+			}
+			rel = file[len(name)+1:]
+		}
+		child, _, isDir := strings.Cut(rel, "/")
+		if seen[child] {
+			continue
+		}
+		seen[child] = true
+		entries = append(entries, fs.FileInfoToDirEntry(&%[4]s{fs: f, path: path.Join(name, child), dir: isDir}))
+	}
+	if len(entries) == 0 {
+		if _, ok := f.files[name]; ok {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+		}
+		if name != "." {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+func (f *%[2]s) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if data, err := f.ReadFile(name); err == nil {
+		return &%[3]s{info: &%[4]s{fs: f, path: name}, data: bytes.NewReader(data)}, nil
+	}
+	entries, err := f.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return &%[3]s{info: &%[4]s{fs: f, path: name, dir: true}, entries: entries}, nil
+}
+type %[3]s struct {
+	info    *%[4]s
+	data    *bytes.Reader
+	entries []fs.DirEntry
+	off     int
+}
+func (f *%[3]s) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *%[3]s) Read(p []byte) (int, error) {
+	if f.data == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.info.path, Err: fs.ErrInvalid}
+	}
+	return f.data.Read(p)
+}
+func (f *%[3]s) Seek(offset int64, whence int) (int64, error) {
+	if f.data == nil {
+		return 0, &fs.PathError{Op: "seek", Path: f.info.path, Err: fs.ErrInvalid}
+	}
+	return f.data.Seek(offset, whence)
+}
+func (f *%[3]s) ReadAt(p []byte, off int64) (int, error) {
+	if f.data == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.info.path, Err: fs.ErrInvalid}
+	}
+	return f.data.ReadAt(p, off)
+}
+func (f *%[3]s) Close() error { return nil }
+func (f *%[3]s) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.data != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: f.info.path, Err: fs.ErrInvalid}
+	}
+	rest := f.entries[f.off:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && len(rest) > n {
+		rest = rest[:n]
+	}
+	f.off += len(rest)
+	return rest, nil
+}
+type %[4]s struct {
+	fs   *%[2]s
+	path string
+	dir  bool
+}
+func (i *%[4]s) Name() string { return path.Base(i.path) }
+func (i *%[4]s) Size() int64 {
+	if i.dir {
+		return 0
+	}
+	data, _ := i.fs.ReadFile(i.path)
+	return int64(len(data))
+}
+func (i *%[4]s) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+func (i *%[4]s) ModTime() time.Time { return time.Time{} }
+func (i *%[4]s) IsDir() bool        { return i.dir }
+func (i *%[4]s) Sys() interface{}   { return nil }
+`
@@ -0,0 +1,122 @@
+package obfuscator
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+func TestEmbedAssetsPass_EncryptsAndDecryptsOnRead(t *testing.T) {
+	src := `package main
+import (
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+)
+//go:embed config.txt
+var config string
+//go:embed key.bin
+var key []byte
+//go:embed templates
+var templates embed.FS
+//go:embed plain.txt
+var plain embed.FS
+func show(fsys embed.FS) { fmt.Println(fsys != embed.FS{}) }
+func main() {
+	fmt.Print(config)
+	fmt.Println(key)
+	page, err := templates.ReadFile("templates/index.html")
+	fmt.Println(string(page), err)
+	fs.WalkDir(templates, ".", func(path string, d fs.DirEntry, err error) error {
+		info, _ := d.Info()
+		fmt.Println(path, d.IsDir(), info.Size())
+		return err
+	})
+	f, _ := templates.Open("templates/partials/footer.html")
+	data, _ := io.ReadAll(f)
+	fmt.Println(string(data))
+	_, err = templates.ReadFile("templates/missing.html")
+	fmt.Println(err != nil)
+	show(plain)
+}
+`
+	files := map[string]string{
+		"main.go":                        src,
+		"key.go":                         "package main\nvar weave_key_dummy int64\n",
+		"config.txt":                     "listen=127.0.0.1:8443\n",
+		"key.bin":                        "\x01\x02\x03secret-key",
+		"templates/index.html":           "<h1>top secret template</h1>",
+		"templates/partials/footer.html": "<footer>confidential footer</footer>",
+		"templates/.hidden":              "not embedded",
+		"plain.txt":                      "kept because embed.FS escapes",
+	}
+	want := "listen=127.0.0.1:8443\n[1 2 3 115 101 99 114 101 116 45 107 101 121]\n<h1>top secret template</h1> <nil>\n" +
+		". true 0\ntemplates true 0\ntemplates/index.html false 28\ntemplates/partials true 0\ntemplates/partials/footer.html false 36\n" +
+		"<footer>confidential footer</footer>\ntrue\ntrue\n"
+	pkg := loadTestPackage(t, files)
+	srcDir := filepath.Dir(pkg.GoFiles[0])
+	obf := &Obfuscator{WeavingKeyVarName: "weave_key_dummy"}
+	if err := (&EmbedAssetsPass{}).Apply(obf, pkg); err != nil {
+		t.Fatalf("EmbedAssetsPass.Apply failed: %v", err)
+	}
+	// The renaming of local variables runs over the decryptor too.
+	for i, file := range pkg.Syntax {
+		if strings.HasSuffix(pkg.GoFiles[i], "main.go") {
+			RenameIdentifiers(file)
+		}
+	}
+	outDir := t.TempDir()
+	writeTestFiles(t, outDir, map[string]string{"go.mod": "module testprog\n\ngo 1.24.4\n"})
+	if err := writePackageFiles(pkg.Fset, pkg, srcDir, outDir); err != nil {
+		t.Fatalf("writePackageFiles failed: %v", err)
+	}
+	if err := obf.writeAssets(pkg, srcDir, outDir); err != nil {
+		t.Fatalf("writeAssets failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "plain.txt")); err != nil {
+		t.Errorf("Expected the embed.FS passed as embed.FS to keep its plaintext file: %v", err)
+	}
+	filepath.Walk(outDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, ".go") {
+			return err
+		}
+		data, _ := os.ReadFile(path)
+		for _, secret := range []string{"127.0.0.1", "secret-key", "top secret", "confidential", "index.html", "footer.html"} {
+			if bytes.Contains(data, []byte(secret)) {
+				t.Errorf("Asset %s contains plaintext %q", path, secret)
+			}
+		}
+		return nil
+	})
+	if got := runGoDir(t, outDir); got != want {
+		t.Errorf("Output mismatch:\ngot  %q\nwant %q", got, want)
+	}
+}
+func TestResolveEmbedPatterns(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"a.txt": "", "b.txt": "", "static/x.css": "", "static/_skip.css": "", "static/.hidden/y": "",
+	})
+	tests := []struct {
+		patterns []string
+		want     string
+	}{
+		{[]string{"*.txt"}, "a.txt b.txt"},
+		{[]string{"static"}, "static/x.css"},
+		{[]string{"all:static"}, "static/.hidden/y static/_skip.css static/x.css"},
+		{[]string{"a.txt", "static/_skip.css"}, "a.txt static/_skip.css"},
+	}
+	for _, tt := range tests {
+		files, err := resolveEmbedPatterns(dir, tt.patterns)
+		if err != nil {
+			t.Fatalf("resolveEmbedPatterns(%v) failed: %v", tt.patterns, err)
+		}
+		if got := strings.Join(files, " "); got != tt.want {
+			t.Errorf("resolveEmbedPatterns(%v) = %q, want %q", tt.patterns, got, tt.want)
+		}
+	}
+	if _, err := resolveEmbedPatterns(dir, []string{"missing/*"}); err == nil {
+		t.Errorf("Expected an error for a pattern without matches")
+	}
+}
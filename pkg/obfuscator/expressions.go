@@ -1,45 +1,36 @@
 package obfuscator
 import (
 	"go/ast"
+	"go/constant"
 	"go/token"
 	"go/types"
+	"strconv"
 	"golang.org/x/tools/go/ast/astutil"
 )
-// ObfuscateExpressions traverses the AST and replaces simple binary expressions
-// with more complex, but functionally equivalent, forms.
-func ObfuscateExpressions(file *ast.File, info *types.Info) {
+// ObfuscateExpressions rewrites integer operations and comparisons over operands without side
+// effects into mixed boolean-arithmetic expressions, applied depth times, and boolean operators
+// into equivalent forms. Constant expressions are left alone. The type information is kept up to
+// date for the code it generates, so that later passes see it like any other.
+func ObfuscateExpressions(file *ast.File, info *types.Info, depth int) {
+	if info == nil {
+		return
+	}
 	astutil.Apply(file, func(cursor *astutil.Cursor) bool {
-		node := cursor.Node()
-		binaryExpr, ok := node.(*ast.BinaryExpr)
-		if !ok {
-			return true
-		}
-		if randInt(2) == 0 {
+		expr, ok := cursor.Node().(ast.Expr)
+		if !ok || randInt(2) == 0 {
 			return true
 		}
-		if info == nil {
+		if tv, ok := info.Types[expr]; !ok || tv.Value != nil {
 			return true
 		}
 		var newExpr ast.Expr
-		template := randInt(2)
-		// Check if it's an integer operation
-		if t, ok := info.TypeOf(binaryExpr.X).(*types.Basic); ok && t.Info()&types.IsInteger != 0 {
-			switch binaryExpr.Op {
-			case token.ADD:
-				newExpr = obfuscateAdd(binaryExpr.X, binaryExpr.Y, int(template))
-			case token.SUB:
-				newExpr = obfuscateSub(binaryExpr.X, binaryExpr.Y, int(template))
-			case token.XOR:
-				newExpr = obfuscateXor(binaryExpr.X, binaryExpr.Y, int(template))
-			}
-		}
-		// Check if it's a boolean operation
-		if t, ok := info.TypeOf(binaryExpr.X).(*types.Basic); ok && t.Info()&types.IsBoolean != 0 {
-			switch binaryExpr.Op {
-			case token.LAND:
-				newExpr = obfuscateLand(binaryExpr.X, binaryExpr.Y, int(template))
-			case token.LOR:
-				newExpr = obfuscateLor(binaryExpr.X, binaryExpr.Y, int(template))
+		switch e := expr.(type) {
+		case *ast.BinaryExpr:
+			newExpr = obfuscateBinary(e, info, depth)
+		case *ast.UnaryExpr:
+			if (e.Op == token.SUB || e.Op == token.XOR) && isIntegerType(info.TypeOf(e)) && pureExpr(e.X, info) {
+				g := &mbaGenerator{depth: depth}
+				newExpr = emitMBA(g.rewrite(e.Op, mbaArg(0), nil, depth), info, info.TypeOf(e), e.X)
 			}
 		}
 		if newExpr != nil {
@@ -49,73 +40,192 @@ func ObfuscateExpressions(file *ast.File, info *types.Info) {
 		return true
 	}, nil)
 }
-func obfuscateAdd(x, y ast.Expr, template int) ast.Expr {
-	switch template {
-	case 0:
-		// a + b -> (a ^ b) + 2 * (a & b)
-		return &ast.BinaryExpr{
-			X: &ast.ParenExpr{X: &ast.BinaryExpr{X: x, Op: token.XOR, Y: y}},
-			Op: token.ADD,
-			Y: &ast.BinaryExpr{
-				X:  &ast.BasicLit{Kind: token.INT, Value: "2"},
-				Op: token.MUL,
-				Y:  &ast.ParenExpr{X: &ast.BinaryExpr{X: x, Op: token.AND, Y: y}},
-			},
+// obfuscateBinary returns the rewriting of e, or nil. Operators the engine cannot express keep
+// their place with their operands disguised.
+func obfuscateBinary(e *ast.BinaryExpr, info *types.Info, depth int) ast.Expr {
+	xt, yt := info.Types[e.X], info.Types[e.Y]
+	if xt.Type == nil || yt.Type == nil {
+		return nil
+	}
+	if b, ok := xt.Type.Underlying().(*types.Basic); ok && b.Info()&types.IsBoolean != 0 {
+		template := int(randInt(2))
+		// The second template evaluates both operands, and the first one twice.
+		if template == 1 && !(pureExpr(e.X, info) && pureExpr(e.Y, info)) {
+			template = 0
 		}
-	default:
-		// a + b -> (a | b) + (a & b)
-		return &ast.BinaryExpr{
-			X: &ast.ParenExpr{X: &ast.BinaryExpr{X: x, Op: token.OR, Y: y}},
-			Op: token.ADD,
-			Y: &ast.ParenExpr{X: &ast.BinaryExpr{X: x, Op: token.AND, Y: y}},
+		switch e.Op {
+		case token.LAND:
+			return obfuscateLand(e.X, e.Y, template, info)
+		case token.LOR:
+			return obfuscateLor(e.X, e.Y, template, info)
 		}
+		return nil
 	}
+	g := &mbaGenerator{depth: depth, consts: make(map[int]bool)}
+	// operands returns the engine operands of x and y of type t, a constant being expressed
+	// through the other one.
+	operands := func() (*mbaNode, *mbaNode) {
+		x, y := mbaArg(0), mbaArg(1)
+		switch {
+		case xt.Value != nil:
+			g.consts[0] = true
+			x = g.constant(y, x)
+		case yt.Value != nil:
+			g.consts[1] = true
+			y = g.constant(x, y)
+		}
+		return x, y
+	}
+	switch e.Op {
+	case token.ADD, token.SUB, token.MUL, token.AND, token.OR, token.XOR, token.AND_NOT:
+		t := info.TypeOf(e)
+		if !isIntegerType(t) || !pureExpr(e.X, info) || !pureExpr(e.Y, info) {
+			return nil
+		}
+		x, y := operands()
+		return emitMBA(g.rewrite(e.Op, x, y, depth), info, t, e.X, e.Y)
+	case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+		t := xt.Type
+		if xt.Value != nil {
+			t = yt.Type
+		}
+		if !isIntegerType(t) || !pureExpr(e.X, info) || !pureExpr(e.Y, info) {
+			return nil
+		}
+		x, y := operands()
+		return emitCondition(g.compare(e.Op, x, y, isSignedInteger(t)), info, t, info.TypeOf(e), e.X, e.Y)
+	case token.QUO, token.REM, token.SHL, token.SHR:
+		if !isIntegerType(xt.Type) || !isIntegerType(yt.Type) {
+			return nil
+		}
+		x, y := e.X, e.Y
+		if xt.Value == nil && pureExpr(x, info) {
+			other := g.other(mbaArg(0))
+			if e.Op == token.QUO || e.Op == token.REM {
+				if yt.Value == nil && pureExpr(y, info) {
+					other = mbaArg(1)
+				}
+			}
+			x = emitMBA(g.identity(mbaArg(0), other, depth), info, xt.Type, e.X, e.Y)
+		}
+		if yt.Value == nil && pureExpr(y, info) {
+			y = emitMBA(g.identity(mbaArg(0), g.other(mbaArg(0)), depth), info, yt.Type, e.Y)
+		}
+		if x == e.X && y == e.Y {
+			return nil
+		}
+		out := &ast.BinaryExpr{X: x, Op: e.Op, Y: y}
+		info.Types[out] = info.Types[e]
+		return out
+	}
+	return nil
 }
-func obfuscateSub(x, y ast.Expr, template int) ast.Expr {
-	switch template {
-	case 0:
-		// a - b -> a + ^b + 1
-		return &ast.BinaryExpr{
-			X:  &ast.BinaryExpr{X: x, Op: token.ADD, Y: &ast.UnaryExpr{Op: token.XOR, X: y}},
-			Op: token.ADD,
-			Y:  &ast.BasicLit{Kind: token.INT, Value: "1"},
+// pureExpr reports whether evaluating e several times is the same as evaluating it once: it
+// reads variables, fields, elements and constants, but calls nothing and receives nothing.
+func pureExpr(e ast.Expr, info *types.Info) bool {
+	switch e := e.(type) {
+	case *ast.Ident, *ast.BasicLit:
+		return true
+	case *ast.ParenExpr:
+		return pureExpr(e.X, info)
+	case *ast.SelectorExpr:
+		if sel := info.Selections[e]; sel != nil && sel.Kind() != types.FieldVal {
+			return false
 		}
+		return pureExpr(e.X, info)
+	case *ast.StarExpr:
+		return pureExpr(e.X, info)
+	case *ast.IndexExpr:
+		return pureExpr(e.X, info) && pureExpr(e.Index, info)
+	case *ast.UnaryExpr:
+		return e.Op != token.ARROW && pureExpr(e.X, info)
+	case *ast.BinaryExpr:
+		return pureExpr(e.X, info) && pureExpr(e.Y, info)
+	case *ast.CallExpr:
+		// Conversions only.
+		return info.Types[e.Fun].IsType() && len(e.Args) == 1 && pureExpr(e.Args[0], info)
+	}
+	return false
+}
+// emitMBA returns the syntax of n, of type t, over the given operands, recording its types.
+func emitMBA(n *mbaNode, info *types.Info, t types.Type, args ...ast.Expr) ast.Expr {
+	var expr ast.Expr
+	switch n.op {
+	case token.ILLEGAL:
+		return cloneExpr(args[n.arg], info)
+	case token.INT:
+		lit := &ast.BasicLit{Kind: token.INT, Value: strconv.FormatUint(n.c, 10)}
+		info.Types[lit] = types.TypeAndValue{Type: t, Value: constant.MakeUint64(n.c)}
+		return lit
+	}
+	if n.y == nil {
+		expr = &ast.UnaryExpr{Op: n.op, X: parenthesize(emitMBA(n.x, info, t, args...), info)}
+	} else {
+		expr = &ast.BinaryExpr{X: parenthesize(emitMBA(n.x, info, t, args...), info), Op: n.op, Y: parenthesize(emitMBA(n.y, info, t, args...), info)}
+	}
+	info.Types[expr] = types.TypeAndValue{Type: t}
+	return expr
+}
+// emitCondition returns the syntax of c over operands of type t, the comparison being of type
+// result.
+func emitCondition(c mbaCondition, info *types.Info, t, result types.Type, args ...ast.Expr) ast.Expr {
+	op := token.EQL
+	var bound *mbaNode
+	switch {
+	case !c.sign:
+		bound = mbaConst(0)
+	case isSignedInteger(t):
+		op, bound = token.LSS, mbaConst(0)
 	default:
-		// a - b -> (a^b) - 2*(!a & b)
-		return &ast.BinaryExpr{
-			X: &ast.ParenExpr{X: &ast.BinaryExpr{X: x, Op: token.XOR, Y: y}},
-			Op: token.SUB,
-			Y: &ast.BinaryExpr{
-				X:  &ast.BasicLit{Kind: token.INT, Value: "2"},
-				Op: token.MUL,
-				Y: &ast.ParenExpr{X: &ast.BinaryExpr{
-					X:  &ast.UnaryExpr{Op: token.XOR, X: x},
-					Op: token.AND,
-					Y:  y,
-				}},
-			},
+		// The largest value without the sign bit, over an operand so that its type is t.
+		typed := mbaArg(0)
+		if info.Types[args[0]].Value != nil {
+			typed = mbaArg(1)
 		}
+		op, bound = token.GTR, mbaBinary(token.SHR, mbaUnary(token.XOR, mbaBinary(token.AND_NOT, typed, typed)), mbaConst(1))
+	}
+	if c.negate {
+		op = map[token.Token]token.Token{token.EQL: token.NEQ, token.LSS: token.GEQ, token.GTR: token.LEQ}[op]
 	}
+	expr := &ast.BinaryExpr{X: parenthesize(emitMBA(c.e, info, t, args...), info), Op: op, Y: parenthesize(emitMBA(bound, info, t, args...), info)}
+	info.Types[expr] = types.TypeAndValue{Type: result}
+	return expr
 }
-func obfuscateXor(x, y ast.Expr, template int) ast.Expr {
-	switch template {
-	case 0:
-		// a ^ b -> (a | b) &^ (a & b)
-		return &ast.BinaryExpr{
-			X:  &ast.ParenExpr{X: &ast.BinaryExpr{X: x, Op: token.OR, Y: y}},
-			Op: token.AND_NOT,
-			Y:  &ast.ParenExpr{X: &ast.BinaryExpr{X: x, Op: token.AND, Y: y}},
+func parenthesize(e ast.Expr, info *types.Info) ast.Expr {
+	switch e.(type) {
+	case *ast.BinaryExpr, *ast.UnaryExpr:
+		paren := &ast.ParenExpr{X: e}
+		info.Types[paren] = info.Types[e]
+		return paren
+	}
+	return e
+}
+// cloneExpr copies e with its type information.
+func cloneExpr(e ast.Expr, info *types.Info) ast.Expr {
+	clones := make(map[ast.Node]ast.Node)
+	c := cloneNode(e, clones).(ast.Expr)
+	for n, copied := range clones {
+		expr, ok := n.(ast.Expr)
+		if !ok {
+			continue
 		}
-	default:
-		// a ^ b -> (a &^ b) | (b &^ a)
-		return &ast.BinaryExpr{
-			X:  &ast.ParenExpr{X: &ast.BinaryExpr{X: x, Op: token.AND_NOT, Y: y}},
-			Op: token.OR,
-						Y:  &ast.ParenExpr{X: &ast.BinaryExpr{X: y, Op: token.AND_NOT, Y: x}},
+		if tv, ok := info.Types[expr]; ok {
+			info.Types[copied.(ast.Expr)] = tv
+		}
+		if id, ok := n.(*ast.Ident); ok {
+			if obj := info.Uses[id]; obj != nil {
+				info.Uses[copied.(*ast.Ident)] = obj
+			}
+		}
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if s := info.Selections[sel]; s != nil {
+				info.Selections[copied.(*ast.SelectorExpr)] = s
+			}
 		}
 	}
+	return c
 }
-func obfuscateLand(x, y ast.Expr, template int) ast.Expr {
+func obfuscateLand(x, y ast.Expr, template int, info *types.Info) ast.Expr {
 	switch template {
 	case 0:
 		// a && b -> !(!a || !b)
@@ -134,11 +244,11 @@ func obfuscateLand(x, y ast.Expr, template int) ast.Expr {
 		return &ast.BinaryExpr{
 			X:  &ast.BinaryExpr{X: x, Op: token.EQL, Y: y},
 			Op: token.LAND,
-			Y:  x,
+			Y:  cloneExpr(x, info),
 		}
 	}
 }
-func obfuscateLor(x, y ast.Expr, template int) ast.Expr {
+func obfuscateLor(x, y ast.Expr, template int, info *types.Info) ast.Expr {
 	switch template {
 	case 0:
 		// a || b -> !(!a && !b)
@@ -157,7 +267,7 @@ func obfuscateLor(x, y ast.Expr, template int) ast.Expr {
 		return &ast.BinaryExpr{
 			X:  &ast.BinaryExpr{X: x, Op: token.NEQ, Y: y},
 			Op: token.LOR,
-			Y:  x,
+			Y:  cloneExpr(x, info),
 		}
 	}
 }
@@ -0,0 +1,85 @@
+package obfuscator
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+// expressionOps is the body of the functions whose expressions are rewritten, one per type.
+const expressionOps = `func ops_%[1]s(x, y %[1]s) (r [18]%[1]s, c [12]bool) {
+	r[0], r[1], r[2], r[3] = x+y, x-y, x*y, x&y
+	r[4], r[5], r[6], r[7] = x|y, x^y, x&^y, -x
+	r[8], r[9], r[10], r[11] = ^y, x+7, 3-y, x*5
+	r[12], r[13], r[14] = x&^0x5a|y&0x33, x<<(y&7), x>>(uint(y)%%64)
+	if y != 0 {
+		r[15], r[16] = x/y, x%%y
+	}
+	r[17] = (x + y) * (x - 1) ^ y
+	c[0], c[1], c[2], c[3], c[4], c[5] = x == y, x != y, x < y, x <= y, x > y, x >= y
+	c[6], c[7], c[8], c[9], c[10], c[11] = x < 9, 9 > y, x == 0, y >= 1, x <= y && y != 3, x > 2 || y < x
+	return
+}
+`
+// expressionMain checks the operations exhaustively over 8 bits and at random over 64 bits.
+const expressionMain = `package main
+import (
+	"fmt"
+	"math/rand"
+)
+func digest[T int8 | uint8 | int64 | uint64 | int | uintptr](r [18]T, c [12]bool) uint64 {
+	h := uint64(14695981039346656037)
+	for _, v := range r {
+		h = (h ^ uint64(v)) * 1099511628211
+	}
+	for _, b := range c {
+		if b {
+			h = h*31 + 1
+		}
+	}
+	return h
+}
+func main() {
+	var h8, hu8 uint64
+	for x := -128; x < 128; x++ {
+		for y := -128; y < 128; y++ {
+			h8 = h8*31 ^ digest(ops_int8(int8(x), int8(y)))
+			hu8 = hu8*31 ^ digest(ops_uint8(uint8(x), uint8(y)))
+		}
+	}
+	fmt.Println(h8, hu8)
+	rnd := rand.New(rand.NewSource(1))
+	edges := []uint64{0, 1, 2, 1<<63 - 1, 1 << 63, ^uint64(0), 1<<32 - 1}
+	var h64, hu64, hi, hp uint64
+	for i := 0; i < 20000; i++ {
+		x, y := rnd.Uint64(), rnd.Uint64()
+		if i < len(edges)*len(edges) {
+			x, y = edges[i%len(edges)], edges[i/len(edges)]
+		}
+		h64 = h64*31 ^ digest(ops_int64(int64(x), int64(y)))
+		hu64 = hu64*31 ^ digest(ops_uint64(x, y))
+		hi = hi*31 ^ digest(ops_int(int(x), int(y)))
+		hp = hp*31 ^ digest(ops_uintptr(uintptr(x), uintptr(y)))
+	}
+	fmt.Println(h64, hu64, hi, hp)
+}
+`
+func TestObfuscateExpressions_PreservesResults(t *testing.T) {
+	ops := "package main\n"
+	for _, typ := range []string{"int8", "uint8", "int64", "uint64", "int", "uintptr"} {
+		ops += fmt.Sprintf(expressionOps, typ)
+	}
+	program := map[string]string{"main.go": expressionMain, "ops.go": ops}
+	want := runGoProgram(t, program)
+	pkg := loadTestPackage(t, program)
+	for i, file := range pkg.Syntax {
+		if strings.HasSuffix(pkg.GoFiles[i], "ops.go") {
+			ObfuscateExpressions(file, pkg.TypesInfo, DefaultMBADepth)
+		}
+	}
+	out := printPackage(t, pkg)
+	if out["ops.go"] == ops {
+		t.Fatal("Expected the expressions to be rewritten")
+	}
+	if got := runGoProgram(t, out); got != want {
+		t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out["ops.go"])
+	}
+}
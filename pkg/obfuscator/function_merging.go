@@ -0,0 +1,483 @@
+package obfuscator
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"math/rand"
+	"strings"
+	"golang.org/x/tools/go/ast/astutil"
+)
+// mergeMaxGroup is the largest number of functions folded into one super-function.
+const mergeMaxGroup = 4
+// mergedCall is the part of a funcInfo describing how calls reach a function folded into a
+// super-function: the selector of its body and the union parameter receiving each argument.
+type mergedCall struct {
+	into     *funcInfo
+	selector uint32
+	slots    []int
+}
+// mergeFuncs folds groups of unexported functions of the same file returning the same types into
+// super-functions taking a selector and the union of their parameters, and rewrites every call.
+// The super-functions join p.funcs, so call indirection then treats them like any other function.
+func (p *CallIndirectionPass) mergeFuncs(fset *token.FileSet, files map[string]*ast.File) {
+	calls := p.mergeableCalls(files)
+	groups := make(map[*ast.File]map[string][]*funcInfo)
+	for _, info := range p.funcs {
+		if _, ok := calls[info]; !ok {
+			continue
+		}
+		key, ok := p.mergeKey(fset, info)
+		if !ok {
+			continue
+		}
+		if groups[info.file] == nil {
+			groups[info.file] = make(map[string][]*funcInfo)
+		}
+		groups[info.file][key] = append(groups[info.file][key], info)
+	}
+	for file, byResults := range groups {
+		for _, members := range byResults {
+			rand.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+			for len(members) >= 2 {
+				n := 2 + rand.Intn(mergeMaxGroup-1)
+				if n > len(members) || len(members)-n == 1 {
+					n = len(members)
+				}
+				p.merge(fset, file, members[:n])
+				members = members[n:]
+			}
+		}
+	}
+	callees := make(map[*ast.CallExpr]*funcInfo)
+	for info, sites := range calls {
+		for _, call := range sites {
+			if info.merged != nil {
+				callees[call] = info
+			}
+		}
+	}
+	for _, file := range files {
+		// Bottom-up, so that arguments calling merged functions are rewritten too.
+		astutil.Apply(file, nil, func(cursor *astutil.Cursor) bool {
+			call, ok := cursor.Node().(*ast.CallExpr)
+			if info := callees[call]; ok && info != nil {
+				cursor.Replace(p.mergedCallExpr(fset, call, info))
+			}
+			return true
+		})
+	}
+}
+// mergeableCalls returns the calls of every function that may be merged. A function referenced
+// other than as the callee of a call passing exactly its parameters must keep its identity.
+func (p *CallIndirectionPass) mergeableCalls(files map[string]*ast.File) map[*funcInfo][]*ast.CallExpr {
+	calls := make(map[*funcInfo][]*ast.CallExpr)
+	rejected := p.initReachable(files)
+	for _, info := range p.funcs {
+		if mergeBlocker(info) == "" {
+			calls[info] = nil
+		}
+	}
+	for _, file := range files {
+		walkWithStack(file, func(n ast.Node, stack []ast.Node) {
+			ident, ok := n.(*ast.Ident)
+			if !ok || len(stack) < 2 {
+				return
+			}
+			info := p.funcs[ident.Name]
+			if _, ok := calls[info]; !ok || ident == info.decl.Name || (ident.Obj != nil && ident.Obj.Decl != info.decl) {
+				return
+			}
+			switch parent := stack[len(stack)-2].(type) {
+			case *ast.SelectorExpr:
+				if parent.Sel == ident {
+					return
+				}
+			case *ast.CallExpr:
+				if parent.Fun == ident && !parent.Ellipsis.IsValid() && len(parent.Args) == paramCount(info.decl.Type) {
+					calls[info] = append(calls[info], parent)
+					return
+				}
+			}
+			rejected[info] = true
+		})
+	}
+	for info := range rejected {
+		delete(calls, info)
+	}
+	return calls
+}
+// initReachable returns the functions that the initializers of package-level variables may call.
+// A super-function runs the bodies of all its members: merged with a function reading one of these
+// variables, such a function would make the initializer depend on itself.
+func (p *CallIndirectionPass) initReachable(files map[string]*ast.File) map[*funcInfo]bool {
+	reached := make(map[*funcInfo]bool)
+	var visit func(n ast.Node)
+	visit = func(n ast.Node) {
+		ast.Inspect(n, func(n ast.Node) bool {
+			ident, ok := n.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			// By name, as the calls are found: methods and function values are reached too.
+			if info := p.funcs[ident.Name]; info != nil && !reached[info] {
+				reached[info] = true
+				if info.decl.Body != nil {
+					visit(info.decl.Body)
+				}
+			}
+			return true
+		})
+	}
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				for _, value := range spec.(*ast.ValueSpec).Values {
+					visit(value)
+				}
+			}
+		}
+	}
+	return reached
+}
+// mergeBlocker returns why the function of info cannot be folded into a super-function, or ""
+// if it can.
+func mergeBlocker(info *funcInfo) string {
+	fn := info.decl
+	switch {
+	case info.isMethod || fn.Body == nil || fn.Name.IsExported() || fn.Name.Name == "_":
+		return "not an unexported function"
+	case fn.Type.TypeParams != nil:
+		return "generic"
+	case hasDirective(fn.Doc):
+		return "has directives"
+	case usesCgo(info.file) || hasDotImport(info.file):
+		return "file imports C or uses a dot import"
+	}
+	for _, field := range fn.Type.Params.List {
+		if _, ok := field.Type.(*ast.Ellipsis); ok {
+			return "variadic"
+		}
+	}
+	qualified := false
+	for _, list := range []*ast.FieldList{fn.Type.Params, fn.Type.Results} {
+		if list != nil {
+			ast.Inspect(list, func(n ast.Node) bool {
+				_, ok := n.(*ast.SelectorExpr)
+				qualified = qualified || ok
+				return !qualified
+			})
+		}
+	}
+	if qualified {
+		// Callers in other files pass zero values of every union parameter and may not import
+		// the package.
+		return "signature names imported types"
+	}
+	if namedResults(fn.Type) {
+		deferred := false
+		inspectFunc(fn.Body, func(n ast.Node) {
+			_, ok := n.(*ast.DeferStmt)
+			deferred = deferred || ok
+		})
+		if deferred {
+			// Deferred calls may set the results after the return statement.
+			return "named results and defer"
+		}
+	}
+	return ""
+}
+// hasDirective reports whether a doc comment carries a //go: or //export directive, which the
+// comment text omits.
+func hasDirective(doc *ast.CommentGroup) bool {
+	if doc == nil {
+		return false
+	}
+	for _, c := range doc.List {
+		if strings.HasPrefix(c.Text, "//go:") || strings.HasPrefix(c.Text, "//export ") {
+			return true
+		}
+	}
+	return false
+}
+func hasDotImport(file *ast.File) bool {
+	for _, imp := range file.Imports {
+		if imp.Name != nil && imp.Name.Name == "." {
+			return true
+		}
+	}
+	return false
+}
+func paramCount(ft *ast.FuncType) int {
+	n := 0
+	for _, field := range ft.Params.List {
+		n += max(len(field.Names), 1)
+	}
+	return n
+}
+func namedResults(ft *ast.FuncType) bool {
+	return ft.Results != nil && len(ft.Results.List) > 0 && len(ft.Results.List[0].Names) > 0
+}
+// inspectFunc calls fn for every node of body outside function literals.
+func inspectFunc(body ast.Node, fn func(ast.Node)) {
+	ast.Inspect(body, func(n ast.Node) bool {
+		if _, ok := n.(*ast.FuncLit); ok || n == nil {
+			return false
+		}
+		fn(n)
+		return true
+	})
+}
+// mergeKey renders the result types of a function, which its super-function shares.
+func (p *CallIndirectionPass) mergeKey(fset *token.FileSet, info *funcInfo) (string, bool) {
+	var key []string
+	for _, t := range fieldTypes(info.decl.Type.Results) {
+		s, ok := typeString(fset, t)
+		if !ok {
+			return "", false
+		}
+		key = append(key, s)
+	}
+	return strings.Join(key, ","), true
+}
+// fieldTypes returns the type of every name of a parameter or result list.
+func fieldTypes(list *ast.FieldList) []ast.Expr {
+	var ts []ast.Expr
+	if list == nil {
+		return nil
+	}
+	for _, field := range list.List {
+		for i := 0; i < max(len(field.Names), 1); i++ {
+			ts = append(ts, field.Type)
+		}
+	}
+	return ts
+}
+func typeString(fset *token.FileSet, t ast.Expr) (string, bool) {
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, t); err != nil {
+		return "", false
+	}
+	return buf.String(), true
+}
+// copyType returns a position-less copy of a type expression rendered by typeString.
+func copyType(s string) ast.Expr {
+	expr, err := parser.ParseExpr(s)
+	if err != nil {
+		panic(fmt.Sprintf("re-parsing type %q: %v", s, err))
+	}
+	stripPositions(expr)
+	return expr
+}
+// merge replaces the declarations of members with a super-function switching over a selector:
+//
+//	func m(sel uint32, s0 T0, s1 T1, ...) R {
+//		switch sel {
+//		case c1:
+//			a, b := s0, s1
+//			_, _ = a, b
+//			...body of f1...
+//		default:
+//			...body of the last member...
+//		}
+//	}
+//
+// The parameters of each member take union slots in their order, so that rewritten calls still
+// evaluate their arguments from left to right.
+func (p *CallIndirectionPass) merge(fset *token.FileSet, file *ast.File, members []*funcInfo) {
+	var slotTypes []string
+	var slotOwners [][]*funcInfo
+	positions := make([][]int, len(members))
+	for m, info := range members {
+		next := 0
+		for _, t := range fieldTypes(info.decl.Type.Params) {
+			s, _ := typeString(fset, t)
+			slot := -1
+			for i := next; i < len(slotTypes); i++ {
+				if slotTypes[i] == s {
+					slot = i
+					break
+				}
+			}
+			if slot < 0 {
+				slot = next
+				slotTypes = append(slotTypes[:slot], append([]string{s}, slotTypes[slot:]...)...)
+				slotOwners = append(slotOwners[:slot], append([][]*funcInfo{nil}, slotOwners[slot:]...)...)
+				for _, other := range positions[:m] {
+					for i := range other {
+						if other[i] >= slot {
+							other[i]++
+						}
+					}
+				}
+			}
+			slotOwners[slot] = append(slotOwners[slot], info)
+			positions[m] = append(positions[m], slot)
+			next = slot + 1
+		}
+	}
+	name := NewName()
+	selector := NewName()
+	slotNames := make([]string, len(slotTypes))
+	params := []*ast.Field{{Names: []*ast.Ident{ast.NewIdent(selector)}, Type: ast.NewIdent("uint32")}}
+	for i, s := range slotTypes {
+		slotNames[i] = NewName()
+		params = append(params, &ast.Field{Names: []*ast.Ident{ast.NewIdent(slotNames[i])}, Type: copyType(s)})
+	}
+	var results *ast.FieldList
+	if rs := fieldTypes(members[0].decl.Type.Results); len(rs) > 0 {
+		results = &ast.FieldList{}
+		for _, t := range rs {
+			s, _ := typeString(fset, t)
+			results.List = append(results.List, &ast.Field{Type: copyType(s)})
+		}
+	}
+	into := &funcInfo{id: p.nextFuncID, file: file}
+	p.nextFuncID++
+	var clauses []ast.Stmt
+	last := members[len(members)-1].decl
+	used := make(map[uint32]bool)
+	for m, info := range members {
+		sel := uint32(randInt(1 << 32))
+		for used[sel] {
+			sel = uint32(randInt(1 << 32))
+		}
+		used[sel] = true
+		info.merged = &mergedCall{into: into, selector: sel, slots: positions[m]}
+		clause := &ast.CaseClause{List: []ast.Expr{stateLiteral(sel)}, Body: p.mergedBody(fset, file, info.decl, slotNames, positions[m])}
+		if m == len(members)-1 {
+			clause.List = nil
+		}
+		clauses = append(clauses, clause)
+		delete(p.funcs, info.decl.Name.Name)
+	}
+	decl := &ast.FuncDecl{
+		Name: ast.NewIdent(name),
+		Type: &ast.FuncType{Params: &ast.FieldList{List: params}, Results: results},
+		Body: &ast.BlockStmt{List: []ast.Stmt{&ast.SwitchStmt{Tag: ast.NewIdent(selector), Body: &ast.BlockStmt{List: clauses}}}},
+	}
+	fillPositions(decl, last.Pos())
+	into.decl = decl
+	p.funcs[name] = into
+	removed := make(map[ast.Decl]bool)
+	for _, info := range members {
+		removed[info.decl] = true
+	}
+	decls := file.Decls[:0]
+	for _, d := range file.Decls {
+		if d == last {
+			decls = append(decls, decl)
+		} else if !removed[d] {
+			decls = append(decls, d)
+		}
+	}
+	file.Decls = decls
+	var names []string
+	for _, info := range members {
+		names = append(names, info.decl.Name.Name)
+	}
+	fmt.Printf("    - Merged %s into %s\n", strings.Join(names, ", "), name)
+}
+// mergedBody turns the body of fn into the statements of its case in a super-function: its
+// parameters are bound to their slots, its named results become locals returned explicitly and
+// its labels are renamed apart from those of the other members.
+func (p *CallIndirectionPass) mergedBody(fset *token.FileSet, file *ast.File, fn *ast.FuncDecl, slotNames []string, slots []int) []ast.Stmt {
+	dropComments(file, fn.Body)
+	if fn.Doc != nil {
+		dropComments(file, &ast.BlockStmt{Lbrace: fn.Doc.Pos(), Rbrace: fn.Doc.End()})
+	}
+	var lhs, rhs, locals []ast.Expr
+	i := 0
+	for _, field := range fn.Type.Params.List {
+		for j := 0; j < max(len(field.Names), 1); j++ {
+			if len(field.Names) > 0 && field.Names[j].Name != "_" {
+				lhs = append(lhs, ast.NewIdent(field.Names[j].Name))
+				rhs = append(rhs, ast.NewIdent(slotNames[slots[i]]))
+				locals = append(locals, ast.NewIdent(field.Names[j].Name))
+			}
+			i++
+		}
+	}
+	var stmts []ast.Stmt
+	if len(lhs) > 0 {
+		stmts = append(stmts, &ast.AssignStmt{Lhs: lhs, Tok: token.DEFINE, Rhs: rhs})
+	}
+	if namedResults(fn.Type) {
+		var returned []ast.Expr
+		for _, field := range fn.Type.Results.List {
+			spec := &ast.ValueSpec{Type: field.Type}
+			for _, n := range field.Names {
+				if n.Name == "_" {
+					n = ast.NewIdent(NewName())
+				}
+				spec.Names = append(spec.Names, ast.NewIdent(n.Name))
+				returned = append(returned, ast.NewIdent(n.Name))
+				locals = append(locals, ast.NewIdent(n.Name))
+			}
+			stmts = append(stmts, &ast.DeclStmt{Decl: &ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{spec}}})
+		}
+		inspectFunc(fn.Body, func(n ast.Node) {
+			if ret, ok := n.(*ast.ReturnStmt); ok && len(ret.Results) == 0 {
+				for _, r := range returned {
+					ret.Results = append(ret.Results, ast.NewIdent(r.(*ast.Ident).Name))
+				}
+			}
+		})
+	}
+	if len(locals) > 0 {
+		// Parameters and results the body never reads would not compile as locals.
+		blanks := make([]ast.Expr, len(locals))
+		for i := range blanks {
+			blanks[i] = ast.NewIdent("_")
+		}
+		stmts = append(stmts, &ast.AssignStmt{Lhs: blanks, Tok: token.ASSIGN, Rhs: locals})
+	}
+	labels := make(map[string]string)
+	inspectFunc(fn.Body, func(n ast.Node) {
+		if l, ok := n.(*ast.LabeledStmt); ok {
+			labels[l.Label.Name] = NewName()
+		}
+	})
+	inspectFunc(fn.Body, func(n ast.Node) {
+		switch n := n.(type) {
+		case *ast.LabeledStmt:
+			n.Label = &ast.Ident{NamePos: n.Label.NamePos, Name: labels[n.Label.Name]}
+		case *ast.BranchStmt:
+			if n.Label != nil {
+				n.Label = &ast.Ident{NamePos: n.Label.NamePos, Name: labels[n.Label.Name]}
+			}
+		}
+	})
+	fillPositions(&ast.BlockStmt{List: stmts}, fn.Body.Lbrace)
+	return append(stmts, fn.Body.List...)
+}
+// mergedCallExpr rewrites a call of a merged function into a call of its super-function, passing
+// zero values for the parameters of the other members.
+func (p *CallIndirectionPass) mergedCallExpr(fset *token.FileSet, call *ast.CallExpr, info *funcInfo) *ast.CallExpr {
+	params := info.merged.into.decl.Type.Params.List[1:]
+	args := make([]ast.Expr, len(params))
+	for i, slot := range info.merged.slots {
+		args[slot] = call.Args[i]
+	}
+	for i, arg := range args {
+		if arg == nil {
+			s, _ := typeString(fset, params[i].Type)
+			args[i] = &ast.StarExpr{X: &ast.CallExpr{Fun: ast.NewIdent("new"), Args: []ast.Expr{copyType(s)}}}
+		}
+	}
+	merged := &ast.CallExpr{
+		Fun:    &ast.Ident{NamePos: call.Fun.Pos(), Name: info.merged.into.decl.Name.Name},
+		Lparen: call.Lparen,
+		// Typed, since call indirection passes the arguments as interfaces.
+		Args:   append([]ast.Expr{&ast.CallExpr{Fun: ast.NewIdent("uint32"), Args: []ast.Expr{stateLiteral(info.merged.selector)}}}, args...),
+		Rparen: call.Rparen,
+	}
+	fillPositions(merged, call.Lparen)
+	return merged
+}
@@ -0,0 +1,185 @@
+package obfuscator
+import (
+	"go/ast"
+	"strings"
+	"testing"
+)
+var mergingProgram = map[string]string{
+	"main.go": `package main
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+type point struct{ x, y int }
+func sum(a, b int) int { return a + b }
+func scale(p point, f float64, n int) int {
+	return int(float64(p.x*n+p.y) * f)
+}
+func count(s string, _ int) int {
+	n := 0
+loop:
+	for _, r := range s {
+		if r == '.' {
+			break loop
+		}
+		n++
+	}
+	return n
+}
+func fib(n int) int {
+	if n < 2 {
+		return n
+	}
+	return fib(n-1) + fib(n-2)
+}
+func show(label string, v int) {
+	fmt.Println(label, v)
+}
+func banner() {
+	fmt.Println(strings.Repeat("=", 5))
+}
+func parse(s string) (string, error) {
+	if s == "" {
+		return "", errors.New("empty")
+	}
+	return strings.ToUpper(s), nil
+}
+func split(s string) (head string, err error) {
+	i := strings.Index(s, ":")
+loop:
+	if i < 0 {
+		err = errors.New("no colon in " + s)
+		return
+	}
+	head = s[:i]
+	if head == "" {
+		i = -1
+		goto loop
+	}
+	return
+}
+func guarded(n int) (r int) {
+	defer func() { r *= 2 }()
+	return n + 1
+}
+func join(parts ...string) string { return strings.Join(parts, "+") }
+func apply(f func(int) int, v int) int { return f(v) }
+func twice(v int) int { return v * 2 }
+func main() {
+	banner()
+	show("sum", sum(fib(7), count("ab.c", 0)))
+	show("scale", scale(point{3, 4}, 1.5, sum(1, 2)))
+	fmt.Println(parse("go"))
+	fmt.Println(parse(""))
+	fmt.Println(split("key:value"))
+	fmt.Println(split(":value"))
+	fmt.Println(guarded(4), join("a", "b"), apply(twice, 21))
+	fmt.Println(tally([]int{1, 2, 3}), describe(point{1, 2}))
+	fmt.Println(lookup(2), first(lookup(1)))
+	banner()
+}
+`,
+	"other.go": `package main
+import "fmt"
+func tally(xs []int) int {
+	t := 0
+	for _, x := range xs {
+		t = sum(t, x)
+	}
+	return t
+}
+func describe(p point) string {
+	show("describe", p.x)
+	return fmt.Sprint(p.x, "/", p.y)
+}
+func label(p point) string { return fmt.Sprint("p", p.x) }
+func init() {
+	fmt.Println(label(point{7, 8}))
+}
+// build initializes table: merged with lookup, which reads table, it would form an
+// initialization cycle.
+var table = build(4)
+func build(n int) []int {
+	t := make([]int, n)
+	for i := range t {
+		t[i] = square(i)
+	}
+	return t
+}
+func square(i int) int { return i * i }
+func lookup(i int) []int { return table[i:] }
+func first(xs []int) int { return xs[0] }
+`,
+}
+func TestFunctionMerging_PreservesBehaviour(t *testing.T) {
+	want := runGoProgram(t, mergingProgram)
+	for i := 0; i < 3; i++ {
+		pkg := loadTestPackage(t, mergingProgram)
+		files := make(map[string]*ast.File)
+		for i, file := range pkg.Syntax {
+			files[pkg.GoFiles[i]] = file
+		}
+		if err := (&CallIndirectionPass{MergeFunctions: true, DirectCalls: true}).Apply(nil, pkg.Fset, files); err != nil {
+			t.Fatalf("CallIndirectionPass failed: %v", err)
+		}
+		out := printPackage(t, pkg)
+		if got := runGoProgram(t, out); got != want {
+			t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s\n%s", got, want, out["main.go"], out["other.go"])
+		}
+		declared := make(map[string]bool)
+		for _, file := range pkg.Syntax {
+			for _, decl := range file.Decls {
+				if fd, ok := decl.(*ast.FuncDecl); ok {
+					declared[fd.Name.Name] = true
+				}
+			}
+		}
+		for _, name := range []string{"guarded", "join", "twice", "main", "init", "build", "square"} {
+			if !declared[name] {
+				t.Errorf("Expected %s to keep its declaration:\n%s", name, out["main.go"])
+			}
+		}
+		merged := 0
+		for _, name := range []string{"sum", "scale", "count", "fib", "show", "banner", "parse", "split"} {
+			if !declared[name] {
+				merged++
+			}
+		}
+		if merged < 6 {
+			t.Errorf("Expected most functions of main.go to be merged, got %d:\n%s", merged, out["main.go"])
+		}
+	}
+}
+func TestFunctionMerging_ThroughDispatcher(t *testing.T) {
+	src := `package main
+import "fmt"
+func add(a, b int) int { return a + b }
+func neg(a int) int { return -a }
+func mul(a int, b int, c int) int { return a * b * c }
+func say(s string) { fmt.Println("say", s) }
+func shout(s string, n int) { fmt.Println("shout", s, n) }
+func main() {
+	say("hi")
+	shout("hey", add(neg(2), mul(2, 3, 4)))
+	fmt.Println(add(1, 2), neg(add(3, 4)))
+}
+`
+	want := runGoProgram(t, map[string]string{"main.go": src})
+	pkg := loadTestPackage(t, map[string]string{"main.go": src})
+	obf := &Obfuscator{WeavingKeyVarName: NewName()}
+	ensureWeavingKeyDecl(obf, pkg)
+	pass := &CallIndirectionPass{MergeFunctions: true}
+	if err := pass.Apply(obf, pkg.Fset, map[string]*ast.File{pkg.GoFiles[0]: pkg.Syntax[0]}); err != nil {
+		t.Fatalf("CallIndirectionPass failed: %v", err)
+	}
+	out := printFile(t, pkg.Fset, pkg.Syntax[0])
+	if got := runGoProgram(t, map[string]string{"main.go": out}); got != want {
+		t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out)
+	}
+	for _, name := range []string{"add(", "neg(", "mul(", "say(", "shout("} {
+		if strings.Contains(out, name) {
+			t.Errorf("Expected %s to be merged away:\n%s", name, out)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package obfuscator
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	mrand "math/rand"
+	"strings"
+)
+// KeyDecl emits statements that declare the []byte variable name holding a piece of key material.
+type KeyDecl func(obf *Obfuscator, name string) []ast.Stmt
+// KeySource supplies key material to string ciphers.
+type KeySource interface {
+	// Key returns n bytes of key material and the code that recovers them at runtime.
+	Key(n int) ([]byte, KeyDecl, error)
+}
+// literalKeySource embeds random keys as literals masked with the weaving key.
+type literalKeySource struct{}
+func (literalKeySource) Key(n int) ([]byte, KeyDecl, error) {
+	key := make([]byte, n)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	masked := maskStringKey(key, n)
+	return key, func(obf *Obfuscator, name string) []ast.Stmt {
+		return append(mustParseStmts(fmt.Sprintf("%s := %s", name, byteSliceSource(masked))), keyWeavingLoop(obf, name, name))
+	}, nil
+}
+// keySource kinds: where a share of the package key state lives.
+const (
+	keySourceSplitConst = iota // two constants in different files, XORed together
+	keySourceInitVar           // a package variable computed by an initializer loop
+	keySourceFuncHash          // an FNV-1a hash over the outputs of a package-level function literal
+	keySourceKindCount
+)
+// keyShare is one source of key state together with its build-time value.
+type keyShare struct {
+	decls []string // top-level declarations, each placed in a different file where possible
+	expr  string   // runtime expression of type uint64
+	value uint64
+	op    int // how the share is folded into the state: 0 xor, 1 add, 2 rotate then add
+	rot   uint
+}
+// keySchedule derives every key of a package from state spread over the package: no key,
+// IV or seed appears as a literal, only a per-key salt passed to the derivation function.
+type keySchedule struct {
+	kdfName string
+	shares  []keyShare
+	used    bool
+}
+func newKeySchedule() *keySchedule {
+	ks := &keySchedule{kdfName: NewName()}
+	n := keySourceKindCount + mrand.Intn(3)
+	for i := 0; i < n; i++ {
+		kind := i
+		if kind >= keySourceKindCount {
+			kind = mrand.Intn(keySourceKindCount)
+		}
+		share := newKeyShare(kind)
+		share.op = mrand.Intn(3)
+		share.rot = uint(1 + mrand.Intn(63))
+		ks.shares = append(ks.shares, share)
+	}
+	mrand.Shuffle(len(ks.shares), func(i, j int) { ks.shares[i], ks.shares[j] = ks.shares[j], ks.shares[i] })
+	return ks
+}
+// newKeyShare generates a share of the given kind and computes the value it has at runtime.
+func newKeyShare(kind int) keyShare {
+	switch kind {
+	case keySourceSplitConst:
+		a, b := mrand.Uint64(), mrand.Uint64()
+		nameA, nameB := NewName(), NewName()
+		return keyShare{
+			decls: []string{
+				fmt.Sprintf("const %s uint64 = %#x", nameA, a),
+				fmt.Sprintf("const %s uint64 = %#x", nameB, b),
+			},
+			expr:  fmt.Sprintf("(%s ^ %s)", nameA, nameB),
+			value: a ^ b,
+		}
+	case keySourceInitVar:
+		seed, mul, inc := mrand.Uint64(), mrand.Uint64()|1, mrand.Uint64()
+		rounds := 8 + mrand.Intn(24)
+		x := seed
+		for i := 0; i < rounds; i++ {
+			x = x*mul + inc
+			x ^= x >> 29
+		}
+		name, iVar := NewName(), NewName()
+		return keyShare{
+			decls: []string{fmt.Sprintf(`var %[1]s = func() uint64 {
+	x := uint64(%#[3]x)
+	for %[2]s := 0; %[2]s < %[4]d; %[2]s++ {
+		x = x*%#[5]x + %#[6]x
+		x ^= x >> 29
+	}
+	return x
+}()`, name, iVar, seed, rounds, mul, inc)},
+			expr:  name,
+			value: x,
+		}
+	default:
+		c1, c2, c3 := mrand.Uint64(), mrand.Uint64()|1, mrand.Uint64()
+		f := func(x uint64) uint64 { return (x^c1)*c2 + c3 }
+		h := uint64(14695981039346656037)
+		for i := uint64(0); i < 8; i++ {
+			h ^= f(i)
+			h *= 1099511628211
+		}
+		fnName, hashName, iVar := NewName(), NewName(), NewName()
+		return keyShare{
+			decls: []string{
+				fmt.Sprintf("var %s = func(x uint64) uint64 { return (x ^ %#x) * %#x + %#x }", fnName, c1, c2, c3),
+				fmt.Sprintf(`var %[1]s = func() uint64 {
+	h := uint64(14695981039346656037)
+	for %[2]s := uint64(0); %[2]s < 8; %[2]s++ {
+		h ^= %[3]s(%[2]s)
+		h *= 1099511628211
+	}
+	return h
+}()`, hashName, iVar, fnName),
+			},
+			expr:  hashName,
+			value: h,
+		}
+	}
+}
+// state folds the shares into the derivation state for salt, mirroring the emitted code.
+func (ks *keySchedule) state(salt uint64) uint64 {
+	s := salt
+	for _, share := range ks.shares {
+		switch share.op {
+		case 0:
+			s ^= share.value
+		case 1:
+			s += share.value
+		default:
+			s = (s<<share.rot | s>>(64-share.rot)) + share.value
+		}
+	}
+	return s
+}
+// derive expands the state for salt into n key bytes (splitmix64), mirroring the emitted code.
+func (ks *keySchedule) derive(salt uint64, n int) []byte {
+	s := ks.state(salt)
+	out := make([]byte, n)
+	for i := range out {
+		s += 0x9e3779b97f4a7c15
+		z := s
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		out[i] = byte(z ^ z>>31)
+	}
+	return out
+}
+func (ks *keySchedule) Key(n int) ([]byte, KeyDecl, error) {
+	var saltBytes [8]byte
+	if _, err := rand.Read(saltBytes[:]); err != nil {
+		return nil, nil, err
+	}
+	salt := binary.LittleEndian.Uint64(saltBytes[:])
+	ks.used = true
+	return ks.derive(salt, n), func(obf *Obfuscator, name string) []ast.Stmt {
+		return mustParseStmts(fmt.Sprintf("%s := %s(uint64(%#x), %d)", name, ks.kdfName, salt, n))
+	}, nil
+}
+// buildDecls generates the derivation function and the shares. The weaving key is folded into
+// the state, so keys only come out right while it is zero (no debugger detected).
+func (ks *keySchedule) buildDecls(obf *Obfuscator) ([][]ast.Decl, error) {
+	var fold strings.Builder
+	for _, share := range ks.shares {
+		switch share.op {
+		case 0:
+			fmt.Fprintf(&fold, "\ts ^= %s\n", share.expr)
+		case 1:
+			fmt.Fprintf(&fold, "\ts += %s\n", share.expr)
+		default:
+			fmt.Fprintf(&fold, "\ts = (s<<%d | s>>%d) + %s\n", share.rot, 64-share.rot, share.expr)
+		}
+	}
+	if obf != nil && obf.WeavingKeyVarName != "" {
+		fmt.Fprintf(&fold, "\ts ^= uint64(%s)\n", obf.WeavingKeyVarName)
+	}
+	kdf := fmt.Sprintf(`func %[1]s(salt uint64, n int) []byte {
+	s := salt
+%[2]s	out := make([]byte, n)
+	for i := range out {
+		s += 0x9e3779b97f4a7c15
+		z := s
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		out[i] = byte(z ^ z>>31)
+	}
+	return out
+}`, ks.kdfName, fold.String())
+	groups := [][]string{{kdf}}
+	for _, share := range ks.shares {
+		groups = append(groups, share.decls)
+	}
+	var result [][]ast.Decl
+	for _, group := range groups {
+		file, err := parser.ParseFile(token.NewFileSet(), "key_schedule.go", "package p\n"+strings.Join(group, "\n"), 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key schedule: %w", err)
+		}
+		stripPositions(file)
+		result = append(result, file.Decls)
+	}
+	return result, nil
+}
+// emit spreads the schedule over files; the declarations of one share go to consecutive files
+// so split constants never sit next to each other.
+func (ks *keySchedule) emit(obf *Obfuscator, files []*ast.File) error {
+	groups, err := ks.buildDecls(obf)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		start := mrand.Intn(len(files))
+		for i, decl := range group {
+			file := files[(start+i)%len(files)]
+			appendDecls(file, []ast.Decl{decl})
+		}
+	}
+	return nil
+}
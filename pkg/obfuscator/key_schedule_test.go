@@ -0,0 +1,87 @@
+package obfuscator
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+func TestKeySchedule_DerivedKeysRoundTrip(t *testing.T) {
+	sources := map[string]string{
+		"main.go": `
+package main
+import "fmt"
+var weave_key_dummy int64
+var banner = "derived at init"
+func main() {
+	fmt.Println(banner)
+	fmt.Println("first secret")
+	fmt.Println("second secret")
+	fmt.Println(helper())
+}
+`,
+		"helper.go": `
+package main
+func helper() string {
+	return "from another file"
+}
+`,
+	}
+	want := "derived at init\nfirst secret\nsecond secret\nfrom another file\n"
+	for _, mode := range []StringEncryptionMode{StringModeInline, StringModeTable} {
+		t.Run(string(mode), func(t *testing.T) {
+			fset := token.NewFileSet()
+			names := []string{"main.go", "helper.go"}
+			var files []*ast.File
+			for _, name := range names {
+				file, err := parser.ParseFile(fset, name, sources[name], parser.ParseComments)
+				if err != nil {
+					t.Fatalf("Failed to parse %s: %v", name, err)
+				}
+				files = append(files, file)
+			}
+			obf := &Obfuscator{WeavingKeyVarName: "weave_key_dummy"}
+			pass := NewStringEncryptionPass()
+			pass.UseCiphers(CipherPolicyRoundRobin, allStringCiphers(t)...)
+			pass.DeriveKeys()
+			pass.BeginPackage(mode)
+			for _, file := range files {
+				if err := pass.Apply(obf, fset, file); err != nil {
+					t.Fatalf("StringEncryptionPass.Apply failed: %v", err)
+				}
+			}
+			if err := pass.FinishPackage(obf, fset, files); err != nil {
+				t.Fatalf("StringEncryptionPass.FinishPackage failed: %v", err)
+			}
+			out := make(map[string]string)
+			for i, file := range files {
+				out[names[i]] = printFile(t, fset, file)
+			}
+			all := out["main.go"] + out["helper.go"]
+			if strings.Count(all, "const ") < 2 {
+				t.Errorf("Expected split constants from the key schedule, got:\n%s", all)
+			}
+			if !strings.Contains(out["main.go"], " uint64") || !strings.Contains(out["helper.go"], " uint64") {
+				t.Errorf("Expected key state to be spread over both files")
+			}
+			if got := runGoProgram(t, out); got != want {
+				t.Errorf("Decrypted output mismatch: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+func TestKeySchedule_DeriveDependsOnEveryShare(t *testing.T) {
+	ks := newKeySchedule()
+	base := ks.derive(42, 16)
+	for i := range ks.shares {
+		saved := ks.shares[i].value
+		ks.shares[i].value ^= 1
+		if string(ks.derive(42, 16)) == string(base) {
+			t.Errorf("Changing share %d did not change the derived key", i)
+		}
+		ks.shares[i].value = saved
+	}
+	if string(ks.derive(43, 16)) == string(base) {
+		t.Errorf("Different salts should derive different keys")
+	}
+}
@@ -0,0 +1,418 @@
+package obfuscator
+import (
+	"go/token"
+)
+// DefaultMBADepth is how many times mixed boolean-arithmetic rewriting is applied by default: the
+// rewriting of an operator, then that of some operators of the result.
+const DefaultMBADepth = 2
+// mbaMaxOperands bounds the size of the operands of an operator rewritten again, since every
+// identity repeats its operands several times.
+const mbaMaxOperands = 6
+// mbaNode is an expression of the MBA engine: an operand of the rewritten operator, a small
+// constant, or a unary or binary integer operation. Nodes are never modified once built, so
+// subtrees are shared freely.
+type mbaNode struct {
+	op   token.Token // token.ILLEGAL for an operand, token.INT for a constant
+	x, y *mbaNode    // y is nil for unary operators
+	arg  int
+	c    uint64
+}
+func mbaArg(i int) *mbaNode {
+	return &mbaNode{op: token.ILLEGAL, arg: i}
+}
+func mbaConst(c uint64) *mbaNode {
+	return &mbaNode{op: token.INT, c: c}
+}
+func mbaBinary(op token.Token, x, y *mbaNode) *mbaNode {
+	return &mbaNode{op: op, x: x, y: y}
+}
+func mbaUnary(op token.Token, x *mbaNode) *mbaNode {
+	return &mbaNode{op: op, x: x}
+}
+func (n *mbaNode) size() int {
+	switch {
+	case n.x == nil:
+		return 1
+	case n.y == nil:
+		return 1 + n.x.size()
+	}
+	return 1 + n.x.size() + n.y.size()
+}
+// eval computes n over integers of the given width and signedness, held in the low bits of
+// uint64 values.
+func (n *mbaNode) eval(args []uint64, bits uint, signed bool) uint64 {
+	mask := ^uint64(0) >> (64 - bits)
+	switch n.op {
+	case token.ILLEGAL:
+		return args[n.arg] & mask
+	case token.INT:
+		return n.c & mask
+	}
+	x := n.x.eval(args, bits, signed)
+	if n.y == nil {
+		switch n.op {
+		case token.SUB:
+			return -x & mask
+		case token.XOR:
+			return ^x & mask
+		}
+		panic("mba: unexpected unary operator " + n.op.String())
+	}
+	y := n.y.eval(args, bits, signed)
+	// sx and sy are the operands sign-extended, for the operations that depend on the sign.
+	sx, sy := int64(x<<(64-bits))>>(64-bits), int64(y<<(64-bits))>>(64-bits)
+	switch n.op {
+	case token.ADD:
+		return (x + y) & mask
+	case token.SUB:
+		return (x - y) & mask
+	case token.MUL:
+		return (x * y) & mask
+	case token.AND:
+		return x & y
+	case token.OR:
+		return x | y
+	case token.XOR:
+		return x ^ y
+	case token.AND_NOT:
+		return x &^ y
+	case token.QUO:
+		if signed {
+			return uint64(sx/sy) & mask
+		}
+		return x / y
+	case token.REM:
+		if signed {
+			return uint64(sx%sy) & mask
+		}
+		return x % y
+	case token.SHL:
+		if y >= uint64(bits) {
+			return 0
+		}
+		return (x << y) & mask
+	case token.SHR:
+		if signed {
+			return uint64(sx>>min(y, 63)) & mask
+		}
+		if y >= uint64(bits) {
+			return 0
+		}
+		return x >> y
+	}
+	panic("mba: unexpected operator " + n.op.String())
+}
+// mbaTruthTable is the value of a bitwise function of two operands on each combination of their
+// bits, indexed by 2*x+y. A sum of bitwise functions scaled by integers equals the sum of the
+// minterms ^(x|y), y&^x, x&^y and x&y scaled by the summed truth tables, whatever the width of
+// the integers, which is how the identities are built.
+type mbaTruthTable [4]int64
+// mbaTargets are the integer operators as sums of minterms.
+var mbaTargets = map[token.Token]mbaTruthTable{
+	token.ADD:     {0, 1, 1, 2},
+	token.SUB:     {0, -1, 1, 0},
+	token.AND:     {0, 0, 0, 1},
+	token.OR:      {0, 1, 1, 1},
+	token.XOR:     {0, 1, 1, 0},
+	token.AND_NOT: {0, 0, 1, 0},
+}
+// mbaIdentity, mbaNegation and mbaComplement are x, -x and ^x as sums of minterms.
+var (
+	mbaIdentity   = mbaTruthTable{0, 0, 1, 1}
+	mbaNegation   = mbaTruthTable{0, 0, -1, -1}
+	mbaComplement = mbaTruthTable{1, 1, 0, 0}
+)
+// mbaGenerator rewrites integer operations into equivalent mixed boolean-arithmetic expressions.
+type mbaGenerator struct {
+	depth int
+	// consts are the operands standing for constants, which appear only through constant.
+	consts map[int]bool
+}
+// rewrite returns an expression equal to x op y (or op x for the unary operators - and ^, y
+// being then any other expression of the same type), with its own operators rewritten again
+// depth-1 times where their operands are small.
+func (g *mbaGenerator) rewrite(op token.Token, x, y *mbaNode, depth int) *mbaNode {
+	var e *mbaNode
+	switch {
+	case op == token.MUL:
+		e = g.product(x, y)
+	case op == token.SUB && y == nil:
+		e = g.linear(mbaNegation, x, g.other(x))
+	case op == token.XOR && y == nil:
+		e = g.linear(mbaComplement, x, g.other(x))
+	default:
+		e = g.linear(mbaTargets[op], x, y)
+		if depth == g.depth && randInt(4) == 0 {
+			e = g.withNoise(e, x, y)
+		}
+	}
+	if depth <= 1 {
+		return e
+	}
+	return g.deepen(e, depth-1)
+}
+// identity returns an expression equal to x, y being any other expression of the same type.
+func (g *mbaGenerator) identity(x, y *mbaNode, depth int) *mbaNode {
+	e := g.linear(mbaIdentity, x, y)
+	if depth <= 1 {
+		return e
+	}
+	return g.deepen(e, depth-1)
+}
+// other returns the second operand of identities of a single one: x itself or a small constant.
+func (g *mbaGenerator) other(x *mbaNode) *mbaNode {
+	if randInt(2) == 0 {
+		return x
+	}
+	return g.constant(x, mbaConst(uint64(1+randInt(127))))
+}
+// constant returns the constant c as an expression over x: a constant alone would be untyped,
+// and could then overflow once complemented or negated.
+func (g *mbaGenerator) constant(x, c *mbaNode) *mbaNode {
+	var zero *mbaNode
+	switch randInt(3) {
+	case 0:
+		zero = mbaBinary(token.XOR, x, x)
+	case 1:
+		zero = mbaBinary(token.AND_NOT, x, x)
+	default:
+		zero = mbaBinary(token.SUB, x, x)
+	}
+	return mbaBinary([]token.Token{token.OR, token.XOR, token.ADD}[randInt(3)], zero, c)
+}
+// typed reports whether n depends on an operand that is not a constant.
+func (g *mbaGenerator) typed(n *mbaNode) bool {
+	switch {
+	case n.op == token.ILLEGAL:
+		return !g.consts[n.arg]
+	case n.x == nil:
+		return false
+	case n.y == nil:
+		return g.typed(n.x)
+	}
+	return g.typed(n.x) || g.typed(n.y)
+}
+// deepen rewrites again some of the operators of e whose operands are small and typed.
+func (g *mbaGenerator) deepen(e *mbaNode, depth int) *mbaNode {
+	if e.x == nil {
+		return e
+	}
+	x := g.deepen(e.x, depth)
+	if e.y == nil {
+		if (e.op == token.SUB || e.op == token.XOR) && x.size() <= mbaMaxOperands && g.typed(x) && randInt(3) == 0 {
+			return g.rewrite(e.op, x, nil, depth)
+		}
+		return mbaUnary(e.op, x)
+	}
+	y := g.deepen(e.y, depth)
+	if _, ok := mbaTargets[e.op]; (ok || e.op == token.MUL) && x.size()+y.size() <= mbaMaxOperands && g.typed(x) && g.typed(y) && randInt(3) == 0 {
+		return g.rewrite(e.op, x, y, depth)
+	}
+	return mbaBinary(e.op, x, y)
+}
+// mbaTerm is a bitwise expression scaled by a coefficient.
+type mbaTerm struct {
+	coef int64
+	e    *mbaNode
+}
+// linear returns a sum of scaled bitwise expressions of x and y equal to the sum of minterms
+// target: a few random terms, then the terms making up the difference.
+func (g *mbaGenerator) linear(target mbaTruthTable, x, y *mbaNode) *mbaNode {
+	var terms []mbaTerm
+	residual := target
+	for i := randInt(2); i >= 0; i-- {
+		e, tt := g.bitwise(x, y, 2)
+		coef := 1 + randInt(3)
+		if randInt(2) == 0 {
+			coef = -coef
+		}
+		for r := range residual {
+			residual[r] -= coef * tt[r]
+		}
+		terms = append(terms, mbaTerm{coef, e})
+	}
+	for r := range residual {
+		if residual[r] == 0 {
+			continue
+		}
+		// All rows with the same coefficient go into one term.
+		coef, rows := residual[r], 0
+		for s := range residual {
+			if residual[s] == coef {
+				rows |= 1 << (3 - s)
+				residual[s] = 0
+			}
+		}
+		terms = append(terms, mbaTerm{coef, g.spell(rows, x, y)})
+	}
+	return g.sum(terms, x)
+}
+// product returns x*y as (x&y)*(x|y) + (x&^y)*(y&^x), every factor a linear identity.
+func (g *mbaGenerator) product(x, y *mbaNode) *mbaNode {
+	if randInt(2) == 0 {
+		x, y = y, x
+	}
+	and := g.linear(mbaTargets[token.AND], x, y)
+	or := g.linear(mbaTargets[token.OR], x, y)
+	left := g.linear(mbaTargets[token.AND_NOT], x, y)
+	right := g.linear(mbaTargets[token.AND_NOT], y, x)
+	if randInt(2) == 0 {
+		and, or = or, and
+	}
+	return mbaBinary(token.ADD, mbaBinary(token.MUL, and, or), mbaBinary(token.MUL, left, right))
+}
+// withNoise adds to e a multiple of the polynomial (x&y)*(x|y) + (x&^y)*(y&^x) - x*y, which is
+// zero.
+func (g *mbaGenerator) withNoise(e, x, y *mbaNode) *mbaNode {
+	noise := mbaBinary(token.SUB, g.product(x, y), mbaBinary(token.MUL, x, y))
+	return mbaBinary(token.ADD, e, mbaBinary(token.MUL, mbaConst(uint64(1+randInt(7))), noise))
+}
+// sum adds up terms, subtracting those with a negative coefficient.
+func (g *mbaGenerator) sum(terms []mbaTerm, x *mbaNode) *mbaNode {
+	shuffled := make([]mbaTerm, len(terms))
+	for i, j := range randomPermutation(len(terms)) {
+		shuffled[i] = terms[j]
+	}
+	var e *mbaNode
+	for _, t := range shuffled {
+		coef := t.coef
+		if coef < 0 {
+			coef = -coef
+		}
+		term := t.e
+		if coef != 1 {
+			term = mbaBinary(token.MUL, mbaConst(uint64(coef)), term)
+		}
+		switch {
+		case e == nil && t.coef < 0:
+			e = mbaUnary(token.SUB, term)
+		case e == nil:
+			e = term
+		case t.coef < 0:
+			e = mbaBinary(token.SUB, e, term)
+		default:
+			e = mbaBinary(token.ADD, e, term)
+		}
+	}
+	if e == nil {
+		return g.constant(x, mbaConst(0))
+	}
+	return e
+}
+// bitwise returns a random bitwise expression of x and y and its truth table.
+func (g *mbaGenerator) bitwise(x, y *mbaNode, depth int) (*mbaNode, mbaTruthTable) {
+	if depth == 0 || randInt(3) == 0 {
+		if randInt(2) == 0 {
+			return x, mbaIdentity
+		}
+		return y, mbaTruthTable{0, 1, 0, 1}
+	}
+	if randInt(5) == 0 {
+		e, tt := g.bitwise(x, y, depth-1)
+		for r := range tt {
+			tt[r] = 1 - tt[r]
+		}
+		return mbaUnary(token.XOR, e), tt
+	}
+	op := []token.Token{token.AND, token.OR, token.XOR, token.AND_NOT}[randInt(4)]
+	a, at := g.bitwise(x, y, depth-1)
+	b, bt := g.bitwise(x, y, depth-1)
+	var tt mbaTruthTable
+	for r := range tt {
+		switch op {
+		case token.AND:
+			tt[r] = at[r] & bt[r]
+		case token.OR:
+			tt[r] = at[r] | bt[r]
+		case token.XOR:
+			tt[r] = at[r] ^ bt[r]
+		default:
+			tt[r] = at[r] &^ bt[r]
+		}
+	}
+	return mbaBinary(op, a, b), tt
+}
+// spell returns a bitwise expression of x and y with the given truth table, as a bit mask with
+// row 0 in the high bit: a random expression if one turns up, a disjunction of minterms
+// otherwise.
+func (g *mbaGenerator) spell(rows int, x, y *mbaNode) *mbaNode {
+	for i := 0; i < 64; i++ {
+		e, tt := g.bitwise(x, y, 2)
+		found := 0
+		for r := range tt {
+			found |= int(tt[r]) << (3 - r)
+		}
+		if found == rows {
+			return e
+		}
+	}
+	minterms := []*mbaNode{
+		mbaUnary(token.XOR, mbaBinary(token.OR, x, y)),
+		mbaBinary(token.AND_NOT, y, x),
+		mbaBinary(token.AND_NOT, x, y),
+		mbaBinary(token.AND, x, y),
+	}
+	var e *mbaNode
+	for r, m := range minterms {
+		if rows&(1<<(3-r)) == 0 {
+			continue
+		}
+		if e == nil {
+			e = m
+		} else {
+			e = mbaBinary(token.OR, e, m)
+		}
+	}
+	return e
+}
+// mbaCondition is a comparison as an integer expression tested for being zero or for its sign bit.
+type mbaCondition struct {
+	e *mbaNode
+	// sign tests whether the sign bit of e is set instead of whether e is zero.
+	sign bool
+	// negate inverts the test.
+	negate bool
+}
+// compare returns a condition equivalent to x op y for integers of the given signedness: the
+// difference of the operands is zero for equality, and the borrow of x-y, the sign bit of
+// (^x&y) | (^(x^y)&(x-y)) when unsigned and of (x-y) ^ ((x^y)&((x-y)^x)) when signed, orders
+// them.
+func (g *mbaGenerator) compare(op token.Token, x, y *mbaNode, signed bool) mbaCondition {
+	switch op {
+	case token.EQL, token.NEQ:
+		diff := token.XOR
+		if randInt(2) == 0 {
+			diff = token.SUB
+		}
+		return mbaCondition{e: g.rewrite(diff, x, y, g.depth), negate: op == token.NEQ}
+	case token.GTR:
+		x, y = y, x
+	case token.LEQ:
+		// x <= y is !(y < x).
+		c := g.compare(token.LSS, y, x, signed)
+		c.negate = !c.negate
+		return c
+	case token.GEQ:
+		c := g.compare(token.LSS, x, y, signed)
+		c.negate = !c.negate
+		return c
+	}
+	d := g.rewrite(token.SUB, x, y, g.depth)
+	xor := g.rewrite(token.XOR, x, y, g.depth)
+	var borrow *mbaNode
+	if signed {
+		borrow = mbaBinary(token.XOR, d, mbaBinary(token.AND, xor, mbaBinary(token.XOR, d, x)))
+	} else {
+		borrow = mbaBinary(token.OR, mbaBinary(token.AND_NOT, y, x), mbaBinary(token.AND, mbaUnary(token.XOR, xor), d))
+	}
+	return mbaCondition{e: borrow, sign: true}
+}
+// holds evaluates the condition like eval.
+func (c mbaCondition) holds(args []uint64, bits uint, signed bool) bool {
+	v := c.e.eval(args, bits, signed)
+	result := v == 0
+	if c.sign {
+		result = v>>(bits-1) != 0
+	}
+	return result != c.negate
+}
@@ -0,0 +1,129 @@
+package obfuscator
+import (
+	"go/token"
+	"testing"
+)
+var mbaBinaryOps = []token.Token{token.ADD, token.SUB, token.MUL, token.AND, token.OR, token.XOR, token.AND_NOT}
+var mbaComparisons = []token.Token{token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ}
+// mbaReference applies op natively to 8-bit operands.
+func mbaReference(op token.Token, x, y uint8, signed bool) uint8 {
+	switch op {
+	case token.ADD:
+		return x + y
+	case token.SUB:
+		return x - y
+	case token.MUL:
+		return x * y
+	case token.AND:
+		return x & y
+	case token.OR:
+		return x | y
+	case token.XOR:
+		return x ^ y
+	case token.AND_NOT:
+		return x &^ y
+	}
+	panic(op)
+}
+func mbaCompareReference(op token.Token, x, y uint8, signed bool) bool {
+	if signed {
+		a, b := int8(x), int8(y)
+		return map[token.Token]bool{token.EQL: a == b, token.NEQ: a != b, token.LSS: a < b, token.LEQ: a <= b, token.GTR: a > b, token.GEQ: a >= b}[op]
+	}
+	return map[token.Token]bool{token.EQL: x == y, token.NEQ: x != y, token.LSS: x < y, token.LEQ: x <= y, token.GTR: x > y, token.GEQ: x >= y}[op]
+}
+func TestMBA_Exhaustive8Bit(t *testing.T) {
+	g := &mbaGenerator{depth: DefaultMBADepth}
+	args := []uint64{0, 0}
+	for _, signed := range []bool{false, true} {
+		for _, op := range mbaBinaryOps {
+			for i := 0; i < 2; i++ {
+				e := g.rewrite(op, mbaArg(0), mbaArg(1), g.depth)
+				for x := 0; x < 256; x++ {
+					for y := 0; y < 256; y++ {
+						args[0], args[1] = uint64(x), uint64(y)
+						if got, want := uint8(e.eval(args, 8, signed)), mbaReference(op, uint8(x), uint8(y), signed); got != want {
+							t.Fatalf("%s(%d, %d) = %d, want %d (signed %v)", op, x, y, got, want, signed)
+						}
+					}
+				}
+			}
+		}
+		for _, op := range mbaComparisons {
+			for i := 0; i < 2; i++ {
+				c := g.compare(op, mbaArg(0), mbaArg(1), signed)
+				for x := 0; x < 256; x++ {
+					for y := 0; y < 256; y++ {
+						args[0], args[1] = uint64(x), uint64(y)
+						if got, want := c.holds(args, 8, signed), mbaCompareReference(op, uint8(x), uint8(y), signed); got != want {
+							t.Fatalf("%d %s %d = %v, want %v (signed %v)", x, op, y, got, want, signed)
+						}
+					}
+				}
+			}
+		}
+		for _, op := range []token.Token{token.SUB, token.XOR} {
+			e := g.rewrite(op, mbaArg(0), nil, g.depth)
+			for x := 0; x < 256; x++ {
+				args[0] = uint64(x)
+				want := -uint8(x)
+				if op == token.XOR {
+					want = ^uint8(x)
+				}
+				if got := uint8(e.eval(args, 8, signed)); got != want {
+					t.Fatalf("unary %s %d = %d, want %d", op, x, got, want)
+				}
+			}
+		}
+	}
+}
+func TestMBA_ConstantsStayTyped(t *testing.T) {
+	// Operand 1 stands for a constant: below an operator, it must always meet an expression of
+	// operand 0, or the constant subexpression could overflow its type.
+	g := &mbaGenerator{depth: 3, consts: map[int]bool{1: true}}
+	var check func(n *mbaNode)
+	check = func(n *mbaNode) {
+		if n.x == nil {
+			return
+		}
+		if !g.typed(n) {
+			t.Fatalf("Constant subexpression of size %d", n.size())
+		}
+		check(n.x)
+		if n.y != nil {
+			check(n.y)
+		}
+	}
+	for _, op := range mbaBinaryOps {
+		for i := 0; i < 20; i++ {
+			check(g.rewrite(op, mbaArg(0), g.constant(mbaArg(0), mbaArg(1)), g.depth))
+		}
+	}
+}
+func FuzzMBA64(f *testing.F) {
+	f.Add(uint64(0), uint64(0), uint8(0))
+	f.Add(uint64(1)<<63, ^uint64(0), uint8(1))
+	f.Add(uint64(0x7fffffffffffffff), uint64(0x8000000000000000), uint8(7))
+	f.Add(uint64(0xdeadbeefcafebabe), uint64(12345), uint8(12))
+	g := &mbaGenerator{depth: DefaultMBADepth}
+	f.Fuzz(func(t *testing.T, x, y uint64, sel uint8) {
+		args := []uint64{x, y}
+		signed := sel&1 != 0
+		if op := sel >> 1 % 16; int(op) < len(mbaBinaryOps) {
+			e := g.rewrite(mbaBinaryOps[op], mbaArg(0), mbaArg(1), g.depth)
+			if got, want := e.eval(args, 64, signed), mbaBinary(mbaBinaryOps[op], mbaArg(0), mbaArg(1)).eval(args, 64, signed); got != want {
+				t.Fatalf("%#x %s %#x = %#x, want %#x", x, mbaBinaryOps[op], y, got, want)
+			}
+			return
+		}
+		op := mbaComparisons[int(sel>>1)%len(mbaComparisons)]
+		want := map[token.Token]bool{token.EQL: x == y, token.NEQ: x != y, token.LSS: x < y, token.LEQ: x <= y, token.GTR: x > y, token.GEQ: x >= y}[op]
+		if signed {
+			a, b := int64(x), int64(y)
+			want = map[token.Token]bool{token.EQL: a == b, token.NEQ: a != b, token.LSS: a < b, token.LEQ: a <= b, token.GTR: a > b, token.GEQ: a >= b}[op]
+		}
+		if got := g.compare(op, mbaArg(0), mbaArg(1), signed).holds(args, 64, signed); got != want {
+			t.Fatalf("%#x %s %#x = %v, want %v (signed %v)", x, op, y, got, want, signed)
+		}
+	})
+}
@@ -5,7 +5,10 @@ import (
 	"math/rand"
 )
 // MetamorphicEngine provides functions to generate varied but functionally equivalent code.
-type MetamorphicEngine struct{}
+type MetamorphicEngine struct {
+	// Predicates supplies the opaque predicates of the junk; without it, the junk is arithmetic only.
+	Predicates *OpaquePredicates
+}
 // GenerateJunkCodeBlock creates a block of random, non-functional "junk" code.
 func (e *MetamorphicEngine) GenerateJunkCodeBlock() []ast.Stmt {
 	// Randomly choose a junk code template
@@ -14,6 +17,9 @@ func (e *MetamorphicEngine) GenerateJunkCodeBlock() []ast.Stmt {
 	case 0:
 		return e.generateMathJunk()
 	case 1:
+		if e.Predicates == nil {
+			return e.generateMathJunk()
+		}
 		return []ast.Stmt{e.generateOpaquePredicate()}
 	default:
 		return []ast.Stmt{}
@@ -41,34 +47,7 @@ func (e *MetamorphicEngine) generateMathJunk() []ast.Stmt {
 		},
 	}
 }
-// generateOpaquePredicate creates an if statement with a condition that is always true.
+// generateOpaquePredicate creates an if statement whose body never runs.
 func (e *MetamorphicEngine) generateOpaquePredicate() ast.Stmt {
-	x, y := NewName(), NewName()
-	return &ast.IfStmt{
-		Init: &ast.AssignStmt{
-			Lhs: []ast.Expr{ast.NewIdent(x)}, Tok: token.DEFINE,
-			Rhs: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: "99"}},
-		},
-		Cond: &ast.BinaryExpr{
-			X: &ast.BinaryExpr{
-				X:  &ast.BinaryExpr{X: ast.NewIdent(x), Op: token.MUL, Y: ast.NewIdent(x)},
-				Op: token.ADD,
-				Y:  &ast.BasicLit{Kind: token.INT, Value: "1"},
-			},
-			Op: token.GTR,
-			Y:  &ast.BasicLit{Kind: token.INT, Value: "0"},
-		},
-		Body: &ast.BlockStmt{
-			List: []ast.Stmt{
-				&ast.AssignStmt{
-					Lhs: []ast.Expr{ast.NewIdent(y)}, Tok: token.DEFINE,
-					Rhs: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: `"junk"`}},
-				},
-				&ast.AssignStmt{
-					Lhs: []ast.Expr{ast.NewIdent("_")}, Tok: token.ASSIGN,
-					Rhs: []ast.Expr{ast.NewIdent(y)},
-				},
-			},
-		},
-	}
+	return e.Predicates.Dead(e.Predicates.Sink())
 }
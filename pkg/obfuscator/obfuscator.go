@@ -23,8 +23,8 @@ type TypeAwarePass interface {
 	Apply(obf *Obfuscator, pkg *packages.Package) error
 }
 // AddMetamorphicCode walks the AST and inserts junk code into function bodies.
-func AddMetamorphicCode(file *ast.File) {
-	engine := &MetamorphicEngine{}
+func AddMetamorphicCode(file *ast.File, preds *OpaquePredicates) {
+	engine := &MetamorphicEngine{Predicates: preds}
 	ast.Inspect(file, func(n ast.Node) bool {
 		fn, ok := n.(*ast.FuncDecl)
 		if !ok || fn.Body == nil || len(fn.Body.List) == 0 {
@@ -61,28 +61,37 @@ func (p *renamePass) Apply(obf *Obfuscator, fset *token.FileSet, file *ast.File)
 }
 type deadCodePass struct{}
 func (p *deadCodePass) Apply(obf *Obfuscator, fset *token.FileSet, file *ast.File) error {
-	InsertDeadCode(file)
+	InsertDeadCode(file, obf.predicates)
 	return nil
 }
-type controlFlowPass struct{}
+type controlFlowPass struct {
+	// Depth is how many levels of nested statements are lowered into dispatcher states.
+	Depth int
+	// WeaveStates ties the dispatcher state encoding to the weaving key.
+	WeaveStates bool
+	Backend     DispatcherBackend
+	// BogusDensity is the percentage of states given a bogus clone.
+	BogusDensity int
+}
 func (p *controlFlowPass) Apply(obf *Obfuscator, pkg *packages.Package) error {
+	stateKey := ""
+	if p.WeaveStates {
+		stateKey = obf.WeavingKeyVarName
+	}
 	for _, file := range pkg.Syntax {
-		ControlFlow(file, pkg.TypesInfo)
+		ControlFlow(pkg.Fset, file, pkg.TypesInfo, pkg.Types, ControlFlowOptions{Depth: p.Depth, StateKey: stateKey, Backend: p.Backend, Predicates: obf.predicates, BogusDensity: p.BogusDensity})
 	}
 	return nil
 }
-type expressionPass struct{}
+type expressionPass struct {
+	Depth int
+}
 func (p *expressionPass) Apply(obf *Obfuscator, pkg *packages.Package) error {
 	for _, file := range pkg.Syntax {
-		ObfuscateExpressions(file, pkg.TypesInfo)
+		ObfuscateExpressions(file, pkg.TypesInfo, p.Depth)
 	}
 	return nil
 }
-type constantPass struct{}
-func (p *constantPass) Apply(obf *Obfuscator, fset *token.FileSet, file *ast.File) error {
-	ObfuscateConstants(file)
-	return nil
-}
 type antiDebugPass struct{}
 func (p *antiDebugPass) Apply(obf *Obfuscator, fset *token.FileSet, file *ast.File) error {
 	pass := &AntiDebugPass{}
@@ -95,7 +104,7 @@ func (p *antiVMPass) Apply(obf *Obfuscator, fset *token.FileSet, file *ast.File)
 }
 type metamorphicPass struct{}
 func (p *metamorphicPass) Apply(obf *Obfuscator, fset *token.FileSet, file *ast.File) error {
-	AddMetamorphicCode(file)
+	AddMetamorphicCode(file, obf.predicates)
 	return nil
 }
 type selfModifyingPass struct{}
@@ -128,15 +137,75 @@ type Config struct {
 	EncryptStrings       bool
 	InsertDeadCode       bool
 	ObfuscateControlFlow bool
+	// ControlFlowDepth is how many levels of nested statements the control flow flattening
+	// lowers into dispatcher states; 0 means DefaultControlFlowDepth.
+	ControlFlowDepth int
+	// WeaveControlFlow mixes the weaving key into the dispatcher states, so that flattened code
+	// derails when a debugger or VM has been detected.
+	WeaveControlFlow bool
+	// DispatcherBackend is the shape of the flattening dispatchers, DispatcherRandom by default.
+	DispatcherBackend DispatcherBackend
+	// BogusFlowDensity is the percentage of flattened states that also get a mutated clone,
+	// never run but chosen against by an opaque predicate; 0 disables bogus control flow.
+	BogusFlowDensity int
+	// Virtualize compiles the functions marked //obf:virtualize into bytecode run by an
+	// interpreter package emitted into the main module of the output.
+	Virtualize bool
+	// OutlineFunctions moves runs of statements out of functions into helpers spread over the
+	// files of their package.
+	OutlineFunctions     bool
 	ObfuscateExpressions bool
-	ObfuscateConstants   bool
+	// ExpressionDepth is how many times the mixed boolean-arithmetic rewriting of expressions is
+	// applied to its own output; 0 means DefaultMBADepth.
+	ExpressionDepth    int
+	ObfuscateConstants bool
+	// ConstantDensity is the percentage of the eligible numeric constants moved into package
+	// variables; 0 means all of them.
+	ConstantDensity int
+	// EncodeValues stores local integer variables encoded, decoding them on every read.
+	EncodeValues         bool
+	// SplitBooleans splits bool variables, and the bool struct fields marked //obf:split, into
+	// integer shares whose parity is the truth value.
+	SplitBooleans        bool
 	ObfuscateDataFlow    bool
 	AntiDebugging        bool
 	AntiVM               bool
 	IndirectCalls        bool
+	// MergeFunctions folds groups of unexported functions returning the same types into
+	// super-functions selecting the original body by an extra argument.
+	MergeFunctions       bool
 	WeaveIntegrity       bool
 	AddMetamorphicCode   bool
 	EnableSelfModifying  bool
+	// EncryptStringConstants enables the type-aware handling of strings in constant contexts.
+	EncryptStringConstants bool
+	// ObfuscateDeps lists module path patterns (e.g. "example.com/secret/...") whose packages
+	// are obfuscated with the same passes and vendored into the output's vendor/ directory.
+	ObfuscateDeps []string
+	// StringMode is the default string encryption layout; StringModePackages overrides it
+	// for packages whose import path matches a pattern (same syntax as ObfuscateDeps).
+	StringMode         StringEncryptionMode
+	StringModePackages map[string]StringEncryptionMode
+	// StringCiphers are the backends mixed across the strings of the build according to
+	// StringCipherPolicy. Empty means all of StringCipherNames.
+	StringCiphers      []StringCipher
+	StringCipherPolicy StringCipherPolicy
+	// DeriveStringKeys derives string keys at runtime from state spread over each package
+	// instead of embedding them next to the ciphertext.
+	DeriveStringKeys bool
+	// DecoyDensity is the percentage of encrypted strings preceded by a decoy decryptor of a
+	// fake plaintext behind an opaque predicate. 0 disables decoys.
+	DecoyDensity int
+	// HideComparisons replaces equality checks against string and integer constants marked
+	// //obf:secret, on the comparison or the constant declaration, with comparisons of salted
+	// SHA-256 digests.
+	HideComparisons bool
+	// EncryptData encrypts integer data literals of at least DataEncryptionThreshold bytes
+	// and rune literals.
+	EncryptData             bool
+	DataEncryptionThreshold int
+	// EncryptEmbeds encrypts the files behind //go:embed variables and decrypts them on read.
+	EncryptEmbeds bool
 	Anti *Anti
 }
 type Obfuscator struct {
@@ -146,19 +215,62 @@ type Obfuscator struct {
 	WeavingKeyVarName string // Name of the global var for the anti-debug key
 	stringEncryption  *StringEncryptionPass
 	integrityWeaver   *IntegrityWeavingPass
+	// predicates generates the opaque predicates of the package being processed.
+	predicates *OpaquePredicates
+	// vm is the interpreter of virtualized functions, located by ProcessDirectory.
+	vm *virtualMachine
+	stringMode         StringEncryptionMode
+	stringModePackages map[string]StringEncryptionMode
+	// assets holds the files EmbedAssetsPass produced for each package.
+	assets map[*packages.Package]*packageAssets
 	anti *Anti
 }
 func NewObfuscator(cfg *Config) *Obfuscator {
 	obf := &Obfuscator{
-		WeavingKeyVarName: NewName(),
-		anti:              cfg.Anti,
+		WeavingKeyVarName:  NewName(),
+		anti:               cfg.Anti,
+		stringMode:         cfg.StringMode,
+		stringModePackages: cfg.StringModePackages,
 	}
 	// --- Pass Ordering ---
 	if cfg.AntiDebugging {
 		obf.syntaxPasses = append(obf.syntaxPasses, &antiDebugPass{})
 	}
+	if cfg.Virtualize {
+		// First, so the code it compiles is the original one.
+		obf.vm = newVirtualMachine()
+		obf.typeAwarePasses = append(obf.typeAwarePasses, &VirtualizationPass{})
+	}
+	if cfg.HideComparisons {
+		// Before StringConstPass, so constants only used in comparisons stay constants and vanish.
+		obf.typeAwarePasses = append(obf.typeAwarePasses, &ComparisonHashPass{})
+	}
 	if cfg.EncryptStrings {
 		obf.stringEncryption = NewStringEncryptionPass()
+		ciphers := cfg.StringCiphers
+		if len(ciphers) == 0 {
+			// Every backend, so that no single decryptor shape covers the strings of the build.
+			for _, name := range StringCipherNames {
+				c, _ := NewStringCipher(name)
+				ciphers = append(ciphers, c)
+			}
+		}
+		obf.stringEncryption.UseCiphers(cfg.StringCipherPolicy, ciphers...)
+		if cfg.DeriveStringKeys {
+			obf.stringEncryption.DeriveKeys()
+		}
+		if cfg.DecoyDensity > 0 {
+			obf.stringEncryption.UseDecoys(cfg.DecoyDensity)
+		}
+		if cfg.EncryptStringConstants {
+			obf.typeAwarePasses = append(obf.typeAwarePasses, &StringConstPass{})
+		}
+	}
+	if cfg.EncryptEmbeds {
+		obf.typeAwarePasses = append(obf.typeAwarePasses, &EmbedAssetsPass{})
+	}
+	if cfg.EncryptData {
+		obf.typeAwarePasses = append(obf.typeAwarePasses, &DataEncryptionPass{Threshold: cfg.DataEncryptionThreshold})
 	}
 	if cfg.AntiVM {
 		obf.syntaxPasses = append(obf.syntaxPasses, &antiVMPass{})
@@ -170,10 +282,23 @@ func NewObfuscator(cfg *Config) *Obfuscator {
 		obf.syntaxPasses = append(obf.syntaxPasses, &renamePass{})
 	}
 	if cfg.ObfuscateConstants {
-		obf.syntaxPasses = append(obf.syntaxPasses, &constantPass{})
+		// Before the expressions, which then rewrite the arithmetic over the variables.
+		obf.typeAwarePasses = append(obf.typeAwarePasses, &ConstantPass{Density: cfg.ConstantDensity})
+	}
+	if cfg.SplitBooleans {
+		// Before the values and expressions, which then also encode and rewrite the shares.
+		obf.typeAwarePasses = append(obf.typeAwarePasses, &BoolSplitPass{})
+	}
+	if cfg.EncodeValues {
+		// Before the expressions, which then also rewrite the encodings.
+		obf.typeAwarePasses = append(obf.typeAwarePasses, &ValueEncodingPass{})
 	}
 	if cfg.ObfuscateExpressions {
-		obf.typeAwarePasses = append(obf.typeAwarePasses, &expressionPass{})
+		depth := cfg.ExpressionDepth
+		if depth <= 0 {
+			depth = DefaultMBADepth
+		}
+		obf.typeAwarePasses = append(obf.typeAwarePasses, &expressionPass{Depth: depth})
 	}
 	if cfg.InsertDeadCode {
 		obf.syntaxPasses = append(obf.syntaxPasses, &deadCodePass{})
@@ -181,11 +306,19 @@ func NewObfuscator(cfg *Config) *Obfuscator {
 	if cfg.AddMetamorphicCode {
 		obf.syntaxPasses = append(obf.syntaxPasses, &metamorphicPass{})
 	}
+	if cfg.OutlineFunctions {
+		// Before flattening, which then also flattens the helpers.
+		obf.typeAwarePasses = append(obf.typeAwarePasses, &OutliningPass{})
+	}
 	if cfg.ObfuscateControlFlow {
-		obf.typeAwarePasses = append(obf.typeAwarePasses, &controlFlowPass{})
+		depth := cfg.ControlFlowDepth
+		if depth <= 0 {
+			depth = DefaultControlFlowDepth
+		}
+		obf.typeAwarePasses = append(obf.typeAwarePasses, &controlFlowPass{Depth: depth, WeaveStates: cfg.WeaveControlFlow, Backend: cfg.DispatcherBackend, BogusDensity: cfg.BogusFlowDensity})
 	}
-	if cfg.IndirectCalls {
-		obf.globalPasses = append(obf.globalPasses, &CallIndirectionPass{})
+	if cfg.IndirectCalls || cfg.MergeFunctions {
+		obf.globalPasses = append(obf.globalPasses, &CallIndirectionPass{MergeFunctions: cfg.MergeFunctions, DirectCalls: !cfg.IndirectCalls})
 	}
 	if cfg.EnableSelfModifying {
 		obf.syntaxPasses = append(obf.syntaxPasses, &selfModifyingPass{})
@@ -210,6 +343,13 @@ func ProcessDirectory(inputPath, outputPath string, cfg *Config) error {
 		Fset: fset,
 		Dir:  inputPath,
 	}
+	if len(cfg.ObfuscateDeps) > 0 {
+		// Dependencies must be loaded with syntax and module info so they can be vendored.
+		loadCfg.Mode |= packages.NeedImports | packages.NeedDeps | packages.NeedModule | packages.NeedEmbedFiles
+	}
+	if cfg.Virtualize {
+		loadCfg.Mode |= packages.NeedModule
+	}
 	pkgs, err := packages.Load(loadCfg, "./...")
 	if err != nil {
 		return fmt.Errorf("failed to load package: %w", err)
@@ -217,67 +357,150 @@ func ProcessDirectory(inputPath, outputPath string, cfg *Config) error {
 	if packages.PrintErrors(pkgs) > 0 {
 		return fmt.Errorf("errors occurred while loading packages")
 	}
+	if obfuscator.vm != nil {
+		obfuscator.vm.locate(findMainModule(pkgs), inputPath, outputPath)
+	}
 	for _, pkg := range pkgs {
-		fmt.Printf("Processing package: %s\n", pkg.PkgPath)
-		// Run type-aware passes that operate on the whole package at once.
-		for _, pass := range obfuscator.typeAwarePasses {
-			if err := pass.Apply(obfuscator, pkg); err != nil {
-				return fmt.Errorf("error in type-aware pass for package %s: %w", pkg.Name, err)
-			}
+		if err := obfuscator.processPackage(fset, pkg); err != nil {
+			return err
 		}
-		// Run syntax-only passes on each file individually.
-		for i, filePath := range pkg.GoFiles {
-			fileNode := pkg.Syntax[i]
-			fmt.Printf("  - File: %s\n", filePath)
-			// Special handling for string encryption
-			if obfuscator.stringEncryption != nil {
-				if err := obfuscator.stringEncryption.Apply(obfuscator, fset, fileNode); err != nil {
-					return fmt.Errorf("error in string encryption pass for file %s: %w", filePath, err)
-				}
-			}
-			for _, pass := range obfuscator.syntaxPasses {
-				if err := pass.Apply(obfuscator, fset, fileNode); err != nil {
-					return fmt.Errorf("error in syntax pass for file %s: %w", filePath, err)
-				}
-			}
+	}
+	// Write all modified files to the output directory.
+	for _, pkg := range pkgs {
+		if err := writePackageFiles(fset, pkg, inputPath, outputPath); err != nil {
+			return err
 		}
-		// Run global passes that operate on all files at once.
-		fileMap := make(map[string]*ast.File)
-		for i, filePath := range pkg.GoFiles {
-			fileMap[filePath] = pkg.Syntax[i]
+		if err := obfuscator.writeAssets(pkg, inputPath, outputPath); err != nil {
+			return err
 		}
-		for _, pass := range obfuscator.globalPasses {
-			if err := pass.Apply(obfuscator, fset, fileMap); err != nil {
-				return fmt.Errorf("error in global pass for package %s: %w", pkg.Name, err)
-			}
+	}
+	if obfuscator.vm != nil {
+		if err := obfuscator.vm.write(); err != nil {
+			return fmt.Errorf("failed to write interpreter: %w", err)
 		}
-		// Run the final integrity weaving pass if enabled.
-		if obfuscator.integrityWeaver != nil {
-			if err := obfuscator.integrityWeaver.Apply(obfuscator, fset, fileMap); err != nil {
-				return fmt.Errorf("error in integrity weaving pass for package %s: %w", pkg.Name, err)
-			}
+	}
+	if len(cfg.ObfuscateDeps) > 0 {
+		if err := obfuscator.vendorDependencies(fset, pkgs, inputPath, outputPath, cfg.ObfuscateDeps); err != nil {
+			return fmt.Errorf("failed to vendor dependencies: %w", err)
 		}
 	}
-	// Write all modified files to the output directory.
-	for _, pkg := range pkgs {
-		for i, filePath := range pkg.GoFiles {
-			fileNode := pkg.Syntax[i]
-			relPath, err := filepath.Rel(inputPath, filePath)
-			if err != nil {
-				return err
-			}
-			targetPath := filepath.Join(outputPath, relPath)
-			if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-				return err
-			}
-			var buf bytes.Buffer
-			if err := printer.Fprint(&buf, fset, fileNode); err != nil {
-				return fmt.Errorf("failed to print AST for %s: %w", filePath, err)
+	return nil
+}
+// processPackage runs every configured pass over a single loaded package.
+func (obfuscator *Obfuscator) processPackage(fset *token.FileSet, pkg *packages.Package) error {
+	fmt.Printf("Processing package: %s\n", pkg.PkgPath)
+	obfuscator.predicates = NewOpaquePredicates()
+	if obfuscator.stringEncryption != nil {
+		obfuscator.stringEncryption.BeginPackage(obfuscator.stringModeFor(pkg.PkgPath))
+		obfuscator.stringEncryption.metaEngine.Predicates = obfuscator.predicates
+	}
+	// Run type-aware passes that operate on the whole package at once.
+	for _, pass := range obfuscator.typeAwarePasses {
+		if err := pass.Apply(obfuscator, pkg); err != nil {
+			return fmt.Errorf("error in type-aware pass for package %s: %w", pkg.Name, err)
+		}
+	}
+	// Run syntax-only passes on each file individually.
+	for i, filePath := range pkg.GoFiles {
+		fileNode := pkg.Syntax[i]
+		fmt.Printf("  - File: %s\n", filePath)
+		// Special handling for string encryption
+		if obfuscator.stringEncryption != nil {
+			if err := obfuscator.stringEncryption.Apply(obfuscator, fset, fileNode); err != nil {
+				return fmt.Errorf("error in string encryption pass for file %s: %w", filePath, err)
 			}
-			if err := os.WriteFile(targetPath, buf.Bytes(), 0644); err != nil {
-				return fmt.Errorf("failed to write output file %s: %w", targetPath, err)
+		}
+		for _, pass := range obfuscator.syntaxPasses {
+			if err := pass.Apply(obfuscator, fset, fileNode); err != nil {
+				return fmt.Errorf("error in syntax pass for file %s: %w", filePath, err)
 			}
 		}
 	}
+	if obfuscator.stringEncryption != nil {
+		if err := obfuscator.stringEncryption.FinishPackage(obfuscator, fset, pkg.Syntax); err != nil {
+			return fmt.Errorf("error emitting string table for package %s: %w", pkg.Name, err)
+		}
+	}
+	obfuscator.predicates.Emit(fset, pkg.Syntax)
+	// Run global passes that operate on all files at once.
+	fileMap := make(map[string]*ast.File)
+	for i, filePath := range pkg.GoFiles {
+		fileMap[filePath] = pkg.Syntax[i]
+	}
+	for _, pass := range obfuscator.globalPasses {
+		if err := pass.Apply(obfuscator, fset, fileMap); err != nil {
+			return fmt.Errorf("error in global pass for package %s: %w", pkg.Name, err)
+		}
+	}
+	// Run the final integrity weaving pass if enabled.
+	if obfuscator.integrityWeaver != nil {
+		if err := obfuscator.integrityWeaver.Apply(obfuscator, fset, fileMap); err != nil {
+			return fmt.Errorf("error in integrity weaving pass for package %s: %w", pkg.Name, err)
+		}
+	}
+	ensureWeavingKeyDecl(obfuscator, pkg)
+	return nil
+}
+// stringModeFor returns the string encryption mode configured for the given package path. When
+// several patterns match, the most specific wins: the exact path, then the longest pattern.
+func (obfuscator *Obfuscator) stringModeFor(pkgPath string) StringEncryptionMode {
+	best := ""
+	for pattern := range obfuscator.stringModePackages {
+		if !matchModulePattern(pattern, pkgPath) || best == pkgPath {
+			continue
+		}
+		if best == "" || pattern == pkgPath || len(pattern) > len(best) || len(pattern) == len(best) && pattern < best {
+			best = pattern
+		}
+	}
+	if best != "" {
+		return obfuscator.stringModePackages[best]
+	}
+	if obfuscator.stringMode == "" {
+		return StringModeInline
+	}
+	return obfuscator.stringMode
+}
+// ensureWeavingKeyDecl declares the weaving key in packages where the anti-debug pass did not,
+// so that decryptors and dispatchers referencing it still compile outside package main.
+func ensureWeavingKeyDecl(obf *Obfuscator, pkg *packages.Package) {
+	if len(pkg.Syntax) == 0 {
+		return
+	}
+	for _, file := range pkg.Syntax {
+		if isVarDeclared(file, obf.WeavingKeyVarName) {
+			return
+		}
+	}
+	insertDeclsAfterImports(pkg.Syntax[0], []ast.Decl{&ast.GenDecl{
+		Tok: token.VAR,
+		Specs: []ast.Spec{
+			&ast.ValueSpec{
+				Names: []*ast.Ident{ast.NewIdent(obf.WeavingKeyVarName)},
+				Type:  ast.NewIdent("int64"),
+			},
+		},
+	}})
+}
+// writePackageFiles prints every file of pkg into outputPath, preserving its path relative to inputPath.
+func writePackageFiles(fset *token.FileSet, pkg *packages.Package, inputPath, outputPath string) error {
+	for i, filePath := range pkg.GoFiles {
+		fileNode := pkg.Syntax[i]
+		relPath, err := filepath.Rel(inputPath, filePath)
+		if err != nil {
+			return err
+		}
+		targetPath := filepath.Join(outputPath, relPath)
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := printer.Fprint(&buf, fset, fileNode); err != nil {
+			return fmt.Errorf("failed to print AST for %s: %w", filePath, err)
+		}
+		if err := os.WriteFile(targetPath, buf.Bytes(), 0644); err != nil {
+			return fmt.Errorf("failed to write output file %s: %w", targetPath, err)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,150 @@
+package obfuscator
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	mrand "math/rand"
+	"strings"
+)
+// opaqueTrueTemplates hold for any uint32 operands %[1]s and %[2]s, wraparound included, and
+// for pointers %[3]s and %[4]s to the same cell of the array %[6]s and %[5]s to the other one.
+// All of them are comparisons at the top, so flipping the operator yields a false predicate.
+var opaqueTrueTemplates = []string{
+	"(%[1]s*%[1]s+%[1]s)&1 == 0",       // n(n+1) is even
+	"(%[1]s*%[1]s)&3 != 2",              // squares are 0 or 1 mod 4
+	"((%[1]s|1)*(%[1]s|1))&7 == 1",      // odd squares are 1 mod 8
+	"uint64(%[1]s)*uint64(%[1]s)%%3 != 2", // squares are 0 or 1 mod 3
+	"uint64(%[1]s>>11)*uint64(%[1]s>>11+1)*uint64(%[1]s>>11+2)%%6 == 0", // three consecutive integers
+	"(%[1]s-1)*(%[1]s+1) == %[1]s*%[1]s-1",
+	"(%[1]s|%[2]s)+(%[1]s&%[2]s) == %[1]s+%[2]s",
+	"%[1]s^%[2]s == (%[1]s|%[2]s)-(%[1]s&%[2]s)",
+	"%[3]s == %[4]s",
+	"*%[3]s == *%[4]s",
+	"%[3]s != %[5]s",
+	"*%[3]s^*%[5]s == %[6]s[0]^%[6]s[1]",
+}
+// opaqueRandomTemplates depend on the run: %[7]d is a random bit index and %[8]d a random mask.
+var opaqueRandomTemplates = []string{
+	"(%[1]s>>%[7]d)&1 == 0",
+	"%[1]s&%[8]d != 0",
+	"*%[5]s>>%[7]d&1 != %[1]s>>%[7]d&1",
+	"%[1]s < %[2]s",
+}
+// OpaquePredicates generates predicates over package state initialized at run time: a seed
+// drawn from the iteration order of a map literal, an array derived from it and pointers aliasing
+// its cells. The compiler cannot prove anything about that state, so the predicates, and the code
+// they guard, survive into the binary. One generator serves all passes over a package; its state
+// is declared once by Emit.
+type OpaquePredicates struct {
+	seed  string
+	cells string
+	alias [2]string
+	other string
+	sink  string
+	used  bool
+}
+// NewOpaquePredicates returns a generator with fresh names for the package state.
+func NewOpaquePredicates() *OpaquePredicates {
+	return &OpaquePredicates{
+		seed:  NewName(),
+		cells: NewName(),
+		alias: [2]string{NewName(), NewName()},
+		other: NewName(),
+		sink:  NewName(),
+	}
+}
+// True returns a fresh predicate that holds on every run.
+func (p *OpaquePredicates) True() ast.Expr {
+	return p.predicate(opaqueTrueTemplates, false)
+}
+// False returns a fresh predicate that never holds.
+func (p *OpaquePredicates) False() ast.Expr {
+	return p.predicate(opaqueTrueTemplates, true)
+}
+// Random returns a fresh predicate whose value depends on the run.
+func (p *OpaquePredicates) Random() ast.Expr {
+	return p.predicate(opaqueRandomTemplates, false)
+}
+// Dead returns an if statement never running body, which the compiler must keep all the same.
+func (p *OpaquePredicates) Dead(body ...ast.Stmt) ast.Stmt {
+	return &ast.IfStmt{Cond: p.False(), Body: &ast.BlockStmt{List: body}}
+}
+// Sink returns a statement storing a value the compiler cannot predict into package state, for
+// bodies that must not be optimized away. It races with itself, so it only belongs in code that
+// never runs.
+func (p *OpaquePredicates) Sink() ast.Stmt {
+	p.used = true
+	src := fmt.Sprintf("%s ^= %s*%#x", p.sink, p.operand(), mrand.Uint32()|1)
+	return mustParseStmts(src)[0]
+}
+func (p *OpaquePredicates) predicate(templates []string, negate bool) ast.Expr {
+	p.used = true
+	a := p.operand()
+	b := p.operand()
+	for b == a {
+		b = p.operand()
+	}
+	i := mrand.Intn(2)
+	src := fmt.Sprintf(templates[mrand.Intn(len(templates))], a, b, p.alias[i], p.alias[1-i], p.other, p.cells, mrand.Intn(32), 1<<mrand.Intn(32))
+	expr := mustParseStmts("_ = " + src)[0].(*ast.AssignStmt).Rhs[0]
+	if negate {
+		cmp := expr.(*ast.BinaryExpr)
+		switch cmp.Op {
+		case token.EQL:
+			cmp.Op = token.NEQ
+		case token.NEQ:
+			cmp.Op = token.EQL
+		}
+	}
+	return expr
+}
+// operand returns a uint32 expression over the package state.
+func (p *OpaquePredicates) operand() string {
+	switch mrand.Intn(5) {
+	case 0:
+		return p.seed
+	case 1:
+		return fmt.Sprintf("(%s ^ %#x)", p.seed, mrand.Uint32())
+	case 2:
+		return fmt.Sprintf("(*%s)", p.alias[mrand.Intn(2)])
+	case 3:
+		return fmt.Sprintf("(*%s + %#x)", p.other, mrand.Uint32())
+	default:
+		return fmt.Sprintf("%s[%d]", p.cells, mrand.Intn(2))
+	}
+}
+// decls declares the package state. The seed is whichever key of a map literal the runtime
+// iterates over first.
+func (p *OpaquePredicates) decls() []ast.Decl {
+	var keys []string
+	for i := 0; i < 3+mrand.Intn(4); i++ {
+		keys = append(keys, fmt.Sprintf("%#x: true", mrand.Uint32()))
+	}
+	src := fmt.Sprintf(`var %[1]s = func() uint32 {
+	for k := range map[uint32]bool{%[2]s} {
+		return k
+	}
+	return %#[3]x
+}()
+var %[4]s = [2]uint32{%[1]s*%#[5]x | 1, %[1]s ^ %#[6]x}
+var %[7]s, %[8]s = &%[4]s[%[1]s&1], &%[4]s[%[1]s&1]
+var %[9]s = &%[4]s[%[1]s&1^1]
+var %[10]s uint32`, p.seed, strings.Join(keys, ", "), mrand.Uint32(), p.cells, mrand.Uint32()|1, mrand.Uint32(), p.alias[0], p.alias[1], p.other, p.sink)
+	return mustParseDecls(src)
+}
+// Emit declares the package state in the first of files built on every platform, if any
+// predicate was generated.
+func (p *OpaquePredicates) Emit(fset *token.FileSet, files []*ast.File) {
+	if !p.used || len(files) == 0 {
+		return
+	}
+	host := files[0]
+	for _, file := range files {
+		if buildsEverywhere(fset, file) {
+			host = file
+			break
+		}
+	}
+	appendDecls(host, p.decls())
+	p.used = false
+}
@@ -0,0 +1,119 @@
+package obfuscator
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+func TestOpaquePredicates_SurviveCompilation(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not available")
+	}
+	preds := NewOpaquePredicates()
+	kinds := []string{"true", "false", "random"}
+	var src strings.Builder
+	src.WriteString("package main\nimport \"fmt\"\nvar out uint32\n")
+	const probes = 60
+	for i := 0; i < probes; i++ {
+		var cond ast.Expr
+		switch kinds[i%3] {
+		case "true":
+			cond = preds.True()
+		case "false":
+			cond = preds.False()
+		default:
+			cond = preds.Random()
+		}
+		var buf bytes.Buffer
+		if err := printer.Fprint(&buf, token.NewFileSet(), cond); err != nil {
+			t.Fatalf("Failed to print predicate: %v", err)
+		}
+		fmt.Fprintf(&src, "//go:noinline\nfunc probe%d() {\n\tif %s {\n\t\tout = %#x\n\t} else {\n\t\tout = %#x\n\t}\n}\n", i, buf.String(), 0x5a5a0000+i, 0x3c3c0000+i)
+	}
+	src.WriteString("func main() {\n")
+	for i := 0; i < probes; i++ {
+		fmt.Fprintf(&src, "\tprobe%d()\n\tfmt.Printf(\"%%#x\\n\", out)\n", i)
+	}
+	src.WriteString("}\n")
+	state := &ast.File{Name: ast.NewIdent("main")}
+	preds.Emit(token.NewFileSet(), []*ast.File{state})
+	if len(state.Decls) == 0 {
+		t.Fatal("Expected the predicate state to be declared")
+	}
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"go.mod":   "module testprog\n\ngo 1.24.4\n",
+		"main.go":  src.String(),
+		"state.go": printFile(t, token.NewFileSet(), state),
+	})
+	bin := filepath.Join(dir, "probe")
+	run := func(name string, args ...string) string {
+		cmd := exec.Command(name, args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOWORK=off")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s %v failed: %v\n%s\n%s", name, args, err, out, src.String())
+		}
+		return string(out)
+	}
+	run("go", "build", "-o", bin, ".")
+	lines := strings.Fields(run(bin))
+	if len(lines) != probes {
+		t.Fatalf("Expected %d probe results, got %q", probes, lines)
+	}
+	dump := run("go", "tool", "objdump", "-s", `^main\.probe`, bin)
+	for i := 0; i < probes; i++ {
+		taken, skipped := fmt.Sprintf("%#x", 0x5a5a0000+i), fmt.Sprintf("%#x", 0x3c3c0000+i)
+		if !strings.Contains(dump, taken) || !strings.Contains(dump, skipped) {
+			t.Errorf("Predicate of probe%d (%s) was folded by the compiler:\n%s", i, kinds[i%3], src.String())
+		}
+		switch kinds[i%3] {
+		case "true":
+			if lines[i] != taken {
+				t.Errorf("Expected the true predicate of probe%d to hold, got %s", i, lines[i])
+			}
+		case "false":
+			if lines[i] != skipped {
+				t.Errorf("Expected the false predicate of probe%d not to hold, got %s", i, lines[i])
+			}
+		}
+	}
+}
+func TestInsertDeadCode_UsesOpaquePredicates(t *testing.T) {
+	src := `package main
+import "fmt"
+func main() {
+	total := 0
+	for i := 0; i < 5; i++ {
+		total += i
+		fmt.Println(i, total)
+	}
+	fmt.Println("total", total)
+	fmt.Println("done")
+}
+`
+	want := runGoProgram(t, map[string]string{"main.go": src})
+	for i := 0; i < 5; i++ {
+		fset, file := parseTestFile(t, src)
+		preds := NewOpaquePredicates()
+		for j := 0; j < 5; j++ {
+			InsertDeadCode(file, preds)
+			AddMetamorphicCode(file, preds)
+		}
+		preds.Emit(fset, []*ast.File{file})
+		out := printFile(t, fset, file)
+		if got := runGoProgram(t, map[string]string{"main.go": out}); got != want {
+			t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out)
+		}
+		if strings.Contains(out, ":= 123;") || strings.Contains(out, ":= 99;") {
+			t.Errorf("Expected no predicate over local constants:\n%s", out)
+		}
+	}
+}
@@ -0,0 +1,785 @@
+package obfuscator
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strings"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+// outlineDepth is how many times the helpers produced by outlining are outlined again.
+const outlineDepth = 2
+// outlineMinWeight is the smallest number of statements, nested ones included, moved into a helper.
+const outlineMinWeight = 3
+// outlineMaxRun is the largest number of consecutive statements of a block moved into one helper.
+const outlineMaxRun = 4
+// OutliningPass moves runs of statements out of functions into new package-level helpers spread
+// over the files of the package, so the code of one function ends up in many small ones. The
+// variables of the function used by a run are passed by pointer; returns and branches leaving the
+// run become signals the caller acts upon, with returned values written through pointers.
+type OutliningPass struct {
+	// draw picks the lengths of the runs and the files of the helpers; randInt if nil.
+	draw func(max int64) int64
+}
+func (p *OutliningPass) Apply(obf *Obfuscator, pkg *packages.Package) error {
+	o := &outliner{fset: pkg.Fset, pkg: pkg.Types, info: pkg.TypesInfo, helpers: make(map[*ast.FuncDecl]bool), moved: make(map[*ast.File][]string), draw: p.draw}
+	if o.draw == nil {
+		o.draw = randInt
+	}
+	for _, file := range pkg.Syntax {
+		if o.hostFile(file) {
+			o.hosts = append(o.hosts, file)
+		}
+	}
+	for _, file := range pkg.Syntax {
+		if usesCgo(file) {
+			continue
+		}
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Body == nil || o.helpers[fn] || o.info.Defs[fn.Name] == nil {
+				continue
+			}
+			if reason := outlineBlocker(fn, o.info); reason != "" {
+				fmt.Printf("    - %s not outlined: %s\n", fn.Name.Name, reason)
+				continue
+			}
+			before := o.count
+			o.function(file, fn.Body, o.info.Defs[fn.Name].Type().(*types.Signature).Results(), outlineDepth)
+			if o.count > before {
+				fmt.Printf("    - Outlined %d statement runs of %s into helpers\n", o.count-before, fn.Name.Name)
+			}
+		}
+	}
+	for file, paths := range o.moved {
+		for _, path := range paths {
+			dropUnusedImport(o.fset, file, path)
+		}
+	}
+	return nil
+}
+// outlineBlocker returns why the statements of fn cannot be moved to other functions, if they cannot.
+func outlineBlocker(fn *ast.FuncDecl, info *types.Info) string {
+	if sig := info.Defs[fn.Name].Type().(*types.Signature); sig.TypeParams().Len() > 0 || sig.RecvTypeParams().Len() > 0 {
+		return "generic"
+	}
+	if directive := stackDirective(fn.Doc); directive != "" {
+		return directive
+	}
+	reason := ""
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		if br, ok := n.(*ast.BranchStmt); ok && br.Tok == token.GOTO {
+			reason = "uses goto"
+		}
+		return reason == ""
+	})
+	return reason
+}
+// outliner holds the state of OutliningPass over one package. It keeps the type information up to
+// date for the code it generates, so that later passes see helpers like any other function.
+type outliner struct {
+	fset    *token.FileSet
+	pkg     *types.Package
+	info    *types.Info
+	hosts   []*ast.File
+	helpers map[*ast.FuncDecl]bool
+	count   int
+	// moved holds the import paths of packages referred to by code moved out of each file.
+	moved map[*ast.File][]string
+	draw  func(max int64) int64
+}
+// outlinedFunc is a function whose blocks are being outlined.
+type outlinedFunc struct {
+	file    *ast.File
+	results *types.Tuple
+	depth   int
+	// untyped holds the names of locals declared by generated code, which has no type information.
+	untyped map[string]bool
+}
+// run describes a run of statements about to be moved into a helper.
+type run struct {
+	defined map[types.Object]bool
+	names   map[string]bool
+	labels  map[string]bool
+	// outer lists the variables declared outside the run, in order of first use, with the
+	// identifiers referring to them.
+	outer   []*types.Var
+	uses    map[*types.Var][]*ast.Ident
+	pkgRefs map[*ast.Ident]*types.PkgName
+	// returns and branches leave the run.
+	returns  []*ast.ReturnStmt
+	branches []*ast.BranchStmt
+	// terminal is set when the run ends in a terminating statement, which the call replacing it
+	// must end in too.
+	terminal bool
+}
+func (o *outliner) function(file *ast.File, body *ast.BlockStmt, results *types.Tuple, depth int) {
+	fn := &outlinedFunc{file: file, results: results, depth: depth, untyped: make(map[string]bool)}
+	ast.Inspect(body, func(n ast.Node) bool {
+		var names []*ast.Ident
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			if n.Tok == token.DEFINE {
+				for _, lhs := range n.Lhs {
+					if id, ok := lhs.(*ast.Ident); ok {
+						names = append(names, id)
+					}
+				}
+			}
+		case *ast.RangeStmt:
+			if n.Tok == token.DEFINE {
+				for _, e := range []ast.Expr{n.Key, n.Value} {
+					if id, ok := e.(*ast.Ident); ok {
+						names = append(names, id)
+					}
+				}
+			}
+		case *ast.ValueSpec:
+			names = n.Names
+		case *ast.Field:
+			names = n.Names
+		}
+		for _, id := range names {
+			if _, typed := o.info.Defs[id]; !typed {
+				fn.untyped[id.Name] = true
+			}
+		}
+		return true
+	})
+	// A helper moving its whole body into another one would only wrap it.
+	body.List = o.block(fn, body.List, depth == outlineDepth)
+}
+// block outlines runs of list and the blocks nested in the statements left in place. whole allows
+// a single run to take all of list.
+func (o *outliner) block(fn *outlinedFunc, list []ast.Stmt, whole bool) []ast.Stmt {
+	var out []ast.Stmt
+	for i := 0; i < len(list); {
+		moved := false
+		for n := min(1+int(o.draw(outlineMaxRun)), len(list)-i); n > 0 && !moved; n-- {
+			if (n == len(list) && !whole) || statementWeight(list[i:i+n]) < outlineMinWeight {
+				continue
+			}
+			if stmts, ok := o.extract(fn, list[i:i+n], list[i+n:]); ok {
+				out = append(out, stmts...)
+				i += n
+				moved = true
+			}
+		}
+		if !moved {
+			o.nested(fn, list[i])
+			out = append(out, list[i])
+			i++
+		}
+	}
+	return out
+}
+// nested outlines the blocks of stmt.
+func (o *outliner) nested(fn *outlinedFunc, stmt ast.Stmt) {
+	switch s := stmt.(type) {
+	case *ast.BlockStmt:
+		s.List = o.block(fn, s.List, true)
+	case *ast.LabeledStmt:
+		o.nested(fn, s.Stmt)
+	case *ast.IfStmt:
+		s.Body.List = o.block(fn, s.Body.List, true)
+		if s.Else != nil {
+			o.nested(fn, s.Else)
+		}
+	case *ast.ForStmt:
+		s.Body.List = o.block(fn, s.Body.List, true)
+	case *ast.RangeStmt:
+		s.Body.List = o.block(fn, s.Body.List, true)
+	case *ast.SwitchStmt:
+		for _, c := range s.Body.List {
+			c.(*ast.CaseClause).Body = o.block(fn, c.(*ast.CaseClause).Body, true)
+		}
+	case *ast.TypeSwitchStmt:
+		for _, c := range s.Body.List {
+			c.(*ast.CaseClause).Body = o.block(fn, c.(*ast.CaseClause).Body, true)
+		}
+	case *ast.SelectStmt:
+		for _, c := range s.Body.List {
+			c.(*ast.CommClause).Body = o.block(fn, c.(*ast.CommClause).Body, true)
+		}
+	}
+}
+// statementWeight counts the statements of list, nested ones included.
+func statementWeight(list []ast.Stmt) int {
+	weight := 0
+	for _, stmt := range list {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			if _, ok := n.(ast.Stmt); ok {
+				if _, block := n.(*ast.BlockStmt); !block {
+					weight++
+				}
+			}
+			return true
+		})
+	}
+	return weight
+}
+// analyze checks that stmts can run in another function and collects what moving them involves.
+// rest holds the statements following them in their block, the only ones that may refer to
+// their declarations.
+func (o *outliner) analyze(fn *outlinedFunc, stmts, rest []ast.Stmt) (*run, bool) {
+	r := &run{defined: make(map[types.Object]bool), names: make(map[string]bool), labels: make(map[string]bool), uses: make(map[*types.Var][]*ast.Ident), pkgRefs: make(map[*ast.Ident]*types.PkgName)}
+	for _, stmt := range stmts {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			var obj types.Object
+			switch n := n.(type) {
+			case *ast.Ident:
+				obj = o.info.Defs[n]
+				if _, def := o.info.Defs[n]; def {
+					r.names[n.Name] = true
+				}
+			case *ast.CaseClause:
+				obj = o.info.Implicits[n]
+			case *ast.LabeledStmt:
+				r.labels[n.Label.Name] = true
+			}
+			if obj != nil {
+				r.defined[obj] = true
+			}
+			return true
+		})
+	}
+	ok := true
+	for _, stmt := range stmts {
+		walkWithStack(stmt, func(n ast.Node, stack []ast.Node) {
+			inLit := false
+			for _, anc := range stack[:len(stack)-1] {
+				_, lit := anc.(*ast.FuncLit)
+				inLit = inLit || lit
+			}
+			switch n := n.(type) {
+			case *ast.DeferStmt:
+				ok = ok && inLit
+			case *ast.CallExpr:
+				if id, isIdent := ast.Unparen(n.Fun).(*ast.Ident); isIdent && !inLit {
+					if b, builtin := o.info.Uses[id].(*types.Builtin); builtin && b.Name() == "recover" {
+						ok = false
+					}
+				}
+			case *ast.ReturnStmt:
+				if !inLit {
+					r.returns = append(r.returns, n)
+				}
+			case *ast.BranchStmt:
+				if !inLit && r.leaves(n, stack) {
+					ok = ok && n.Tok != token.GOTO && n.Tok != token.FALLTHROUGH
+					r.branches = append(r.branches, n)
+				}
+			case *ast.Ident:
+				ok = ok && o.reference(fn, r, n, stack)
+			}
+		})
+	}
+	for _, stmt := range rest {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			if id, isIdent := n.(*ast.Ident); isIdent && r.defined[o.info.Uses[id]] {
+				ok = false
+			}
+			return ok
+		})
+	}
+	return r, ok
+}
+// leaves reports whether br, found in the run under stack, jumps out of it.
+func (r *run) leaves(br *ast.BranchStmt, stack []ast.Node) bool {
+	if br.Label != nil {
+		return !r.labels[br.Label.Name]
+	}
+	for i := len(stack) - 2; i >= 0; i-- {
+		switch stack[i].(type) {
+		case *ast.ForStmt, *ast.RangeStmt:
+			return false
+		case *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+			if br.Tok != token.CONTINUE {
+				return false
+			}
+		}
+	}
+	return true
+}
+// reference records what the identifier id of the run refers to, and reports whether the run can
+// still be moved.
+func (o *outliner) reference(fn *outlinedFunc, r *run, id *ast.Ident, stack []ast.Node) bool {
+	obj := o.info.Uses[id]
+	if obj == nil {
+		// Generated code has no type information: a local it declared cannot be passed on.
+		_, def := o.info.Defs[id]
+		return def || !fn.untyped[id.Name] || r.names[id.Name]
+	}
+	if r.defined[obj] {
+		return true
+	}
+	local := obj.Pkg() == o.pkg && obj.Parent() != o.pkg.Scope()
+	switch obj := obj.(type) {
+	case *types.Var:
+		if !local || obj.IsField() {
+			return true
+		}
+		if as, ok := stack[len(stack)-2].(*ast.AssignStmt); ok && as.Tok == token.DEFINE {
+			for _, lhs := range as.Lhs {
+				if lhs == id {
+					// Redeclared by :=, which needs the variable itself.
+					return false
+				}
+			}
+		}
+		if r.uses[obj] == nil {
+			r.outer = append(r.outer, obj)
+		}
+		r.uses[obj] = append(r.uses[obj], id)
+	case *types.PkgName:
+		r.pkgRefs[id] = obj
+	case *types.TypeName, *types.Const:
+		// Local types, type parameters and local constants are not visible in a helper.
+		return !local
+	}
+	return true
+}
+// extract moves stmts into a new helper and returns the statements calling it, or reports that
+// they must stay.
+func (o *outliner) extract(fn *outlinedFunc, stmts, rest []ast.Stmt) ([]ast.Stmt, bool) {
+	r, ok := o.analyze(fn, stmts, rest)
+	if !ok {
+		return nil, false
+	}
+	if r.terminal = terminates(stmts[len(stmts)-1], ""); r.terminal && len(r.returns) == 0 {
+		// The run ends in a panic or an endless loop, which the caller has no way to mirror.
+		return nil, false
+	}
+	valueReturns := false
+	for _, ret := range r.returns {
+		valueReturns = valueReturns || len(ret.Results) > 0
+	}
+	// Result slots are declared by the caller, at the position of the run.
+	var slots []*types.Var
+	var slotTypes []ast.Expr
+	names := newTypeNamer(o.fset, fn.file, o.pkg, stmts[0].Pos())
+	if valueReturns {
+		for i := 0; i < fn.results.Len(); i++ {
+			t := fn.results.At(i).Type()
+			expr, err := names.expr(t)
+			if err != nil {
+				return nil, false
+			}
+			slots = append(slots, types.NewVar(token.NoPos, o.pkg, NewName(), t))
+			slotTypes = append(slotTypes, expr)
+		}
+	}
+	for _, host := range o.destinations(fn.file) {
+		if helper, call := o.build(fn, host, stmts, r, slots, slotTypes); helper != nil {
+			names.addImports()
+			return call, true
+		}
+	}
+	return nil, false
+}
+// destinations returns the files a helper of a function in file may be put in, in order of
+// preference. Files with build constraints keep their helpers, since the code of a helper may
+// depend on them; other files send them to any file built everywhere.
+func (o *outliner) destinations(file *ast.File) []*ast.File {
+	for _, host := range o.hosts {
+		if host == file {
+			if other := o.hosts[o.draw(int64(len(o.hosts)))]; other != file {
+				return []*ast.File{other, file}
+			}
+			break
+		}
+	}
+	return []*ast.File{file}
+}
+// hostFile reports whether file is built with every other file of the package and can receive
+// code from any of them.
+func (o *outliner) hostFile(file *ast.File) bool {
+	return !usesCgo(file) && !hasDotImport(file) && buildsEverywhere(o.fset, file)
+}
+// buildsEverywhere reports whether file has neither a build constraint nor a GOOS or GOARCH
+// suffix, so that it is compiled with every other file of its package.
+func buildsEverywhere(fset *token.FileSet, file *ast.File) bool {
+	for _, group := range file.Comments {
+		if group.Pos() >= file.Package {
+			break
+		}
+		for _, c := range group.List {
+			if strings.HasPrefix(c.Text, "//go:build") || strings.HasPrefix(c.Text, "// +build") {
+				return false
+			}
+		}
+	}
+	name := strings.TrimSuffix(filepath.Base(fset.Position(file.Package).Filename), ".go")
+	elems := strings.Split(strings.TrimSuffix(name, "_test"), "_")
+	for _, elem := range elems[1:] {
+		if knownOS[elem] || knownArch[elem] {
+			return false
+		}
+	}
+	return true
+}
+// knownOS and knownArch are the GOOS and GOARCH values that constrain files by name.
+var knownOS = map[string]bool{"aix": true, "android": true, "darwin": true, "dragonfly": true, "freebsd": true, "hurd": true, "illumos": true, "ios": true, "js": true, "linux": true, "nacl": true, "netbsd": true, "openbsd": true, "plan9": true, "solaris": true, "wasip1": true, "windows": true, "zos": true}
+var knownArch = map[string]bool{"386": true, "amd64": true, "amd64p32": true, "arm": true, "armbe": true, "arm64": true, "arm64be": true, "loong64": true, "mips": true, "mipsle": true, "mips64": true, "mips64le": true, "mips64p32": true, "mips64p32le": true, "ppc": true, "ppc64": true, "ppc64le": true, "riscv": true, "riscv64": true, "s390": true, "s390x": true, "sparc": true, "sparc64": true, "wasm": true}
+// usesCgo reports whether file imports "C".
+func usesCgo(file *ast.File) bool {
+	for _, imp := range file.Imports {
+		if imp.Path.Value == `"C"` {
+			return true
+		}
+	}
+	return false
+}
+// build moves stmts into a helper declared in host. It returns nil, leaving everything untouched,
+// if the types or packages the helper refers to cannot be named in host.
+func (o *outliner) build(fn *outlinedFunc, host *ast.File, stmts []ast.Stmt, r *run, slots []*types.Var, slotTypes []ast.Expr) (*ast.FuncDecl, []ast.Stmt) {
+	names := newTypeNamer(o.fset, host, o.pkg, host.Name.End())
+	var params []*types.Var
+	var paramTypes []ast.Expr
+	for _, v := range append(append([]*types.Var(nil), r.outer...), slots...) {
+		ptr := types.NewPointer(v.Type())
+		expr, err := names.expr(ptr)
+		if err != nil {
+			return nil, nil
+		}
+		params = append(params, types.NewParam(token.NoPos, o.pkg, NewName(), ptr))
+		paramTypes = append(paramTypes, expr)
+	}
+	renames := make(map[*ast.Ident]string)
+	if host != fn.file {
+		for id, pn := range r.pkgRefs {
+			name, err := names.packageName(pn.Imported().Path(), pn.Imported().Name())
+			if err != nil || name == "" || (name != id.Name && r.names[name]) {
+				return nil, nil
+			}
+			renames[id] = name
+		}
+	}
+	names.addImports()
+	// Everything below changes the code for good.
+	start := stmts[0].Pos()
+	dropComments(fn.file, &ast.BlockStmt{Lbrace: start, List: stmts, Rbrace: stmts[len(stmts)-1].End()})
+	for id, name := range renames {
+		id.Name = name
+	}
+	if host != fn.file {
+		for _, pn := range r.pkgRefs {
+			o.moved[fn.file] = append(o.moved[fn.file], pn.Imported().Path())
+		}
+	}
+	codes := make(map[string]int)
+	code := func(signal string) ast.Expr {
+		if _, ok := codes[signal]; !ok {
+			for {
+				c := int(randInt(1<<31-1)) + 1
+				unique := true
+				for _, other := range codes {
+					unique = unique && other != c
+				}
+				if unique {
+					codes[signal] = c
+					break
+				}
+			}
+		}
+		return o.intLit(codes[signal])
+	}
+	// paramRef dereferences the parameter i, at the position of the code it stands for.
+	paramRef := func(i int, pos token.Pos) ast.Expr {
+		id := &ast.Ident{NamePos: pos, Name: params[i].Name()}
+		o.info.Uses[id] = params[i]
+		star := &ast.StarExpr{Star: pos, X: id}
+		paren := &ast.ParenExpr{Lparen: pos, X: star, Rparen: pos}
+		o.info.Types[star] = types.TypeAndValue{Type: params[i].Type().(*types.Pointer).Elem()}
+		o.info.Types[paren] = o.info.Types[star]
+		return paren
+	}
+	replaced := make(map[*ast.Ident]int)
+	for i, v := range r.outer {
+		for _, id := range r.uses[v] {
+			replaced[id] = i
+		}
+	}
+	// A return of values writes them through the slots, then signals; the values are evaluated
+	// first as in the original statement.
+	// A terminating run with a single way out needs no signal: the caller takes it after the call.
+	kinds := make(map[bool]bool)
+	for _, ret := range r.returns {
+		kinds[len(ret.Results) > 0] = true
+	}
+	quiet := r.terminal && len(r.branches) == 0 && len(kinds) == 1
+	signalReturn := func(kind string) *ast.ReturnStmt {
+		if quiet {
+			return &ast.ReturnStmt{}
+		}
+		return &ast.ReturnStmt{Results: []ast.Expr{code(kind)}}
+	}
+	signals := make(map[ast.Stmt][]ast.Stmt)
+	var branchSignals []*ast.BranchStmt
+	for _, ret := range r.returns {
+		if len(ret.Results) == 0 {
+			signals[ret] = []ast.Stmt{signalReturn("return")}
+			continue
+		}
+		var lhs []ast.Expr
+		for i := range slots {
+			lhs = append(lhs, paramRef(len(r.outer)+i, ret.Pos()))
+		}
+		signals[ret] = []ast.Stmt{
+			&ast.AssignStmt{Lhs: lhs, Tok: token.ASSIGN, Rhs: ret.Results},
+			signalReturn("values"),
+		}
+	}
+	for _, br := range r.branches {
+		key := br.Tok.String()
+		if br.Label != nil {
+			key += " " + br.Label.Name
+		}
+		if _, seen := codes[key]; !seen {
+			branchSignals = append(branchSignals, br)
+		}
+		signals[br] = []ast.Stmt{signalReturn(key)}
+	}
+	for stmt, replacement := range signals {
+		for _, s := range replacement {
+			fillPositions(s, stmt.Pos())
+		}
+	}
+	body := &ast.BlockStmt{List: append([]ast.Stmt(nil), stmts...)}
+	astutil.Apply(body, nil, func(cursor *astutil.Cursor) bool {
+		switch n := cursor.Node().(type) {
+		case *ast.Ident:
+			if i, ok := replaced[n]; ok {
+				cursor.Replace(paramRef(i, n.Pos()))
+			}
+		case ast.Stmt:
+			replacement, ok := signals[n]
+			switch {
+			case !ok:
+			case len(replacement) == 1:
+				cursor.Replace(replacement[0])
+			case cursor.Index() >= 0:
+				cursor.InsertBefore(replacement[0])
+				cursor.Replace(replacement[1])
+			default:
+				cursor.Replace(&ast.BlockStmt{Lbrace: n.Pos(), List: replacement, Rbrace: n.Pos()})
+			}
+		}
+		return true
+	})
+	var results *types.Tuple
+	helperType := &ast.FuncType{Params: &ast.FieldList{}}
+	for i, p := range params {
+		id := ast.NewIdent(p.Name())
+		o.info.Defs[id] = p
+		helperType.Params.List = append(helperType.Params.List, &ast.Field{Names: []*ast.Ident{id}, Type: paramTypes[i]})
+	}
+	if len(codes) > 0 {
+		results = types.NewTuple(types.NewParam(token.NoPos, o.pkg, "", types.Typ[types.Int]))
+		helperType.Results = &ast.FieldList{List: []*ast.Field{{Type: ast.NewIdent("int")}}}
+		if !r.terminal {
+			body.List = append(body.List, &ast.ReturnStmt{Results: []ast.Expr{code("")}})
+		}
+	}
+	sig := types.NewSignatureType(nil, nil, nil, types.NewTuple(params...), results, false)
+	helper := &ast.FuncDecl{Name: ast.NewIdent(NewName()), Type: helperType, Body: body}
+	obj := types.NewFunc(token.NoPos, o.pkg, helper.Name.Name, sig)
+	o.info.Defs[helper.Name] = obj
+	o.pkg.Scope().Insert(obj)
+	fillPositions(helper, host.Name.End())
+	appendDecls(host, []ast.Decl{helper})
+	o.helpers[helper] = true
+	o.count++
+	// The call passes the variables and result slots by address.
+	callee := ast.NewIdent(helper.Name.Name)
+	o.info.Uses[callee] = obj
+	call := &ast.CallExpr{Fun: callee}
+	o.info.Types[call] = types.TypeAndValue{Type: types.NewTuple()}
+	if results != nil {
+		o.info.Types[call] = types.TypeAndValue{Type: types.Typ[types.Int]}
+	}
+	var out []ast.Stmt
+	var slotRefs []ast.Expr
+	for i, v := range append(append([]*types.Var(nil), r.outer...), slots...) {
+		id := ast.NewIdent(v.Name())
+		if i < len(r.outer) {
+			use := r.uses[v][0]
+			id.Name, id.Obj = use.Name, use.Obj
+		} else {
+			def := ast.NewIdent(v.Name())
+			o.info.Defs[def] = v
+			out = append(out, &ast.DeclStmt{Decl: &ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{&ast.ValueSpec{Names: []*ast.Ident{def}, Type: slotTypes[i-len(r.outer)]}}}})
+			ref := ast.NewIdent(v.Name())
+			o.info.Uses[ref] = v
+			slotRefs = append(slotRefs, ref)
+		}
+		o.info.Uses[id] = v
+		addr := &ast.UnaryExpr{Op: token.AND, X: id}
+		o.info.Types[addr] = types.TypeAndValue{Type: types.NewPointer(v.Type())}
+		call.Args = append(call.Args, addr)
+	}
+	switch {
+	case quiet && kinds[true]:
+		out = append(out, &ast.ExprStmt{X: call}, &ast.ReturnStmt{Results: slotRefs})
+	case quiet:
+		out = append(out, &ast.ExprStmt{X: call}, &ast.ReturnStmt{})
+	case results == nil:
+		out = append(out, &ast.ExprStmt{X: call})
+	default:
+		out = append(out, o.dispatchSignals(call, codes, branchSignals, slotRefs, r.terminal)...)
+	}
+	for _, stmt := range out {
+		fillPositions(stmt, start)
+	}
+	if fn.depth > 0 {
+		o.function(host, body, results, fn.depth-1)
+	}
+	return helper, out
+}
+// dispatchSignals returns the statement calling a helper and acting on the signal it returns:
+// returning from the caller or branching as the moved statements did. When the moved statements
+// were terminating, one of their returns is taken unconditionally after checking the other signals.
+func (o *outliner) dispatchSignals(call *ast.CallExpr, codes map[string]int, branches []*ast.BranchStmt, slots []ast.Expr, terminal bool) []ast.Stmt {
+	signal := types.NewVar(token.NoPos, o.pkg, NewName(), types.Typ[types.Int])
+	def := ast.NewIdent(signal.Name())
+	o.info.Defs[def] = signal
+	type action struct {
+		code int
+		stmt ast.Stmt
+	}
+	var actions []action
+	if c, ok := codes["return"]; ok {
+		actions = append(actions, action{c, &ast.ReturnStmt{}})
+	}
+	if c, ok := codes["values"]; ok {
+		actions = append(actions, action{c, &ast.ReturnStmt{Results: slots}})
+	}
+	returns := len(actions)
+	for _, br := range branches {
+		key := br.Tok.String()
+		branch := &ast.BranchStmt{Tok: br.Tok}
+		if br.Label != nil {
+			key += " " + br.Label.Name
+			branch.Label = ast.NewIdent(br.Label.Name)
+			o.info.Uses[branch.Label] = o.info.Uses[br.Label]
+		}
+		actions = append(actions, action{codes[key], branch})
+	}
+	var last ast.Stmt
+	if terminal {
+		i := int(randInt(int64(returns)))
+		last = actions[i].stmt
+		actions = append(actions[:i], actions[i+1:]...)
+	}
+	var chain *ast.IfStmt
+	for _, i := range randomPermutation(len(actions)) {
+		ref := ast.NewIdent(signal.Name())
+		o.info.Uses[ref] = signal
+		cond := &ast.BinaryExpr{X: ref, Op: token.EQL, Y: o.intLit(actions[i].code)}
+		o.info.Types[cond] = types.TypeAndValue{Type: types.Typ[types.Bool]}
+		next := &ast.IfStmt{Cond: cond, Body: &ast.BlockStmt{List: []ast.Stmt{actions[i].stmt}}}
+		if chain != nil {
+			next.Else = chain
+		}
+		chain = next
+	}
+	chain.Init = &ast.AssignStmt{Lhs: []ast.Expr{def}, Tok: token.DEFINE, Rhs: []ast.Expr{call}}
+	if last != nil {
+		return []ast.Stmt{chain, last}
+	}
+	return []ast.Stmt{chain}
+}
+// intLit returns a typed literal of the int value v.
+func (o *outliner) intLit(v int) ast.Expr {
+	lit := stateLiteral(uint32(v))
+	o.info.Types[lit] = types.TypeAndValue{Type: types.Typ[types.Int], Value: constant.MakeInt64(int64(v))}
+	return lit
+}
+// terminates reports whether stmt is a terminating statement as defined by the specification, so
+// that no statement needs to follow it at the end of a function. label is the label of stmt.
+func terminates(stmt ast.Stmt, label string) bool {
+	switch s := stmt.(type) {
+	case *ast.ReturnStmt:
+		return true
+	case *ast.BranchStmt:
+		return s.Tok == token.GOTO || s.Tok == token.FALLTHROUGH
+	case *ast.ExprStmt:
+		call, ok := s.X.(*ast.CallExpr)
+		if !ok {
+			return false
+		}
+		id, ok := ast.Unparen(call.Fun).(*ast.Ident)
+		return ok && id.Name == "panic" && id.Obj == nil
+	case *ast.LabeledStmt:
+		return terminates(s.Stmt, s.Label.Name)
+	case *ast.BlockStmt:
+		return terminatesList(s.List)
+	case *ast.IfStmt:
+		return s.Else != nil && terminatesList(s.Body.List) && terminates(s.Else, "")
+	case *ast.ForStmt:
+		return s.Cond == nil && !hasBreak(s.Body, label)
+	case *ast.SwitchStmt:
+		return terminatesClauses(s.Body, label)
+	case *ast.TypeSwitchStmt:
+		return terminatesClauses(s.Body, label)
+	case *ast.SelectStmt:
+		return terminatesClauses(s.Body, label)
+	}
+	return false
+}
+func terminatesList(list []ast.Stmt) bool {
+	for i := len(list) - 1; i >= 0; i-- {
+		if _, empty := list[i].(*ast.EmptyStmt); !empty {
+			return terminates(list[i], "")
+		}
+	}
+	return false
+}
+// terminatesClauses reports whether the switch or select with the given body terminates: it has
+// no break referring to it, and every clause ends in a terminating statement. A switch also needs
+// a default clause.
+func terminatesClauses(body *ast.BlockStmt, label string) bool {
+	if hasBreak(body, label) {
+		return false
+	}
+	hasDefault := false
+	for _, c := range body.List {
+		var list []ast.Stmt
+		switch c := c.(type) {
+		case *ast.CaseClause:
+			list, hasDefault = c.Body, hasDefault || c.List == nil
+		case *ast.CommClause:
+			list, hasDefault = c.Body, true
+		}
+		if !terminatesList(list) {
+			return false
+		}
+	}
+	return hasDefault
+}
+// hasBreak reports whether body holds a break out of the statement it belongs to: an unlabeled
+// one outside nested loops, switches and selects, or one with label.
+func hasBreak(body ast.Node, label string) bool {
+	found := false
+	walkWithStack(body, func(n ast.Node, stack []ast.Node) {
+		br, ok := n.(*ast.BranchStmt)
+		if !ok || br.Tok != token.BREAK {
+			return
+		}
+		if br.Label != nil {
+			found = found || br.Label.Name == label
+			return
+		}
+		for _, anc := range stack[1 : len(stack)-1] {
+			switch anc.(type) {
+			case *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt, *ast.FuncLit:
+				return
+			}
+		}
+		found = true
+	})
+	return found
+}
@@ -0,0 +1,234 @@
+package obfuscator
+import (
+	"go/ast"
+	"math/rand"
+	"strings"
+	"testing"
+)
+var outliningProgram = map[string]string{
+	"main.go": `package main
+import (
+	"errors"
+	"fmt"
+	str "strings"
+)
+type account struct {
+	name    string
+	balance int
+}
+func (a *account) deposit(n int) error {
+	if n <= 0 {
+		return errors.New("invalid amount")
+	}
+	a.balance += n
+	fmt.Println("deposit", a.name, n)
+	a.name = str.ToUpper(a.name)
+	return nil
+}
+func check(key string) (ok bool, score int) {
+	parts := str.Split(key, "-")
+	if len(parts) != 3 {
+		return
+	}
+	total := 0
+	for i, p := range parts {
+		if p == "" {
+			continue
+		}
+		for _, c := range p {
+			total += int(c) * (i + 1)
+			if total > 5000 {
+				break
+			}
+		}
+		if i == 1 && total%7 == 3 {
+			return false, -total
+		}
+	}
+	score = total % 97
+	ok = score > 10
+	fmt.Println("checked", key, score)
+	return
+}
+func scan(grid [][]int, limit int) (found []int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered: %v", r)
+		}
+	}()
+outer:
+	for y, row := range grid {
+		sum := 0
+		for x, v := range row {
+			switch {
+			case v < 0:
+				continue outer
+			case v == 0:
+				break outer
+			case v > limit:
+				panic(fmt.Sprint("too big at ", x, y))
+			}
+			sum += v
+		}
+		found = append(found, sum)
+		fmt.Println("row", y, sum)
+	}
+	return found, nil
+}
+func closures(n int) []func() int {
+	var fns []func() int
+	base := n * 2
+	for i := 0; i < n; i++ {
+		k := i * base
+		fns = append(fns, func() int { return k + base })
+		base++
+	}
+	var v interface{} = n
+	switch t := v.(type) {
+	case int:
+		t += base
+		fmt.Println("int", t)
+		fmt.Println("base", base)
+		base = t
+	}
+	fns = append(fns, func() int { return base })
+	return fns
+}
+func main() {
+	a := &account{name: "alice"}
+	fmt.Println(a.deposit(5), a.deposit(-1), a.balance, a.name)
+	for _, k := range []string{"ab-cd-ef", "x-y", "zz--q", "key-7-abc", "hello-world-foo"} {
+		fmt.Println(check(k))
+	}
+	fmt.Println(scan([][]int{{1, 2}, {3, -1, 4}, {5, 6}}, 10))
+	fmt.Println(scan([][]int{{1, 2}, {0, 9}, {5, 6}}, 10))
+	fmt.Println(scan([][]int{{1, 2}, {30}}, 10))
+	for _, f := range closures(4) {
+		fmt.Print(f(), " ")
+	}
+	fmt.Println(report(3), platform())
+}
+`,
+	"report.go": `package main
+import "fmt"
+func report(n int) string {
+	lines := []string{}
+	for i := 0; i < n; i++ {
+		line := fmt.Sprintf("line %d", i)
+		if i%2 == 1 {
+			line += "!"
+		}
+		lines = append(lines, line)
+	}
+	return fmt.Sprint(lines)
+}
+`,
+	"platform_linux.go": `package main
+import "runtime"
+func platform() string {
+	name := runtime.GOOS
+	if len(name) > 3 {
+		name = name[:3]
+	}
+	name += "/"
+	return name + runtime.GOARCH[:1]
+}
+`,
+}
+func TestOutliningPass_PreservesBehaviour(t *testing.T) {
+	want := runGoProgram(t, outliningProgram)
+	for _, flatten := range []bool{false, true} {
+		name := "outlined"
+		if flatten {
+			name += "+flattened"
+		}
+		t.Run(name, func(t *testing.T) {
+			pkg := loadTestPackage(t, outliningProgram)
+			before := map[string]int{}
+			for i, file := range pkg.Syntax {
+				before[pkg.GoFiles[i]] = len(file.Decls)
+			}
+			// Which functions get split and where their helpers go depend on the draws: seed them.
+			pass := &OutliningPass{draw: rand.New(rand.NewSource(1)).Int63n}
+			if err := pass.Apply(nil, pkg); err != nil {
+				t.Fatalf("OutliningPass failed: %v", err)
+			}
+			if flatten {
+				for _, file := range pkg.Syntax {
+					ControlFlow(pkg.Fset, file, pkg.TypesInfo, pkg.Types, ControlFlowOptions{Depth: DefaultControlFlowDepth, Backend: DispatcherSwitch})
+				}
+			}
+			out := printPackage(t, pkg)
+			if got := runGoProgram(t, out); got != want {
+				t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s\n%s", got, want, out["main.go"], out["report.go"])
+			}
+			hosts := 0
+			for i, file := range pkg.Syntax {
+				added := len(file.Decls) - before[pkg.GoFiles[i]]
+				if strings.HasSuffix(pkg.GoFiles[i], "_linux.go") && (len(file.Imports) != 1 || strings.Contains(out["platform_linux.go"], "fmt.")) {
+					t.Errorf("Expected platform_linux.go to receive no helpers of other files:\n%s", out["platform_linux.go"])
+				}
+				if added > 0 {
+					hosts++
+				}
+			}
+			if hosts < 2 {
+				t.Errorf("Expected helpers spread over main.go and report.go:\n%s\n%s", out["main.go"], out["report.go"])
+			}
+			for _, file := range pkg.Syntax {
+				for _, decl := range file.Decls {
+					fd, ok := decl.(*ast.FuncDecl)
+					if ok && fd.Name.Name == "check" && statementWeight(fd.Body.List) > 12 && !flatten {
+						t.Errorf("Expected check to be split into helpers:\n%s", out["main.go"])
+					}
+				}
+			}
+		})
+	}
+}
+func TestOutliningPass_KeepsUnmovableCode(t *testing.T) {
+	src := `package main
+import "fmt"
+func generic[T any](v T) T {
+	fmt.Println(v)
+	fmt.Println(v)
+	fmt.Println(v)
+	return v
+}
+func jumps(n int) int {
+	i := 0
+loop:
+	i++
+	fmt.Println(i)
+	if i < n {
+		goto loop
+	}
+	return i
+}
+func local(n int) int {
+	type pair struct{ a, b int }
+	const k = 3
+	p := pair{n, n * k}
+	p.a++
+	p.b++
+	return p.a + p.b
+}
+func main() {
+	fmt.Println(generic(1), jumps(3), local(2))
+}
+`
+	want := runGoProgram(t, map[string]string{"main.go": src})
+	pkg := loadTestPackage(t, map[string]string{"main.go": src})
+	if err := (&OutliningPass{}).Apply(nil, pkg); err != nil {
+		t.Fatalf("OutliningPass failed: %v", err)
+	}
+	out := printFile(t, pkg.Fset, pkg.Syntax[0])
+	if got := runGoProgram(t, map[string]string{"main.go": out}); got != want {
+		t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out)
+	}
+	for _, decl := range pkg.Syntax[0].Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok && (fd.Name.Name == "generic" || fd.Name.Name == "jumps") && statementWeight(fd.Body.List) < 4 {
+			t.Errorf("Expected %s to be left alone:\n%s", fd.Name.Name, out)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package obfuscator
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math/bits"
+	mrand "math/rand"
+	"strings"
+)
+// EncryptedString is the output of a StringCipher: the ciphertext and the code that reverses it.
+type EncryptedString struct {
+	Ciphertext []byte
+	// Imports lists the packages the decryption statements depend on.
+	Imports []string
+	// Decrypt returns statements that replace the contents of the []byte variable named buf,
+	// which initially holds Ciphertext, with the plaintext.
+	Decrypt func(obf *Obfuscator, buf string) []ast.Stmt
+}
+// StringCipher is a pluggable string encryption backend.
+type StringCipher interface {
+	Name() string
+	// Encrypt encrypts plaintext with key material drawn from keys.
+	Encrypt(plaintext []byte, keys KeySource) (*EncryptedString, error)
+}
+// StringCipherPolicy decides how the enabled ciphers are distributed over the strings of a build.
+type StringCipherPolicy string
+const (
+	// CipherPolicyRandom picks a cipher uniformly at random for every string.
+	CipherPolicyRandom StringCipherPolicy = "random"
+	// CipherPolicyRoundRobin cycles through the ciphers so every backend is guaranteed to be used.
+	CipherPolicyRoundRobin StringCipherPolicy = "round-robin"
+)
+// StringCipherNames lists the names accepted by NewStringCipher.
+var StringCipherNames = []string{"aes-ctr", "aes-gcm", "xor-rotate", "synth"}
+// NewStringCipher returns the backend registered under name.
+func NewStringCipher(name string) (StringCipher, error) {
+	switch name {
+	case "aes-ctr":
+		return aesCTRCipher{}, nil
+	case "aes-gcm":
+		return aesGCMCipher{}, nil
+	case "xor-rotate":
+		return xorRotateCipher{}, nil
+	case "synth":
+		return synthCipher{}, nil
+	default:
+		return nil, fmt.Errorf("unknown string cipher %q (available: %s)", name, strings.Join(StringCipherNames, ", "))
+	}
+}
+// ParseStringCipherPolicy validates a policy name coming from the command line.
+func ParseStringCipherPolicy(s string) (StringCipherPolicy, error) {
+	switch policy := StringCipherPolicy(s); policy {
+	case "", CipherPolicyRandom:
+		return CipherPolicyRandom, nil
+	case CipherPolicyRoundRobin:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown string cipher policy %q", s)
+	}
+}
+// parseStmts parses a snippet of statements generated from a template. Identifiers are left
+// unresolved: a snippet may use names declared by another one, and passes that rename by
+// object would otherwise rename the declaration without its uses.
+func parseStmts(src string) ([]ast.Stmt, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), "snippet.go", "package p\nfunc _() {\n"+src+"\n}", parser.SkipObjectResolution)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse generated statements: %w", err)
+	}
+	body := file.Decls[0].(*ast.FuncDecl).Body
+	stripPositions(body)
+	return body.List, nil
+}
+// mustParseDecls parses top-level declarations generated from a template whose validity is
+// guaranteed by construction.
+func mustParseDecls(src string) []ast.Decl {
+	file, err := parser.ParseFile(token.NewFileSet(), "snippet.go", "package p\n"+src, 0)
+	if err != nil {
+		panic(fmt.Errorf("failed to parse generated declarations: %w", err))
+	}
+	stripPositions(file)
+	return file.Decls
+}
+// mustParseStmts is parseStmts for templates whose validity is guaranteed by construction.
+func mustParseStmts(src string) []ast.Stmt {
+	stmts, err := parseStmts(src)
+	if err != nil {
+		panic(err)
+	}
+	return stmts
+}
+// weavingKeyName returns the identifier of the weaving key used by decryptors.
+func weavingKeyName(obf *Obfuscator) string {
+	if obf == nil || obf.WeavingKeyVarName == "" {
+		return "weaveKeyFallback0"
+	}
+	return obf.WeavingKeyVarName
+}
+// --- AES-CTR ---
+// aesCTRCipher is the original backend: AES-128-CTR with a key woven with the anti-debug key.
+type aesCTRCipher struct{}
+func (aesCTRCipher) Name() string { return "aes-ctr" }
+func (aesCTRCipher) Encrypt(plaintext []byte, keys KeySource) (*EncryptedString, error) {
+	key, keyDecl, err := keys.Key(16)
+	if err != nil {
+		return nil, err
+	}
+	iv, ivDecl, err := keys.Key(aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, plaintext)
+	return &EncryptedString{
+		Ciphertext: ciphertext,
+		Imports:    []string{"crypto/aes", "crypto/cipher"},
+		Decrypt: func(obf *Obfuscator, buf string) []ast.Stmt {
+			keyVar, ivVar, blockVar, errVar := NewName(), NewName(), NewName(), NewName()
+			// --- Metamorphic part: shuffle declaration order ---
+			declarations := [][]ast.Stmt{keyDecl(obf, keyVar), ivDecl(obf, ivVar)}
+			mrand.Shuffle(len(declarations), func(i, j int) {
+				declarations[i], declarations[j] = declarations[j], declarations[i]
+			})
+			stmts := append(declarations[0], declarations[1]...)
+			return append(stmts, mustParseStmts(fmt.Sprintf(`
+%[2]s, %[3]s := aes.NewCipher(%[4]s)
+if %[3]s != nil {
+	panic(%[3]s)
+}
+cipher.NewCTR(%[2]s, %[5]s).XORKeyStream(%[1]s, %[1]s)`, buf, blockVar, errVar, keyVar, ivVar))...)
+		},
+	}, nil
+}
+// keyWeavingLoop builds the loop that mixes the weaving key into a key slice:
+// key[i] ^= byte(((uint64(weavingKey) >> uint((i%8)*8)) ^ uint64(byte(i)*31) ^ uint64(byte(len(data))*17)) & 0xff)
+func keyWeavingLoop(obf *Obfuscator, keyVar, dataVar string) ast.Stmt {
+	iVar := NewName()
+	return mustParseStmts(fmt.Sprintf(`
+for %[1]s := 0; %[1]s < len(%[2]s); %[1]s++ {
+	%[2]s[%[1]s] ^= byte(((uint64(%[3]s) >> uint((%[1]s%%8)*8)) ^ uint64(byte(%[1]s*31)) ^ uint64(byte(len(%[4]s)*17))) & 0xff)
+}`, iVar, keyVar, weavingKeyName(obf), dataVar))[0]
+}
+// createByteSliceLiteral renders data as a []byte composite literal.
+func createByteSliceLiteral(data []byte) *ast.CompositeLit {
+	slice := &ast.CompositeLit{Type: &ast.ArrayType{Elt: ast.NewIdent("byte")}}
+	for _, b := range data {
+		slice.Elts = append(slice.Elts, &ast.BasicLit{Kind: token.INT, Value: fmt.Sprintf("0x%x", b)})
+	}
+	return slice
+}
+// --- AES-GCM ---
+// aesGCMCipher authenticates the ciphertext, so a tampered blob or wrong key panics instead of
+// silently producing garbage.
+type aesGCMCipher struct{}
+func (aesGCMCipher) Name() string { return "aes-gcm" }
+func (aesGCMCipher) Encrypt(plaintext []byte, keys KeySource) (*EncryptedString, error) {
+	key, keyDecl, err := keys.Key(16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, nonceDecl, err := keys.Key(12)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nil, nonce, plaintext, nil)
+	return &EncryptedString{
+		Ciphertext: sealed,
+		Imports:    []string{"crypto/aes", "crypto/cipher"},
+		Decrypt: func(obf *Obfuscator, buf string) []ast.Stmt {
+			keyVar, nonceVar, blockVar, gcmVar, errVar := NewName(), NewName(), NewName(), NewName(), NewName()
+			stmts := append(keyDecl(obf, keyVar), nonceDecl(obf, nonceVar)...)
+			return append(stmts, mustParseStmts(fmt.Sprintf(`
+%[2]s, %[4]s := aes.NewCipher(%[5]s)
+if %[4]s != nil {
+	panic(%[4]s)
+}
+%[3]s, %[4]s := cipher.NewGCM(%[2]s)
+if %[4]s != nil {
+	panic(%[4]s)
+}
+%[1]s, %[4]s = %[3]s.Open(nil, %[6]s, %[1]s, nil)
+if %[4]s != nil {
+	panic(%[4]s)
+}`, buf, blockVar, gcmVar, errVar, keyVar, nonceVar))...)
+		},
+	}, nil
+}
+// --- XOR-rotate stream ---
+// xorRotateCipher XORs every byte with an LCG keystream and rotates it by a keystream-derived amount.
+type xorRotateCipher struct{}
+func (xorRotateCipher) Name() string { return "xor-rotate" }
+func (xorRotateCipher) Encrypt(plaintext []byte, keys KeySource) (*EncryptedString, error) {
+	seedBytes, seedDecl, err := keys.Key(4)
+	if err != nil {
+		return nil, err
+	}
+	seed := binary.LittleEndian.Uint32(seedBytes)
+	mul := uint32(mrand.Intn(1<<20))*4 + 1 // odd multiplier ≡ 1 (mod 4) keeps the LCG full-period
+	inc := uint32(mrand.Intn(1<<20))*2 + 1
+	ciphertext := make([]byte, len(plaintext))
+	state := seed
+	for i, b := range plaintext {
+		state = state*mul + inc
+		ks := byte(state >> 24)
+		ciphertext[i] = bits.RotateLeft8(b^ks, int(state>>13)&7)
+	}
+	return &EncryptedString{
+		Ciphertext: ciphertext,
+		Decrypt: func(obf *Obfuscator, buf string) []ast.Stmt {
+			seedVar, stateVar, iVar, rotVar := NewName(), NewName(), NewName(), NewName()
+			// The rotation is spelled with shifts: the code is inlined where math/bits may be shadowed.
+			return append(seedDecl(obf, seedVar), mustParseStmts(fmt.Sprintf(`
+%[2]s := uint32(%[4]s[0]) | uint32(%[4]s[1])<<8 | uint32(%[4]s[2])<<16 | uint32(%[4]s[3])<<24
+for %[3]s := range %[1]s {
+	%[2]s = %[2]s*%[5]d + %[6]d
+	%[7]s := uint(%[2]s>>13) & 7
+	%[1]s[%[3]s] = (%[1]s[%[3]s]>>%[7]s | %[1]s[%[3]s]<<(8-%[7]s)) ^ byte(%[2]s>>24)
+}`, buf, stateVar, iVar, seedVar, mul, inc, rotVar))...)
+		},
+	}, nil
+}
+// --- Synthesized chain ---
+// synthOp is one reversible byte operation of a synthesized cipher.
+type synthOp struct {
+	kind int
+	k, m byte
+	r    int
+}
+const (
+	synthAdd = iota
+	synthXor
+	synthRotate
+	synthSwap
+	synthNot
+	synthReverse
+	synthOpCount
+)
+// synthCipher generates a fresh chain of reversible byte operations for every string and emits
+// the inverse chain as straight-line code, so no two strings share a decryptor shape.
+type synthCipher struct{}
+func (synthCipher) Name() string { return "synth" }
+func (synthCipher) Encrypt(plaintext []byte, keys KeySource) (*EncryptedString, error) {
+	whitening, whiteningDecl, err := keys.Key(8)
+	if err != nil {
+		return nil, err
+	}
+	ops := make([]synthOp, 3+mrand.Intn(6))
+	for i := range ops {
+		ops[i] = synthOp{kind: mrand.Intn(synthOpCount), k: byte(mrand.Intn(256)), m: byte(mrand.Intn(256)), r: 1 + mrand.Intn(7)}
+	}
+	ciphertext := make([]byte, len(plaintext))
+	copy(ciphertext, plaintext)
+	for _, op := range ops {
+		op.apply(ciphertext)
+	}
+	for i := range ciphertext {
+		ciphertext[i] ^= whitening[i%len(whitening)]
+	}
+	return &EncryptedString{
+		Ciphertext: ciphertext,
+		Decrypt: func(obf *Obfuscator, buf string) []ast.Stmt {
+			whiteningVar, iVar := NewName(), NewName()
+			var src strings.Builder
+			fmt.Fprintf(&src, "for %[2]s := range %[1]s {\n\t%[1]s[%[2]s] ^= %[3]s[%[2]s%%len(%[3]s)]\n}\n", buf, iVar, whiteningVar)
+			for i := len(ops) - 1; i >= 0; i-- {
+				src.WriteString(ops[i].inverseSource(buf))
+			}
+			return append(whiteningDecl(obf, whiteningVar), mustParseStmts(src.String())...)
+		},
+	}, nil
+}
+// apply performs the forward operation in place.
+func (op synthOp) apply(b []byte) {
+	switch op.kind {
+	case synthAdd:
+		for i := range b {
+			b[i] += op.k + byte(i)*op.m
+		}
+	case synthXor:
+		for i := range b {
+			b[i] ^= op.k ^ byte(i)*op.m
+		}
+	case synthRotate:
+		for i := range b {
+			b[i] = b[i]<<op.r | b[i]>>(8-op.r)
+		}
+	case synthSwap:
+		for i := 0; i+1 < len(b); i += 2 {
+			b[i], b[i+1] = b[i+1], b[i]
+		}
+	case synthNot:
+		for i := range b {
+			b[i] = ^b[i]
+		}
+	case synthReverse:
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+	}
+}
+// inverseSource renders the Go statements that undo the operation on the variable buf.
+func (op synthOp) inverseSource(buf string) string {
+	i, j := NewName(), NewName()
+	switch op.kind {
+	case synthAdd:
+		return fmt.Sprintf("for %[2]s := range %[1]s {\n\t%[1]s[%[2]s] -= %[3]d + byte(%[2]s)*%[4]d\n}\n", buf, i, op.k, op.m)
+	case synthXor:
+		return fmt.Sprintf("for %[2]s := range %[1]s {\n\t%[1]s[%[2]s] ^= %[3]d ^ byte(%[2]s)*%[4]d\n}\n", buf, i, op.k, op.m)
+	case synthRotate:
+		return fmt.Sprintf("for %[2]s := range %[1]s {\n\t%[1]s[%[2]s] = %[1]s[%[2]s]>>%[3]d | %[1]s[%[2]s]<<%[4]d\n}\n", buf, i, op.r, 8-op.r)
+	case synthSwap:
+		return fmt.Sprintf("for %[2]s := 0; %[2]s+1 < len(%[1]s); %[2]s += 2 {\n\t%[1]s[%[2]s], %[1]s[%[2]s+1] = %[1]s[%[2]s+1], %[1]s[%[2]s]\n}\n", buf, i)
+	case synthNot:
+		return fmt.Sprintf("for %[2]s := range %[1]s {\n\t%[1]s[%[2]s] = ^%[1]s[%[2]s]\n}\n", buf, i)
+	default:
+		return fmt.Sprintf("for %[2]s, %[3]s := 0, len(%[1]s)-1; %[2]s < %[3]s; %[2]s, %[3]s = %[2]s+1, %[3]s-1 {\n\t%[1]s[%[2]s], %[1]s[%[3]s] = %[1]s[%[3]s], %[1]s[%[2]s]\n}\n", buf, i, j)
+	}
+}
+// byteSliceSource renders data as the source of a []byte composite literal.
+func byteSliceSource(data []byte) string {
+	return "[]byte{" + byteListLiteral(data) + "}"
+}
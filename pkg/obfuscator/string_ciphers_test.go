@@ -0,0 +1,145 @@
+package obfuscator
+import (
+	"go/ast"
+	"strings"
+	"testing"
+)
+func allStringCiphers(t *testing.T) []StringCipher {
+	t.Helper()
+	var ciphers []StringCipher
+	for _, name := range StringCipherNames {
+		c, err := NewStringCipher(name)
+		if err != nil {
+			t.Fatalf("NewStringCipher(%q) failed: %v", name, err)
+		}
+		ciphers = append(ciphers, c)
+	}
+	return ciphers
+}
+func TestStringCiphers_XorRotateWithBitsDeclared(t *testing.T) {
+	src := `
+package main
+import "fmt"
+var weave_key_dummy int64
+var bits = "package"
+func count() int {
+	bits := 0
+	for _, s := range []string{"local one", "local two"} {
+		bits += len(s)
+	}
+	return bits
+}
+func main() {
+	fmt.Println("rotated secret", bits, count())
+}
+`
+	want := "rotated secret package 18\n"
+	c, err := NewStringCipher("xor-rotate")
+	if err != nil {
+		t.Fatalf("NewStringCipher failed: %v", err)
+	}
+	for _, mode := range []StringEncryptionMode{StringModeInline, StringModeTable} {
+		t.Run(string(mode), func(t *testing.T) {
+			fset, file := parseTestFile(t, src)
+			obf := &Obfuscator{WeavingKeyVarName: "weave_key_dummy"}
+			pass := NewStringEncryptionPass()
+			pass.UseCiphers(CipherPolicyRoundRobin, c)
+			pass.BeginPackage(mode)
+			if err := pass.Apply(obf, fset, file); err != nil {
+				t.Fatalf("StringEncryptionPass.Apply failed: %v", err)
+			}
+			if err := pass.FinishPackage(obf, fset, []*ast.File{file}); err != nil {
+				t.Fatalf("StringEncryptionPass.FinishPackage failed: %v", err)
+			}
+			if got := runGoProgram(t, map[string]string{"main.go": printFile(t, fset, file)}); got != want {
+				t.Errorf("Decrypted output mismatch: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+func TestStringCiphers_RoundTripMixed(t *testing.T) {
+	src := `
+package main
+import "fmt"
+var weave_key_dummy int64
+func main() {
+	fmt.Println("first secret")
+	fmt.Println("second secret, a bit longer than the first one")
+	fmt.Println("x")
+	fmt.Println("ünïcødé ✓")
+	fmt.Println("fifth")
+	fmt.Println("sixth string with\ttabs")
+	fmt.Println("seventh")
+	fmt.Println("eighth")
+}
+`
+	want := "first secret\nsecond secret, a bit longer than the first one\nx\nünïcødé ✓\nfifth\nsixth string with\ttabs\nseventh\neighth\n"
+	for _, mode := range []StringEncryptionMode{StringModeInline, StringModeTable} {
+		t.Run(string(mode), func(t *testing.T) {
+			fset, file := parseTestFile(t, src)
+			obf := &Obfuscator{WeavingKeyVarName: "weave_key_dummy"}
+			pass := NewStringEncryptionPass()
+			pass.UseCiphers(CipherPolicyRoundRobin, allStringCiphers(t)...)
+			pass.BeginPackage(mode)
+			if err := pass.Apply(obf, fset, file); err != nil {
+				t.Fatalf("StringEncryptionPass.Apply failed: %v", err)
+			}
+			if err := pass.FinishPackage(obf, fset, []*ast.File{file}); err != nil {
+				t.Fatalf("StringEncryptionPass.FinishPackage failed: %v", err)
+			}
+			out := printFile(t, fset, file)
+			for _, marker := range []string{"cipher.NewCTR(", "cipher.NewGCM(", "<<(8-"} {
+				if !strings.Contains(out, marker) {
+					t.Errorf("Expected round-robin policy to use the backend emitting %s", marker)
+				}
+			}
+			if got := runGoProgram(t, map[string]string{"main.go": out}); got != want {
+				t.Errorf("Decrypted output mismatch: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+func TestNewObfuscator_MixesAllCiphersByDefault(t *testing.T) {
+	obf := NewObfuscator(&Config{EncryptStrings: true})
+	if got := len(obf.stringEncryption.ciphers); got != len(StringCipherNames) {
+		t.Errorf("Expected the %d backends to be mixed without a cipher list, got %d", len(StringCipherNames), got)
+	}
+}
+func TestSynthCipher_NoCommonSignature(t *testing.T) {
+	fset, file := parseTestFile(t, `
+package main
+import "fmt"
+func main() {
+	fmt.Println("alpha", "beta", "gamma")
+}
+`)
+	obf := &Obfuscator{WeavingKeyVarName: "weave_key_dummy"}
+	pass := NewStringEncryptionPass()
+	pass.UseCiphers(CipherPolicyRandom, synthCipher{})
+	if err := pass.Apply(obf, fset, file); err != nil {
+		t.Fatalf("StringEncryptionPass.Apply failed: %v", err)
+	}
+	out := printFile(t, fset, file)
+	if strings.Contains(out, "crypto/") || strings.Contains(out, "XORKeyStream") {
+		t.Errorf("Synthesized cipher should not depend on crypto packages:\n%s", out)
+	}
+	for _, s := range []string{`"alpha"`, `"beta"`, `"gamma"`} {
+		if strings.Contains(out, s) {
+			t.Errorf("Expected %s to be encrypted", s)
+		}
+	}
+}
+func TestSynthOps_Invertible(t *testing.T) {
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	for kind := 0; kind < synthOpCount; kind++ {
+		op := synthOp{kind: kind, k: 0xA7, m: 0x3D, r: 3}
+		buf := append([]byte(nil), data...)
+		op.apply(buf)
+		if kind != synthSwap && kind != synthReverse && string(buf) == string(data) {
+			t.Errorf("op %d did not change the data", kind)
+		}
+		if _, err := parseStmts(op.inverseSource("buf")); err != nil {
+			t.Errorf("op %d produced invalid inverse code: %v", kind, err)
+		}
+	}
+}
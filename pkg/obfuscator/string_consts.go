@@ -0,0 +1,376 @@
+package obfuscator
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strconv"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+// StringConstPass prepares a package for string encryption using type information. It turns
+// string constants that are only used in non-constant contexts into package-level or local
+// variables, rewrites string switches into explicit comparisons, and tells the string
+// encryption pass which literals must stay plaintext and which need a conversion to a named type.
+type StringConstPass struct {
+	// Plaintext lists the constants and literals that had to be left unencrypted, with the reason.
+	Plaintext []string
+}
+// constCandidate tracks whether a string constant can be demoted to a variable.
+type constCandidate struct {
+	obj      *types.Const
+	spec     *ast.ValueSpec
+	eligible bool
+	reason   string
+}
+func (p *StringConstPass) Apply(obf *Obfuscator, pkg *packages.Package) error {
+	if obf.stringEncryption == nil || pkg.TypesInfo == nil {
+		return nil
+	}
+	info := pkg.TypesInfo
+	candidates, specs := p.collectCandidates(pkg)
+	p.resolveEligibility(pkg, candidates, specs)
+	for _, file := range pkg.Syntax {
+		p.convertConstDecls(file, specs)
+	}
+	for _, file := range pkg.Syntax {
+		rewriteStringSwitches(file, info)
+		p.markLiterals(obf.stringEncryption, file, pkg, specs)
+	}
+	for _, c := range candidates {
+		if !c.eligible {
+			p.report(pkg.Fset, c.spec.Pos(), fmt.Sprintf("constant %s (%s)", c.obj.Name(), c.reason))
+		}
+	}
+	return nil
+}
+func (p *StringConstPass) report(fset *token.FileSet, pos token.Pos, what string) {
+	msg := fmt.Sprintf("%s: %s", fset.Position(pos), what)
+	p.Plaintext = append(p.Plaintext, msg)
+	fmt.Printf("    - String kept in plaintext: %s\n", msg)
+}
+// collectCandidates finds every const spec declaring only string constants with explicit values.
+func (p *StringConstPass) collectCandidates(pkg *packages.Package) (map[*types.Const]*constCandidate, map[*ast.ValueSpec][]*constCandidate) {
+	candidates := make(map[*types.Const]*constCandidate)
+	specs := make(map[*ast.ValueSpec][]*constCandidate)
+	for _, file := range pkg.Syntax {
+		ast.Inspect(file, func(n ast.Node) bool {
+			decl, ok := n.(*ast.GenDecl)
+			if !ok || decl.Tok != token.CONST {
+				return true
+			}
+			for _, spec := range decl.Specs {
+				vs, ok := spec.(*ast.ValueSpec)
+				if !ok || len(vs.Values) != len(vs.Names) {
+					continue
+				}
+				var group []*constCandidate
+				allStrings := true
+				for _, name := range vs.Names {
+					obj, ok := pkg.TypesInfo.Defs[name].(*types.Const)
+					if !ok || !isStringType(obj.Type()) || obj.Val().Kind() != constant.String {
+						allStrings = false
+						break
+					}
+					c := &constCandidate{obj: obj, spec: vs, eligible: true}
+					if obj.Exported() && obj.Parent() == pkg.Types.Scope() {
+						c.eligible, c.reason = false, "exported, other packages may need a constant"
+					}
+					group = append(group, c)
+				}
+				if !allStrings {
+					continue
+				}
+				for _, c := range group {
+					candidates[c.obj] = c
+				}
+				specs[vs] = group
+			}
+			return false
+		})
+	}
+	return candidates, specs
+}
+// resolveEligibility marks constants used in constant-required contexts as ineligible. Uses inside
+// the value of another candidate only count while that candidate itself stays a constant, so the
+// check is repeated until it reaches a fixed point.
+func (p *StringConstPass) resolveEligibility(pkg *packages.Package, candidates map[*types.Const]*constCandidate, specs map[*ast.ValueSpec][]*constCandidate) {
+	for changed := true; changed; {
+		changed = false
+		for _, file := range pkg.Syntax {
+			walkWithStack(file, func(n ast.Node, stack []ast.Node) {
+				ident, ok := n.(*ast.Ident)
+				if !ok {
+					return
+				}
+				obj, ok := pkg.TypesInfo.Uses[ident].(*types.Const)
+				if !ok {
+					return
+				}
+				c := candidates[obj]
+				if c == nil || !c.eligible {
+					return
+				}
+				reason := ""
+				if requiresConstant(stack, pkg.TypesInfo, specs) {
+					reason = fmt.Sprintf("used in a constant expression at %s", pkg.Fset.Position(ident.Pos()))
+				} else if tv, ok := pkg.TypesInfo.Types[ident]; ok && isUntyped(obj.Type()) && !isPlainStringOrInterface(tv.Type) {
+					reason = fmt.Sprintf("implicitly converted to %s at %s", tv.Type, pkg.Fset.Position(ident.Pos()))
+				}
+				if reason == "" {
+					return
+				}
+				for _, member := range specs[c.spec] {
+					if member.eligible {
+						member.eligible, member.reason = false, reason
+						changed = true
+					}
+				}
+			})
+		}
+	}
+}
+// convertConstDecls moves eligible const specs into var declarations with folded literal values.
+func (p *StringConstPass) convertConstDecls(file *ast.File, specs map[*ast.ValueSpec][]*constCandidate) {
+	astutil.Apply(file, func(cursor *astutil.Cursor) bool {
+		var decl *ast.GenDecl
+		switch n := cursor.Node().(type) {
+		case *ast.GenDecl:
+			decl = n
+		case *ast.DeclStmt:
+			decl, _ = n.Decl.(*ast.GenDecl)
+		}
+		if decl == nil || decl.Tok != token.CONST {
+			return true
+		}
+		var keep, move []ast.Spec
+		for _, spec := range decl.Specs {
+			vs, ok := spec.(*ast.ValueSpec)
+			group := specs[vs]
+			if !ok || len(group) == 0 || !group[0].eligible {
+				keep = append(keep, spec)
+				continue
+			}
+			for i, c := range group {
+				vs.Values[i] = &ast.BasicLit{
+					ValuePos: vs.Values[i].Pos(),
+					Kind:     token.STRING,
+					Value:    strconv.Quote(constant.StringVal(c.obj.Val())),
+				}
+			}
+			move = append(move, vs)
+		}
+		if len(move) == 0 {
+			return false
+		}
+		varDecl := &ast.GenDecl{Tok: token.VAR, Specs: move}
+		if len(move) > 1 {
+			varDecl.Lparen, varDecl.Rparen = decl.Lparen, decl.Rparen
+		}
+		if len(keep) == 0 {
+			decl.Tok, decl.Specs = token.VAR, move
+			return false
+		}
+		decl.Specs = keep
+		if _, ok := cursor.Node().(*ast.DeclStmt); ok {
+			cursor.InsertAfter(&ast.DeclStmt{Decl: varDecl})
+		} else {
+			cursor.InsertAfter(varDecl)
+		}
+		return false
+	}, nil)
+}
+// markLiterals records which string literals the encryption pass must skip or convert.
+func (p *StringConstPass) markLiterals(enc *StringEncryptionPass, file *ast.File, pkg *packages.Package, specs map[*ast.ValueSpec][]*constCandidate) {
+	walkWithStack(file, func(n ast.Node, stack []ast.Node) {
+		lit, ok := n.(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return
+		}
+		if requiresConstant(stack, pkg.TypesInfo, specs) {
+			enc.keepPlaintext(lit)
+			if len(lit.Value) > 2 {
+				p.report(pkg.Fset, lit.Pos(), "literal "+lit.Value+" in a constant context")
+			}
+			return
+		}
+		t := literalType(lit, stack, pkg.TypesInfo, specs)
+		if t == nil || isPlainStringOrInterface(t) {
+			return
+		}
+		conv, err := typeExpr(t, file, pkg.Types)
+		if err != nil {
+			enc.keepPlaintext(lit)
+			p.report(pkg.Fset, lit.Pos(), fmt.Sprintf("literal %s of type %s (%v)", lit.Value, t, err))
+			return
+		}
+		enc.convertTo(lit, conv)
+	})
+}
+// literalType returns the type a string literal takes in its context. Folded values of converted
+// constants are not in types.Info; they take the type of the former constant.
+func literalType(lit *ast.BasicLit, stack []ast.Node, info *types.Info, specs map[*ast.ValueSpec][]*constCandidate) types.Type {
+	if tv, ok := info.Types[lit]; ok {
+		return tv.Type
+	}
+	if len(stack) > 1 {
+		if vs, ok := stack[len(stack)-2].(*ast.ValueSpec); ok {
+			for i, value := range vs.Values {
+				if value == lit && i < len(specs[vs]) {
+					return specs[vs][i].obj.Type()
+				}
+			}
+		}
+	}
+	return nil
+}
+// requiresConstant reports whether the node on top of stack must remain a constant expression:
+// the value of a const declaration, an array length, or an array index key.
+func requiresConstant(stack []ast.Node, info *types.Info, specs map[*ast.ValueSpec][]*constCandidate) bool {
+	if len(stack) == 0 {
+		return false
+	}
+	cur := stack[len(stack)-1]
+	for i := len(stack) - 2; i >= 0; i-- {
+		parent := stack[i]
+		if expr, ok := parent.(ast.Expr); ok {
+			if tv, ok := info.Types[expr]; ok && tv.Value != nil {
+				cur = parent
+				continue
+			}
+		}
+		switch pn := parent.(type) {
+		case *ast.ValueSpec:
+			if i == 0 {
+				return false
+			}
+			decl, ok := stack[i-1].(*ast.GenDecl)
+			if !ok || decl.Tok != token.CONST {
+				return false
+			}
+			if group := specs[pn]; len(group) > 0 && group[0].eligible {
+				return false
+			}
+			for _, v := range pn.Values {
+				if v == cur {
+					return true
+				}
+			}
+			return false
+		case *ast.ArrayType:
+			return pn.Len == cur
+		case *ast.KeyValueExpr:
+			if pn.Key != cur || i == 0 {
+				return false
+			}
+			if lit, ok := stack[i-1].(*ast.CompositeLit); ok {
+				if tv, ok := info.Types[lit]; ok {
+					switch tv.Type.Underlying().(type) {
+					case *types.Array, *types.Slice:
+						return true
+					}
+				}
+			}
+			return false
+		default:
+			return false
+		}
+	}
+	return false
+}
+// rewriteStringSwitches turns `switch s { case "a": }` into `switch t := s; { case t == "a": }` so
+// the compiler cannot lower the cases into a table of plaintext constants.
+func rewriteStringSwitches(file *ast.File, info *types.Info) {
+	ast.Inspect(file, func(n ast.Node) bool {
+		sw, ok := n.(*ast.SwitchStmt)
+		if !ok || sw.Tag == nil || sw.Init != nil {
+			return true
+		}
+		tv, ok := info.Types[sw.Tag]
+		if !ok || tv.Value != nil || !isStringType(tv.Type) {
+			return true
+		}
+		hasCases := false
+		for _, stmt := range sw.Body.List {
+			if cc, ok := stmt.(*ast.CaseClause); ok && len(cc.List) > 0 {
+				hasCases = true
+			}
+		}
+		if !hasCases {
+			return true
+		}
+		tagVar := NewName()
+		sw.Init = &ast.AssignStmt{Lhs: []ast.Expr{ast.NewIdent(tagVar)}, Tok: token.DEFINE, Rhs: []ast.Expr{sw.Tag}}
+		sw.Tag = nil
+		for _, stmt := range sw.Body.List {
+			cc := stmt.(*ast.CaseClause)
+			for i, expr := range cc.List {
+				cc.List[i] = &ast.BinaryExpr{X: ast.NewIdent(tagVar), Op: token.EQL, Y: expr}
+			}
+		}
+		return true
+	})
+}
+// walkWithStack calls fn for every node with the stack of its ancestors (including the node itself).
+func walkWithStack(root ast.Node, fn func(n ast.Node, stack []ast.Node)) {
+	var stack []ast.Node
+	ast.Inspect(root, func(n ast.Node) bool {
+		if n == nil {
+			stack = stack[:len(stack)-1]
+			return false
+		}
+		stack = append(stack, n)
+		fn(n, stack)
+		return true
+	})
+}
+func isStringType(t types.Type) bool {
+	b, ok := t.Underlying().(*types.Basic)
+	return ok && b.Info()&types.IsString != 0
+}
+func isUntyped(t types.Type) bool {
+	b, ok := t.(*types.Basic)
+	return ok && b.Info()&types.IsUntyped != 0
+}
+// isPlainStringOrInterface reports whether a value of type string can be used where t is expected.
+func isPlainStringOrInterface(t types.Type) bool {
+	if _, ok := t.(*types.TypeParam); ok {
+		return false
+	}
+	if types.IsInterface(t) {
+		return true
+	}
+	b, ok := t.(*types.Basic)
+	return ok && (b.Kind() == types.String || b.Kind() == types.UntypedString)
+}
+// typeExpr renders t as a type expression valid inside file, qualifying types from other
+// packages with the names under which file imports them.
+func typeExpr(t types.Type, file *ast.File, pkg *types.Package) (ast.Expr, error) {
+	var qualifyErr error
+	qualifier := func(other *types.Package) string {
+		if other == pkg {
+			return ""
+		}
+		for _, imp := range file.Imports {
+			path, _ := strconv.Unquote(imp.Path.Value)
+			if path != other.Path() {
+				continue
+			}
+			if imp.Name != nil && imp.Name.Name != "_" && imp.Name.Name != "." {
+				return imp.Name.Name
+			}
+			if imp.Name == nil {
+				return other.Name()
+			}
+		}
+		qualifyErr = fmt.Errorf("package %s is not imported", other.Path())
+		return other.Name()
+	}
+	typeString := types.TypeString(t, qualifier)
+	if qualifyErr != nil {
+		return nil, qualifyErr
+	}
+	return parser.ParseExpr(typeString)
+}
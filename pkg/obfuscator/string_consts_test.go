@@ -0,0 +1,67 @@
+package obfuscator
+import (
+	"strings"
+	"testing"
+)
+func TestStringConstPass_EncryptsConstantContexts(t *testing.T) {
+	src := `package main
+import "fmt"
+type Color string
+const apiKey = "sk-live-0123456789"
+const (
+	prefix   = "pre"
+	combined = prefix + "-fix"
+	width    = "abcd"
+)
+const red Color = "red"
+const Exported = "exported-value"
+var grid [len(width)]int
+func classify(s string) string {
+	switch s {
+	case "alpha", "beta":
+		return "greek"
+	case apiKey:
+		return "key"
+	default:
+		return "other"
+	}
+}
+func main() {
+	const local = "local-secret"
+	var c Color = "blue"
+	fmt.Println(apiKey, combined, local, len(grid), red, c, Exported)
+	fmt.Println(classify("beta"), classify(apiKey), classify("x"))
+}
+`
+	pkg := loadTestPackage(t, map[string]string{"main.go": src})
+	obf := &Obfuscator{WeavingKeyVarName: "weave_key_dummy", stringEncryption: NewStringEncryptionPass()}
+	constPass := &StringConstPass{}
+	if err := constPass.Apply(obf, pkg); err != nil {
+		t.Fatalf("StringConstPass.Apply failed: %v", err)
+	}
+	for _, file := range pkg.Syntax {
+		if err := obf.stringEncryption.Apply(obf, pkg.Fset, file); err != nil {
+			t.Fatalf("StringEncryptionPass.Apply failed: %v", err)
+		}
+	}
+	files := printPackage(t, pkg)
+	out := files["main.go"]
+	for _, secret := range []string{`"sk-live-0123456789"`, `"local-secret"`, `"-fix"`, `"alpha"`, `"blue"`, `"red"`} {
+		if strings.Contains(out, secret) {
+			t.Errorf("Expected %s to be encrypted:\n%s", secret, out)
+		}
+	}
+	if !strings.Contains(out, `"abcd"`) || !strings.Contains(out, `"exported-value"`) {
+		t.Errorf("Constants required at compile time or exported must stay plaintext:\n%s", out)
+	}
+	report := strings.Join(constPass.Plaintext, "\n")
+	if !strings.Contains(report, "constant width") || !strings.Contains(report, "constant Exported") {
+		t.Errorf("Expected width and Exported to be reported as plaintext, got:\n%s", report)
+	}
+	files["main.go"] = out + "\nvar weave_key_dummy int64\n"
+	got := runGoProgram(t, files)
+	want := "sk-live-0123456789 pre-fix local-secret 4 red blue exported-value\ngreek key other\n"
+	if got != want {
+		t.Errorf("Program output mismatch: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,106 @@
+package obfuscator
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	mrand "math/rand"
+	"strconv"
+	"strings"
+)
+// stringTable collects the encrypted strings of one package. Every literal is replaced by a
+// call to an accessor that decrypts its entry once under sync.Once and caches the plaintext.
+type stringTable struct {
+	entries      []*EncryptedString
+	accessorName string
+}
+func newStringTable() *stringTable {
+	return &stringTable{accessorName: NewName()}
+}
+// add registers an encrypted string and returns the accessor call that replaces the literal.
+func (t *stringTable) add(enc *EncryptedString) ast.Expr {
+	t.entries = append(t.entries, enc)
+	return &ast.CallExpr{
+		Fun:  ast.NewIdent(t.accessorName),
+		Args: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(len(t.entries) - 1)}},
+	}
+}
+// imports returns the packages required by the accessor and the ciphers of all entries.
+func (t *stringTable) imports() []string {
+	paths := []string{"sync"}
+	seen := map[string]bool{"sync": true}
+	for _, entry := range t.entries {
+		for _, path := range entry.Imports {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+// buildDecls lays out the ciphertext blob in a random order and generates the accessor, which
+// dispatches on the entry index to the decryption code of the cipher that encrypted it.
+func (t *stringTable) buildDecls(obf *Obfuscator) ([]ast.Decl, error) {
+	blobVar, offsVar, onceVar, cacheVar, bufVar := NewName(), NewName(), NewName(), NewName(), NewName()
+	order := mrand.Perm(len(t.entries))
+	offsets := make([]int, 2*len(t.entries))
+	var blob []byte
+	for _, idx := range order {
+		entry := t.entries[idx]
+		offsets[2*idx] = len(blob)
+		offsets[2*idx+1] = len(entry.Ciphertext)
+		blob = append(blob, entry.Ciphertext...)
+	}
+	var offsetLits []string
+	for _, off := range offsets {
+		offsetLits = append(offsetLits, strconv.Itoa(off))
+	}
+	template := `
+package main
+var %[1]s = []byte{%[6]s}
+var %[2]s = []int{%[7]s}
+var %[3]s [%[8]d]sync.Once
+var %[4]s [%[8]d]string
+func %[5]s(i int) string {
+	%[3]s[i].Do(func() {
+		off, n := %[2]s[2*i], %[2]s[2*i+1]
+		%[9]s := make([]byte, n)
+		copy(%[9]s, %[1]s[off:off+n])
+		switch i {
+		}
+		%[4]s[i] = string(%[9]s)
+	})
+	return %[4]s[i]
+}`
+	sourceCode := fmt.Sprintf(template, blobVar, offsVar, onceVar, cacheVar, t.accessorName,
+		byteListLiteral(blob), strings.Join(offsetLits, ", "), len(t.entries), bufVar)
+	// Without objects, RenameIdentifiers leaves the buffer alone in the template as in the cases.
+	file, err := parser.ParseFile(token.NewFileSet(), "string_table.go", sourceCode, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse string table: %w", err)
+	}
+	stripPositions(file)
+	var dispatch *ast.SwitchStmt
+	ast.Inspect(file, func(n ast.Node) bool {
+		if sw, ok := n.(*ast.SwitchStmt); ok {
+			dispatch = sw
+		}
+		return dispatch == nil
+	})
+	for _, idx := range order {
+		dispatch.Body.List = append(dispatch.Body.List, &ast.CaseClause{
+			List: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(idx)}},
+			Body: t.entries[idx].Decrypt(obf, bufVar),
+		})
+	}
+	return file.Decls, nil
+}
+// byteListLiteral renders data as the element list of a []byte composite literal.
+func byteListLiteral(data []byte) string {
+	parts := make([]string, len(data))
+	for i, b := range data {
+		parts[i] = fmt.Sprintf("0x%x", b)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -1,8 +1,5 @@
 package obfuscator
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	"fmt"
 	"go/ast"
 	"go/token"
@@ -11,21 +8,151 @@ import (
 	"strconv"
 	"golang.org/x/tools/go/ast/astutil"
 )
-// StringEncryptionPass handles the inlined string encryption process using AES-CTR.
+// StringEncryptionMode selects how encrypted strings are laid out in a package.
+type StringEncryptionMode string
+const (
+	// StringModeInline replaces every literal with a self-contained decryptor closure.
+	StringModeInline StringEncryptionMode = "inline"
+	// StringModeTable stores all ciphertext in one per-package blob decrypted lazily through an accessor.
+	StringModeTable StringEncryptionMode = "table"
+)
+// ParseStringEncryptionMode validates a mode name coming from the command line.
+func ParseStringEncryptionMode(s string) (StringEncryptionMode, error) {
+	switch mode := StringEncryptionMode(s); mode {
+	case "", StringModeInline:
+		return StringModeInline, nil
+	case StringModeTable:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown string encryption mode %q", s)
+	}
+}
+// StringEncryptionPass replaces string literals with decryptors built by pluggable StringCipher
+// backends (AES-CTR by default).
 type StringEncryptionPass struct {
 	metaEngine *MetamorphicEngine
+	mode       StringEncryptionMode
+	table      *stringTable
+	ciphers    []StringCipher
+	policy     StringCipherPolicy
+	nextCipher int
+	// deriveKeys enables a per-package keySchedule instead of literal keys.
+	deriveKeys bool
+	keys       *keySchedule
+	// decoyDensity is the percentage of literals preceded by a decoy decryptor.
+	decoyDensity int
+	decoys       *decoyState
+	// plaintext and conversions are filled by StringConstPass when type information is available.
+	plaintext   map[*ast.BasicLit]bool
+	conversions map[*ast.BasicLit]ast.Expr
 }
 // NewStringEncryptionPass creates a new pass instance.
 func NewStringEncryptionPass() *StringEncryptionPass {
 	return &StringEncryptionPass{
 		metaEngine: &MetamorphicEngine{},
+		mode:       StringModeInline,
+	}
+}
+// UseCiphers replaces the default AES-CTR backend with a mix of ciphers distributed by policy.
+func (p *StringEncryptionPass) UseCiphers(policy StringCipherPolicy, ciphers ...StringCipher) {
+	p.policy = policy
+	p.ciphers = ciphers
+}
+// DeriveKeys makes the ciphers derive their keys at runtime from state spread over each package
+// instead of embedding them. It takes effect from the next BeginPackage.
+func (p *StringEncryptionPass) DeriveKeys() {
+	p.deriveKeys = true
+}
+// UseDecoys places a decoy decryptor, guarded by an opaque predicate, in front of the given
+// percentage of the statements containing an encrypted literal. It takes effect from the next
+// BeginPackage.
+func (p *StringEncryptionPass) UseDecoys(density int) {
+	p.decoyDensity = density
+}
+// BeginPackage selects the encryption mode for the next package and resets the per-package state.
+func (p *StringEncryptionPass) BeginPackage(mode StringEncryptionMode) {
+	p.mode = mode
+	p.table = nil
+	p.keys = nil
+	p.decoys = nil
+	if p.decoyDensity > 0 {
+		p.decoys = newDecoyState(p.decoyDensity)
+	}
+	if mode == StringModeTable {
+		p.table = newStringTable()
+	}
+	if p.deriveKeys {
+		p.keys = newKeySchedule()
+	}
+}
+// keySource returns where the ciphers take their keys from in the current package.
+func (p *StringEncryptionPass) keySource() KeySource {
+	if p.keys != nil {
+		return p.keys
+	}
+	return literalKeySource{}
+}
+// keepPlaintext excludes a literal that must remain a constant from encryption.
+func (p *StringEncryptionPass) keepPlaintext(lit *ast.BasicLit) {
+	if p.plaintext == nil {
+		p.plaintext = make(map[*ast.BasicLit]bool)
+	}
+	p.plaintext[lit] = true
+}
+// convertTo wraps the decrypted value of lit in a conversion to the given named type.
+func (p *StringEncryptionPass) convertTo(lit *ast.BasicLit, typ ast.Expr) {
+	if p.conversions == nil {
+		p.conversions = make(map[*ast.BasicLit]ast.Expr)
+	}
+	p.conversions[lit] = typ
+}
+// wrap applies the conversion registered for lit, if any, to the decrypting expression.
+func (p *StringEncryptionPass) wrap(lit *ast.BasicLit, expr ast.Expr) ast.Expr {
+	if typ, ok := p.conversions[lit]; ok {
+		return &ast.CallExpr{Fun: typ, Args: []ast.Expr{expr}}
+	}
+	return expr
+}
+// FinishPackage emits the string table collected in table mode into the first file of the package
+// and spreads the key schedule, if one was used, over all files. The state read by the decoy
+// predicates also goes into the first file.
+func (p *StringEncryptionPass) FinishPackage(obf *Obfuscator, fset *token.FileSet, files []*ast.File) error {
+	if len(files) == 0 {
+		return nil
+	}
+	if p.table != nil && len(p.table.entries) > 0 {
+		decls, err := p.table.buildDecls(obf)
+		if err != nil {
+			return err
+		}
+		for _, path := range p.table.imports() {
+			astutil.AddImport(fset, files[0], path)
+		}
+		appendDecls(files[0], decls)
+	}
+	if p.keys != nil && p.keys.used {
+		if err := p.keys.emit(obf, files); err != nil {
+			return err
+		}
+	}
+	if p.decoys != nil && p.decoys.own {
+		p.decoys.predicates.Emit(fset, files)
 	}
+	p.table = nil
+	p.keys = nil
+	p.decoys = nil
+	return nil
 }
 // Apply finds string literals and replaces them with a metamorphic, inlined, self-decrypting block of code.
 func (p *StringEncryptionPass) Apply(obf *Obfuscator, fset *token.FileSet, file *ast.File) error {
+	var stmts map[*ast.BasicLit]ast.Stmt
+	if p.decoys != nil {
+		stmts = listStatements(file)
+		p.decoys.usePredicates(obf)
+	}
 	astutil.Apply(file, func(cursor *astutil.Cursor) bool {
 		node, ok := cursor.Node().(*ast.BasicLit)
-		if !ok || node.Kind != token.STRING {
+		if !ok || node.Kind != token.STRING || p.plaintext[node] {
 			return true
 		}
 		unquoted, err := strconv.Unquote(node.Value)
@@ -49,203 +176,67 @@ func (p *StringEncryptionPass) Apply(obf *Obfuscator, fset *token.FileSet, file
 		if len(node.Value) <= 2 {
 			return true
 		}
-		encryptedData, key, iv := encryptStringAES(unquoted)
-		if encryptedData == nil {
+		cipher := p.pickCipher()
+		enc, err := cipher.Encrypt([]byte(unquoted), p.keySource())
+		if err != nil {
+			log.Printf("Warning: failed to encrypt string: %v. Skipping string.", err)
 			return true
 		}
-		astutil.AddImport(fset, file, "crypto/aes")
-		astutil.AddImport(fset, file, "crypto/cipher")
-		decryptor := p.createMetamorphicDecryptor(obf, encryptedData, key, iv)
-		if mrand.Intn(100) < 30 {
-			astutil.AddImport(fset, file, "crypto/aes")
-			astutil.AddImport(fset, file, "crypto/cipher")
-			fakeData := make([]byte, len(encryptedData))
-			copy(fakeData, encryptedData)
-			for i := range fakeData {
-				fakeData[i] ^= byte(0x5A) 
-			}
-			fake := p.createMetamorphicDecryptor(obf, fakeData, key, iv)
-			opaque := &ast.IfStmt{
-				Cond: &ast.BinaryExpr{
-					X:  &ast.CallExpr{Fun: ast.NewIdent("len"), Args: []ast.Expr{&ast.CompositeLit{Type: &ast.ArrayType{Elt: ast.NewIdent("byte")}, Elts: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: "1"}, &ast.BasicLit{Kind: token.INT, Value: "2"}, &ast.BasicLit{Kind: token.INT, Value: "3"}}}}},
-					Op: token.EQL,
-					Y:  &ast.BasicLit{Kind: token.INT, Value: "4"},
-				},
-				Body: &ast.BlockStmt{List: []ast.Stmt{
-					&ast.ExprStmt{X: fake},
-				}},
+		if stmt, ok := stmts[node]; ok && p.decoys.roll() {
+			// The decoy uses the same cipher as the real literal so the two look alike.
+			if fake, err := cipher.Encrypt([]byte(decoyPlaintext(unquoted)), p.keySource()); err == nil {
+				for _, path := range fake.Imports {
+					astutil.AddImport(fset, file, path)
+				}
+				p.decoys.add(stmt, p.createMetamorphicDecryptor(obf, fake))
 			}
-			_ = opaque
 		}
-		cursor.Replace(decryptor)
+		if p.mode == StringModeTable && p.table != nil {
+			cursor.Replace(p.wrap(node, p.table.add(enc)))
+			return false
+		}
+		for _, path := range enc.Imports {
+			astutil.AddImport(fset, file, path)
+		}
+		cursor.Replace(p.wrap(node, p.createMetamorphicDecryptor(obf, enc)))
 		return false
 	}, nil)
+	p.decoys.insert(file)
 	return nil
 }
-// createMetamorphicDecryptor generates a varied AST for a self-contained decryption block.
-func (p *StringEncryptionPass) createMetamorphicDecryptor(obf *Obfuscator, encryptedData, key, iv []byte) *ast.CallExpr {
-	createByteSliceLiteral := func(data []byte) *ast.CompositeLit {
-		slice := &ast.CompositeLit{Type: &ast.ArrayType{Elt: ast.NewIdent("byte")}}
-		for _, b := range data {
-			slice.Elts = append(slice.Elts, &ast.BasicLit{Kind: token.INT, Value: fmt.Sprintf("0x%x", b)})
-		}
-		return slice
+// pickCipher selects the backend for the next string according to the configured policy.
+func (p *StringEncryptionPass) pickCipher() StringCipher {
+	if len(p.ciphers) == 0 {
+		return aesCTRCipher{}
 	}
-	dataVar, keyVar, ivVar, blockVar, streamVar, resultVar, errVar, iVar :=
-		NewName(), NewName(), NewName(), NewName(), NewName(), NewName(), NewName(), NewName()
-	weaveIdent := ast.NewIdent(obf.WeavingKeyVarName)
-	if weaveIdent.Name == "" {
-		weaveIdent = ast.NewIdent("weaveKeyFallback0")
+	if p.policy == CipherPolicyRoundRobin {
+		c := p.ciphers[p.nextCipher%len(p.ciphers)]
+		p.nextCipher++
+		return c
 	}
-	var fallbackDecl ast.Stmt = nil
-	if weaveIdent.Name == "weaveKeyFallback0" {
-		fallbackDecl = &ast.DeclStmt{Decl: &ast.GenDecl{
+	return p.ciphers[mrand.Intn(len(p.ciphers))]
+}
+// createMetamorphicDecryptor generates a varied AST for a self-contained decryption block.
+func (p *StringEncryptionPass) createMetamorphicDecryptor(obf *Obfuscator, enc *EncryptedString) *ast.CallExpr {
+	bufVar := NewName()
+	bodyStmts := []ast.Stmt{}
+	if weavingKeyName(obf) == "weaveKeyFallback0" {
+		bodyStmts = append(bodyStmts, &ast.DeclStmt{Decl: &ast.GenDecl{
 			Tok: token.VAR,
 			Specs: []ast.Spec{
 				&ast.ValueSpec{
-					Names:  []*ast.Ident{weaveIdent},
+					Names:  []*ast.Ident{ast.NewIdent("weaveKeyFallback0")},
 					Type:   ast.NewIdent("int64"),
 					Values: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: "0"}},
 				},
 			},
-		}}
-	}
-	keyWeavingLoop := &ast.ForStmt{
-		Init: &ast.AssignStmt{
-			Lhs: []ast.Expr{ast.NewIdent(iVar)}, Tok: token.DEFINE,
-			Rhs: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: "0"}},
-		},
-		Cond: &ast.BinaryExpr{
-			X:  ast.NewIdent(iVar),
-			Op: token.LSS,
-			Y:  &ast.CallExpr{Fun: ast.NewIdent("len"), Args: []ast.Expr{ast.NewIdent(keyVar)}},
-		},
-		Post: &ast.IncDecStmt{X: ast.NewIdent(iVar), Tok: token.INC},
-		Body: &ast.BlockStmt{List: []ast.Stmt{
-			// key[i] ^= byte(((uint64(weavingKey) >> uint((i%8)*8)) ^ uint64(byte(i)*31) ^ uint64(byte(len(data))*17)) & 0xff)
-			&ast.AssignStmt{
-				Lhs: []ast.Expr{&ast.IndexExpr{X: ast.NewIdent(keyVar), Index: ast.NewIdent(iVar)}},
-				Tok: token.XOR_ASSIGN,
-				Rhs: []ast.Expr{
-					&ast.CallExpr{Fun: ast.NewIdent("byte"), Args: []ast.Expr{
-						&ast.BinaryExpr{
-							X: &ast.BinaryExpr{
-								X: &ast.BinaryExpr{
-									X: &ast.BinaryExpr{
-										X: &ast.CallExpr{
-											Fun:  ast.NewIdent("uint64"),
-											Args: []ast.Expr{ast.NewIdent(obf.WeavingKeyVarName)},
-										},
-										Op: token.SHR,
-										Y: &ast.CallExpr{
-											Fun: ast.NewIdent("uint"),
-											Args: []ast.Expr{&ast.ParenExpr{X: &ast.BinaryExpr{
-												X:  &ast.BinaryExpr{X: ast.NewIdent(iVar), Op: token.REM, Y: &ast.BasicLit{Kind: token.INT, Value: "8"}},
-												Op: token.MUL,
-												Y:  &ast.BasicLit{Kind: token.INT, Value: "8"},
-											}}},
-										},
-									},
-									Op: token.XOR,
-									Y: &ast.CallExpr{
-										Fun: ast.NewIdent("uint64"),
-										Args: []ast.Expr{&ast.CallExpr{
-											Fun: ast.NewIdent("byte"),
-											Args: []ast.Expr{&ast.BinaryExpr{
-												X:  ast.NewIdent(iVar),
-												Op: token.MUL,
-												Y:  &ast.BasicLit{Kind: token.INT, Value: "31"},
-											}},
-										}},
-									},
-								},
-								Op: token.XOR,
-								Y: &ast.CallExpr{
-									Fun: ast.NewIdent("uint64"),
-									Args: []ast.Expr{&ast.CallExpr{
-										Fun: ast.NewIdent("byte"),
-										Args: []ast.Expr{&ast.BinaryExpr{
-											X:  &ast.CallExpr{Fun: ast.NewIdent("len"), Args: []ast.Expr{ast.NewIdent(dataVar)}},
-											Op: token.MUL,
-											Y:  &ast.BasicLit{Kind: token.INT, Value: "17"},
-										}},
-									}},
-								},
-							},
-							Op: token.AND,
-							Y:  &ast.BasicLit{Kind: token.INT, Value: "0xff"},
-						},
-					}},
-				},
-			},
-		}},
-	}
-	// --- Metamorphic part: shuffle declaration order ---
-	declarations := []ast.Stmt{
-		&ast.AssignStmt{Lhs: []ast.Expr{ast.NewIdent(keyVar)}, Tok: token.DEFINE, Rhs: []ast.Expr{createByteSliceLiteral(key)}},
-		&ast.AssignStmt{Lhs: []ast.Expr{ast.NewIdent(ivVar)}, Tok: token.DEFINE, Rhs: []ast.Expr{createByteSliceLiteral(iv)}},
-		&ast.AssignStmt{Lhs: []ast.Expr{ast.NewIdent(dataVar)}, Tok: token.DEFINE, Rhs: []ast.Expr{createByteSliceLiteral(encryptedData)}},
+		}})
 	}
-	mrand.Shuffle(len(declarations), func(i, j int) {
-		declarations[i], declarations[j] = declarations[j], declarations[i]
-	})
-	bodyStmts := []ast.Stmt{}
-	if fallbackDecl != nil {
-		bodyStmts = append(bodyStmts, fallbackDecl)
-	}
-	bodyStmts = append(bodyStmts, declarations...)
+	bodyStmts = append(bodyStmts, &ast.AssignStmt{Lhs: []ast.Expr{ast.NewIdent(bufVar)}, Tok: token.DEFINE, Rhs: []ast.Expr{createByteSliceLiteral(enc.Ciphertext)}})
 	bodyStmts = append(bodyStmts, p.metaEngine.GenerateJunkCodeBlock()...) // Junk
-	bodyStmts = append(bodyStmts, keyWeavingLoop)                          // Weave
-	bodyStmts = append(bodyStmts, &ast.IfStmt{
-		Cond: &ast.BinaryExpr{
-			X:  &ast.CallExpr{Fun: ast.NewIdent("len"), Args: []ast.Expr{ast.NewIdent(ivVar)}},
-			Op: token.GTR,
-			Y:  &ast.BasicLit{Kind: token.INT, Value: "0"},
-		},
-		Body: &ast.BlockStmt{List: []ast.Stmt{
-			&ast.AssignStmt{
-				Lhs: []ast.Expr{&ast.IndexExpr{X: ast.NewIdent(ivVar), Index: &ast.BasicLit{Kind: token.INT, Value: "0"}}},
-				Tok: token.XOR_ASSIGN,
-				Rhs: []ast.Expr{&ast.CallExpr{
-					Fun:  ast.NewIdent("byte"),
-					Args: []ast.Expr{&ast.CallExpr{Fun: ast.NewIdent("len"), Args: []ast.Expr{ast.NewIdent(dataVar)}}},
-				}},
-			},
-		}},
-	})
-	bodyStmts = append(bodyStmts, &ast.AssignStmt{
-		Lhs: []ast.Expr{ast.NewIdent(blockVar), ast.NewIdent(errVar)}, Tok: token.DEFINE,
-		Rhs: []ast.Expr{&ast.CallExpr{
-			Fun:  &ast.SelectorExpr{X: ast.NewIdent("aes"), Sel: ast.NewIdent("NewCipher")},
-			Args: []ast.Expr{ast.NewIdent(keyVar)},
-		}},
-	})
-	bodyStmts = append(bodyStmts, &ast.IfStmt{
-		Cond: &ast.BinaryExpr{X: ast.NewIdent(errVar), Op: token.NEQ, Y: ast.NewIdent("nil")},
-		Body: &ast.BlockStmt{List: []ast.Stmt{
-			&ast.ExprStmt{X: &ast.CallExpr{Fun: ast.NewIdent("panic"), Args: []ast.Expr{ast.NewIdent(errVar)}}},
-		}},
-	})
+	bodyStmts = append(bodyStmts, enc.Decrypt(obf, bufVar)...)
 	bodyStmts = append(bodyStmts, p.metaEngine.GenerateJunkCodeBlock()...) // More junk
-	bodyStmts = append(bodyStmts, &ast.AssignStmt{
-		Lhs: []ast.Expr{ast.NewIdent(resultVar)}, Tok: token.DEFINE,
-		Rhs: []ast.Expr{&ast.CallExpr{
-			Fun:  ast.NewIdent("make"),
-			Args: []ast.Expr{&ast.ArrayType{Elt: ast.NewIdent("byte")}, &ast.CallExpr{Fun: ast.NewIdent("len"), Args: []ast.Expr{ast.NewIdent(dataVar)}}},
-		}},
-	})
-	bodyStmts = append(bodyStmts, &ast.AssignStmt{
-		Lhs: []ast.Expr{ast.NewIdent(streamVar)}, Tok: token.DEFINE,
-		Rhs: []ast.Expr{&ast.CallExpr{
-			Fun:  &ast.SelectorExpr{X: ast.NewIdent("cipher"), Sel: ast.NewIdent("NewCTR")},
-			Args: []ast.Expr{ast.NewIdent(blockVar), ast.NewIdent(ivVar)},
-		}},
-	})
-	bodyStmts = append(bodyStmts, &ast.ExprStmt{X: &ast.CallExpr{
-		Fun:  &ast.SelectorExpr{X: ast.NewIdent(streamVar), Sel: ast.NewIdent("XORKeyStream")},
-		Args: []ast.Expr{ast.NewIdent(resultVar), ast.NewIdent(dataVar)},
-	}})
-	bodyStmts = append(bodyStmts, &ast.ReturnStmt{Results: []ast.Expr{&ast.CallExpr{Fun: ast.NewIdent("string"), Args: []ast.Expr{ast.NewIdent(resultVar)}}}})
+	bodyStmts = append(bodyStmts, &ast.ReturnStmt{Results: []ast.Expr{&ast.CallExpr{Fun: ast.NewIdent("string"), Args: []ast.Expr{ast.NewIdent(bufVar)}}}})
 	return &ast.CallExpr{
 		Fun: &ast.FuncLit{
 			Type: &ast.FuncType{
@@ -256,35 +247,12 @@ func (p *StringEncryptionPass) createMetamorphicDecryptor(obf *Obfuscator, encry
 		},
 	}
 }
-// encryptStringAES performs AES-CTR encryption.
-func encryptStringAES(s string) ([]byte, []byte, []byte) {
-	key := make([]byte, 16) // AES-128
-	iv := make([]byte, 16)  // AES block size
-	if _, err := rand.Read(key); err != nil {
-		log.Printf("Warning: failed to generate random key: %v. Skipping string.", err)
-		return nil, nil, nil
-	}
-	if _, err := rand.Read(iv); err != nil {
-		log.Printf("Warning: failed to generate random IV: %v. Skipping string.", err)
-		return nil, nil, nil
-	}
-	var sum uint32
-	for i := 0; i < len(s); i++ {
-		sum += uint32(byte(s[i]))
-	}
+// maskStringKey pre-applies the inverse of the runtime key weaving, so that a decryptor running
+// with a zero weaving key (clean environment) recovers the real key.
+func maskStringKey(key []byte, dataLen int) []byte {
+	maskedKey := make([]byte, len(key))
 	for i := range key {
-		key[i] ^= byte((sum>>uint(i%24))&0xFF) ^ byte(len(s)+i*7)
-	}
-	for i := range iv {
-		iv[i] ^= byte((sum>>uint((i+3)%24))&0xFF) ^ byte(len(s)*3+i*11)
-	}
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		log.Printf("Warning: failed to create AES cipher: %v. Skipping string.", err)
-		return nil, nil, nil
+		maskedKey[i] = key[i] ^ byte(uint64(byte(i*31))^uint64(byte(dataLen*17)))
 	}
-	stream := cipher.NewCTR(block, iv)
-	encrypted := make([]byte, len(s))
-	stream.XORKeyStream(encrypted, []byte(s))
-	return encrypted, key, iv
+	return maskedKey
 }
@@ -1,6 +1,7 @@
 package obfuscator
 import (
 	"bytes"
+	"go/ast"
 	"go/parser"
 	"go/printer"
 	"go/token"
@@ -80,3 +81,102 @@ func main() {
 		t.Errorf("Original code was unexpectedly altered")
 	}
 }
+func TestStringEncryption_TableMode(t *testing.T) {
+	src := `
+package main
+import "fmt"
+func main() {
+	for i := 0; i < 3; i++ {
+		fmt.Println("hot loop string")
+	}
+	fmt.Println("another string")
+}
+`
+	fset, file := parseTestFile(t, src)
+	obf := &Obfuscator{WeavingKeyVarName: "weave_key_dummy"}
+	pass := NewStringEncryptionPass()
+	pass.BeginPackage(StringModeTable)
+	if err := pass.Apply(obf, fset, file); err != nil {
+		t.Fatalf("StringEncryptionPass.Apply failed: %v", err)
+	}
+	if err := pass.FinishPackage(obf, fset, []*ast.File{file}); err != nil {
+		t.Fatalf("StringEncryptionPass.FinishPackage failed: %v", err)
+	}
+	out := printFile(t, fset, file)
+	if strings.Contains(out, `"hot loop string"`) || strings.Contains(out, `"another string"`) {
+		t.Errorf("Original string literals should not be present in the output")
+	}
+	if strings.Count(out, ".Do(func()") != 1 {
+		t.Errorf("Expected exactly one shared accessor in table mode, got:\n%s", out)
+	}
+	if strings.Count(out, "aes.NewCipher(") != 2 {
+		t.Errorf("Expected one decryption case per table entry, got:\n%s", out)
+	}
+	if !strings.Contains(out, "sync.Once") || !strings.Contains(out, `"sync"`) {
+		t.Errorf("Expected the accessor to cache plaintexts under sync.Once")
+	}
+	// The renaming of local variables runs over the accessor and the cases.
+	RenameIdentifiers(file)
+	got := runGoProgram(t, map[string]string{"main.go": printFile(t, fset, file), "key.go": "package main\nvar weave_key_dummy int64\n"})
+	if want := "hot loop string\nhot loop string\nhot loop string\nanother string\n"; got != want {
+		t.Errorf("Decrypted output mismatch: got %q, want %q", got, want)
+	}
+}
+func TestStringEncryption_RoundTrip(t *testing.T) {
+	src := `
+package main
+import "fmt"
+var greeting = "package level"
+func main() {
+	for i := 0; i < 2; i++ {
+		fmt.Println("hello, world!")
+	}
+	fmt.Println(greeting, "ünïcødé")
+}
+`
+	for _, mode := range []StringEncryptionMode{StringModeInline, StringModeTable} {
+		t.Run(string(mode), func(t *testing.T) {
+			fset, file := parseTestFile(t, src)
+			obf := &Obfuscator{WeavingKeyVarName: "weave_key_dummy"}
+			pass := NewStringEncryptionPass()
+			pass.BeginPackage(mode)
+			if err := pass.Apply(obf, fset, file); err != nil {
+				t.Fatalf("StringEncryptionPass.Apply failed: %v", err)
+			}
+			if err := pass.FinishPackage(obf, fset, []*ast.File{file}); err != nil {
+				t.Fatalf("StringEncryptionPass.FinishPackage failed: %v", err)
+			}
+			// The renaming of local variables runs over the decryptors too.
+			RenameIdentifiers(file)
+			got := runGoProgram(t, map[string]string{"main.go": printFile(t, fset, file), "key.go": "package main\nvar weave_key_dummy int64\n"})
+			want := "hello, world!\nhello, world!\npackage level ünïcødé\n"
+			if got != want {
+				t.Errorf("Decrypted output mismatch: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+func TestStringModeFor_MostSpecificPatternWins(t *testing.T) {
+	obf := &Obfuscator{stringMode: StringModeInline, stringModePackages: map[string]StringEncryptionMode{
+		"a/...":   StringModeTable,
+		"a/b":     StringModeInline,
+		"a/b/...": StringModeTable,
+		"a/c/*":   StringModeInline,
+		"a/c/...": StringModeTable,
+	}}
+	cases := map[string]StringEncryptionMode{
+		"a":     StringModeTable,
+		"a/b":   StringModeInline,
+		"a/b/x": StringModeTable,
+		"a/c/x": StringModeTable,
+		"a/d":   StringModeTable,
+		"z":     StringModeInline,
+	}
+	for i := 0; i < 20; i++ {
+		for pkgPath, want := range cases {
+			if got := obf.stringModeFor(pkgPath); got != want {
+				t.Fatalf("stringModeFor(%q) = %q, want %q", pkgPath, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package obfuscator
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"golang.org/x/tools/go/packages"
+)
+func writeTestFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		target := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatalf("Failed to create directory for %s: %v", name, err)
+		}
+		if err := os.WriteFile(target, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+}
+// printFile renders an AST back to Go source.
+func printFile(t *testing.T, fset *token.FileSet, file *ast.File) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, file); err != nil {
+		t.Fatalf("Failed to print AST: %v", err)
+	}
+	return buf.String()
+}
+// printNode renders any syntax node back to Go source.
+func printNode(t *testing.T, fset *token.FileSet, node ast.Node) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, node); err != nil {
+		t.Fatalf("Failed to print AST: %v", err)
+	}
+	return buf.String()
+}
+// parseTestFile parses src as a single file named source.go.
+func parseTestFile(t *testing.T, src string) (*token.FileSet, *ast.File) {
+	t.Helper()
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "source.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Failed to parse source: %v", err)
+	}
+	return fset, file
+}
+// runGoProgram builds and runs the given main package sources as a standalone module
+// and returns the program's combined output.
+func runGoProgram(t *testing.T, files map[string]string) string {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not available")
+	}
+	dir := t.TempDir()
+	all := map[string]string{"go.mod": "module testprog\n\ngo 1.24.4\n"}
+	for name, content := range files {
+		all[name] = content
+	}
+	writeTestFiles(t, dir, all)
+	return runGoDir(t, dir)
+}
+// runGoDir runs the main package of the module in dir and returns its combined output.
+func runGoDir(t *testing.T, dir string) string {
+	t.Helper()
+	cmd := exec.Command("go", "run", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOWORK=off", "OBF_DISABLE_ANTI_VM=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		var sources bytes.Buffer
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && filepath.Ext(path) == ".go" {
+				data, _ := os.ReadFile(path)
+				sources.WriteString("--- " + path + " ---\n")
+				sources.Write(data)
+			}
+			return nil
+		})
+		t.Fatalf("Program failed: %v\n%s\n%s", err, out, sources.String())
+	}
+	return string(out)
+}
+// loadTestPackage writes files as a standalone module and loads its main package with full
+// type information (dependencies are type-checked from source).
+func loadTestPackage(t *testing.T, files map[string]string) *packages.Package {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not available")
+	}
+	dir := t.TempDir()
+	all := map[string]string{"go.mod": "module testprog\n\ngo 1.24.4\n"}
+	for name, content := range files {
+		all[name] = content
+	}
+	writeTestFiles(t, dir, all)
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedSyntax | packages.NeedTypes |
+			packages.NeedTypesInfo | packages.NeedImports | packages.NeedDeps,
+		Fset: token.NewFileSet(),
+		Dir:  dir,
+		Env:  append(os.Environ(), "GOFLAGS=-mod=mod", "GOWORK=off"),
+	}
+	pkgs, err := packages.Load(cfg, ".")
+	if err != nil {
+		t.Fatalf("Failed to load package: %v", err)
+	}
+	if packages.PrintErrors(pkgs) > 0 || len(pkgs) != 1 {
+		t.Fatalf("Failed to load test package")
+	}
+	return pkgs[0]
+}
+// printPackage renders every file of pkg keyed by its base name, ready for runGoProgram.
+func printPackage(t *testing.T, pkg *packages.Package) map[string]string {
+	t.Helper()
+	out := make(map[string]string)
+	for i, file := range pkg.Syntax {
+		out[filepath.Base(pkg.GoFiles[i])] = printFile(t, pkg.Fset, file)
+	}
+	return out
+}
@@ -0,0 +1,270 @@
+package obfuscator
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
+	"golang.org/x/tools/go/ast/astutil"
+)
+// typeNamer spells types in the source of one file, for declarations inserted at a given
+// position. Packages are referred to by the names their imports have there; packages that are
+// not imported yet, or whose name is shadowed at that position, are imported under a fresh alias
+// when addImports is called. Types that no code at that position can name are reported as errors.
+type typeNamer struct {
+	fset *token.FileSet
+	file *ast.File
+	pkg  *types.Package
+	pos  token.Pos
+	// imports maps the path of each package to import to its name, "" for the package name.
+	imports map[string]string
+	aliases map[string]bool
+}
+func newTypeNamer(fset *token.FileSet, file *ast.File, pkg *types.Package, pos token.Pos) *typeNamer {
+	return &typeNamer{fset: fset, file: file, pkg: pkg, pos: pos, imports: make(map[string]string), aliases: make(map[string]bool)}
+}
+// expr returns the type expression of t, the default type of t for untyped constants.
+func (n *typeNamer) expr(t types.Type) (ast.Expr, error) {
+	t = types.Default(t)
+	if err := n.check(t, make(map[types.Type]bool)); err != nil {
+		return nil, err
+	}
+	var qualifyErr error
+	typeString := types.TypeString(t, func(other *types.Package) string {
+		name, err := n.packageName(other.Path(), other.Name())
+		if err != nil && qualifyErr == nil {
+			qualifyErr = err
+		}
+		return name
+	})
+	if qualifyErr != nil {
+		return nil, qualifyErr
+	}
+	expr, err := parser.ParseExpr(typeString)
+	if err != nil {
+		return nil, err
+	}
+	// The positions of the parsed expression refer to no file.
+	stripPositions(expr)
+	return expr, nil
+}
+// check reports why t cannot be named at the position, if it cannot.
+func (n *typeNamer) check(t types.Type, seen map[types.Type]bool) error {
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+	switch t := t.(type) {
+	case *types.Basic:
+		switch {
+		case t.Kind() == types.UnsafePointer:
+			// TypeString spells it unsafe.Pointer whatever the import is called.
+			if name, err := n.packageName("unsafe", "unsafe"); err != nil || name != "unsafe" {
+				return fmt.Errorf("unsafe is not available as unsafe")
+			}
+		case t.Info()&types.IsUntyped != 0:
+			return fmt.Errorf("%s has no type", t)
+		}
+	case *types.Named:
+		if err := n.checkObject(t.Obj()); err != nil {
+			return err
+		}
+		for i := 0; i < t.TypeArgs().Len(); i++ {
+			if err := n.check(t.TypeArgs().At(i), seen); err != nil {
+				return err
+			}
+		}
+	case *types.Alias:
+		if err := n.checkObject(t.Obj()); err != nil {
+			return err
+		}
+		for i := 0; i < t.TypeArgs().Len(); i++ {
+			if err := n.check(t.TypeArgs().At(i), seen); err != nil {
+				return err
+			}
+		}
+	case *types.TypeParam:
+		if _, obj := n.lookup(t.Obj().Name()); obj != t.Obj() {
+			return fmt.Errorf("type parameter %s is not in scope", t.Obj().Name())
+		}
+	case *types.Pointer:
+		return n.check(t.Elem(), seen)
+	case *types.Slice:
+		return n.check(t.Elem(), seen)
+	case *types.Array:
+		return n.check(t.Elem(), seen)
+	case *types.Chan:
+		return n.check(t.Elem(), seen)
+	case *types.Map:
+		if err := n.check(t.Key(), seen); err != nil {
+			return err
+		}
+		return n.check(t.Elem(), seen)
+	case *types.Signature:
+		for _, tuple := range []*types.Tuple{t.Params(), t.Results()} {
+			for i := 0; i < tuple.Len(); i++ {
+				if err := n.check(tuple.At(i).Type(), seen); err != nil {
+					return err
+				}
+			}
+		}
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			field := t.Field(i)
+			if !field.Exported() && field.Pkg() != n.pkg {
+				return fmt.Errorf("struct field %s is unexported in %s", field.Name(), field.Pkg().Path())
+			}
+			if err := n.check(field.Type(), seen); err != nil {
+				return err
+			}
+		}
+	case *types.Interface:
+		for i := 0; i < t.NumExplicitMethods(); i++ {
+			m := t.ExplicitMethod(i)
+			if !m.Exported() && m.Pkg() != n.pkg {
+				return fmt.Errorf("interface method %s is unexported in %s", m.Name(), m.Pkg().Path())
+			}
+			if err := n.check(m.Type(), seen); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < t.NumEmbeddeds(); i++ {
+			if err := n.check(t.EmbeddedType(i), seen); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s cannot be named", t)
+	}
+	return nil
+}
+// checkObject verifies that a named type can be referred to at the position.
+func (n *typeNamer) checkObject(obj *types.TypeName) error {
+	switch {
+	case obj.Pkg() == nil:
+		// Predeclared: error, comparable.
+		if _, found := n.lookup(obj.Name()); found != obj {
+			return fmt.Errorf("%s is shadowed", obj.Name())
+		}
+	case obj.Pkg() != n.pkg:
+		if !obj.Exported() {
+			return fmt.Errorf("%s is unexported in %s", obj.Name(), obj.Pkg().Path())
+		}
+		if !importable(n.pkg.Path(), obj.Pkg().Path()) {
+			return fmt.Errorf("%s cannot be imported from %s", obj.Pkg().Path(), n.pkg.Path())
+		}
+	default:
+		// Package-level or local to an enclosing function: the name must resolve to obj here.
+		if _, found := n.lookup(obj.Name()); found != obj {
+			return fmt.Errorf("%s is not in scope", obj.Name())
+		}
+	}
+	return nil
+}
+// lookup resolves name at the position.
+func (n *typeNamer) lookup(name string) (*types.Scope, types.Object) {
+	scope := n.pkg.Scope().Innermost(n.pos)
+	if scope == nil {
+		return nil, nil
+	}
+	return scope.LookupParent(name, n.pos)
+}
+// packageName returns the name under which the code at the position refers to the package at
+// path, scheduling an import if it has none.
+func (n *typeNamer) packageName(path, name string) (string, error) {
+	if path == n.pkg.Path() {
+		return "", nil
+	}
+	if local, ok := n.imports[path]; ok {
+		if local == "" {
+			return name, nil
+		}
+		return local, nil
+	}
+	for _, imp := range n.file.Imports {
+		if p, _ := strconv.Unquote(imp.Path.Value); p != path {
+			continue
+		}
+		local := name
+		if imp.Name != nil {
+			local = imp.Name.Name
+		}
+		switch local {
+		case "_":
+			continue
+		case ".":
+			return "", nil
+		}
+		if pn, ok := n.resolve(local); ok && pn.Imported().Path() == path {
+			return local, nil
+		}
+		if _, obj := n.lookup(local); obj == nil {
+			// Added by an earlier rewrite, and not shadowed.
+			return local, nil
+		}
+	}
+	if !importable(n.pkg.Path(), path) {
+		return "", fmt.Errorf("%s cannot be imported from %s", path, n.pkg.Path())
+	}
+	if n.taken(name) {
+		local := NewName()
+		n.imports[path] = local
+		n.aliases[local] = true
+		return local, nil
+	}
+	n.imports[path] = ""
+	n.aliases[name] = true
+	return name, nil
+}
+// resolve returns the package name that name refers to at the position.
+func (n *typeNamer) resolve(name string) (*types.PkgName, bool) {
+	_, obj := n.lookup(name)
+	pn, ok := obj.(*types.PkgName)
+	return pn, ok
+}
+// taken reports whether importing a package as name would clash with another declaration.
+func (n *typeNamer) taken(name string) bool {
+	if _, obj := n.lookup(name); obj != nil || n.aliases[name] {
+		return true
+	}
+	for _, imp := range n.file.Imports {
+		if imp.Name != nil && imp.Name.Name == name {
+			return true
+		}
+		if p, _ := strconv.Unquote(imp.Path.Value); imp.Name == nil && p[strings.LastIndex(p, "/")+1:] == name {
+			return true
+		}
+	}
+	return n.pkg.Scope().Lookup(name) != nil
+}
+// addImports adds the imports scheduled by packageName to the file.
+func (n *typeNamer) addImports() {
+	for path, local := range n.imports {
+		if local == "" {
+			astutil.AddImport(n.fset, n.file, path)
+		} else {
+			astutil.AddNamedImport(n.fset, n.file, local, path)
+		}
+	}
+	n.imports = make(map[string]string)
+}
+// importable reports whether the package at from may import the package at path: internal
+// packages are only visible under their parent, and vendored or main packages not at all.
+func importable(from, path string) bool {
+	if path == "main" || path == "C" || strings.HasPrefix(path, "vendor/") || strings.Contains(path, "/vendor/") {
+		return false
+	}
+	elems := strings.Split(path, "/")
+	for i := len(elems) - 1; i >= 0; i-- {
+		if elems[i] != "internal" {
+			continue
+		}
+		// Internal packages of the standard library (empty parent) are out of reach of the code
+		// being obfuscated.
+		parent := strings.Join(elems[:i], "/")
+		return parent != "" && (from == parent || strings.HasPrefix(from, parent+"/"))
+	}
+	return true
+}
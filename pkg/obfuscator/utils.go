@@ -4,6 +4,9 @@ import (
 	"go/ast"
 	"go/token"
 	"math/big"
+	"reflect"
+	"strconv"
+	"golang.org/x/tools/go/ast/astutil"
 )
 const (
 	charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
@@ -58,3 +61,75 @@ func insertDeclsAfterImports(file *ast.File, decls []ast.Decl) {
 		file.Decls = append(decls, file.Decls...)
 	}
 }
+// appendDecls adds generated declarations at the end of file. Large position-less code placed
+// before the original declarations makes the printer flush their comments (including
+// directives) too early; after the last declaration there is nothing left to displace.
+func appendDecls(file *ast.File, decls []ast.Decl) {
+	file.Decls = append(file.Decls, decls...)
+}
+// stripPositions clears every position in a subtree parsed from a generated template, so that
+// the printer does not interpret offsets from a foreign FileSet when the subtree is spliced in.
+// The only position carrying meaning, the ellipsis of a variadic call, is kept valid.
+func stripPositions(root ast.Node) {
+	pinPositions(root, token.NoPos)
+}
+// pinPositions sets every position in a generated subtree to pos, typically the position of the
+// node it replaces: the printer then keeps the code in place instead of flushing the comments
+// that follow it (such as directives) into the middle of it.
+func pinPositions(root ast.Node, pos token.Pos) {
+	setPositions(root, pos, false)
+}
+// fillPositions sets the missing positions in a subtree mixing original and generated code to
+// pos, so that the printer does not run past the comments following the subtree while it prints
+// the generated part.
+func fillPositions(root ast.Node, pos token.Pos) {
+	setPositions(root, pos, true)
+}
+func setPositions(root ast.Node, pos token.Pos, missingOnly bool) {
+	posType := reflect.TypeOf(token.NoPos)
+	ast.Inspect(root, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		v := reflect.ValueOf(n)
+		if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+			return true
+		}
+		call, variadic := n.(*ast.CallExpr)
+		variadic = variadic && call.Ellipsis.IsValid()
+		// A valid Lparen makes the printer parenthesize a declaration of a single spec.
+		_, decl := n.(*ast.GenDecl)
+		v = v.Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if decl && missingOnly && v.Type().Field(i).Name != "TokPos" {
+				continue
+			}
+			if f := v.Field(i); f.Type() == posType && f.CanSet() && (!missingOnly || f.Int() == 0) {
+				f.SetInt(int64(pos))
+			}
+		}
+		if call != nil && !variadic {
+			call.Ellipsis = token.NoPos
+		} else if variadic && !pos.IsValid() {
+			call.Ellipsis = token.Pos(1)
+		}
+		return true
+	})
+}
+// dropUnusedImport removes the import of path from file once a rewrite has removed its last use.
+// Blank imports are kept since they are imported for their side effects.
+func dropUnusedImport(fset *token.FileSet, file *ast.File, path string) {
+	for _, imp := range file.Imports {
+		if p, _ := strconv.Unquote(imp.Path.Value); p != path || (imp.Name != nil && imp.Name.Name == "_") {
+			continue
+		}
+		if !astutil.UsesImport(file, path) {
+			if imp.Name != nil {
+				astutil.DeleteNamedImport(fset, file, imp.Name.Name, path)
+			} else {
+				astutil.DeleteImport(fset, file, path)
+			}
+		}
+		return
+	}
+}
@@ -0,0 +1,313 @@
+package obfuscator
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	mrand "math/rand"
+	"strconv"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+// ValueEncodingPass stores local integer variables in encoded form: every write stores a*v + b
+// modulo 2^n, with an odd a, or v ^ m, and every read decodes the variable, so that the values
+// in memory never are the ones the program computes with. Parameters, results, and variables
+// whose address is taken or which are assigned in ways a rewrite cannot follow (tuple
+// assignments, range clauses, select cases) are left alone.
+type ValueEncodingPass struct{}
+// valueEncoding is how one variable is stored.
+type valueEncoding struct {
+	typ    types.Type
+	bits   uint
+	signed bool
+	xor    bool
+	// mask is the XOR mask; a, b and inverse, the inverse of a, define the affine map.
+	mask, a, b, inverse uint64
+	// conversion spells the type, for the constants initializing the variable without one.
+	conversion ast.Expr
+}
+func (p *ValueEncodingPass) Apply(obf *Obfuscator, pkg *packages.Package) error {
+	if pkg.TypesInfo == nil {
+		return nil
+	}
+	encoded := 0
+	for _, file := range pkg.Syntax {
+		vars := p.plan(pkg, file)
+		if len(vars) == 0 {
+			continue
+		}
+		encodeValues(file, pkg.TypesInfo, vars)
+		for _, imp := range append([]*ast.ImportSpec(nil), file.Imports...) {
+			path, _ := strconv.Unquote(imp.Path.Value)
+			dropUnusedImport(pkg.Fset, file, path)
+		}
+		encoded += len(vars)
+	}
+	if encoded > 0 {
+		fmt.Printf("    - Encoded the values of %d local variables\n", encoded)
+	}
+	return nil
+}
+// plan chooses the encoding of every local variable of file that can be encoded.
+func (p *ValueEncodingPass) plan(pkg *packages.Package, file *ast.File) map[*types.Var]*valueEncoding {
+	info := pkg.TypesInfo
+	vars := make(map[*types.Var]*valueEncoding)
+	// untyped holds the variables initialized by a constant without a type to convert it to.
+	untyped := make(map[*types.Var]bool)
+	candidate := func(id *ast.Ident) *types.Var {
+		v, ok := info.Defs[id].(*types.Var)
+		if !ok || id.Name == "_" || !isIntegerType(v.Type()) {
+			return nil
+		}
+		return v
+	}
+	walkWithStack(file, func(n ast.Node, stack []ast.Node) {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			if n.Tok != token.DEFINE || len(n.Lhs) != len(n.Rhs) || selectCase(n, stack) {
+				return
+			}
+			for i, lhs := range n.Lhs {
+				if v := candidate(lhs.(*ast.Ident)); v != nil {
+					vars[v] = nil
+					untyped[v] = info.Types[n.Rhs[i]].Value != nil
+				}
+			}
+		case *ast.ValueSpec:
+			if len(stack) < 3 || len(n.Values) != 0 && len(n.Values) != len(n.Names) {
+				return
+			}
+			if _, local := stack[len(stack)-3].(*ast.DeclStmt); !local {
+				return
+			}
+			for i, name := range n.Names {
+				if v := candidate(name); v != nil {
+					vars[v] = nil
+					untyped[v] = n.Type == nil && len(n.Values) > 0 && info.Types[n.Values[i]].Value != nil
+				}
+			}
+		}
+	})
+	// Drop the variables used where the encoded value would leak or could not be rewritten.
+	walkWithStack(file, func(n ast.Node, stack []ast.Node) {
+		id, ok := n.(*ast.Ident)
+		if !ok {
+			return
+		}
+		v, ok := info.Uses[id].(*types.Var)
+		if _, planned := vars[v]; !ok || !planned {
+			return
+		}
+		switch parent := stack[len(stack)-2].(type) {
+		case *ast.AssignStmt:
+			for _, lhs := range parent.Lhs {
+				if lhs == id && (len(parent.Lhs) != len(parent.Rhs) || selectCase(parent, stack[:len(stack)-1])) {
+					delete(vars, v)
+				}
+			}
+		case *ast.UnaryExpr:
+			if parent.Op == token.AND {
+				delete(vars, v)
+			}
+		case *ast.SelectorExpr, *ast.RangeStmt, *ast.ParenExpr:
+			delete(vars, v)
+		}
+	})
+	for v := range vars {
+		e := newValueEncoding(v.Type())
+		if untyped[v] && !types.Identical(v.Type(), types.Typ[types.Int]) {
+			var err error
+			names := newTypeNamer(pkg.Fset, file, pkg.Types, v.Pos())
+			if e.conversion, err = names.expr(v.Type()); err != nil {
+				delete(vars, v)
+				continue
+			}
+			names.addImports()
+		}
+		vars[v] = e
+	}
+	return vars
+}
+// selectCase reports whether the assignment on top of stack receives the case of a select
+// statement, which must stay a receive operation.
+func selectCase(assign *ast.AssignStmt, stack []ast.Node) bool {
+	clause, ok := stack[len(stack)-2].(*ast.CommClause)
+	return ok && clause.Comm == assign
+}
+// newValueEncoding draws an encoding for values of type t. The size of int, uint and uintptr
+// depends on the platform the output is built for: they get masks that fit in 31 bits.
+func newValueEncoding(t types.Type) *valueEncoding {
+	e := &valueEncoding{typ: t, bits: 64, signed: isSignedInteger(t), xor: randInt(2) == 0}
+	switch t.Underlying().(*types.Basic).Kind() {
+	case types.Int8, types.Uint8:
+		e.bits = 8
+	case types.Int16, types.Uint16:
+		e.bits = 16
+	case types.Int32, types.Uint32:
+		e.bits = 32
+	case types.Int, types.Uint, types.Uintptr:
+		e.xor = true
+		e.mask = uint64(mrand.Int31()) | 1
+		return e
+	}
+	e.mask = mrand.Uint64()&e.truncation() | 1
+	e.a, e.b = mrand.Uint64()|1, mrand.Uint64()
+	// Newton's iteration doubles the number of correct low bits of the inverse of an odd number.
+	e.inverse = e.a
+	for i := 0; i < 5; i++ {
+		e.inverse *= 2 - e.a*e.inverse
+	}
+	e.a, e.b, e.inverse = e.a&e.truncation(), e.b&e.truncation(), e.inverse&e.truncation()
+	return e
+}
+func (e *valueEncoding) truncation() uint64 {
+	return ^uint64(0) >> (64 - e.bits)
+}
+// encodeConstant returns the encoding of the bits of a constant.
+func (e *valueEncoding) encodeConstant(v uint64) uint64 {
+	if e.xor {
+		return v ^ e.mask
+	}
+	return (v*e.a + e.b) & e.truncation()
+}
+// literal returns a constant of the type of the variable with the given bits.
+func (e *valueEncoding) literal(v uint64, info *types.Info) ast.Expr {
+	v &= e.truncation()
+	value := constant.MakeUint64(v)
+	if e.signed && v>>(e.bits-1) != 0 {
+		value = constant.MakeInt64(int64(v<<(64-e.bits)) >> (64 - e.bits))
+	}
+	if constant.Sign(value) >= 0 {
+		lit := &ast.BasicLit{Kind: token.INT, Value: value.ExactString()}
+		info.Types[lit] = types.TypeAndValue{Type: e.typ, Value: value}
+		return lit
+	}
+	abs := constant.UnaryOp(token.SUB, value, 0)
+	lit := &ast.BasicLit{Kind: token.INT, Value: abs.ExactString()}
+	info.Types[lit] = types.TypeAndValue{Type: e.typ, Value: abs}
+	neg := &ast.UnaryExpr{Op: token.SUB, X: lit}
+	info.Types[neg] = types.TypeAndValue{Type: e.typ, Value: value}
+	return neg
+}
+// binary returns x op y, of the type of the variable.
+func (e *valueEncoding) binary(x ast.Expr, op token.Token, y ast.Expr, info *types.Info) ast.Expr {
+	expr := &ast.BinaryExpr{X: parenthesize(x, info), Op: op, Y: parenthesize(y, info)}
+	info.Types[expr] = types.TypeAndValue{Type: e.typ}
+	return expr
+}
+// encode returns the stored form of value.
+func (e *valueEncoding) encode(value ast.Expr, info *types.Info) ast.Expr {
+	if tv := info.Types[value]; tv.Value != nil {
+		bits, _ := integerValue(info, value)
+		lit := e.literal(e.encodeConstant(bits), info)
+		if e.conversion == nil {
+			return lit
+		}
+		conv := &ast.CallExpr{Fun: cloneExpr(e.conversion, info), Args: []ast.Expr{lit}}
+		info.Types[conv] = info.Types[lit]
+		return conv
+	}
+	if e.xor {
+		return e.binary(value, token.XOR, e.literal(e.mask, info), info)
+	}
+	return e.binary(e.binary(value, token.MUL, e.literal(e.a, info), info), token.ADD, e.literal(e.b, info), info)
+}
+// decode returns the value stored in the variable read by id.
+func (e *valueEncoding) decode(id *ast.Ident, info *types.Info) ast.Expr {
+	var value ast.Expr
+	if e.xor {
+		value = e.binary(id, token.XOR, e.literal(e.mask, info), info)
+	} else {
+		value = e.binary(e.binary(id, token.SUB, e.literal(e.b, info), info), token.MUL, e.literal(e.inverse, info), info)
+	}
+	paren := &ast.ParenExpr{X: value}
+	info.Types[paren] = info.Types[value]
+	return paren
+}
+// encodeValues rewrites the declarations, writes and reads of the variables of file.
+func encodeValues(file *ast.File, info *types.Info, vars map[*types.Var]*valueEncoding) {
+	// done holds the identifiers that are assigned, or that read a value already decoded.
+	done := make(map[*ast.Ident]bool)
+	lookup := func(expr ast.Expr) (*ast.Ident, *valueEncoding) {
+		id, ok := expr.(*ast.Ident)
+		if !ok {
+			return nil, nil
+		}
+		obj := info.ObjectOf(id)
+		v, _ := obj.(*types.Var)
+		return id, vars[v]
+	}
+	// reading returns a new identifier reading the variable of id.
+	reading := func(id *ast.Ident) *ast.Ident {
+		// The object of the parser keeps the identifier with the others for RenameIdentifiers.
+		read := &ast.Ident{Name: id.Name, Obj: id.Obj}
+		done[read] = true
+		info.Uses[read] = info.ObjectOf(id)
+		info.Types[read] = types.TypeAndValue{Type: info.ObjectOf(id).Type()}
+		return read
+	}
+	astutil.Apply(file, func(cursor *astutil.Cursor) bool {
+		switch n := cursor.Node().(type) {
+		case *ast.AssignStmt:
+			for i, lhs := range n.Lhs {
+				id, e := lookup(lhs)
+				if e == nil {
+					continue
+				}
+				done[id] = true
+				switch n.Tok {
+				case token.ASSIGN, token.DEFINE:
+					n.Rhs[i] = e.encode(n.Rhs[i], info)
+				default:
+					// x op= y becomes x = encode(decode(x) op y).
+					op := n.Tok - (token.ADD_ASSIGN - token.ADD)
+					n.Tok = token.ASSIGN
+					n.Rhs[i] = e.encode(e.binary(e.decode(reading(id), info), op, n.Rhs[i], info), info)
+				}
+			}
+		case *ast.IncDecStmt:
+			id, e := lookup(n.X)
+			if e == nil {
+				return true
+			}
+			op := token.ADD
+			if n.Tok == token.DEC {
+				op = token.SUB
+			}
+			done[id] = true
+			one := e.literal(1, info)
+			cursor.Replace(&ast.AssignStmt{Lhs: []ast.Expr{id}, TokPos: n.TokPos, Tok: token.ASSIGN, Rhs: []ast.Expr{e.encode(e.binary(e.decode(reading(id), info), op, one, info), info)}})
+		case *ast.ValueSpec:
+			var encoded bool
+			for _, name := range n.Names {
+				if _, e := lookup(name); e != nil {
+					done[name], encoded = true, true
+				}
+			}
+			if !encoded {
+				return true
+			}
+			if len(n.Values) == 0 {
+				// The zero value is encoded too; the other names share the integer type.
+				for range n.Names {
+					lit := &ast.BasicLit{Kind: token.INT, Value: "0"}
+					info.Types[lit] = types.TypeAndValue{Type: info.TypeOf(n.Names[0]), Value: constant.MakeInt64(0)}
+					n.Values = append(n.Values, lit)
+				}
+			}
+			for i, name := range n.Names {
+				if _, e := lookup(name); e != nil {
+					n.Values[i] = e.encode(n.Values[i], info)
+				}
+			}
+		case *ast.Ident:
+			if id, e := lookup(n); e != nil && !done[id] {
+				done[id] = true
+				cursor.Replace(e.decode(id, info))
+				return false
+			}
+		}
+		return true
+	}, nil)
+}
@@ -0,0 +1,103 @@
+package obfuscator
+import (
+	"strings"
+	"testing"
+)
+var valueEncodingProgram = map[string]string{
+	"main.go": `package main
+import (
+	"fmt"
+	"time"
+)
+type level uint16
+func widths(n int) {
+	var a int8 = -100
+	var b uint8
+	c := int16(-30000)
+	d, e := uint32(4000000000), int64(-9000000000000000000)
+	var f, g = uint64(0xfeedfacecafef00d), uintptr(n)
+	var l level = 7
+	var r = 'x'
+	for i := 0; i < 300; i++ {
+		a += int8(i)
+		b -= 3
+		c *= 7
+		d ^= uint32(i) << 3
+		e /= 3
+		f = f>>1 | f<<63
+		g++
+		l <<= 1
+		r--
+	}
+	fmt.Println(a, b, c, d, e, f, g, l, r)
+}
+func control(xs []int) (total int) {
+	count := 0
+	for _, x := range xs {
+		switch step := x % 3; step {
+		case 0:
+			count++
+		case 1:
+			total += x
+		default:
+			total -= step
+		}
+	}
+	inc := func(k int) int {
+		count += k
+		return count
+	}
+	inc(10)
+	return total + inc(1)
+}
+func untouched() int {
+	n := 7
+	p := &n
+	*p += 1
+	m := 3
+	ch := make(chan int, 1)
+	ch <- 5
+	select {
+	case m = <-ch:
+	default:
+	}
+	v, ok := 4, true
+	if q, found := map[int]int{1: 2}[1]; found && ok {
+		v += q
+	}
+	return n + m + v
+}
+func main() {
+	widths(5)
+	fmt.Println(control([]int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}))
+	fmt.Println(untouched())
+	month := time.March
+	month++
+	fmt.Println(month)
+}
+`,
+}
+func TestValueEncodingPass_PreservesBehaviour(t *testing.T) {
+	want := runGoProgram(t, valueEncodingProgram)
+	pkg := loadTestPackage(t, valueEncodingProgram)
+	// Encodings applied over each other must compose.
+	for i := 0; i < 2; i++ {
+		if err := (&ValueEncodingPass{}).Apply(nil, pkg); err != nil {
+			t.Fatalf("ValueEncodingPass failed: %v", err)
+		}
+	}
+	out := printPackage(t, pkg)
+	if got := runGoProgram(t, out); got != want {
+		t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out["main.go"])
+	}
+	for _, plain := range []string{"a += int8(i)", "i++", "b -= 3", "count++", "month++", "0xfeedfacecafef00d"} {
+		if strings.Contains(out["main.go"], plain) {
+			t.Errorf("Expected %q to be encoded:\n%s", plain, out["main.go"])
+		}
+	}
+	for _, kept := range []string{"n := 7", "case m = <-ch:", "total += x", "q, found :="} {
+		if !strings.Contains(out["main.go"], kept) {
+			t.Errorf("Expected %q to be left alone:\n%s", kept, out["main.go"])
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package obfuscator
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	mrand "math/rand"
+	"strconv"
+	"strings"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+// virtualizeDirective marks a function whose body is compiled to bytecode: `//obf:virtualize`.
+const virtualizeDirective = "//obf:virtualize"
+// VirtualizationPass compiles the bodies of the functions marked with virtualizeDirective into
+// bytecode for the interpreter of the build, and replaces them with a call running it. Functions
+// using anything the compiler does not support are reported and left as they are.
+type VirtualizationPass struct{}
+func (p *VirtualizationPass) Apply(obf *Obfuscator, pkg *packages.Package) error {
+	if obf.vm == nil || obf.vm.path == "" {
+		return nil
+	}
+	for _, file := range pkg.Syntax {
+		alias, used := NewName(), false
+		for _, decl := range file.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok || fd.Body == nil || pkg.TypesInfo.Defs[fd.Name] == nil {
+				continue
+			}
+			directive := virtualizeComment(fd.Doc)
+			if directive == nil {
+				continue
+			}
+			removeComment(file, directive)
+			if err := virtualize(obf.vm, pkg, file, fd, alias); err != nil {
+				fmt.Printf("    - Function %s not virtualized: %v\n", fd.Name.Name, err)
+				continue
+			}
+			fmt.Printf("    - Virtualized %s\n", fd.Name.Name)
+			used = true
+		}
+		if used {
+			astutil.AddNamedImport(pkg.Fset, file, alias, obf.vm.path)
+		}
+	}
+	return nil
+}
+func virtualizeComment(doc *ast.CommentGroup) *ast.Comment {
+	if doc == nil {
+		return nil
+	}
+	for _, c := range doc.List {
+		if strings.TrimSpace(c.Text) == virtualizeDirective {
+			return c
+		}
+	}
+	return nil
+}
+// virtualize compiles the body of fd and, if it compiles, replaces it with its interpretation by
+// the package imported as alias.
+func virtualize(vm *virtualMachine, pkg *packages.Package, file *ast.File, fd *ast.FuncDecl, alias string) error {
+	if usesCgo(file) {
+		return fmt.Errorf("file uses cgo")
+	}
+	if hasDotImport(file) {
+		return fmt.Errorf("file has dot imports")
+	}
+	sig := pkg.TypesInfo.Defs[fd.Name].Type().(*types.Signature)
+	if sig.TypeParams().Len() > 0 || sig.RecvTypeParams().Len() > 0 {
+		return fmt.Errorf("generic")
+	}
+	names := newTypeNamer(pkg.Fset, file, pkg.Types, file.Name.Pos())
+	c := newVMCompiler(pkg.Fset, pkg.TypesInfo, pkg.Types, vm, names, sig)
+	c.function(fd)
+	if c.err != nil {
+		return c.err
+	}
+	key := mrand.Uint32()
+	out := NewName()
+	var tail []string
+	var values []string
+	for i := 0; i < sig.Results().Len(); i++ {
+		values = append(values, NewName())
+		tail = append(tail, c.native(fd, values[i], fmt.Sprintf("%s[%d]", out, i), sig.Results().At(i).Type()))
+	}
+	if c.err != nil {
+		return c.err
+	}
+	// The stub passes the parameters under fresh names, which no wrapper can shadow.
+	var params []*types.Var
+	var fields []*ast.Field
+	if fd.Recv != nil {
+		params = append(params, sig.Recv())
+		fields = append(fields, fd.Recv.List...)
+	}
+	for i := 0; i < sig.Params().Len(); i++ {
+		params = append(params, sig.Params().At(i))
+	}
+	fields = append(fields, fd.Type.Params.List...)
+	var args, fresh []string
+	for _, field := range fields {
+		for i := 0; i < max(1, len(field.Names)); i++ {
+			fresh = append(fresh, NewName())
+			args = append(args, vmCanonical(fresh[len(args)], params[len(args)].Type()))
+		}
+	}
+	run := fmt.Sprintf("%s.Run(%s, %#x, []interface{}{%s}, []interface{}{%s}, []func([]interface{}) []interface{}{%s})", alias, strconv.Quote(string(vm.encrypt(c.code, key))), key, strings.Join(args, ", "), strings.Join(c.zeros, ", "), strings.Join(c.funcs, ",\n"))
+	src := run
+	if len(values) > 0 {
+		src = out + " := " + run + "\n" + strings.Join(tail, "\n") + "\nreturn " + strings.Join(values, ", ")
+	}
+	stmts, err := parseStmts(src)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if len(field.Names) == 0 {
+			field.Names = []*ast.Ident{ast.NewIdent("_")}
+		}
+		for _, name := range field.Names {
+			name.Name, fresh = fresh[0], fresh[1:]
+		}
+	}
+	if fd.Type.Results != nil {
+		for _, field := range fd.Type.Results.List {
+			for _, name := range field.Names {
+				name.Name = NewName()
+			}
+		}
+	}
+	dropComments(file, fd.Body)
+	fd.Body.List = stmts
+	names.addImports()
+	for _, imp := range append([]*ast.ImportSpec(nil), file.Imports...) {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		dropUnusedImport(pkg.Fset, file, path)
+	}
+	// The stub is generated code without type information, which later passes leave alone.
+	delete(pkg.TypesInfo.Defs, fd.Name)
+	vm.used = true
+	return nil
+}
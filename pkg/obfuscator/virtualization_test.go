@@ -0,0 +1,216 @@
+package obfuscator
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+var virtualizationProgram = map[string]string{
+	"main.go": `package main
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	str "strings"
+)
+type level uint8
+type ledger struct {
+	owner   string
+	entries []int64
+}
+var rounds = 3
+//obf:virtualize
+func checksum(key string, seed uint32) (uint32, error) {
+	if key == "" {
+		return 0, errors.New("empty key")
+	}
+	h := seed
+	for i, r := range key {
+		h ^= uint32(r) << (uint(i) % 24)
+		h = h*16777619 + uint32(i)
+		h = h>>13 | h<<19
+	}
+	for i := 0; i < rounds; i++ {
+		h -= h / 7
+	}
+	return h, nil
+}
+//obf:virtualize
+func widths(a int8, b uint16, c int32, d uint64) (int8, uint16, int32, uint64, int) {
+	a *= 3
+	a -= 100
+	b += 65000
+	c = -c / 3 % 1000
+	d = ^d >> 3
+	n := int(a) + int(b) - int(c)
+	n <<= 2
+	n &^= 5
+	return a, b, c, d, n % 11
+}
+//obf:virtualize
+func (l *ledger) add(amounts ...int64) (total int64) {
+	for _, a := range amounts {
+		if a < 0 {
+			continue
+		}
+		l.entries = append(l.entries, a)
+	}
+	for _, e := range l.entries {
+		total += e
+	}
+	return
+}
+//obf:virtualize
+func (l ledger) describe(prefix string) string {
+	parts := []string{}
+	for i := range len(l.entries) {
+		parts = append(parts, strconv.FormatInt(l.entries[i], 16))
+	}
+	label := level(len(parts))
+	switch {
+	case label > 3:
+		prefix += "!"
+		fallthrough
+	case label > 1:
+		prefix += "+"
+	default:
+		prefix = str.ToUpper(prefix)
+	}
+	return fmt.Sprintf("%s %s [%s] %d", prefix, l.owner, str.Join(parts, ","), label)
+}
+//obf:virtualize
+func grade(score int) (g string) {
+	switch score / 10 {
+	case 10, 9:
+		g = "A"
+	case 8:
+		g = "B"
+	case 7, 6:
+		if score%10 >= 5 {
+			g = "C+"
+			break
+		}
+		g = "C"
+	default:
+		g = "F"
+	}
+	return
+}
+//obf:virtualize
+func transform(data []byte, key string) []byte {
+	out := make([]byte, len(data), len(data)+4)
+	copy(out, data)
+	kb := []byte(key)
+outer:
+	for i := 0; i < len(out); i++ {
+		for j := 0; j < len(kb); j++ {
+			if kb[j] == 0 {
+				break outer
+			}
+			out[i] ^= kb[j] + byte(i)
+			if j > 1 {
+				continue outer
+			}
+		}
+	}
+	out = append(out, data[1:3]...)
+	return out[:len(out):len(out)]
+}
+//obf:virtualize
+func parse(fields []string) (sum int, bad []string, err error) {
+	var n int
+	for _, f := range fields {
+		if n, err = strconv.Atoi(f); err != nil {
+			bad = append(bad, f)
+			continue
+		}
+		sum += n
+	}
+	if len(bad) == len(fields) && err != nil {
+		return 0, nil, fmt.Errorf("nothing parsed: %w", err)
+	}
+	var e error
+	if e == nil && err != nil {
+		err = nil
+	}
+	return
+}
+//obf:virtualize
+func unsupported(n int) int {
+	defer fmt.Println("deferred")
+	return n + 1
+}
+//obf:virtualize
+func closure(n int) int {
+	f := func() int { return n * 2 }
+	return f()
+}
+func main() {
+	fmt.Println(checksum("letmein", 2166136261))
+	fmt.Println(checksum("", 0))
+	fmt.Println(widths(50, 1000, 123456, 1<<63))
+	fmt.Println(widths(-7, 65535, -2, 7))
+	l := &ledger{owner: "ann"}
+	fmt.Println(l.add(5, -3, 40, 255))
+	fmt.Println(l.describe("sum"), ledger{owner: "bob"}.describe("none"))
+	l.add(1, 2)
+	fmt.Println(l.describe("big"))
+	for _, s := range []int{100, 93, 80, 77, 71, 12} {
+		fmt.Print(grade(s), " ")
+	}
+	fmt.Println()
+	fmt.Println(transform([]byte("hello, world"), "k3y"), transform([]byte("abcd"), "a\x00b"))
+	fmt.Println(parse([]string{"1", "x", "22"}))
+	fmt.Println(parse([]string{"y", "z"}))
+	fmt.Println(unsupported(1), closure(2))
+}
+`,
+}
+func TestVirtualizationPass_PreservesBehaviour(t *testing.T) {
+	want := runGoProgram(t, virtualizationProgram)
+	pkg := loadTestPackage(t, virtualizationProgram)
+	vm := newVirtualMachine()
+	vm.path = "testprog/" + vm.name
+	obf := &Obfuscator{vm: vm}
+	if err := (&VirtualizationPass{}).Apply(obf, pkg); err != nil {
+		t.Fatalf("VirtualizationPass failed: %v", err)
+	}
+	out := printPackage(t, pkg)
+	src, err := vm.source()
+	if err != nil {
+		t.Fatalf("Failed to generate the interpreter: %v", err)
+	}
+	out[filepath.Join(vm.name, vm.name+".go")] = string(src)
+	if got := runGoProgram(t, out); got != want {
+		t.Fatalf("Output mismatch:\ngot  %q\nwant %q\n%s", got, want, out["main.go"])
+	}
+	if n := strings.Count(out["main.go"], ".Run("); n != 7 {
+		t.Errorf("Expected 7 virtualized functions, got %d", n)
+	}
+	for _, kept := range []string{`defer fmt.Println("deferred")`, "return n * 2", "return n + 1"} {
+		if !strings.Contains(out["main.go"], kept) {
+			t.Errorf("Expected unsupported functions to be left alone, missing %q", kept)
+		}
+	}
+	for _, plain := range []string{"16777619", "nothing parsed", "65000"} {
+		if strings.Contains(out["main.go"], plain) {
+			t.Errorf("Expected %q to be compiled away:\n%s", plain, out["main.go"])
+		}
+	}
+}
+func TestVirtualMachine_EncodingsDiffer(t *testing.T) {
+	a, b := newVirtualMachine(), newVirtualMachine()
+	if a.opcodes == b.opcodes {
+		t.Error("Expected each build to draw its own opcodes")
+	}
+	seen := make(map[byte]bool)
+	for _, op := range a.opcodes {
+		if seen[op] {
+			t.Fatalf("Opcode %#x used twice", op)
+		}
+		seen[op] = true
+	}
+	plain := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if string(a.encrypt(plain, 1)) == string(a.encrypt(plain, 2)) || string(a.encrypt(plain, 1)) == string(b.encrypt(plain, 1)) {
+		t.Error("Expected the bytecode encoding to depend on the key and the build")
+	}
+}
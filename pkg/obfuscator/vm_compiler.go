@@ -0,0 +1,1187 @@
+package obfuscator
+import (
+	"encoding/binary"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"strings"
+)
+// vmClass is how the virtual machine holds the values of a type.
+type vmClass int
+const (
+	vmInt    vmClass = iota // uint64, sign-extended for signed kinds
+	vmBool                  // bool
+	vmString                // string
+	vmSlice                 // the slice itself, worked on through reflection
+	vmOpaque                // the Go value, only passed around and handed to calls
+)
+func vmClassOf(t types.Type) vmClass {
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch {
+		case u.Info()&types.IsInteger != 0:
+			return vmInt
+		case u.Info()&types.IsBoolean != 0:
+			return vmBool
+		case u.Info()&types.IsString != 0:
+			return vmString
+		}
+	case *types.Slice:
+		return vmSlice
+	}
+	return vmOpaque
+}
+// vmKindOf returns the kind operand of the arithmetic and ordering of t.
+func vmKindOf(t types.Type) uint64 {
+	if vmClassOf(t) == vmString {
+		return vmKindString
+	}
+	switch types.Default(t).Underlying().(*types.Basic).Kind() {
+	case types.Uint8:
+		return vmKindUint8
+	case types.Uint16:
+		return vmKindUint16
+	case types.Uint32:
+		return vmKindUint32
+	case types.Uint64:
+		return vmKindUint64
+	case types.Uint, types.Uintptr:
+		return vmKindUint
+	case types.Int8:
+		return vmKindInt8
+	case types.Int16:
+		return vmKindInt16
+	case types.Int32:
+		return vmKindInt32
+	case types.Int64:
+		return vmKindInt64
+	}
+	return vmKindInt
+}
+func isSignedInteger(t types.Type) bool {
+	b, ok := types.Default(t).Underlying().(*types.Basic)
+	return ok && b.Info()&types.IsInteger != 0 && b.Info()&types.IsUnsigned == 0
+}
+func isNillable(t types.Type) bool {
+	switch u := t.Underlying().(type) {
+	case *types.Pointer, *types.Slice, *types.Map, *types.Chan, *types.Signature, *types.Interface:
+		return true
+	case *types.Basic:
+		return u.Kind() == types.UnsafePointer
+	}
+	return false
+}
+var vmArithOps = map[token.Token]vmOp{
+	token.ADD: opAdd, token.SUB: opSub, token.MUL: opMul, token.QUO: opDiv, token.REM: opRem,
+	token.AND: opAnd, token.OR: opOr, token.XOR: opXor, token.AND_NOT: opAndNot, token.SHL: opShl, token.SHR: opShr,
+}
+var vmOrderOps = map[token.Token]vmOp{token.LSS: opLt, token.LEQ: opLe, token.GTR: opGt, token.GEQ: opGe}
+var vmAssignOps = map[token.Token]token.Token{
+	token.ADD_ASSIGN: token.ADD, token.SUB_ASSIGN: token.SUB, token.MUL_ASSIGN: token.MUL, token.QUO_ASSIGN: token.QUO,
+	token.REM_ASSIGN: token.REM, token.AND_ASSIGN: token.AND, token.OR_ASSIGN: token.OR, token.XOR_ASSIGN: token.XOR,
+	token.AND_NOT_ASSIGN: token.AND_NOT, token.SHL_ASSIGN: token.SHL, token.SHR_ASSIGN: token.SHR,
+}
+// vmLabel is a position in the bytecode and the jumps to it.
+type vmLabel struct {
+	pos  int
+	refs []int
+}
+// vmTarget is a statement break, and for loops continue, can leave.
+type vmTarget struct {
+	label     string
+	brk, cont *vmLabel
+}
+// vmPlace is the destination of an assignment: a local, an element of a slice or a field
+// through a pointer whose operands are evaluated into temporaries, or nothing.
+type vmPlace struct {
+	slot     int
+	x, index int
+	elem     bool
+	field    *ast.SelectorExpr
+	blank    bool
+}
+// vmCompiler translates the body of one function into bytecode. Locals live in numbered slots,
+// the parameters first; calls out of the virtual machine, and whatever the machine cannot do
+// itself, go through wrappers converting values at the boundary. The first unsupported
+// construct is recorded in err, and the function must then be left alone.
+type vmCompiler struct {
+	fset    *token.FileSet
+	info    *types.Info
+	scope   *types.Scope
+	vm      *virtualMachine
+	names   *typeNamer
+	sig     *types.Signature
+	code    []byte
+	slots   map[types.Object]int
+	nslots  int
+	labels  []*vmLabel
+	targets []*vmTarget
+	fall    *vmLabel
+	// zeros and funcs hold the source of the type table and the function table of Run.
+	zeros     []string
+	zeroIndex map[string]int
+	funcs     []string
+	err       error
+}
+func newVMCompiler(fset *token.FileSet, info *types.Info, pkg *types.Package, vm *virtualMachine, names *typeNamer, sig *types.Signature) *vmCompiler {
+	return &vmCompiler{fset: fset, info: info, scope: pkg.Scope(), vm: vm, names: names, sig: sig, slots: make(map[types.Object]int), zeroIndex: make(map[string]int)}
+}
+func (c *vmCompiler) fail(n ast.Node, format string, args ...interface{}) {
+	if c.err == nil {
+		c.err = fmt.Errorf("line %d: %s", c.fset.Position(n.Pos()).Line, fmt.Sprintf(format, args...))
+	}
+}
+func (c *vmCompiler) op(op vmOp, operands ...uint64) {
+	c.code = append(c.code, c.vm.opcodes[op])
+	for _, x := range operands {
+		c.code = binary.AppendUvarint(c.code, x)
+	}
+}
+func (c *vmCompiler) newLabel() *vmLabel {
+	l := &vmLabel{}
+	c.labels = append(c.labels, l)
+	return l
+}
+func (c *vmCompiler) mark(l *vmLabel) {
+	l.pos = len(c.code)
+}
+// jump emits a jump with room for its target, patched once the function is compiled.
+func (c *vmCompiler) jump(op vmOp, l *vmLabel) {
+	c.code = append(c.code, c.vm.opcodes[op])
+	l.refs = append(l.refs, len(c.code))
+	c.code = append(c.code, 0, 0, 0, 0, 0)
+}
+// putFixed writes x as a varint of five bytes, which the interpreter reads like any other.
+func (c *vmCompiler) putFixed(at int, x int) {
+	for i := 0; i < 4; i++ {
+		c.code[at+i] = byte(x>>(7*i))&0x7f | 0x80
+	}
+	c.code[at+4] = byte(x >> 28)
+}
+func (c *vmCompiler) temp() int {
+	c.nslots++
+	return c.nslots - 1
+}
+func (c *vmCompiler) slot(obj types.Object) int {
+	if s, ok := c.slots[obj]; ok {
+		return s
+	}
+	c.slots[obj] = c.temp()
+	return c.slots[obj]
+}
+// function compiles the body of fd. The bytecode starts with the number of slots.
+func (c *vmCompiler) function(fd *ast.FuncDecl) {
+	c.code = append(c.code, 0, 0, 0, 0, 0)
+	if c.sig.Recv() != nil {
+		c.slot(c.sig.Recv())
+	}
+	for i := 0; i < c.sig.Params().Len(); i++ {
+		c.slot(c.sig.Params().At(i))
+	}
+	results := c.sig.Results()
+	if results.Len() > 0 && results.At(0).Name() != "" {
+		for i := 0; i < results.Len(); i++ {
+			c.zero(fd, results.At(i).Type())
+			c.op(opStore, uint64(c.slot(results.At(i))))
+		}
+	}
+	c.stmts(fd.Body.List)
+	c.returnNamed()
+	c.putFixed(0, c.nslots)
+	for _, l := range c.labels {
+		for _, ref := range l.refs {
+			c.putFixed(ref, l.pos)
+		}
+	}
+}
+func (c *vmCompiler) returnNamed() {
+	results := c.sig.Results()
+	if results.Len() > 0 && results.At(0).Name() == "" {
+		// Falling off the end of such a function is unreachable.
+		c.op(opReturn, 0)
+		return
+	}
+	for i := 0; i < results.Len(); i++ {
+		c.op(opLoad, uint64(c.slot(results.At(i))))
+	}
+	c.op(opReturn, uint64(results.Len()))
+}
+func (c *vmCompiler) stmts(list []ast.Stmt) {
+	for _, s := range list {
+		c.stmt(s, "")
+	}
+}
+func (c *vmCompiler) stmt(s ast.Stmt, label string) {
+	if c.err != nil {
+		return
+	}
+	switch s := s.(type) {
+	case *ast.EmptyStmt:
+	case *ast.BlockStmt:
+		c.stmts(s.List)
+	case *ast.LabeledStmt:
+		c.stmt(s.Stmt, s.Label.Name)
+	case *ast.ExprStmt:
+		call, ok := ast.Unparen(s.X).(*ast.CallExpr)
+		if !ok {
+			c.fail(s, "expression statement")
+			return
+		}
+		for n := c.call(call); n > 0; n-- {
+			c.op(opPop)
+		}
+	case *ast.AssignStmt:
+		c.assign(s)
+	case *ast.IncDecStmt:
+		tok := token.ADD
+		if s.Tok == token.DEC {
+			tok = token.SUB
+		}
+		c.update(s, s.X, tok, func() { c.op(opPushInt, 1) }, nil)
+	case *ast.DeclStmt:
+		c.decl(s.Decl.(*ast.GenDecl))
+	case *ast.IfStmt:
+		if s.Init != nil {
+			c.stmt(s.Init, "")
+		}
+		els, end := c.newLabel(), c.newLabel()
+		c.expr(s.Cond)
+		c.jump(opJumpIfNot, els)
+		c.stmts(s.Body.List)
+		c.jump(opJump, end)
+		c.mark(els)
+		if s.Else != nil {
+			c.stmt(s.Else, "")
+		}
+		c.mark(end)
+	case *ast.ForStmt:
+		if s.Init != nil {
+			c.stmt(s.Init, "")
+		}
+		top, t := c.newLabel(), &vmTarget{label: label, brk: c.newLabel(), cont: c.newLabel()}
+		c.mark(top)
+		if s.Cond != nil {
+			c.expr(s.Cond)
+			c.jump(opJumpIfNot, t.brk)
+		}
+		c.loopBody(t, s.Body)
+		if s.Post != nil {
+			c.stmt(s.Post, "")
+		}
+		c.jump(opJump, top)
+		c.mark(t.brk)
+	case *ast.RangeStmt:
+		c.rangeStmt(s, label)
+	case *ast.SwitchStmt:
+		c.switchStmt(s, label)
+	case *ast.ReturnStmt:
+		c.returnStmt(s)
+	case *ast.BranchStmt:
+		c.branch(s)
+	default:
+		c.fail(s, "%s statements are not supported", strings.TrimSuffix(strings.TrimPrefix(fmt.Sprintf("%T", s), "*ast."), "Stmt"))
+	}
+}
+// loopBody compiles the body of a loop and marks where continue goes.
+func (c *vmCompiler) loopBody(t *vmTarget, body *ast.BlockStmt) {
+	c.targets = append(c.targets, t)
+	c.stmts(body.List)
+	c.targets = c.targets[:len(c.targets)-1]
+	c.mark(t.cont)
+}
+func (c *vmCompiler) branch(s *ast.BranchStmt) {
+	switch s.Tok {
+	case token.FALLTHROUGH:
+		c.jump(opJump, c.fall)
+		return
+	case token.GOTO:
+		c.fail(s, "goto is not supported")
+		return
+	}
+	for i := len(c.targets) - 1; i >= 0; i-- {
+		t := c.targets[i]
+		if s.Label != nil && t.label != s.Label.Name || s.Tok == token.CONTINUE && t.cont == nil {
+			continue
+		}
+		if s.Tok == token.BREAK {
+			c.jump(opJump, t.brk)
+		} else {
+			c.jump(opJump, t.cont)
+		}
+		return
+	}
+	c.fail(s, "%s without target", s.Tok)
+}
+func (c *vmCompiler) decl(d *ast.GenDecl) {
+	switch d.Tok {
+	case token.CONST:
+		// Uses of constants are folded.
+		return
+	case token.VAR:
+	default:
+		c.fail(d, "local %s declarations are not supported", d.Tok)
+		return
+	}
+	for _, spec := range d.Specs {
+		vs := spec.(*ast.ValueSpec)
+		lhs := make([]ast.Expr, len(vs.Names))
+		for i, name := range vs.Names {
+			lhs[i] = name
+		}
+		if len(vs.Values) == 0 {
+			for _, name := range vs.Names {
+				c.zero(name, c.info.ObjectOf(name).Type())
+				c.storePlace(c.place(name))
+			}
+			continue
+		}
+		c.assignValues(vs, lhs, vs.Values)
+	}
+}
+func (c *vmCompiler) assign(s *ast.AssignStmt) {
+	if tok, ok := vmAssignOps[s.Tok]; ok {
+		c.update(s, s.Lhs[0], tok, func() { c.expr(s.Rhs[0]) }, c.info.TypeOf(s.Rhs[0]))
+		return
+	}
+	c.assignValues(s, s.Lhs, s.Rhs)
+}
+// assignValues evaluates the operands of the destinations, then the values, then assigns them
+// from left to right.
+func (c *vmCompiler) assignValues(n ast.Node, lhs, rhs []ast.Expr) {
+	places := make([]vmPlace, len(lhs))
+	for i, e := range lhs {
+		places[i] = c.place(e)
+	}
+	if len(rhs) == 1 && len(lhs) > 1 {
+		call, ok := ast.Unparen(rhs[0]).(*ast.CallExpr)
+		if !ok {
+			c.fail(n, "comma-ok expressions are not supported")
+			return
+		}
+		c.call(call)
+	} else {
+		for i, e := range rhs {
+			c.value(e, c.placeType(lhs[i], e))
+		}
+	}
+	if len(places) == 1 {
+		c.storePlace(places[0])
+		return
+	}
+	values := make([]int, len(places))
+	for i := len(places) - 1; i >= 0; i-- {
+		values[i] = c.temp()
+		c.op(opStore, uint64(values[i]))
+	}
+	for i, p := range places {
+		c.op(opLoad, uint64(values[i]))
+		c.storePlace(p)
+	}
+}
+func (c *vmCompiler) placeType(lhs, rhs ast.Expr) types.Type {
+	if id, ok := lhs.(*ast.Ident); ok && id.Name == "_" {
+		return c.info.TypeOf(rhs)
+	}
+	if id, ok := lhs.(*ast.Ident); ok {
+		return c.info.ObjectOf(id).Type()
+	}
+	return c.info.TypeOf(lhs)
+}
+// update compiles x op= y, evaluating the operands of x once.
+func (c *vmCompiler) update(n ast.Node, x ast.Expr, tok token.Token, y func(), yt types.Type) {
+	p := c.place(x)
+	if p.blank {
+		c.fail(n, "assignment to _")
+		return
+	}
+	switch {
+	case p.elem:
+		c.op(opLoad, uint64(p.x))
+		c.op(opLoad, uint64(p.index))
+		c.op(opIndex)
+	case p.field != nil:
+		c.op(opLoad, uint64(p.x))
+		w := c.wrapper()
+		ptr := w.param(p.field, c.info.TypeOf(p.field.X))
+		w.call(p.field, ptr+"."+p.field.Sel.Name, []types.Type{c.info.TypeOf(p.field)})
+	default:
+		c.op(opLoad, uint64(p.slot))
+	}
+	t := c.info.TypeOf(x)
+	if yt == nil {
+		yt = t
+	}
+	y()
+	c.arith(n, tok, t, yt)
+	c.storePlace(p)
+}
+// place evaluates the operands of an assignment destination.
+func (c *vmCompiler) place(e ast.Expr) vmPlace {
+	switch e := ast.Unparen(e).(type) {
+	case *ast.Ident:
+		if e.Name == "_" {
+			return vmPlace{blank: true}
+		}
+		obj := c.info.ObjectOf(e)
+		if _, local := c.slots[obj]; !local && c.info.Defs[e] == nil {
+			c.fail(e, "assignment to %s outside the function", e.Name)
+		}
+		return vmPlace{slot: c.slot(obj)}
+	case *ast.IndexExpr:
+		if vmClassOf(c.info.TypeOf(e.X)) != vmSlice {
+			c.fail(e, "assignment to an element of %s", c.info.TypeOf(e.X))
+		}
+		p := vmPlace{elem: true, x: c.temp(), index: c.temp()}
+		c.expr(e.X)
+		c.op(opStore, uint64(p.x))
+		c.expr(e.Index)
+		c.op(opStore, uint64(p.index))
+		return p
+	case *ast.SelectorExpr:
+		sel := c.info.Selections[e]
+		if _, ptr := c.info.TypeOf(e.X).Underlying().(*types.Pointer); sel == nil || sel.Kind() != types.FieldVal || !ptr {
+			c.fail(e, "assignment to %s is only supported through a pointer", c.source(e))
+		}
+		p := vmPlace{field: e, x: c.temp()}
+		c.expr(e.X)
+		c.op(opStore, uint64(p.x))
+		return p
+	}
+	c.fail(e, "assignment to %T", e)
+	return vmPlace{blank: true}
+}
+// storePlace pops the top of the stack into p.
+func (c *vmCompiler) storePlace(p vmPlace) {
+	switch {
+	case p.blank:
+		c.op(opPop)
+	case p.elem:
+		v := c.temp()
+		c.op(opStore, uint64(v))
+		c.op(opLoad, uint64(p.x))
+		c.op(opLoad, uint64(p.index))
+		c.op(opLoad, uint64(v))
+		c.op(opSetIndex)
+	case p.field != nil:
+		v := c.temp()
+		c.op(opStore, uint64(v))
+		c.op(opLoad, uint64(p.x))
+		c.op(opLoad, uint64(v))
+		w := c.wrapper()
+		ptr := w.param(p.field, c.info.TypeOf(p.field.X))
+		x := w.param(p.field, c.info.TypeOf(p.field))
+		w.call(p.field, ptr+"."+p.field.Sel.Name+" = "+x, nil)
+	default:
+		c.op(opStore, uint64(p.slot))
+	}
+}
+func (c *vmCompiler) rangeStmt(s *ast.RangeStmt, label string) {
+	if s.Tok == token.ASSIGN {
+		for _, e := range []ast.Expr{s.Key, s.Value} {
+			if id, ok := e.(*ast.Ident); e != nil && (!ok || id.Name != "_" && c.info.Defs[id] == nil && !c.local(id)) {
+				c.fail(e, "range assigning outside the function")
+				return
+			}
+		}
+	}
+	// assign pops the top of the stack into a key or value, if any.
+	assign := func(e ast.Expr) {
+		if e == nil {
+			c.op(opPop)
+			return
+		}
+		c.storePlace(c.place(e))
+	}
+	xt := c.info.TypeOf(s.X)
+	kind := uint64(vmKindInt)
+	if s.Key != nil && c.info.TypeOf(s.Key) != nil {
+		kind = vmKindOf(c.info.TypeOf(s.Key))
+	}
+	top, t := c.newLabel(), &vmTarget{label: label, brk: c.newLabel(), cont: c.newLabel()}
+	x, i, n := c.temp(), c.temp(), c.temp()
+	c.expr(s.X)
+	c.op(opStore, uint64(x))
+	c.op(opPushInt, 0)
+	c.op(opStore, uint64(i))
+	switch vmClassOf(xt) {
+	case vmInt:
+		c.mark(top)
+		c.op(opLoad, uint64(i))
+		c.op(opLoad, uint64(x))
+		c.op(opLt, kind)
+		c.jump(opJumpIfNot, t.brk)
+		c.op(opLoad, uint64(i))
+		assign(s.Key)
+		c.op(opPushInt, 1)
+	case vmSlice:
+		c.op(opLoad, uint64(x))
+		c.op(opLen)
+		c.op(opStore, uint64(n))
+		c.mark(top)
+		c.op(opLoad, uint64(i))
+		c.op(opLoad, uint64(n))
+		c.op(opLt, vmKindInt)
+		c.jump(opJumpIfNot, t.brk)
+		c.op(opLoad, uint64(i))
+		assign(s.Key)
+		if s.Value != nil {
+			c.op(opLoad, uint64(x))
+			c.op(opLoad, uint64(i))
+			c.op(opIndex)
+			assign(s.Value)
+		}
+		c.op(opPushInt, 1)
+	case vmString:
+		c.mark(top)
+		c.op(opLoad, uint64(i))
+		c.op(opLoad, uint64(x))
+		c.op(opLen)
+		c.op(opLt, vmKindInt)
+		c.jump(opJumpIfNot, t.brk)
+		c.op(opLoad, uint64(x))
+		c.op(opLoad, uint64(i))
+		c.op(opRune)
+		c.op(opStore, uint64(n))
+		assign(s.Value)
+		c.op(opLoad, uint64(i))
+		assign(s.Key)
+		c.op(opLoad, uint64(n))
+	default:
+		c.fail(s, "range over %s is not supported", xt)
+		return
+	}
+	// The increment waits on the stack for the end of the iteration.
+	step := c.temp()
+	c.op(opStore, uint64(step))
+	c.loopBody(t, s.Body)
+	c.op(opLoad, uint64(i))
+	c.op(opLoad, uint64(step))
+	c.op(opAdd, kind)
+	c.op(opStore, uint64(i))
+	c.jump(opJump, top)
+	c.mark(t.brk)
+}
+func (c *vmCompiler) switchStmt(s *ast.SwitchStmt, label string) {
+	if s.Init != nil {
+		c.stmt(s.Init, "")
+	}
+	tag := -1
+	var tagType types.Type
+	if s.Tag != nil {
+		tagType = types.Default(c.info.TypeOf(s.Tag))
+		tag = c.temp()
+		c.expr(s.Tag)
+		c.op(opStore, uint64(tag))
+	}
+	t := &vmTarget{label: label, brk: c.newLabel()}
+	clauses := s.Body.List
+	bodies := make([]*vmLabel, len(clauses)+1)
+	deflt := t.brk
+	for i, clause := range clauses {
+		bodies[i] = c.newLabel()
+		if clause.(*ast.CaseClause).List == nil {
+			deflt = bodies[i]
+		}
+	}
+	bodies[len(clauses)] = t.brk
+	for i, clause := range clauses {
+		for _, e := range clause.(*ast.CaseClause).List {
+			if tag < 0 {
+				c.expr(e)
+			} else {
+				if types.IsInterface(c.info.TypeOf(e)) && !types.IsInterface(tagType) {
+					c.fail(e, "case of interface type")
+				}
+				c.op(opLoad, uint64(tag))
+				c.value(e, tagType)
+				c.op(opEq)
+			}
+			c.jump(opJumpIf, bodies[i])
+		}
+	}
+	c.jump(opJump, deflt)
+	c.targets = append(c.targets, t)
+	for i, clause := range clauses {
+		c.mark(bodies[i])
+		c.fall = bodies[i+1]
+		c.stmts(clause.(*ast.CaseClause).Body)
+		c.jump(opJump, t.brk)
+	}
+	c.targets = c.targets[:len(c.targets)-1]
+	c.mark(t.brk)
+}
+func (c *vmCompiler) returnStmt(s *ast.ReturnStmt) {
+	results := c.sig.Results()
+	switch {
+	case len(s.Results) == 0:
+		c.returnNamed()
+		return
+	case len(s.Results) == 1 && results.Len() > 1:
+		call, ok := ast.Unparen(s.Results[0]).(*ast.CallExpr)
+		if !ok {
+			c.fail(s, "return of %T", s.Results[0])
+			return
+		}
+		c.call(call)
+	default:
+		for i, e := range s.Results {
+			c.value(e, results.At(i).Type())
+		}
+	}
+	c.op(opReturn, uint64(results.Len()))
+}
+// local reports whether id refers to a variable of the function.
+func (c *vmCompiler) local(id *ast.Ident) bool {
+	_, ok := c.slots[c.info.ObjectOf(id)]
+	return ok
+}
+// zero pushes the zero value of t.
+func (c *vmCompiler) zero(n ast.Node, t types.Type) {
+	switch vmClassOf(t) {
+	case vmInt:
+		c.op(opPushInt, 0)
+	case vmBool:
+		c.op(opPushBool, 0)
+	default:
+		c.op(opZero, c.typeIndex(n, t))
+	}
+}
+// typeIndex returns the index of the zero value of t in the type table.
+func (c *vmCompiler) typeIndex(n ast.Node, t types.Type) uint64 {
+	src := `""`
+	if vmClassOf(t) != vmString {
+		src = "*new(" + c.typeName(n, t) + ")"
+	}
+	i, ok := c.zeroIndex[src]
+	if !ok {
+		i = len(c.zeros)
+		c.zeros = append(c.zeros, src)
+		c.zeroIndex[src] = i
+	}
+	return uint64(i)
+}
+// typeName spells t in the function.
+func (c *vmCompiler) typeName(n ast.Node, t types.Type) string {
+	expr, err := c.names.expr(t)
+	if err != nil {
+		c.fail(n, "%v", err)
+		return "int"
+	}
+	src, _ := typeString(token.NewFileSet(), expr)
+	return src
+}
+// value compiles e for a destination of type t: untyped nil is the zero value of t, and values
+// the machine holds in its own form are boxed into interfaces.
+func (c *vmCompiler) value(e ast.Expr, t types.Type) {
+	tv := c.info.Types[e]
+	switch {
+	case tv.IsNil():
+		if !isNillable(t) {
+			c.fail(e, "nil for %s", t)
+		}
+		c.op(opZero, c.typeIndex(e, t))
+	case types.IsInterface(t) && !types.IsInterface(tv.Type) && vmClassOf(tv.Type) != vmOpaque && vmClassOf(tv.Type) != vmSlice:
+		c.expr(e)
+		c.box(e, types.Default(tv.Type), t)
+	default:
+		c.expr(e)
+	}
+}
+// box converts the value on the stack, of type from, to the interface type to.
+func (c *vmCompiler) box(n ast.Node, from, to types.Type) {
+	w := c.wrapper()
+	x := w.param(n, from)
+	w.call(n, "("+c.typeName(n, to)+")("+x+")", []types.Type{to})
+}
+// expr compiles an expression of a single value.
+func (c *vmCompiler) expr(e ast.Expr) {
+	if c.err != nil {
+		return
+	}
+	tv := c.info.Types[e]
+	if tv.Value != nil {
+		c.constant(e, tv)
+		return
+	}
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		c.expr(e.X)
+	case *ast.Ident:
+		obj := c.info.Uses[e]
+		if s, ok := c.slots[obj]; ok {
+			c.op(opLoad, uint64(s))
+			return
+		}
+		if obj == nil || obj.Parent() != c.scope {
+			c.fail(e, "%s is not supported", e.Name)
+			return
+		}
+		c.global(e)
+	case *ast.SelectorExpr:
+		sel := c.info.Selections[e]
+		switch {
+		case sel == nil:
+			c.global(e)
+		case sel.Kind() == types.FieldVal:
+			c.expr(e.X)
+			w := c.wrapper()
+			x := w.param(e, c.info.TypeOf(e.X))
+			w.call(e, x+"."+e.Sel.Name, []types.Type{tv.Type})
+		default:
+			c.fail(e, "method values are not supported")
+		}
+	case *ast.BinaryExpr:
+		c.binary(e)
+	case *ast.UnaryExpr:
+		switch e.Op {
+		case token.ADD:
+			c.expr(e.X)
+		case token.SUB, token.XOR:
+			if vmClassOf(tv.Type) != vmInt {
+				c.fail(e, "%s on %s", e.Op, tv.Type)
+			}
+			c.expr(e.X)
+			if e.Op == token.SUB {
+				c.op(opNeg, vmKindOf(tv.Type))
+			} else {
+				c.op(opCpl, vmKindOf(tv.Type))
+			}
+		case token.NOT:
+			c.expr(e.X)
+			c.op(opNot)
+		default:
+			c.fail(e, "%s is not supported", e.Op)
+		}
+	case *ast.CallExpr:
+		if n := c.call(e); n != 1 && c.err == nil {
+			c.fail(e, "call of %d values", n)
+		}
+	case *ast.IndexExpr:
+		if k := vmClassOf(c.info.TypeOf(e.X)); k != vmSlice && k != vmString {
+			c.fail(e, "indexing %s is not supported", c.info.TypeOf(e.X))
+			return
+		}
+		c.expr(e.X)
+		c.expr(e.Index)
+		c.op(opIndex)
+	case *ast.SliceExpr:
+		if k := vmClassOf(c.info.TypeOf(e.X)); k != vmSlice && k != vmString {
+			c.fail(e, "slicing %s is not supported", c.info.TypeOf(e.X))
+			return
+		}
+		c.expr(e.X)
+		mask := uint64(0)
+		for i, bound := range []ast.Expr{e.Low, e.High, e.Max} {
+			if bound != nil {
+				c.expr(bound)
+				mask |= 1 << i
+			}
+		}
+		c.op(opSlice, mask)
+	case *ast.CompositeLit:
+		c.sliceLiteral(e, tv.Type)
+	default:
+		c.fail(e, "%T expressions are not supported", e)
+	}
+}
+// constant pushes the value of a constant expression.
+func (c *vmCompiler) constant(e ast.Expr, tv types.TypeAndValue) {
+	switch vmClassOf(types.Default(tv.Type)) {
+	case vmInt:
+		v := constant.ToInt(tv.Value)
+		if u, ok := constant.Uint64Val(v); ok {
+			c.op(opPushInt, u)
+		} else if i, ok := constant.Int64Val(v); ok {
+			c.op(opPushInt, uint64(i))
+		} else {
+			c.fail(e, "constant %s overflows", tv.Value)
+		}
+	case vmBool:
+		b := uint64(0)
+		if constant.BoolVal(tv.Value) {
+			b = 1
+		}
+		c.op(opPushBool, b)
+	case vmString:
+		s := constant.StringVal(tv.Value)
+		c.op(opPushStr, uint64(len(s)))
+		c.code = append(c.code, s...)
+	default:
+		c.fail(e, "constants of type %s are not supported", tv.Type)
+	}
+}
+func (c *vmCompiler) binary(e *ast.BinaryExpr) {
+	t := c.info.TypeOf(e)
+	xt, yt := c.info.TypeOf(e.X), c.info.TypeOf(e.Y)
+	switch e.Op {
+	case token.LAND, token.LOR:
+		short, end := c.newLabel(), c.newLabel()
+		c.expr(e.X)
+		if e.Op == token.LAND {
+			c.jump(opJumpIfNot, short)
+		} else {
+			c.jump(opJumpIf, short)
+		}
+		c.expr(e.Y)
+		c.jump(opJump, end)
+		c.mark(short)
+		c.op(opPushBool, map[bool]uint64{false: 0, true: 1}[e.Op == token.LOR])
+		c.mark(end)
+	case token.EQL, token.NEQ:
+		c.equal(e, e.X, e.Y, xt, yt)
+		if e.Op == token.NEQ {
+			c.op(opNot)
+		}
+	case token.LSS, token.LEQ, token.GTR, token.GEQ:
+		if c.info.Types[e.X].Value != nil {
+			xt = yt
+		}
+		if k := vmClassOf(xt); k != vmInt && k != vmString {
+			c.fail(e, "ordering %s is not supported", xt)
+			return
+		}
+		c.expr(e.X)
+		c.expr(e.Y)
+		c.op(vmOrderOps[e.Op], vmKindOf(xt))
+	default:
+		c.expr(e.X)
+		c.expr(e.Y)
+		c.arith(e, e.Op, t, yt)
+	}
+}
+// equal compares x and y, converting a concrete operand to the interface type of the other.
+func (c *vmCompiler) equal(n ast.Node, x, y ast.Expr, xt, yt types.Type) {
+	switch {
+	case c.info.Types[x].IsNil():
+		x, y, xt, yt = y, x, yt, xt
+		fallthrough
+	case c.info.Types[y].IsNil():
+		c.expr(x)
+		iface := uint64(0)
+		if types.IsInterface(xt) {
+			iface = 1
+		}
+		c.op(opIsNil, iface)
+		return
+	}
+	if vmClassOf(xt) == vmSlice || vmClassOf(yt) == vmSlice {
+		c.fail(n, "comparison of slices")
+		return
+	}
+	if types.IsInterface(yt) && !types.IsInterface(xt) {
+		c.value(x, yt)
+	} else {
+		c.expr(x)
+	}
+	if types.IsInterface(xt) && !types.IsInterface(yt) {
+		c.value(y, xt)
+	} else {
+		c.expr(y)
+	}
+	c.op(opEq)
+}
+// arith applies tok to the two values on the stack, the result being of type t and the second
+// operand of type yt.
+func (c *vmCompiler) arith(n ast.Node, tok token.Token, t, yt types.Type) {
+	if tok == token.ADD && vmClassOf(t) == vmString {
+		c.op(opCat)
+		return
+	}
+	op, ok := vmArithOps[tok]
+	if !ok || vmClassOf(t) != vmInt {
+		c.fail(n, "%s on %s is not supported", tok, t)
+		return
+	}
+	if tok == token.SHL || tok == token.SHR {
+		signedCount := uint64(0)
+		if isSignedInteger(yt) {
+			signedCount = 1
+		}
+		c.op(op, vmKindOf(t), signedCount)
+		return
+	}
+	c.op(op, vmKindOf(t))
+}
+func (c *vmCompiler) sliceLiteral(e *ast.CompositeLit, t types.Type) {
+	s, ok := t.Underlying().(*types.Slice)
+	if !ok {
+		c.fail(e, "composite literals of %s are not supported", t)
+		return
+	}
+	tmp := c.temp()
+	c.op(opPushInt, uint64(len(e.Elts)))
+	c.op(opMake, c.typeIndex(e, t), 0)
+	c.op(opStore, uint64(tmp))
+	for i, elt := range e.Elts {
+		if _, keyed := elt.(*ast.KeyValueExpr); keyed {
+			c.fail(elt, "keyed slice literals are not supported")
+			return
+		}
+		c.op(opLoad, uint64(tmp))
+		c.op(opPushInt, uint64(i))
+		c.value(elt, s.Elem())
+		c.op(opSetIndex)
+	}
+	c.op(opLoad, uint64(tmp))
+}
+// call compiles a call and returns the number of values it pushes.
+func (c *vmCompiler) call(e *ast.CallExpr) int {
+	fun := ast.Unparen(e.Fun)
+	if tv := c.info.Types[fun]; tv.IsType() {
+		c.conversion(e, tv.Type)
+		return 1
+	}
+	if id, ok := fun.(*ast.Ident); ok {
+		if b, ok := c.info.Uses[id].(*types.Builtin); ok {
+			if n, done := c.builtin(e, b.Name()); done {
+				return n
+			}
+		}
+	}
+	return c.external(e)
+}
+// builtin compiles the builtins the machine implements itself.
+func (c *vmCompiler) builtin(e *ast.CallExpr, name string) (int, bool) {
+	var k vmClass
+	if len(e.Args) > 0 {
+		k = vmClassOf(c.info.TypeOf(e.Args[0]))
+	}
+	switch {
+	case name == "len" && (k == vmSlice || k == vmString), name == "cap" && k == vmSlice:
+		c.expr(e.Args[0])
+		if name == "len" {
+			c.op(opLen)
+		} else {
+			c.op(opCap)
+		}
+	case name == "append" && k == vmSlice:
+		c.expr(e.Args[0])
+		if e.Ellipsis.IsValid() {
+			c.expr(e.Args[1])
+			c.op(opAppendAll)
+			return 1, true
+		}
+		elem := c.info.TypeOf(e.Args[0]).Underlying().(*types.Slice).Elem()
+		for _, arg := range e.Args[1:] {
+			c.value(arg, elem)
+		}
+		c.op(opAppend, uint64(len(e.Args)-1))
+	case name == "copy":
+		c.expr(e.Args[0])
+		c.expr(e.Args[1])
+		c.op(opCopy)
+	case name == "make" && vmClassOf(c.info.TypeOf(e.Args[0])) == vmSlice:
+		for _, arg := range e.Args[1:] {
+			c.expr(arg)
+		}
+		c.op(opMake, c.typeIndex(e, c.info.TypeOf(e.Args[0])), uint64(len(e.Args)-2))
+	case name == "recover":
+		c.fail(e, "recover is not supported")
+	default:
+		return 0, false
+	}
+	return 1, true
+}
+// conversion converts within the machine between integer kinds, strings and slices; other
+// conversions are done by a wrapper.
+func (c *vmCompiler) conversion(e *ast.CallExpr, t types.Type) {
+	arg := e.Args[0]
+	at := c.info.TypeOf(arg)
+	to, from := vmClassOf(t), vmClassOf(at)
+	switch {
+	case c.info.Types[arg].IsNil():
+		c.value(arg, t)
+	case types.IsInterface(t):
+		c.value(arg, t)
+	case to == vmInt && from == vmInt:
+		c.expr(arg)
+		c.op(opWrap, vmKindOf(t))
+	case to == from && (to == vmBool || to == vmString):
+		c.expr(arg)
+	case to == vmString && (from == vmInt || from == vmSlice), to == vmSlice && (from == vmString || from == vmSlice):
+		c.expr(arg)
+		c.op(opConvert, c.typeIndex(e, t))
+	default:
+		c.external(e)
+	}
+}
+// global reads a package-level variable or function.
+func (c *vmCompiler) global(e ast.Expr) {
+	if !c.static(e) {
+		c.fail(e, "%s is not supported", c.source(e))
+		return
+	}
+	c.wrapper().call(e, c.source(e), []types.Type{c.info.TypeOf(e)})
+}
+// external calls out of the machine through a wrapper taking the receiver or function value, if
+// it is not static, and the arguments; type arguments, nil and float constants are spelled in the
+// wrapper.
+func (c *vmCompiler) external(e *ast.CallExpr) int {
+	w := c.wrapper()
+	var callee string
+	fun := ast.Unparen(e.Fun)
+	sel, _ := fun.(*ast.SelectorExpr)
+	switch {
+	case c.info.Types[fun].IsType():
+		callee = "(" + c.typeName(fun, c.info.TypeOf(fun)) + ")"
+	case sel != nil && c.info.Selections[sel] != nil && c.info.Selections[sel].Kind() == types.MethodVal:
+		s := c.info.Selections[sel]
+		_, ptrRecv := s.Obj().Type().(*types.Signature).Recv().Type().(*types.Pointer)
+		if _, ptr := s.Recv().Underlying().(*types.Pointer); ptrRecv && !ptr && !types.IsInterface(s.Recv()) {
+			c.fail(e, "method %s needs the address of its receiver", sel.Sel.Name)
+			return 0
+		}
+		c.expr(sel.X)
+		callee = w.param(sel.X, s.Recv()) + "." + sel.Sel.Name
+	case c.static(fun):
+		callee = c.source(fun)
+	default:
+		c.expr(fun)
+		callee = w.param(fun, c.info.TypeOf(fun))
+	}
+	var args []string
+	var tuple *types.Tuple
+	if len(e.Args) == 1 {
+		tuple, _ = c.info.TypeOf(e.Args[0]).(*types.Tuple)
+	}
+	if tuple != nil {
+		c.call(ast.Unparen(e.Args[0]).(*ast.CallExpr))
+		for i := 0; i < tuple.Len(); i++ {
+			args = append(args, w.param(e, tuple.At(i).Type()))
+		}
+	} else {
+		for _, arg := range e.Args {
+			tv := c.info.Types[arg]
+			switch {
+			case tv.IsType():
+				args = append(args, c.typeName(arg, tv.Type))
+			case tv.IsNil():
+				args = append(args, "nil")
+			case tv.Value != nil && vmClassOf(tv.Type) == vmOpaque:
+				if tv.Value.Kind() != constant.Float {
+					c.fail(arg, "constants of type %s are not supported", tv.Type)
+				}
+				args = append(args, tv.Value.String())
+			default:
+				c.expr(arg)
+				args = append(args, w.param(arg, types.Default(tv.Type)))
+			}
+		}
+	}
+	if e.Ellipsis.IsValid() && len(args) > 0 {
+		args[len(args)-1] += "..."
+	}
+	var results []types.Type
+	switch t := c.info.TypeOf(e).(type) {
+	case *types.Tuple:
+		for i := 0; i < t.Len(); i++ {
+			results = append(results, t.At(i).Type())
+		}
+	case nil:
+	default:
+		results = []types.Type{t}
+	}
+	w.call(e, callee+"("+strings.Join(args, ", ")+")", results)
+	return len(results)
+}
+// static reports whether e denotes the same function or variable wherever it is evaluated in the
+// package: package-level names, possibly qualified or instantiated, and method expressions.
+func (c *vmCompiler) static(e ast.Expr) bool {
+	switch e := e.(type) {
+	case *ast.Ident:
+		switch obj := c.info.Uses[e].(type) {
+		case nil:
+			return false
+		case *types.Builtin:
+			return true
+		default:
+			return obj.Pkg() == nil || obj.Parent() == obj.Pkg().Scope()
+		}
+	case *ast.SelectorExpr:
+		sel := c.info.Selections[e]
+		if sel == nil {
+			_, qualified := c.info.Uses[ast.Unparen(e.X).(*ast.Ident)].(*types.PkgName)
+			return qualified
+		}
+		return sel.Kind() == types.MethodExpr && c.static(e.X)
+	case *ast.ParenExpr:
+		return c.static(e.X)
+	case *ast.StarExpr:
+		return c.info.Types[e].IsType() && c.static(e.X)
+	case *ast.IndexExpr:
+		return c.static(e.X) && c.info.Types[e.Index].IsType()
+	case *ast.IndexListExpr:
+		for _, index := range e.Indices {
+			if !c.info.Types[index].IsType() {
+				return false
+			}
+		}
+		return c.static(e.X)
+	}
+	return false
+}
+func (c *vmCompiler) source(e ast.Expr) string {
+	src, _ := typeString(c.fset, e)
+	return src
+}
+// vmWrapper builds a function of the function table: it converts its arguments from the form of
+// the machine, computes a Go expression over them and converts the results back.
+type vmWrapper struct {
+	c     *vmCompiler
+	args  string
+	stmts []string
+	n     int
+}
+func (c *vmCompiler) wrapper() *vmWrapper {
+	return &vmWrapper{c: c, args: NewName()}
+}
+// param declares the next value taken from the stack as a Go value of type t.
+func (w *vmWrapper) param(n ast.Node, t types.Type) string {
+	name := NewName()
+	w.stmts = append(w.stmts, w.c.native(n, name, fmt.Sprintf("%s[%d]", w.args, w.n), t))
+	w.n++
+	return name
+}
+// call registers the wrapper computing expr, of the given result types, and emits its call.
+func (w *vmWrapper) call(n ast.Node, expr string, results []types.Type) {
+	if len(results) == 0 {
+		w.stmts = append(w.stmts, expr, "return nil")
+	} else {
+		names := make([]string, len(results))
+		values := make([]string, len(results))
+		for i, t := range results {
+			names[i] = NewName()
+			values[i] = vmCanonical(names[i], t)
+		}
+		w.stmts = append(w.stmts, strings.Join(names, ", ")+" := "+expr, "return []interface{}{"+strings.Join(values, ", ")+"}")
+	}
+	w.c.funcs = append(w.c.funcs, fmt.Sprintf("func(%s []interface{}) []interface{} {\n%s\n}", w.args, strings.Join(w.stmts, "\n")))
+	w.c.op(opCall, uint64(len(w.c.funcs)-1), uint64(w.n))
+}
+// native declares name as the Go value of type t of the machine value x.
+func (c *vmCompiler) native(n ast.Node, name, x string, t types.Type) string {
+	typ := c.typeName(n, t)
+	switch vmClassOf(t) {
+	case vmInt:
+		return fmt.Sprintf("%s := (%s)(%s.(uint64))", name, typ, x)
+	case vmBool:
+		return fmt.Sprintf("%s := (%s)(%s.(bool))", name, typ, x)
+	case vmString:
+		return fmt.Sprintf("%s := (%s)(%s.(string))", name, typ, x)
+	}
+	return fmt.Sprintf("%s, _ := %s.(%s)", name, x, typ)
+}
+// vmCanonical spells the machine form of the Go value x of type t.
+func vmCanonical(x string, t types.Type) string {
+	switch vmClassOf(t) {
+	case vmInt:
+		return "uint64(" + x + ")"
+	case vmBool:
+		return "bool(" + x + ")"
+	case vmString:
+		return "string(" + x + ")"
+	}
+	return x
+}
@@ -0,0 +1,531 @@
+package obfuscator
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	mrand "math/rand"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+	"golang.org/x/tools/go/packages"
+)
+// vmOp is an instruction of the virtual machine. Its encoding in the bytecode differs from build
+// to build; operands are unsigned varints, noted in brackets.
+type vmOp int
+const (
+	opPushInt     vmOp = iota // [value] pushes an integer
+	opPushStr                 // [length] bytes... pushes a string
+	opPushBool                // [0 or 1] pushes a bool
+	opZero                    // [type] pushes the zero value of a type of the function's table
+	opLoad                    // [slot] pushes a local
+	opStore                   // [slot] pops into a local
+	opPop                     // drops the top of the stack
+	opAdd                     // [kind] integer arithmetic, wrapping to the kind
+	opSub                     // [kind]
+	opMul                     // [kind]
+	opDiv                     // [kind]
+	opRem                     // [kind]
+	opAnd                     // [kind]
+	opOr                      // [kind]
+	opXor                     // [kind]
+	opAndNot                  // [kind]
+	opShl                     // [kind] [1 if the count is signed]
+	opShr                     // [kind] [1 if the count is signed]
+	opNeg                     // [kind]
+	opCpl                     // [kind]
+	opNot                     // negates a bool
+	opCat                     // concatenates two strings
+	opEq                      // compares any two comparable values
+	opNe
+	opLt // [kind] orders integers of the kind or strings
+	opLe // [kind]
+	opGt // [kind]
+	opGe // [kind]
+	opIsNil     // [1 for interfaces] tests a nillable value
+	opJump      // [target]
+	opJumpIf    // [target] pops a bool and jumps if it holds
+	opJumpIfNot // [target]
+	opCall      // [function] [arguments] calls a function of the function's table
+	opReturn    // [results] returns the top of the stack
+	opLen       // length of a string or slice
+	opCap       // capacity of a slice
+	opIndex     // element of a string or slice
+	opSetIndex  // pops a slice, an index and a value and stores the element
+	opSlice     // [1 low | 2 high | 4 max] slices a string or slice
+	opMake      // [type] [1 with a capacity] makes a slice
+	opAppend    // [count] appends values to a slice
+	opAppendAll // appends a slice or a string to a slice
+	opCopy      // copies a slice or string into a slice
+	opConvert   // [type] converts between strings and slices
+	opWrap      // [kind] converts between integer kinds
+	opRune      // pops a string and an index and pushes the rune there and its length
+	vmOpCount
+)
+// vmOpNames are the constant names of the opcodes in the interpreter template.
+var vmOpNames = [vmOpCount]string{
+	"opPushInt", "opPushStr", "opPushBool", "opZero", "opLoad", "opStore", "opPop",
+	"opAdd", "opSub", "opMul", "opDiv", "opRem", "opAnd", "opOr", "opXor", "opAndNot", "opShl", "opShr",
+	"opNeg", "opCpl", "opNot", "opCat", "opEq", "opNe", "opLt", "opLe", "opGt", "opGe", "opIsNil",
+	"opJump", "opJumpIf", "opJumpIfNot", "opCall", "opReturn", "opLen", "opCap", "opIndex", "opSetIndex",
+	"opSlice", "opMake", "opAppend", "opAppendAll", "opCopy", "opConvert", "opWrap", "opRune",
+}
+// Integer kinds, operands of the arithmetic instructions; vmKindString orders strings.
+const (
+	vmKindUint8 = iota
+	vmKindUint16
+	vmKindUint32
+	vmKindUint64
+	vmKindUint
+	vmKindInt8
+	vmKindInt16
+	vmKindInt32
+	vmKindInt64
+	vmKindInt
+	vmKindString
+)
+// virtualMachine is the interpreter emitted for one build: the encoding of its opcodes and of
+// the bytecode are drawn at random, and it lives in a package of its own in the main module.
+type virtualMachine struct {
+	name    string
+	path    string // import path
+	dir     string // output directory
+	opcodes [vmOpCount]byte
+	mul     uint32
+	used    bool
+}
+func newVirtualMachine() *virtualMachine {
+	vm := &virtualMachine{name: strings.ToLower(NewName()), mul: mrand.Uint32() | 1}
+	for i, b := range mrand.Perm(256)[:vmOpCount] {
+		vm.opcodes[i] = byte(b)
+	}
+	return vm
+}
+// encrypt encodes plain bytecode under key as the interpreter decodes it: every byte is masked
+// by a keystream depending on its offset.
+func (vm *virtualMachine) encrypt(plain []byte, key uint32) []byte {
+	code := make([]byte, len(plain))
+	for pc, b := range plain {
+		code[pc] = b ^ byte((key^uint32(pc)*vm.mul)>>(uint(pc)&3*8))
+	}
+	return code
+}
+// source returns the interpreter package.
+func (vm *virtualMachine) source() ([]byte, error) {
+	var consts strings.Builder
+	for i, name := range vmOpNames {
+		fmt.Fprintf(&consts, "\t%s = %#x\n", name, vm.opcodes[i])
+	}
+	src := fmt.Sprintf(vmRuntimeTemplate, vm.name, consts.String(), vm.mul)
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "vm.go", src, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse interpreter: %w", err)
+	}
+	RenameIdentifiers(file)
+	var buf strings.Builder
+	if err := printer.Fprint(&buf, fset, file); err != nil {
+		return nil, err
+	}
+	return []byte(buf.String()), nil
+}
+// locate places the interpreter in a package of its own at the root of the main module of the
+// output, or disables virtualization when there is none.
+func (vm *virtualMachine) locate(mod *packages.Module, inputPath, outputPath string) {
+	abs, err := filepath.Abs(inputPath)
+	if mod == nil || err != nil {
+		fmt.Println("Virtualization disabled: the input is not in a module")
+		return
+	}
+	rel, err := filepath.Rel(abs, mod.Dir)
+	if err != nil {
+		fmt.Println("Virtualization disabled: the module is on another volume")
+		return
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		// The input is a directory inside the module: the interpreter goes next to it.
+		sub, _ := filepath.Rel(mod.Dir, abs)
+		vm.dir = filepath.Join(outputPath, vm.name)
+		vm.path = pathpkg.Join(mod.Path, filepath.ToSlash(sub), vm.name)
+		return
+	}
+	vm.dir = filepath.Join(outputPath, rel, vm.name)
+	vm.path = mod.Path + "/" + vm.name
+}
+// write emits the interpreter package into the output tree if any function was virtualized.
+func (vm *virtualMachine) write() error {
+	if !vm.used {
+		return nil
+	}
+	src, err := vm.source()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(vm.dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(vm.dir, vm.name+".go"), src, 0644)
+}
+// importSpec returns the import of the interpreter under a fresh name.
+func (vm *virtualMachine) importSpec() *ast.ImportSpec {
+	return &ast.ImportSpec{Name: ast.NewIdent(NewName()), Path: &ast.BasicLit{Kind: token.STRING, Value: fmt.Sprintf("%q", vm.path)}}
+}
+// vmRuntimeTemplate is the interpreter package (%[1]s) with its opcode constants (%[2]s) and
+// keystream multiplier (%#[3]x). Values are uint64 for integers of every kind, sign-extended
+// for signed kinds, plain bools and strings, and Go values for the rest; the callers convert
+// them at the boundary. The fields of machine are exported only so that RenameIdentifiers, which
+// does not follow selectors, leaves them alone.
+const vmRuntimeTemplate = `package %[1]s
+import (
+	"math/bits"
+	"reflect"
+	"unicode/utf8"
+)
+const (
+%[2]s)
+const codeMul = %#[3]x
+const (
+	kindUint8 = iota
+	kindUint16
+	kindUint32
+	kindUint64
+	kindUint
+	kindInt8
+	kindInt16
+	kindInt32
+	kindInt64
+	kindInt
+	kindString
+)
+type machine struct {
+	Code  string
+	Key   uint32
+	PC    int
+	Stack []interface{}
+}
+func (m *machine) next() byte {
+	b := m.Code[m.PC] ^ byte((m.Key^uint32(m.PC)*codeMul)>>(uint(m.PC)&3*8))
+	m.PC++
+	return b
+}
+func (m *machine) operand() uint64 {
+	var x uint64
+	for shift := uint(0); ; shift += 7 {
+		b := m.next()
+		x |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return x
+		}
+	}
+}
+func (m *machine) push(v interface{}) {
+	m.Stack = append(m.Stack, v)
+}
+func (m *machine) pop() interface{} {
+	v := m.Stack[len(m.Stack)-1]
+	m.Stack = m.Stack[:len(m.Stack)-1]
+	return v
+}
+func (m *machine) popInt() uint64 {
+	return m.pop().(uint64)
+}
+func (m *machine) popIndex() int {
+	return int(int64(m.popInt()))
+}
+// Run interprets the bytecode of one function over its arguments, with the zero values of the
+// types it makes and the functions it calls, and returns its results.
+func Run(code string, key uint32, args []interface{}, types []interface{}, funcs []func([]interface{}) []interface{}) []interface{} {
+	m := &machine{Code: code, Key: key}
+	locals := make([]interface{}, m.operand())
+	copy(locals, args)
+	for {
+		switch op := m.next(); op {
+		case opPushInt:
+			m.push(m.operand())
+		case opPushStr:
+			b := make([]byte, m.operand())
+			for i := range b {
+				b[i] = m.next()
+			}
+			m.push(string(b))
+		case opPushBool:
+			m.push(m.operand() != 0)
+		case opZero:
+			m.push(types[m.operand()])
+		case opLoad:
+			m.push(locals[m.operand()])
+		case opStore:
+			locals[m.operand()] = m.pop()
+		case opPop:
+			m.pop()
+		case opAdd, opSub, opMul, opDiv, opRem, opAnd, opOr, opXor, opAndNot:
+			k := int(m.operand())
+			y, x := m.popInt(), m.popInt()
+			m.push(wrap(k, arith(op, k, x, y)))
+		case opShl, opShr:
+			k, signedCount := int(m.operand()), m.operand() != 0
+			y, x := m.popInt(), m.popInt()
+			m.push(wrap(k, shift(op, k, x, y, signedCount)))
+		case opNeg:
+			m.push(wrap(int(m.operand()), -m.popInt()))
+		case opCpl:
+			m.push(wrap(int(m.operand()), ^m.popInt()))
+		case opNot:
+			m.push(!m.pop().(bool))
+		case opCat:
+			y, x := m.pop().(string), m.pop().(string)
+			m.push(x + y)
+		case opEq:
+			y, x := m.pop(), m.pop()
+			m.push(x == y)
+		case opNe:
+			y, x := m.pop(), m.pop()
+			m.push(x != y)
+		case opLt, opLe, opGt, opGe:
+			k := int(m.operand())
+			y, x := m.pop(), m.pop()
+			switch op {
+			case opLt:
+				m.push(less(k, x, y))
+			case opLe:
+				m.push(!less(k, y, x))
+			case opGt:
+				m.push(less(k, y, x))
+			default:
+				m.push(!less(k, x, y))
+			}
+		case opIsNil:
+			iface, x := m.operand() != 0, m.pop()
+			m.push(x == nil || !iface && reflect.ValueOf(x).IsNil())
+		case opJump:
+			m.PC = int(m.operand())
+		case opJumpIf, opJumpIfNot:
+			target := int(m.operand())
+			if m.pop().(bool) == (op == opJumpIf) {
+				m.PC = target
+			}
+		case opCall:
+			f, n := funcs[m.operand()], int(m.operand())
+			in := make([]interface{}, n)
+			copy(in, m.Stack[len(m.Stack)-n:])
+			m.Stack = append(m.Stack[:len(m.Stack)-n], f(in)...)
+		case opReturn:
+			n := int(m.operand())
+			out := make([]interface{}, n)
+			copy(out, m.Stack[len(m.Stack)-n:])
+			return out
+		case opLen:
+			x := m.pop()
+			if s, ok := x.(string); ok {
+				m.push(uint64(len(s)))
+			} else {
+				m.push(uint64(reflect.ValueOf(x).Len()))
+			}
+		case opCap:
+			m.push(uint64(reflect.ValueOf(m.pop()).Cap()))
+		case opIndex:
+			i, x := m.popIndex(), m.pop()
+			if s, ok := x.(string); ok {
+				m.push(uint64(s[i]))
+				break
+			}
+			v := reflect.ValueOf(x)
+			_ = make([]struct{}, v.Len())[i]
+			m.push(value(v.Index(i)))
+		case opSetIndex:
+			x, i := m.pop(), m.popIndex()
+			v := reflect.ValueOf(m.pop())
+			_ = make([]struct{}, v.Len())[i]
+			set(v.Index(i), x)
+		case opSlice:
+			m.push(slice(int(m.operand()), m))
+		case opMake:
+			t, withCap := reflect.TypeOf(types[m.operand()]), m.operand() != 0
+			n := m.popIndex()
+			c := n
+			if withCap {
+				c, n = n, m.popIndex()
+			}
+			_ = make([]struct{}, n, c)
+			m.push(reflect.MakeSlice(t, n, c).Interface())
+		case opAppend:
+			elems := make([]interface{}, m.operand())
+			for i := len(elems) - 1; i >= 0; i-- {
+				elems[i] = m.pop()
+			}
+			v := reflect.ValueOf(m.pop())
+			for _, x := range elems {
+				e := reflect.New(v.Type().Elem()).Elem()
+				set(e, x)
+				v = reflect.Append(v, e)
+			}
+			m.push(v.Interface())
+		case opAppendAll:
+			y, x := m.pop(), m.pop()
+			if s, ok := y.(string); ok {
+				y = []byte(s)
+			}
+			m.push(reflect.AppendSlice(reflect.ValueOf(x), reflect.ValueOf(y)).Interface())
+		case opCopy:
+			y, x := m.pop(), m.pop()
+			m.push(uint64(reflect.Copy(reflect.ValueOf(x), reflect.ValueOf(y))))
+		case opConvert:
+			t := reflect.TypeOf(types[m.operand()])
+			m.push(value(reflect.ValueOf(m.pop()).Convert(t)))
+		case opWrap:
+			m.push(wrap(int(m.operand()), m.popInt()))
+		case opRune:
+			i := m.popIndex()
+			r, n := utf8.DecodeRuneInString(m.pop().(string)[i:])
+			m.push(uint64(int64(r)))
+			m.push(uint64(n))
+		default:
+			panic("invalid instruction")
+		}
+	}
+}
+func signed(k int) bool {
+	return k >= kindInt8 && k <= kindInt
+}
+func wrap(k int, x uint64) uint64 {
+	switch k {
+	case kindUint8:
+		return uint64(uint8(x))
+	case kindUint16:
+		return uint64(uint16(x))
+	case kindUint32:
+		return uint64(uint32(x))
+	case kindUint:
+		return uint64(uint(x))
+	case kindInt8:
+		return uint64(int8(x))
+	case kindInt16:
+		return uint64(int16(x))
+	case kindInt32:
+		return uint64(int32(x))
+	case kindInt:
+		if bits.UintSize == 32 {
+			return uint64(int32(x))
+		}
+	}
+	return x
+}
+func arith(op byte, k int, x, y uint64) uint64 {
+	switch op {
+	case opAdd:
+		return x + y
+	case opSub:
+		return x - y
+	case opMul:
+		return x * y
+	case opDiv:
+		if signed(k) {
+			return uint64(int64(x) / int64(y))
+		}
+		return x / y
+	case opRem:
+		if signed(k) {
+			return uint64(int64(x) %% int64(y))
+		}
+		return x %% y
+	case opAnd:
+		return x & y
+	case opOr:
+		return x | y
+	case opXor:
+		return x ^ y
+	}
+	return x &^ y
+}
+func shift(op byte, k int, x, y uint64, signedCount bool) uint64 {
+	if signedCount {
+		// Shifting by the signed count panics on negative counts as compiled code does.
+		c := int64(y)
+		if op == opShl {
+			return x << c
+		}
+		if signed(k) {
+			return uint64(int64(x) >> c)
+		}
+		return wrap(k, x) >> c
+	}
+	if op == opShl {
+		return x << y
+	}
+	if signed(k) {
+		return uint64(int64(x) >> y)
+	}
+	return wrap(k, x) >> y
+}
+func less(k int, x, y interface{}) bool {
+	if k == kindString {
+		return x.(string) < y.(string)
+	}
+	if signed(k) {
+		return int64(x.(uint64)) < int64(y.(uint64))
+	}
+	return x.(uint64) < y.(uint64)
+}
+func slice(mask int, m *machine) interface{} {
+	var lo, hi, max int
+	if mask&4 != 0 {
+		max = m.popIndex()
+	}
+	if mask&2 != 0 {
+		hi = m.popIndex()
+	}
+	if mask&1 != 0 {
+		lo = m.popIndex()
+	}
+	x := m.pop()
+	if s, ok := x.(string); ok {
+		if mask&2 == 0 {
+			hi = len(s)
+		}
+		return s[lo:hi]
+	}
+	v := reflect.ValueOf(x)
+	if mask&2 == 0 {
+		hi = v.Len()
+	}
+	if mask&4 != 0 {
+		_ = make([]struct{}, v.Len(), v.Cap())[lo:hi:max]
+		return v.Slice3(lo, hi, max).Interface()
+	}
+	_ = make([]struct{}, v.Len(), v.Cap())[lo:hi]
+	return v.Slice(lo, hi).Interface()
+}
+func value(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint()
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.String:
+		return v.String()
+	}
+	return v.Interface()
+}
+func set(v reflect.Value, x interface{}) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(x.(uint64)))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		v.SetUint(x.(uint64))
+	case reflect.Bool:
+		v.SetBool(x.(bool))
+	case reflect.String:
+		v.SetString(x.(string))
+	default:
+		if x == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(x))
+		}
+	}
+}
+`